@@ -1,30 +1,62 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	// "github.com/NathanielRand/boilerplate-go-api-clean/internal/config"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/config"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/handlers"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/health"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/middleware"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/repositories"
 	"github.com/NathanielRand/boilerplate-go-api-clean/internal/routes"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/services"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/tracing"
 )
 
 // Start
 func StartServer() error {
 
-	// Get the router from the routes package
-	router := routes.SetupRouter()
+	// Load the environment variables from the .env file, if there is one
+	if err := config.Load(); err != nil {
+		logging.Default().Warn("Continuing with process environment", "error", err)
+	}
+	setupLogging()
+	flushSpans := setupTracing()
+	defer flushSpans()
+
+	// Get the router from the routes package. The readiness probe checks
+	// the dependencies registered along the way.
+	registry := health.NewRegistry()
+	opts, pending := routerOptions(registry)
+
+	// Serve the profiling endpoints when enabled, on their own listener if
+	// one is configured so they are never reachable through the API
+	if config.GetBool("PPROF_ENABLED", false) {
+		opts = append(opts, debugOptions()...)
+		if addr := config.Get("PPROF_ADDR"); addr != "" {
+			go startDebugServer(addr, opts)
+		} else {
+			opts = append(opts, routes.WithPprof())
+		}
+	}
+
+	router := routes.SetupRouter(opts...)
 
 	// Get the port from the environment variables
 	port := ":8080"
 
-	// Load the environment variables
-	// err := config.Load() // Load environment variables from .env file
-	// if err != nil {
-	// 	// Log the error
-	// 	log.Printf("Error loading environment variables: %v", err)
-	// 	return err
-	// }
-
 	// Create an HTTP server with timeouts
 	server := &http.Server{
 		Addr:         port,
@@ -33,11 +65,615 @@ func StartServer() error {
 		WriteTimeout: 10 * time.Second,
 	}
 
+	// Serve TLS directly when a certificate is configured, e.g. for
+	// internal callers authenticating with client certificates
+	if certFile := config.Get("TLS_CERT_FILE"); certFile != "" {
+		reloader, err := config.NewTLSReloader(certFile, config.Get("TLS_KEY_FILE"), config.Get("TLS_CLIENT_CA_FILE"))
+		if err != nil {
+			return err
+		}
+
+		// Pick up rotated certificates without a restart
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go reloader.Watch(ctx, config.GetDuration("TLS_RELOAD_INTERVAL", time.Minute))
+
+		server.TLSConfig = reloader.TLSConfig()
+		drained := shutdownOnSignal(server, registry, pending)
+		if err := server.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		<-drained
+		return nil
+	}
+
 	// Start the HTTP server
-	err := server.ListenAndServe()
-	if err != nil {
+	drained := shutdownOnSignal(server, registry, pending)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
+	<-drained
 
 	return nil
 }
+
+// shutdownOnSignal shuts the server down gracefully on SIGTERM or SIGINT.
+// Readiness fails first, for SHUTDOWN_DELAY, so load balancers stop
+// sending requests. The server then stops accepting connections and waits
+// up to SHUTDOWN_TIMEOUT for the requests in flight, and writes out the
+// usage still held in memory. The returned channel is closed once done.
+func shutdownOnSignal(server *http.Server, registry *health.Registry, pending *pendingUsage) <-chan struct{} {
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		<-signals
+
+		logging.Default().Info("Shutting down")
+		registry.Shutdown()
+		time.Sleep(config.GetDuration("SHUTDOWN_DELAY", 5*time.Second))
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.GetDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logging.Default().Error("Could not drain requests", "error", err)
+		}
+		pending.flush()
+	}()
+	return drained
+}
+
+// pendingUsage holds the dependencies counting usage in memory, which must
+// be written out before the process exits. The meter and usage service are
+// only set when a user database is configured.
+type pendingUsage struct {
+	quota *middleware.Quota
+	meter *middleware.UsageMeter
+	usage *services.UsageService
+}
+
+// flush writes out the usage held in memory: the quota usage, the queued
+// usage events, and the volume and spend of the users with new events.
+func (p *pendingUsage) flush() {
+	p.quota.Close()
+	if p.meter == nil {
+		return
+	}
+	p.meter.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.GetDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancel()
+	if err := p.usage.ReconcilePending(ctx); err != nil {
+		logging.Default().Error("Could not reconcile usage", "error", err)
+	}
+}
+
+// startDebugServer serves the profiling endpoints on addr. CPU profiles and
+// traces run for up to a minute, longer than the API write timeout.
+func startDebugServer(addr string, opts []routes.Option) {
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      routes.SetupDebugRouter(opts...),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 2 * time.Minute,
+	}
+
+	log.Printf("Serving profiling endpoints on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		logging.Default().Error("Debug server stopped", "error", err)
+	}
+}
+
+// debugOptions configures the profiling endpoints from the environment: the
+// optional time-boxed debug token, and the sampling of the block and mutex
+// profiles, which are empty unless enabled.
+func debugOptions() []routes.Option {
+	var opts []routes.Option
+
+	// The debug token expires at PPROF_TOKEN_EXPIRES_AT (RFC 3339), or an
+	// hour after startup when not set
+	if token := config.Get("PPROF_TOKEN"); token != "" {
+		expiresAt := time.Now().Add(time.Hour)
+		if value := config.Get("PPROF_TOKEN_EXPIRES_AT"); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				log.Fatalf("Invalid PPROF_TOKEN_EXPIRES_AT: %v", err)
+			}
+			expiresAt = parsed
+		}
+		log.Printf("Debug token accepted until %s", expiresAt.Format(time.RFC3339))
+		opts = append(opts, routes.WithDebugAuthenticators(middleware.NewDebugTokenAuthenticator(token, expiresAt)))
+	}
+
+	if rate, err := strconv.Atoi(config.Get("PPROF_BLOCK_PROFILE_RATE")); err == nil {
+		runtime.SetBlockProfileRate(rate)
+	}
+	if fraction, err := strconv.Atoi(config.Get("PPROF_MUTEX_PROFILE_FRACTION")); err == nil {
+		runtime.SetMutexProfileFraction(fraction)
+	}
+
+	return opts
+}
+
+// routerOptions builds the router dependencies from the environment, and
+// returns those holding usage to write out on shutdown. Authentication is
+// only enabled when a user database is configured.
+func routerOptions(registry *health.Registry) ([]routes.Option, *pendingUsage) {
+	// Limits are counted per instance unless a shared store is configured
+	plans := planCatalog()
+	rateLimit := rateLimitConfig(plans)
+	quota := quotaConfig(plans)
+	store := counterStore()
+	if store != nil {
+		// The shared store counts in fixed windows; the other algorithms
+		// only count per instance
+		if config.Get("RATE_LIMIT_ALGORITHM") != "" || len(rateLimit.RouteLimiters) > 0 {
+			log.Fatalf("RATE_LIMIT_ALGORITHM and RATE_LIMIT_ROUTE_ALGORITHMS cannot be used with LIMIT_STORE, which counts fixed windows across instances")
+		}
+		rateLimit.Limiter = sharedLimiter(store, "rate", rateLimit.Period)
+		quota.Store = store
+	}
+	pending := &pendingUsage{
+		quota: middleware.NewQuota(quota),
+	}
+
+	opts := []routes.Option{
+		routes.WithSecurityConfig(securityConfig()),
+		routes.WithCORSConfig(corsConfig()),
+		routes.WithIPFilterConfig(ipFilterConfig()),
+		routes.WithRateLimitConfig(rateLimit),
+		routes.WithQuota(pending.quota),
+		routes.WithCostConfig(costConfig()),
+		routes.WithPlanConfig(planConfig(plans)),
+		routes.WithRequestIDConfig(requestIDConfig()),
+		routes.WithLoggingConfig(loggingConfig()),
+		routes.WithAccessLogConfig(accessLogConfig()),
+		routes.WithConditionalConfig(conditionalConfig()),
+		routes.WithCacheConfig(cacheConfig()),
+		routes.WithCoalesceConfig(coalesceConfig()),
+		routes.WithHealth(registry),
+	}
+
+	// Readiness fails while the disk cache tier or the image bucket is
+	// unusable
+	checkConfig := healthCheckConfig()
+	if dir := config.Get("CACHE_DISK_DIR"); dir != "" {
+		minFree := uint64(config.GetInt("HEALTH_DISK_MIN_FREE_BYTES", 256<<20))
+		registry.Register("disk_cache", health.DiskSpaceCheck(dir, minFree), checkConfig)
+	}
+	if bucket := config.Get("STORAGE_BUCKET"); bucket != "" {
+		handle := config.GetStorageClient().Bucket(bucket)
+		registry.Register("storage", func(ctx context.Context) error {
+			_, err := handle.Attrs(ctx)
+			return err
+		}, checkConfig)
+	}
+
+	// Serve the Prometheus metrics unless disabled
+	if config.GetBool("METRICS_ENABLED", true) {
+		opts = append(opts, routes.WithMetrics())
+	}
+
+	if config.Get("FIREBASE_DATABASE_URL") != "" {
+		repo := repositories.NewFirestoreRepository(config.GetDatabaseClient())
+		registry.Register("firestore", repo.Ping, checkConfig)
+
+		// Request signing settings
+		signatureConfig := middleware.DefaultSignatureConfig()
+		signatureConfig.MaxSkew = config.GetDuration("SIGNATURE_MAX_SKEW", signatureConfig.MaxSkew)
+		signatureConfig.Nonces = store
+
+		authenticators := []middleware.Authenticator{
+			middleware.NewAPIKeyAuthenticator(repo),
+			middleware.NewSignatureAuthenticator(repo, repo, signatureConfig),
+		}
+
+		// Client certificates are only verified when a CA bundle is configured
+		if config.Get("TLS_CLIENT_CA_FILE") != "" {
+			authenticators = append(authenticators, middleware.NewClientCertAuthenticator(repo, clientCertMapper()))
+		}
+
+		// OAuth2 is only enabled when a token signing key is configured
+		if signingKey := config.Get("OAUTH_TOKEN_SIGNING_KEY"); signingKey != "" {
+			oauthService := services.NewOAuthService(repo, repo, services.OAuthConfig{
+				Issuer:     config.GetDefault("OAUTH_ISSUER", "boilerplate-go-api-clean"),
+				SigningKey: []byte(signingKey),
+				TokenTTL:   config.GetDuration("OAUTH_TOKEN_TTL", 15*time.Minute),
+			})
+			authenticators = append(authenticators, middleware.NewBearerTokenAuthenticator(oauthService, repo))
+			opts = append(opts, routes.WithOAuth(handlers.NewOAuthHandler(oauthService)))
+		}
+
+		opts = append(opts, routes.WithAuthenticators(authenticators...))
+
+		// Record billable requests in the usage ledger, and keep the users'
+		// volume and spend in line with it
+		pending.usage = services.NewUsageService(repo, repo, services.UsageConfig{
+			Pricing: services.NewPricingEngine(plans),
+		})
+		meterConfig := middleware.DefaultUsageMeterConfig()
+		meterConfig.Recorder = pending.usage
+		meterConfig.Plans = plans
+		pending.meter = middleware.NewUsageMeter(meterConfig)
+		go reconcileUsage(pending.usage, config.GetDuration("USAGE_RECONCILE_INTERVAL", time.Minute))
+		opts = append(opts, routes.WithUsage(pending.meter, pending.usage))
+	}
+
+	return opts, pending
+}
+
+// clientCertMapper selects how client certificates map to user IDs: by the
+// subject common name (the default) or by a subject alternative name with
+// the configured prefix.
+func clientCertMapper() middleware.CertUserMapper {
+	if config.Get("CLIENT_CERT_IDENTITY") == "san" {
+		return middleware.MapCertSAN(config.Get("CLIENT_CERT_SAN_PREFIX"))
+	}
+	return middleware.MapCertCommonName
+}
+
+// securityConfig builds the HTTPS enforcement and security header settings
+// from the environment, starting from the defaults.
+func securityConfig() middleware.SecurityConfig {
+	security := middleware.DefaultSecurityConfig()
+	security.TrustedProxies = ipNetworks("TRUSTED_PROXIES")
+
+	security.EnforceHTTPS = config.GetBool("SECURITY_ENFORCE_HTTPS", security.EnforceHTTPS)
+	security.HSTSMaxAge = config.GetDuration("SECURITY_HSTS_MAX_AGE", security.HSTSMaxAge)
+	security.HSTSIncludeSubdomains = config.GetBool("SECURITY_HSTS_INCLUDE_SUBDOMAINS", security.HSTSIncludeSubdomains)
+	security.HSTSPreload = config.GetBool("SECURITY_HSTS_PRELOAD", security.HSTSPreload)
+	security.ContentTypeNosniff = config.GetBool("SECURITY_CONTENT_TYPE_NOSNIFF", security.ContentTypeNosniff)
+	security.ContentSecurityPolicy = config.GetDefault("SECURITY_CONTENT_SECURITY_POLICY", security.ContentSecurityPolicy)
+	security.ReferrerPolicy = config.GetDefault("SECURITY_REFERRER_POLICY", security.ReferrerPolicy)
+	security.PermissionsPolicy = config.GetDefault("SECURITY_PERMISSIONS_POLICY", security.PermissionsPolicy)
+
+	return security
+}
+
+// corsConfig builds the browser client settings from the environment. The
+// allowed origins may be set per environment with CORS_ALLOWED_ORIGINS_<ENV>
+// (e.g. CORS_ALLOWED_ORIGINS_STAGING when APP_ENV=staging), falling back to
+// CORS_ALLOWED_ORIGINS.
+func corsConfig() middleware.CORSConfig {
+	cors := middleware.DefaultCORSConfig()
+
+	cors.AllowedOrigins = config.GetList("CORS_ALLOWED_ORIGINS")
+	if env := strings.ToUpper(config.Get("APP_ENV")); env != "" {
+		if origins := config.GetList("CORS_ALLOWED_ORIGINS_" + env); len(origins) > 0 {
+			cors.AllowedOrigins = origins
+		}
+	}
+
+	if headers := config.GetList("CORS_ALLOWED_HEADERS"); len(headers) > 0 {
+		cors.AllowedHeaders = headers
+	}
+	if headers := config.GetList("CORS_EXPOSED_HEADERS"); len(headers) > 0 {
+		cors.ExposedHeaders = headers
+	}
+	cors.AllowCredentials = config.GetBool("CORS_ALLOW_CREDENTIALS", cors.AllowCredentials)
+	cors.MaxAge = config.GetDuration("CORS_MAX_AGE", cors.MaxAge)
+	if err := cors.Validate(); err != nil {
+		log.Fatalf("Invalid CORS_ALLOWED_ORIGINS with CORS_ALLOW_CREDENTIALS: %v", err)
+	}
+
+	return cors
+}
+
+// ipFilterConfig builds the client IP, allow and deny list and automatic
+// ban settings from the environment, starting from the defaults.
+func ipFilterConfig() middleware.IPFilterConfig {
+	filter := middleware.DefaultIPFilterConfig()
+	filter.TrustedProxies = ipNetworks("TRUSTED_PROXIES")
+	filter.Allow = ipNetworks("IP_ALLOWLIST")
+	filter.Deny = ipNetworks("IP_DENYLIST")
+
+	filter.BanThreshold = config.GetInt("IP_BAN_THRESHOLD", filter.BanThreshold)
+	filter.BanWindow = config.GetDuration("IP_BAN_WINDOW", filter.BanWindow)
+	filter.BanDuration = config.GetDuration("IP_BAN_DURATION", filter.BanDuration)
+
+	return filter
+}
+
+// planCatalog builds the subscription plans: the default plans, replaced
+// by those in the JSON file at PLANS_FILE.
+func planCatalog() models.PlanCatalog {
+	plans := models.DefaultPlanCatalog()
+	if path := config.Get("PLANS_FILE"); path != "" {
+		if err := config.LoadPlans(path, plans); err != nil {
+			log.Fatalf("Invalid PLANS_FILE: %v", err)
+		}
+	}
+	return plans
+}
+
+// rateLimitConfig builds the rate limits from the environment, starting
+// from the defaults and the plans' limits. RATE_LIMIT_ROUTES is a list of
+// route=limit pairs, and RATE_LIMIT_ROUTE_ALGORITHMS of route=algorithm
+// pairs.
+func rateLimitConfig(plans models.PlanCatalog) middleware.RateLimitConfig {
+	rateLimit := middleware.DefaultRateLimitConfig()
+	rateLimit.Plans = plans
+	rateLimit.Algorithm = config.GetDefault("RATE_LIMIT_ALGORITHM", rateLimit.Algorithm)
+	rateLimit.Period = config.GetDuration("RATE_LIMIT_PERIOD", rateLimit.Period)
+	rateLimit.DefaultLimit = int64(config.GetInt("RATE_LIMIT_DEFAULT", int(rateLimit.DefaultLimit)))
+	rateLimit.IdleTimeout = config.GetDuration("RATE_LIMIT_IDLE_TIMEOUT", rateLimit.IdleTimeout)
+
+	rateLimit.Routes = limits("RATE_LIMIT_ROUTES")
+
+	// Routes may use a different algorithm, each with its own state
+	limiterConfig := middleware.LimiterConfig{
+		Period:      rateLimit.Period,
+		IdleTimeout: rateLimit.IdleTimeout,
+		Now:         rateLimit.Now,
+	}
+	if _, err := middleware.NewLimiter(rateLimit.Algorithm, limiterConfig); err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_ALGORITHM: %v", err)
+	}
+	rateLimit.RouteLimiters = make(map[string]middleware.Limiter)
+	for route, algorithm := range config.GetMap("RATE_LIMIT_ROUTE_ALGORITHMS") {
+		limiter, err := middleware.NewLimiter(algorithm, limiterConfig)
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_ROUTE_ALGORITHMS entry for %q: %v", route, err)
+		}
+		rateLimit.RouteLimiters[route] = limiter
+	}
+
+	return rateLimit
+}
+
+// quotaConfig builds the monthly quotas from the environment, starting from
+// the defaults and the plans' quotas. QUOTA_WARN_AT is a list of
+// percentages, e.g. "75,100".
+func quotaConfig(plans models.PlanCatalog) middleware.QuotaConfig {
+	quota := middleware.DefaultQuotaConfig()
+	quota.Plans = plans
+	quota.DefaultLimit = int64(config.GetInt("QUOTA_DEFAULT", int(quota.DefaultLimit)))
+	if warnAt := config.GetList("QUOTA_WARN_AT"); len(warnAt) > 0 {
+		quota.WarnAt = nil
+		for _, value := range warnAt {
+			percent, err := strconv.Atoi(value)
+			if err != nil {
+				log.Fatalf("Invalid QUOTA_WARN_AT percentage %q: %v", value, err)
+			}
+			quota.WarnAt = append(quota.WarnAt, percent)
+		}
+	}
+	quota.FlushEvery = int64(config.GetInt("QUOTA_FLUSH_EVERY", int(quota.FlushEvery)))
+	quota.FlushInterval = config.GetDuration("QUOTA_FLUSH_INTERVAL", quota.FlushInterval)
+	return quota
+}
+
+// setupLogging makes the default logger write JSON entries of at least
+// LOG_LEVEL to standard error, and routes the standard log package through
+// it.
+func setupLogging() {
+	level, err := logging.ParseLevel(config.Get("LOG_LEVEL"))
+	if err != nil {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+	logger := logging.New(os.Stderr, level)
+	logging.SetDefault(logger)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.LevelInfo))
+}
+
+// setupTracing samples TRACE_SAMPLE_RATE of new traces and sends their
+// spans to TRACE_EXPORTER: stdout, otlp (the OTLP/HTTP collector at
+// TRACE_ENDPOINT, with the TRACE_HEADERS), cloudtrace (Cloud Trace in
+// TRACE_PROJECT_ID or GOOGLE_CLOUD_PROJECT) or none. It returns a function
+// sending the spans still waiting to be exported.
+func setupTracing() func() {
+	traces := tracing.DefaultConfig()
+	traces.Exporter = strings.ToLower(config.GetDefault("TRACE_EXPORTER", traces.Exporter))
+	traces.SampleRate = config.GetFloat("TRACE_SAMPLE_RATE", traces.SampleRate)
+	traces.ServiceName = config.GetDefault("TRACE_SERVICE_NAME", traces.ServiceName)
+	traces.Endpoint = config.Get("TRACE_ENDPOINT")
+	traces.Headers = config.GetMap("TRACE_HEADERS")
+	traces.ProjectID = config.GetDefault("TRACE_PROJECT_ID", config.Get("GOOGLE_CLOUD_PROJECT"))
+
+	flush, err := tracing.Setup(traces)
+	if err != nil {
+		log.Fatalf("Invalid tracing configuration: %v", err)
+	}
+	return flush
+}
+
+// healthCheckConfig builds the settings of the dependency checks from the
+// environment. HEALTH_CHECK_TIMEOUT bounds each check, and
+// HEALTH_CHECK_CACHE_TTL is how long its result is reused.
+func healthCheckConfig() health.CheckConfig {
+	check := health.DefaultCheckConfig()
+	check.Timeout = config.GetDuration("HEALTH_CHECK_TIMEOUT", check.Timeout)
+	check.CacheTTL = config.GetDuration("HEALTH_CHECK_CACHE_TTL", check.CacheTTL)
+	return check
+}
+
+// requestIDConfig builds the request ID settings from the environment.
+// REQUEST_ID_TRUST_INCOMING=false ignores the IDs sent by clients.
+func requestIDConfig() middleware.RequestIDConfig {
+	requestID := middleware.DefaultRequestIDConfig()
+	requestID.TrustIncoming = config.GetBool("REQUEST_ID_TRUST_INCOMING", requestID.TrustIncoming)
+	return requestID
+}
+
+// loggingConfig builds the request logging settings from the environment.
+// LOG_HEADERS lists the logged request headers, and LOG_REDACT extra
+// fragments of credential header and parameter names.
+func loggingConfig() middleware.LoggingConfig {
+	logs := middleware.DefaultLoggingConfig()
+	if headers := config.GetList("LOG_HEADERS"); len(headers) > 0 {
+		logs.Headers = headers
+	}
+	logs.Secrets = append(logs.Secrets, config.GetList("LOG_REDACT")...)
+	return logs
+}
+
+// accessLogConfig builds the access log settings from the environment.
+// ACCESS_LOG_FORMAT is json, combined, cloud or off.
+func accessLogConfig() middleware.AccessLogConfig {
+	accessLog := middleware.DefaultAccessLogConfig()
+	accessLog.Format = strings.ToLower(config.GetDefault("ACCESS_LOG_FORMAT", accessLog.Format))
+	switch accessLog.Format {
+	case middleware.AccessLogJSON, middleware.AccessLogCombined, middleware.AccessLogCloud, middleware.AccessLogOff:
+	default:
+		log.Fatalf("Invalid ACCESS_LOG_FORMAT %q", accessLog.Format)
+	}
+	accessLog.Secrets = append(accessLog.Secrets, config.GetList("LOG_REDACT")...)
+	accessLog.TrustedProxies = ipNetworks("TRUSTED_PROXIES")
+	return accessLog
+}
+
+// conditionalConfig builds the conditional request settings from the
+// environment. HTTP_CACHE_CONTROL is the Cache-Control header of responses
+// that do not set their own.
+func conditionalConfig() middleware.ConditionalConfig {
+	conditional := middleware.DefaultConditionalConfig()
+	conditional.CacheControl = config.GetDefault("HTTP_CACHE_CONTROL", conditional.CacheControl)
+	return conditional
+}
+
+// cacheConfig builds the response cache from the environment: an in-memory
+// LRU cache of CACHE_MEMORY_BYTES, and when CACHE_DISK_DIR is set a disk
+// tier of CACHE_DISK_BYTES for responses larger than
+// CACHE_MEMORY_MAX_ENTRY_BYTES.
+func cacheConfig() middleware.CacheConfig {
+	cache := middleware.DefaultCacheConfig()
+	cache.TTL = config.GetDuration("CACHE_TTL", cache.TTL)
+
+	memory := middleware.NewLRUCache(int64(config.GetInt("CACHE_MEMORY_BYTES", 64<<20)))
+	cache.Cache = memory
+	if dir := config.Get("CACHE_DISK_DIR"); dir != "" {
+		disk, err := middleware.NewDiskCache(dir, int64(config.GetInt("CACHE_DISK_BYTES", 1<<30)))
+		if err != nil {
+			log.Fatalf("Invalid CACHE_DISK_DIR: %v", err)
+		}
+		cache.Cache = middleware.NewTieredCache(
+			middleware.CacheTier{Cache: memory, MaxEntryBytes: int64(config.GetInt("CACHE_MEMORY_MAX_ENTRY_BYTES", 1<<20))},
+			middleware.CacheTier{Cache: disk},
+		)
+	}
+	return cache
+}
+
+// coalesceConfig builds the request coalescing settings from the
+// environment. COALESCE_OPERATIONS lists the coalesced image operations,
+// and COALESCE_MAX_PROCESSING how many can be processed at once before the
+// instance reports itself not ready.
+func coalesceConfig() middleware.CoalesceConfig {
+	coalesce := middleware.DefaultCoalesceConfig()
+	if operations := config.GetList("COALESCE_OPERATIONS"); len(operations) > 0 {
+		coalesce.Operations = operations
+	}
+	coalesce.Timeout = config.GetDuration("COALESCE_TIMEOUT", coalesce.Timeout)
+	coalesce.MaxProcessing = config.GetInt("COALESCE_MAX_PROCESSING", 4*runtime.NumCPU())
+	return coalesce
+}
+
+// planConfig builds the plan restrictions from the environment.
+// PLAN_OPERATIONS lists the image operations restricted by the plans.
+func planConfig(plans models.PlanCatalog) middleware.PlanConfig {
+	plan := middleware.DefaultPlanConfig()
+	plan.Plans = plans
+	if operations := config.GetList("PLAN_OPERATIONS"); len(operations) > 0 {
+		plan.Operations = operations
+	}
+	return plan
+}
+
+// costConfig builds the image request cost settings from the environment.
+// COST_WEIGHTS is a list of operation=weight pairs, e.g. "resize=1.5".
+func costConfig() middleware.CostConfig {
+	cost := middleware.DefaultCostConfig()
+	for operation, value := range config.GetMap("COST_WEIGHTS") {
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Fatalf("Invalid COST_WEIGHTS weight for %q: %v", operation, err)
+		}
+		cost.Weights[operation] = weight
+	}
+	cost.DefaultWeight = config.GetFloat("COST_DEFAULT_WEIGHT", cost.DefaultWeight)
+	cost.OutputBytesPerUnit = int64(config.GetInt("COST_OUTPUT_BYTES_PER_UNIT", int(cost.OutputBytesPerUnit)))
+	return cost
+}
+
+// counterStore returns the store shared by all instances for counting rate
+// limits and quotas, selected by LIMIT_STORE: "firebase" for the user
+// database, "memory" for this instance only, or nil when not set.
+func counterStore() middleware.CounterStore {
+	switch store := config.Get("LIMIT_STORE"); store {
+	case "":
+		return nil
+	case "memory":
+		return middleware.NewMemoryCounterStore()
+	case "firebase":
+		repo := repositories.NewFirestoreRepository(config.GetDatabaseClient())
+		go deleteExpiredCounters(repo)
+		return repo
+	default:
+		log.Fatalf("Invalid LIMIT_STORE %q", store)
+		return nil
+	}
+}
+
+// sharedLimiter creates a limiter counting in fixed windows of period in
+// the shared store, configured by LIMIT_STORE_BATCH_SIZE and
+// LIMIT_STORE_TOLERANCE.
+func sharedLimiter(store middleware.CounterStore, namespace string, period time.Duration) middleware.Limiter {
+	shared := middleware.DefaultSharedLimiterConfig()
+	shared.Namespace = namespace
+	shared.Period = period
+	shared.BatchSize = int64(config.GetInt("LIMIT_STORE_BATCH_SIZE", int(shared.BatchSize)))
+	shared.Tolerance = config.GetFloat("LIMIT_STORE_TOLERANCE", shared.Tolerance)
+	shared.Timeout = config.GetDuration("LIMIT_STORE_TIMEOUT", shared.Timeout)
+	return middleware.NewSharedLimiter(store, shared)
+}
+
+// deleteExpiredCounters deletes expired counters from the shared store
+// every hour.
+func deleteExpiredCounters(repo *repositories.FirestoreRepository) {
+	for range time.Tick(time.Hour) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if _, err := repo.DeleteExpiredCounters(ctx, time.Now()); err != nil {
+			logging.Default().Error("Could not delete expired counters", "error", err)
+		}
+		cancel()
+	}
+}
+
+// reconcileUsage reconciles the volume and spend of users with new usage
+// events from the usage ledger every interval.
+func reconcileUsage(usage *services.UsageService, interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := usage.ReconcilePending(ctx); err != nil {
+			logging.Default().Error("Could not reconcile usage", "error", err)
+		}
+		cancel()
+	}
+}
+
+// limits parses a list of name=limit pairs from the environment, exiting
+// on invalid limits.
+func limits(name string) map[string]int64 {
+	parsed := make(map[string]int64)
+	for key, value := range config.GetMap(name) {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid %s limit for %q: %v", name, key, err)
+		}
+		parsed[key] = limit
+	}
+	return parsed
+}
+
+// ipNetworks parses a comma separated list of CIDRs from the environment,
+// exiting on invalid entries.
+func ipNetworks(name string) middleware.IPNetworks {
+	networks, err := middleware.ParseIPNetworks(config.GetList(name))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return networks
+}
@@ -3,16 +3,18 @@ package config
 import (
 	"context"
 	"log"
+	"sync"
 
 	"cloud.google.com/go/storage"
 )
 
 var (
-	storageClient *storage.Client
+	storageClient     *storage.Client
+	storageClientOnce sync.Once
 )
 
-// Initialize the Google Cloud Storage client
-func init() {
+// initStorageClient initializes the Google Cloud Storage client
+func initStorageClient() {
 	// Initialize the Google Cloud Storage client
 	var err error
 	storageClient, err = storage.NewClient(context.Background())
@@ -21,7 +23,10 @@ func init() {
 	}
 }
 
-// GetStorageClient returns the global storage client instance
+// GetStorageClient returns the global storage client instance. The client
+// is created on first use so that importing this package does not require
+// Google Cloud credentials.
 func GetStorageClient() *storage.Client {
+	storageClientOnce.Do(initStorageClient)
 	return storageClient
 }
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/db"
+)
+
+var (
+	databaseClient     *db.Client
+	databaseClientOnce sync.Once
+)
+
+// initDatabaseClient initializes the Firebase database client used by the
+// repositories package.
+func initDatabaseClient() {
+	ctx := context.Background()
+
+	// Create the Firebase app pointed at the configured database URL
+	app, err := firebase.NewApp(ctx, &firebase.Config{
+		DatabaseURL: Get("FIREBASE_DATABASE_URL"),
+	})
+	if err != nil {
+		log.Fatalf("Failed to create Firebase app: %v", err)
+	}
+
+	// Create the database client from the app
+	client, err := app.Database(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create Firebase database client: %v", err)
+	}
+	databaseClient = client
+}
+
+// GetDatabaseClient returns the global Firebase database client instance.
+// The client is created on first use.
+func GetDatabaseClient() *db.Client {
+	databaseClientOnce.Do(initDatabaseClient)
+	return databaseClient
+}
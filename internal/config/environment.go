@@ -3,8 +3,10 @@
 package config
 
 import (
-	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,7 +15,6 @@ import (
 func Load() error {
 	err := godotenv.Load(".env")
 	if err != nil {
-		log.Println("Error loading .env file:", err)
 		return err
 	}
 	return nil
@@ -23,3 +24,79 @@ func Load() error {
 func Get(name string) string {
 	return os.Getenv(name)
 }
+
+// GetDefault retrieves the value of an environment variable by name, or the
+// fallback if it is not set. A variable set to the empty string returns the
+// empty string.
+func GetDefault(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// GetDuration retrieves an environment variable parsed as a duration
+// (e.g. "5m"), or the fallback if it is not set or invalid
+func GetDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// GetBool retrieves an environment variable parsed as a boolean, or the
+// fallback if it is not set or invalid
+func GetBool(name string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// GetList retrieves an environment variable as a comma separated list,
+// with empty items removed
+func GetList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// GetInt retrieves an environment variable parsed as an integer, or the
+// fallback if it is not set or invalid
+func GetInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// GetMap retrieves an environment variable as a comma separated list of
+// key=value pairs (e.g. "basic=32,pro=64"). Items without "=" are ignored.
+func GetMap(name string) map[string]string {
+	values := make(map[string]string)
+	for _, item := range GetList(name) {
+		key, value, found := strings.Cut(item, "=")
+		if !found {
+			continue
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return values
+}
+
+// GetFloat retrieves an environment variable parsed as a floating point
+// number, or the fallback if it is not set or invalid
+func GetFloat(name string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
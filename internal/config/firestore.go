@@ -3,17 +3,19 @@ package config
 import (
 	"context"
 	"log"
+	"sync"
 
 	"cloud.google.com/go/firestore"
 	// "google.golang.org/api/option"
 )
 
 var (
-	firestoreClient *firestore.Client
+	firestoreClient     *firestore.Client
+	firestoreClientOnce sync.Once
 )
 
-// Initialize the Google Cloud Firestore client
-func init() {
+// initFirestoreClient initializes the Google Cloud Firestore client
+func initFirestoreClient() {
 	// Initialize the Google Cloud Firestore client
 	ctx := context.Background()
 
@@ -21,7 +23,7 @@ func init() {
 	projectID := "<project-id-here>"
 
 	// Create Firestore client with project ID
-	// Additional Options (if needed due to deployment 
+	// Additional Options (if needed due to deployment
 	// outside of google cloud): option.WithCredentialsFile("path/to/credentials.json")
 	client, err := firestore.NewClient(ctx, projectID)
 	if err != nil {
@@ -30,7 +32,10 @@ func init() {
 	firestoreClient = client
 }
 
-// GetFirestoreClient returns the global Firestore client instance
+// GetFirestoreClient returns the global Firestore client instance. The
+// client is created on first use so that importing this package does not
+// require Google Cloud credentials.
 func GetFirestoreClient() *firestore.Client {
+	firestoreClientOnce.Do(initFirestoreClient)
 	return firestoreClient
 }
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// LoadPlans reads subscription plans from a JSON file mapping plan names to
+// plans, e.g. {"pro": {"quota": 100000, "rate_limit": 64, ...}}, into the
+// catalog. Plans replace those of the same name, compared case
+// insensitively.
+func LoadPlans(path string, catalog models.PlanCatalog) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var plans map[string]models.Plan
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return fmt.Errorf("parsing plans file %s: %w", path, err)
+	}
+
+	for name, plan := range plans {
+		name = strings.ToLower(name)
+		plan.Name = name
+		catalog[name] = plan
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+func TestLoadPlans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plans.json")
+	data := `{"Pro": {"quota": 5000, "rate_limit": 16, "metered": true, "unit_price": 0.01}}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog := models.DefaultPlanCatalog()
+	if err := LoadPlans(path, catalog); err != nil {
+		t.Fatal(err)
+	}
+
+	pro := catalog["pro"]
+	if pro.Name != "pro" || pro.Quota != 5000 || pro.RateLimit != 16 || !pro.Metered || pro.UnitPrice != 0.01 {
+		t.Errorf("pro plan = %+v, want the plan from the file", pro)
+	}
+	if _, ok := catalog["free"]; !ok {
+		t.Error("free plan missing after loading the file")
+	}
+}
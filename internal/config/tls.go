@@ -0,0 +1,160 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+)
+
+// TLSReloader serves a TLS certificate and client CA bundle loaded from
+// files, reloading them when the files change so certificates can be
+// rotated without restarting the server.
+type TLSReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// NewTLSReloader loads the certificate, key and (optional) client CA bundle
+// and returns a reloader serving them.
+func NewTLSReloader(certFile, keyFile, caFile string) (*TLSReloader, error) {
+	r := &TLSReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On error the previously loaded
+// certificate and CA bundle keep being served.
+func (r *TLSReloader) Reload() error {
+	// Record the modification times before reading so a change made while
+	// loading is picked up by the next check
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return err
+	}
+
+	// Load the server certificate and key
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	// Load the CA bundle used to verify client certificates
+	var clientCAs *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("reading client CA bundle: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("client CA bundle contains no certificates")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// Changed reports whether any of the files were modified since they were
+// last loaded.
+func (r *TLSReloader) Changed() bool {
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for name, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch checks the files every interval and reloads them when they change,
+// until ctx is cancelled.
+func (r *TLSReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.Changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				logging.Default().Error("Could not reload TLS certificates", "error", err)
+				continue
+			}
+			logging.Default().Info("Reloaded TLS certificates")
+		}
+	}
+}
+
+// TLSConfig returns a server TLS configuration that always uses the most
+// recently loaded certificate and CA bundle. When a CA bundle is configured,
+// client certificates are requested and verified against it, but not
+// required, so clients may still authenticate by other means.
+func (r *TLSReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				config.ClientCAs = r.clientCAs
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return config, nil
+		},
+	}
+}
+
+// fileModTimes returns the modification time of each configured file.
+func (r *TLSReloader) fileModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[name] = info.ModTime()
+	}
+	return modTimes, nil
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a self-signed certificate and key with the
+// given common name to dir and returns their paths.
+func writeSelfSignedCert(t *testing.T, dir, commonName string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// servedCommonName returns the common name of the certificate the
+// reloader currently serves.
+func servedCommonName(t *testing.T, r *TLSReloader) string {
+	t.Helper()
+	config, err := r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestTLSReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir, "first")
+	caFile := certFile
+
+	reloader, err := NewTLSReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("NewTLSReloader: %v", err)
+	}
+	if got := servedCommonName(t, reloader); got != "first" {
+		t.Errorf("got certificate %q want %q", got, "first")
+	}
+
+	// Client certificates are verified when a CA bundle is configured
+	config, _ := reloader.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if config.ClientAuth != tls.VerifyClientCertIfGiven || config.ClientCAs == nil {
+		t.Errorf("client certificate verification not configured")
+	}
+
+	// Rotate the certificate on disk
+	writeSelfSignedCert(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	for _, name := range []string{certFile, keyFile} {
+		if err := os.Chtimes(name, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reloader.Changed() {
+		t.Fatalf("expected rotated files to be detected")
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := servedCommonName(t, reloader); got != "second" {
+		t.Errorf("got certificate %q want %q", got, "second")
+	}
+	if reloader.Changed() {
+		t.Errorf("expected no changes after reload")
+	}
+
+	// A broken file keeps the last good certificate
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("expected an error reloading a broken certificate")
+	}
+	if got := servedCommonName(t, reloader); got != "second" {
+		t.Errorf("got certificate %q want %q", got, "second")
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+	"github.com/gorilla/mux"
+)
+
+// BanStore lists and lifts IP bans.
+// *middleware.IPFilter satisfies this interface.
+type BanStore interface {
+	Bans() []models.Ban
+	Unban(ip string) bool
+}
+
+// BansHandler serves the admin endpoints for inspecting and lifting
+// automatic IP bans. Bans are kept by each instance, so the endpoints only
+// list and lift the bans of the instance serving the request.
+type BansHandler struct {
+	store BanStore
+}
+
+// NewBansHandler creates a new BansHandler.
+func NewBansHandler(store BanStore) *BansHandler {
+	return &BansHandler{
+		store: store,
+	}
+}
+
+// ListBansHandler is a handler for GET /admin/bans.
+func (h *BansHandler) ListBansHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, models.Payload{
+		Status:  "success",
+		Message: "Active IP bans.",
+		Data:    h.store.Bans(),
+	})
+}
+
+// LiftBanHandler is a handler for DELETE /admin/bans/{ip}.
+func (h *BansHandler) LiftBanHandler(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	if !h.store.Unban(ip) {
+		writeJSON(w, http.StatusNotFound, models.Payload{
+			Status:  "error",
+			Message: "No active ban for this IP address.",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.Payload{
+		Status:  "success",
+		Message: "Ban lifted.",
+		Data:    map[string]string{"ip": ip},
+	})
+}
+
+// writeJSON encodes the response object as JSON and writes it with the
+// given status code.
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	// Errors carry the request ID set by the request ID middleware
+	if payload, ok := response.(models.Payload); ok && payload.Status == "error" && payload.RequestID == "" {
+		payload.RequestID = w.Header().Get(requestid.Header)
+		response = payload
+	}
+
+	// Set the response content type to JSON
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	// Encode the response object as JSON and write it to the response
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/middleware"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// CacheStore reports on and purges cached responses.
+// *middleware.LRUCache, *middleware.DiskCache and *middleware.TieredCache
+// satisfy this interface.
+type CacheStore interface {
+	PurgePrefix(prefix string) int
+	PurgeOwner(owner string) int
+	Stats() middleware.CacheStats
+}
+
+// CacheHandler serves the admin endpoints for inspecting and purging the
+// response cache.
+type CacheHandler struct {
+	store CacheStore
+}
+
+// NewCacheHandler creates a new CacheHandler.
+func NewCacheHandler(store CacheStore) *CacheHandler {
+	return &CacheHandler{
+		store: store,
+	}
+}
+
+// CacheStatsHandler is a handler for GET /admin/cache. It reports the
+// cache's hits, misses, evictions, entries and size.
+func (h *CacheHandler) CacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, models.Payload{
+		Status:  "success",
+		Message: "Response cache statistics.",
+		Data:    h.store.Stats(),
+	})
+}
+
+// PurgeCacheHandler is a handler for DELETE /admin/cache. It purges the
+// responses whose path starts with the prefix query parameter, or those
+// cached for the user with the user query parameter's ID.
+func (h *CacheHandler) PurgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	params := r.URL.Query()
+	prefix, userID := params.Get("prefix"), params.Get("user")
+	if prefix == "" && userID == "" {
+		writeJSON(w, http.StatusBadRequest, models.Payload{
+			Status:  "error",
+			Message: "A prefix or user query parameter is required.",
+		})
+		return
+	}
+
+	// Purge by both when both are given
+	purged := 0
+	if prefix != "" {
+		purged += h.store.PurgePrefix(prefix)
+	}
+	if userID != "" {
+		purged += h.store.PurgeOwner("user:" + userID)
+	}
+
+	writeJSON(w, http.StatusOK, models.Payload{
+		Status:  "success",
+		Message: "Cache purged.",
+		Data:    map[string]int{"purged": purged},
+	})
+}
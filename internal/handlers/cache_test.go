@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/middleware"
+)
+
+func TestPurgeCacheHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		purged int
+		left   int64
+	}{
+		{"no parameters", "", http.StatusBadRequest, 0, 3},
+		{"prefix", "?prefix=/api/v1/image/resize", http.StatusOK, 2, 1},
+		{"user", "?user=user-2", http.StatusOK, 1, 2},
+		{"prefix and user", "?prefix=/api/v1/image/resize&user=user-2", http.StatusOK, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := middleware.NewLRUCache(1 << 20)
+			store.Set("/api/v1/image/resize?w=1", &middleware.CachedResponse{Status: http.StatusOK, Owner: "user:user-1"}, time.Minute)
+			store.Set("/api/v1/image/resize?w=2", &middleware.CachedResponse{Status: http.StatusOK, Owner: "user:user-1"}, time.Minute)
+			store.Set("/api/v1/image/crop", &middleware.CachedResponse{Status: http.StatusOK, Owner: "user:user-2"}, time.Minute)
+
+			req := httptest.NewRequest(http.MethodDelete, "/admin/cache"+tt.query, nil)
+			rr := httptest.NewRecorder()
+			NewCacheHandler(store).PurgeCacheHandler(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := store.Stats().Entries; got != tt.left {
+				t.Errorf("entries left = %d, want %d", got, tt.left)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var response struct {
+				Data struct {
+					Purged int `json:"purged"`
+				} `json:"data"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Data.Purged != tt.purged {
+				t.Errorf("purged = %d, want %d", response.Data.Purged, tt.purged)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/services"
+)
+
+// OAuthHandler serves the OAuth2 token, introspection and revocation
+// endpoints for the client_credentials grant.
+type OAuthHandler struct {
+	service *services.OAuthService
+}
+
+// NewOAuthHandler creates a new OAuthHandler.
+func NewOAuthHandler(service *services.OAuthService) *OAuthHandler {
+	return &OAuthHandler{
+		service: service,
+	}
+}
+
+// TokenHandler is a handler for the /oauth/token endpoint (RFC 6749 4.4).
+func (h *OAuthHandler) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the form encoded request body
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The request body could not be parsed.")
+		return
+	}
+
+	// Only the client credentials grant is supported
+	if r.PostForm.Get("grant_type") != "client_credentials" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the client_credentials grant is supported.")
+		return
+	}
+
+	// Authenticate the client and issue the token
+	clientID, clientSecret := clientCredentials(r)
+	token, claims, err := h.service.IssueToken(r.Context(), clientID, clientSecret, strings.Fields(r.PostForm.Get("scope")))
+	switch {
+	case errors.Is(err, services.ErrInvalidClient):
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed.")
+		return
+	case errors.Is(err, services.ErrInvalidScope):
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "The requested scope is not allowed for this client.")
+		return
+	case err != nil:
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "The token could not be issued.")
+		return
+	}
+
+	// Create and populate the response object
+	response := map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(claims.ExpiresAt.Sub(claims.IssuedAt).Seconds()),
+		"scope":        strings.Join(claims.Scopes, " "),
+	}
+	writeOAuthJSON(w, http.StatusOK, response)
+}
+
+// IntrospectHandler is a handler for the /oauth/introspect endpoint
+// (RFC 7662). Clients may only introspect tokens issued to their own user.
+func (h *OAuthHandler) IntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	// Authenticate the calling client
+	user, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	// Inactive tokens, and tokens of other users, only report inactive
+	claims, err := h.service.VerifyAccessToken(r.Context(), r.PostForm.Get("token"))
+	if err != nil || claims.UserID != user.ID {
+		writeOAuthJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+
+	// Create and populate the response object
+	response := map[string]interface{}{
+		"active":     true,
+		"scope":      strings.Join(claims.Scopes, " "),
+		"client_id":  claims.ClientID,
+		"sub":        claims.UserID,
+		"token_type": "Bearer",
+		"iat":        claims.IssuedAt.Unix(),
+		"exp":        claims.ExpiresAt.Unix(),
+		"jti":        claims.ID,
+	}
+	writeOAuthJSON(w, http.StatusOK, response)
+}
+
+// RevokeHandler is a handler for the /oauth/revoke endpoint (RFC 7009).
+// Clients may only revoke tokens issued to their own user.
+func (h *OAuthHandler) RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	// Authenticate the calling client
+	user, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	// Revoke the token. Unknown tokens are not an error.
+	if err := h.service.RevokeToken(r.Context(), r.PostForm.Get("token"), user.ID); err != nil {
+		writeOAuthError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "The token could not be revoked.")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateClient parses the form and authenticates the calling client,
+// writing an error response if it fails.
+func (h *OAuthHandler) authenticateClient(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The request body could not be parsed.")
+		return nil, false
+	}
+
+	clientID, clientSecret := clientCredentials(r)
+	user, _, err := h.service.AuthenticateClient(r.Context(), clientID, clientSecret)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed.")
+		return nil, false
+	}
+	return user, true
+}
+
+// clientCredentials returns the client ID and secret from HTTP Basic
+// authentication, falling back to the client_id and client_secret form
+// parameters.
+func clientCredentials(r *http.Request) (string, string) {
+	if clientID, clientSecret, ok := r.BasicAuth(); ok {
+		return clientID, clientSecret
+	}
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+}
+
+// writeOAuthError writes an OAuth2 error response (RFC 6749 5.2).
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	writeOAuthJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// writeOAuthJSON writes a JSON response that must not be cached.
+func writeOAuthJSON(w http.ResponseWriter, status int, response interface{}) {
+	// Set the response content type to JSON
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	// Encode the response object as JSON and write it to the response
+	json.NewEncoder(w).Encode(response)
+}
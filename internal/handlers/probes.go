@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/health"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// HealthChecker runs the liveness and readiness checks.
+// *health.Registry satisfies this interface.
+type HealthChecker interface {
+	Live(ctx context.Context) health.Report
+	Ready(ctx context.Context) health.Report
+}
+
+// ProbeHandler serves the liveness and readiness probes.
+type ProbeHandler struct {
+	checker HealthChecker
+}
+
+// NewProbeHandler creates a new ProbeHandler.
+func NewProbeHandler(checker HealthChecker) *ProbeHandler {
+	return &ProbeHandler{
+		checker: checker,
+	}
+}
+
+// LivenessHandler answers GET /livez: 200 while the process can serve
+// requests, 503 when it should be restarted.
+func (h *ProbeHandler) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, h.checker.Live(r.Context()), false)
+}
+
+// ReadinessHandler answers GET /readyz: 200 while the instance and its
+// dependencies can serve requests, 503 when load balancers should send
+// requests elsewhere, e.g. during shutdown.
+func (h *ProbeHandler) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, h.checker.Ready(r.Context()), false)
+}
+
+// VerboseLivenessHandler answers GET /livez?verbose with the result of
+// every check. The check errors may describe the infrastructure, so it is
+// restricted to admins.
+func (h *ProbeHandler) VerboseLivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, h.checker.Live(r.Context()), true)
+}
+
+// VerboseReadinessHandler answers GET /readyz?verbose with the result of
+// every check, for admins.
+func (h *ProbeHandler) VerboseReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, h.checker.Ready(r.Context()), true)
+}
+
+// writeReport writes the report of a probe, with the check results if
+// verbose.
+func writeReport(w http.ResponseWriter, report health.Report, verbose bool) {
+	// Probes must always see the current state
+	w.Header().Set("Cache-Control", "no-store")
+
+	payload := models.Payload{Status: "success", Message: "ok"}
+	status := http.StatusOK
+	if !report.Healthy {
+		payload = models.Payload{Status: "error", Message: "failing"}
+		status = http.StatusServiceUnavailable
+	}
+	if report.ShuttingDown {
+		payload.Message = "shutting down"
+	}
+	if verbose {
+		payload.Data = report
+	}
+	writeJSON(w, status, payload)
+}
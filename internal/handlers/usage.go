@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/middleware"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/services"
+)
+
+// UsageReporter reports the usage of a user.
+// *services.UsageService satisfies this interface.
+type UsageReporter interface {
+	Report(ctx context.Context, userID string, query services.UsageQuery) (*models.UsageReport, error)
+}
+
+// UsageHandler serves usage reports from the usage ledger.
+type UsageHandler struct {
+	reports UsageReporter
+}
+
+// NewUsageHandler creates a new UsageHandler.
+func NewUsageHandler(reports UsageReporter) *UsageHandler {
+	return &UsageHandler{
+		reports: reports,
+	}
+}
+
+// GetUsageHandler is a handler for GET /api/v1/usage. It reports the
+// caller's usage, or with user_id any user's usage to admins, filtered by
+// the from, to, granularity (day or month), operation and key query
+// parameters. The report is CSV with format=csv or an Accept: text/csv
+// header, and JSON otherwise.
+func (h *UsageHandler) GetUsageHandler(w http.ResponseWriter, r *http.Request) {
+	// Reports are only for the user who asked for them
+	w.Header().Set("Cache-Control", "private")
+
+	user, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, models.Payload{
+			Status:  "error",
+			Message: "Authentication required.",
+		})
+		return
+	}
+
+	// Only admins may see the usage of other users
+	params := r.URL.Query()
+	userID := user.ID
+	if other := params.Get("user_id"); other != "" && other != user.ID {
+		if !middleware.HasRole(user, "admin") {
+			writeJSON(w, http.StatusForbidden, models.Payload{
+				Status:  "error",
+				Message: "Not allowed to see the usage of other users.",
+			})
+			return
+		}
+		userID = other
+	}
+
+	// Parse the query
+	query := services.UsageQuery{
+		Granularity: params.Get("granularity"),
+		Operation:   params.Get("operation"),
+		KeyID:       params.Get("key"),
+	}
+	var err error
+	if query.From, err = parseUsageTime(params.Get("from")); err != nil {
+		writeJSON(w, http.StatusBadRequest, models.Payload{
+			Status:  "error",
+			Message: "Invalid from time, expected a date (2006-01-02) or RFC 3339 time.",
+		})
+		return
+	}
+	if query.To, err = parseUsageTime(params.Get("to")); err != nil {
+		writeJSON(w, http.StatusBadRequest, models.Payload{
+			Status:  "error",
+			Message: "Invalid to time, expected a date (2006-01-02) or RFC 3339 time.",
+		})
+		return
+	}
+
+	report, err := h.reports.Report(r.Context(), userID, query)
+	if errors.Is(err, services.ErrInvalidUsageQuery) {
+		writeJSON(w, http.StatusBadRequest, models.Payload{
+			Status:  "error",
+			Message: "Invalid usage query: granularity must be day or month, and from before to.",
+		})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Unable to report usage", "report_user_id", userID, "error", err)
+		writeJSON(w, http.StatusInternalServerError, models.Payload{
+			Status:  "error",
+			Message: "Unable to report usage.",
+		})
+		return
+	}
+
+	if params.Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		writeUsageCSV(w, report)
+		return
+	}
+	writeJSON(w, http.StatusOK, models.Payload{
+		Status:  "success",
+		Message: "Usage report.",
+		Data:    report,
+	})
+}
+
+// writeUsageCSV writes the periods of a usage report as CSV, one row per
+// period.
+func writeUsageCSV(w http.ResponseWriter, report *models.UsageReport) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		fmt.Sprintf("usage-%s-%s.csv", report.UserID, report.From.Format("20060102"))))
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"period", "requests", "input_bytes", "output_bytes", "megapixels", "duration_ms", "cost", "amount"})
+	for _, period := range report.Periods {
+		writer.Write([]string{
+			period.Period,
+			strconv.Itoa(period.Requests),
+			strconv.FormatInt(period.InputBytes, 10),
+			strconv.FormatInt(period.OutputBytes, 10),
+			strconv.FormatFloat(period.Megapixels, 'f', -1, 64),
+			strconv.FormatInt(period.DurationMS, 10),
+			strconv.FormatInt(period.Cost, 10),
+			strconv.FormatFloat(period.Amount, 'f', -1, 64),
+		})
+	}
+	writer.Flush()
+}
+
+// parseUsageTime parses a date or an RFC 3339 time. An empty value is the
+// zero time.
+func parseUsageTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
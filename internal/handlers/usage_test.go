@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/middleware"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/services"
+)
+
+// fakeReporter records the last query and reports one period of usage.
+type fakeReporter struct {
+	userID string
+	query  services.UsageQuery
+}
+
+func (f *fakeReporter) Report(ctx context.Context, userID string, query services.UsageQuery) (*models.UsageReport, error) {
+	f.userID, f.query = userID, query
+	period := models.UsageSummary{Period: "2023-05-02", Requests: 2, Cost: 3, Amount: 0.75}
+	return &models.UsageReport{
+		UserID:  userID,
+		From:    time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+		Periods: []models.UsageSummary{period},
+		Total:   period,
+	}, nil
+}
+
+// serveUsage serves a usage request from the user.
+func serveUsage(reports UsageReporter, user *models.User, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if user != nil {
+		req = req.WithContext(middleware.WithIdentity(req.Context(), &middleware.Identity{User: user}))
+	}
+	rr := httptest.NewRecorder()
+	NewUsageHandler(reports).GetUsageHandler(rr, req)
+	return rr
+}
+
+func TestGetUsageHandler_OtherUsers(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   *models.User
+		status int
+		userID string
+	}{
+		{"anonymous", nil, http.StatusUnauthorized, ""},
+		{"user", &models.User{ID: "user-1"}, http.StatusForbidden, ""},
+		{"admin", &models.User{ID: "admin-1", Roles: []string{"admin"}}, http.StatusOK, "user-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reports := &fakeReporter{}
+			rr := serveUsage(reports, tt.user, "/api/v1/usage?user_id=user-2")
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if reports.userID != tt.userID {
+				t.Errorf("reported user = %q, want %q", reports.userID, tt.userID)
+			}
+		})
+	}
+
+	// Users may name themselves
+	reports := &fakeReporter{}
+	if rr := serveUsage(reports, &models.User{ID: "user-1"}, "/api/v1/usage?user_id=user-1"); rr.Code != http.StatusOK || reports.userID != "user-1" {
+		t.Errorf("own usage: status = %d, reported user = %q", rr.Code, reports.userID)
+	}
+}
+
+func TestGetUsageHandler_CSV(t *testing.T) {
+	user := &models.User{ID: "user-1"}
+	want := "period,requests,input_bytes,output_bytes,megapixels,duration_ms,cost,amount\n2023-05-02,2,0,0,0,0,3,0.75\n"
+
+	for _, target := range []string{"/api/v1/usage?format=csv", "/api/v1/usage"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = req.WithContext(middleware.WithIdentity(req.Context(), &middleware.Identity{User: user}))
+		req.Header.Set("Accept", "text/csv")
+		rr := httptest.NewRecorder()
+		NewUsageHandler(&fakeReporter{}).GetUsageHandler(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", target, rr.Code, http.StatusOK)
+		}
+		if got := rr.Header().Get("Content-Type"); got != "text/csv" {
+			t.Errorf("%s: Content-Type = %q, want text/csv", target, got)
+		}
+		if got := rr.Header().Get("Content-Disposition"); !strings.Contains(got, "usage-user-1-20230501.csv") {
+			t.Errorf("%s: Content-Disposition = %q", target, got)
+		}
+		if got := rr.Body.String(); got != want {
+			t.Errorf("%s: body = %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestGetUsageHandler_InvalidTimes(t *testing.T) {
+	user := &models.User{ID: "user-1"}
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/api/v1/usage?from=yesterday", http.StatusBadRequest},
+		{"/api/v1/usage?to=2023-13-01", http.StatusBadRequest},
+		{"/api/v1/usage?from=2023-05-01&to=2023-06-01T00:00:00Z", http.StatusOK},
+	}
+	for _, tt := range tests {
+		reports := &fakeReporter{}
+		rr := serveUsage(reports, user, tt.target)
+		if rr.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.target, rr.Code, tt.status)
+		}
+	}
+
+	// The times are passed on
+	reports := &fakeReporter{}
+	serveUsage(reports, user, "/api/v1/usage?from=2023-05-01&to=2023-06-01T00:00:00Z")
+	if want := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC); !reports.query.From.Equal(want) {
+		t.Errorf("from = %v, want %v", reports.query.From, want)
+	}
+	if want := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC); !reports.query.To.Equal(want) {
+		t.Errorf("to = %v, want %v", reports.query.To, want)
+	}
+}
@@ -0,0 +1,240 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check probes a dependency, returning an error when it is unusable. It
+// should return once ctx is done.
+type Check func(ctx context.Context) error
+
+// CheckConfig configures how a check is run.
+type CheckConfig struct {
+	// Timeout bounds each run of the check. A check still running after it
+	// fails.
+	Timeout time.Duration
+
+	// CacheTTL is how long a result is reused, so frequent probes from
+	// several load balancers do not hammer the dependency.
+	CacheTTL time.Duration
+
+	// Liveness also runs the check for the liveness probe. Most checks
+	// should only affect readiness: restarting the process does not fix an
+	// unreachable dependency.
+	Liveness bool
+}
+
+// DefaultCheckConfig returns the default check configuration: a readiness
+// check timing out after 2 seconds, with results reused for 5 seconds.
+func DefaultCheckConfig() CheckConfig {
+	return CheckConfig{
+		Timeout:  2 * time.Second,
+		CacheTTL: 5 * time.Second,
+	}
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Name       string    `json:"name"`
+	Healthy    bool      `json:"healthy"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS float64   `json:"duration_ms"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// Report is the outcome of the checks of a probe.
+type Report struct {
+	Healthy      bool     `json:"healthy"`
+	ShuttingDown bool     `json:"shutting_down,omitempty"`
+	Checks       []Result `json:"checks"`
+}
+
+// check is a registered check with its last result.
+type check struct {
+	name   string
+	fn     Check
+	config CheckConfig
+
+	mu      sync.Mutex
+	last    Result
+	expires time.Time
+}
+
+// Registry holds the named checks run by the liveness and readiness
+// probes.
+type Registry struct {
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	mu           sync.Mutex
+	checks       []*check
+	shuttingDown atomic.Bool
+}
+
+// NewRegistry creates a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		Now: time.Now,
+	}
+}
+
+// Register adds a named check, replacing any check of the same name.
+func (r *Registry) Register(name string, fn Check, config CheckConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := &check{name: name, fn: fn, config: config}
+	for i, existing := range r.checks {
+		if existing.name == name {
+			r.checks[i] = c
+			return
+		}
+	}
+	r.checks = append(r.checks, c)
+}
+
+// Shutdown makes readiness fail from now on, so load balancers stop
+// sending requests while the server drains. Liveness is unaffected.
+func (r *Registry) Shutdown() {
+	r.shuttingDown.Store(true)
+}
+
+// Live runs the liveness checks.
+func (r *Registry) Live(ctx context.Context) Report {
+	return r.run(ctx, true)
+}
+
+// Ready runs the readiness checks, which include the liveness checks. It
+// fails once Shutdown is called.
+func (r *Registry) Ready(ctx context.Context) Report {
+	report := r.run(ctx, false)
+	if r.shuttingDown.Load() {
+		report.Healthy = false
+		report.ShuttingDown = true
+	}
+	return report
+}
+
+// run runs the checks concurrently, only the liveness checks if liveness
+// is set, and reports them in registration order.
+func (r *Registry) run(ctx context.Context, liveness bool) Report {
+	r.mu.Lock()
+	checks := make([]*check, 0, len(r.checks))
+	for _, c := range r.checks {
+		if !liveness || c.config.Liveness {
+			checks = append(checks, c)
+		}
+	}
+	r.mu.Unlock()
+
+	report := Report{Healthy: true, Checks: make([]Result, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			report.Checks[i] = r.result(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		report.Healthy = report.Healthy && result.Healthy
+	}
+	return report
+}
+
+// result returns the cached result of the check, or runs it. Concurrent
+// probes wait for a single run. Results are not cached when ctx is done,
+// as the check then fails because the probe went away.
+func (r *Registry) result(ctx context.Context, c *check) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := r.Now()
+	if now.Before(c.expires) {
+		return c.last
+	}
+
+	err := runCheck(ctx, c.fn, c.config.Timeout)
+	result := Result{
+		Name:       c.name,
+		Healthy:    err == nil,
+		DurationMS: float64(r.Now().Sub(now)) / float64(time.Millisecond),
+		CheckedAt:  now,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	// A probe that went away says nothing about the dependency, so its
+	// result is not reused by the next probes
+	if ctx.Err() != nil {
+		return result
+	}
+	c.last = result
+	c.expires = now.Add(c.config.CacheTTL)
+	return c.last
+}
+
+// runCheck runs the check, failing it after the timeout even if it does
+// not return.
+func runCheck(ctx context.Context, fn Check, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			// A panicking check fails rather than the server
+			if err := recover(); err != nil {
+				done <- fmt.Errorf("check panicked: %v", err)
+			}
+		}()
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		return ctx.Err()
+	}
+}
+
+// SaturationCheck fails while inUse reports capacity or more busy
+// workers, so a saturated instance stops receiving new requests.
+func SaturationCheck(inUse func() int, capacity int) Check {
+	return func(ctx context.Context) error {
+		if busy := inUse(); busy >= capacity {
+			return fmt.Errorf("%d of %d workers busy", busy, capacity)
+		}
+		return nil
+	}
+}
+
+// DiskSpaceCheck fails when the file system of dir has less than minFree
+// bytes available.
+func DiskSpaceCheck(dir string, minFree uint64) Check {
+	return func(ctx context.Context) error {
+		free, err := freeSpace(dir)
+		if err != nil {
+			return err
+		}
+		if free < minFree {
+			return fmt.Errorf("%d bytes free in %s, want at least %d", free, dir, minFree)
+		}
+		return nil
+	}
+}
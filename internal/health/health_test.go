@@ -0,0 +1,134 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistryReady(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register("ok", func(ctx context.Context) error { return nil }, DefaultCheckConfig())
+	registry.Register("down", func(ctx context.Context) error { return errors.New("unreachable") }, DefaultCheckConfig())
+
+	report := registry.Ready(context.Background())
+	if report.Healthy || len(report.Checks) != 2 {
+		t.Fatalf("Ready() = %+v, want two checks, failing", report)
+	}
+	if !report.Checks[0].Healthy || report.Checks[1].Healthy || report.Checks[1].Error != "unreachable" {
+		t.Errorf("checks = %+v, want ok then down", report.Checks)
+	}
+
+	// Readiness checks do not affect liveness
+	if report := registry.Live(context.Background()); !report.Healthy || len(report.Checks) != 0 {
+		t.Errorf("Live() = %+v, want healthy without checks", report)
+	}
+}
+
+func TestRegistryTimeout(t *testing.T) {
+	registry := NewRegistry()
+	block := make(chan struct{})
+	defer close(block)
+	registry.Register("slow", func(ctx context.Context) error {
+		<-block
+		return nil
+	}, CheckConfig{Timeout: 10 * time.Millisecond, Liveness: true})
+
+	report := registry.Live(context.Background())
+	if report.Healthy || !strings.Contains(report.Checks[0].Error, "timed out") {
+		t.Errorf("Live() = %+v, want the slow check timed out", report)
+	}
+}
+
+func TestRegistryCachesResults(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	registry := NewRegistry()
+	registry.Now = func() time.Time { return now }
+	var runs int32
+	registry.Register("counted", func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}, CheckConfig{Timeout: time.Second, CacheTTL: 5 * time.Second})
+
+	registry.Ready(context.Background())
+	registry.Ready(context.Background())
+	if runs != 1 {
+		t.Errorf("check ran %d times within its TTL, want 1", runs)
+	}
+
+	now = now.Add(5 * time.Second)
+	registry.Ready(context.Background())
+	if runs != 2 {
+		t.Errorf("check ran %d times after its TTL, want 2", runs)
+	}
+}
+
+func TestRegistryDoesNotCacheCanceledProbes(t *testing.T) {
+	registry := NewRegistry()
+	started := make(chan struct{}, 1)
+	var runs int32
+	registry.Register("blocking", func(ctx context.Context) error {
+		// Only the first run blocks, until its probe goes away
+		if atomic.AddInt32(&runs, 1) > 1 {
+			return nil
+		}
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}, CheckConfig{Timeout: time.Second, CacheTTL: time.Minute})
+
+	// The first probe goes away mid-check
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if report := registry.Ready(ctx); report.Healthy {
+		t.Fatalf("Ready() = %+v, want the canceled check failing", report)
+	}
+
+	// The next probe runs the check again
+	if report := registry.Ready(context.Background()); !report.Healthy || runs != 2 {
+		t.Errorf("Ready() = %+v after %d runs, want healthy after 2", report, runs)
+	}
+}
+
+func TestRegistryShutdown(t *testing.T) {
+	registry := NewRegistry()
+	registry.Shutdown()
+
+	if report := registry.Ready(context.Background()); report.Healthy || !report.ShuttingDown {
+		t.Errorf("Ready() = %+v, want failing while shutting down", report)
+	}
+	if report := registry.Live(context.Background()); !report.Healthy {
+		t.Errorf("Live() = %+v, want healthy while shutting down", report)
+	}
+}
+
+func TestSaturationCheck(t *testing.T) {
+	busy := 3
+	check := SaturationCheck(func() int { return busy }, 4)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("check() with 3 of 4 busy = %v, want nil", err)
+	}
+	busy = 4
+	if err := check(context.Background()); err == nil {
+		t.Error("check() with 4 of 4 busy = nil, want an error")
+	}
+}
+
+func TestDiskSpaceCheck(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := freeSpace(dir); err != nil {
+		t.Skipf("free space is not available: %v", err)
+	}
+	if err := DiskSpaceCheck(dir, 1)(context.Background()); err != nil {
+		t.Errorf("check() wanting 1 free byte = %v, want nil", err)
+	}
+	if err := DiskSpaceCheck(dir, 1<<62)(context.Background()); err == nil {
+		t.Error("check() wanting 4EB free = nil, want an error")
+	}
+}
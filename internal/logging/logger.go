@@ -0,0 +1,224 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// The log levels, in increasing severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the level's Cloud Logging severity, e.g. "WARNING".
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARNING"
+	default:
+		return "ERROR"
+	}
+}
+
+// ParseLevel parses a level name: debug, info, warn (or warning) or error.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// field is a key and value of a log entry.
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes leveled log entries as JSON lines, with the severity,
+// message and time fields read by Cloud Logging, followed by the logger's
+// fields and the entry's.
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	level  Level
+	fields []field
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// New creates a new Logger writing entries of at least the level to out.
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{
+		out:   out,
+		mu:    &sync.Mutex{},
+		level: level,
+		Now:   time.Now,
+	}
+}
+
+// defaultLogger is the logger used without one in the context.
+var defaultLogger = New(os.Stderr, LevelInfo)
+
+// Default returns the default logger.
+func Default() *Logger {
+	return defaultLogger
+}
+
+// SetDefault replaces the default logger.
+func SetDefault(logger *Logger) {
+	defaultLogger = logger
+}
+
+// With returns a logger adding the alternating keys and values to every
+// entry, e.g. With("user_id", id).
+func (l *Logger) With(args ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]field(nil), l.fields...), fields(args)...)
+	return &child
+}
+
+// Enabled reports whether entries of the level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug logs a message with alternating keys and values at debug level.
+func (l *Logger) Debug(msg string, args ...interface{}) {
+	l.Log(LevelDebug, msg, args...)
+}
+
+// Info logs a message with alternating keys and values at info level.
+func (l *Logger) Info(msg string, args ...interface{}) {
+	l.Log(LevelInfo, msg, args...)
+}
+
+// Warn logs a message with alternating keys and values at warning level.
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.Log(LevelWarn, msg, args...)
+}
+
+// Error logs a message with alternating keys and values at error level.
+func (l *Logger) Error(msg string, args ...interface{}) {
+	l.Log(LevelError, msg, args...)
+}
+
+// Log writes an entry if its level is enabled.
+func (l *Logger) Log(level Level, msg string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	// Encode the entry as a JSON object, keeping the fields in order
+	var entry bytes.Buffer
+	entry.WriteString("{")
+	writeField(&entry, "severity", level.String())
+	entry.WriteString(",")
+	writeField(&entry, "message", msg)
+	entry.WriteString(",")
+	writeField(&entry, "time", l.Now().UTC().Format(time.RFC3339Nano))
+	for _, f := range append(append([]field(nil), l.fields...), fields(args)...) {
+		entry.WriteString(",")
+		writeField(&entry, f.key, f.value)
+	}
+	entry.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(entry.Bytes())
+}
+
+// Writer returns a writer logging each line written to it as an entry of
+// the level, e.g. to route the standard log package through the logger.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: l, level: level}
+}
+
+// lineWriter logs the lines written to it.
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+// Write logs each line of p.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.Log(w.level, line)
+	}
+	return len(p), nil
+}
+
+// fields pairs alternating keys and values. A value without a key, or a
+// key that is not a string, is logged under "!BADKEY".
+func fields(args []interface{}) []field {
+	var fs []field
+	for len(args) > 0 {
+		key, ok := args[0].(string)
+		if !ok || len(args) == 1 {
+			fs = append(fs, field{key: "!BADKEY", value: args[0]})
+			args = args[1:]
+			continue
+		}
+		fs = append(fs, field{key: key, value: args[1]})
+		args = args[2:]
+	}
+	return fs
+}
+
+// writeField writes a JSON object member. Errors are written as their
+// message, and values that cannot be encoded as their string form.
+func writeField(buf *bytes.Buffer, key string, value interface{}) {
+	encodedKey, _ := json.Marshal(key)
+	buf.Write(encodedKey)
+	buf.WriteString(":")
+
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(encoded)
+}
+
+// loggerContextKey stores the *Logger of a request
+type loggerContextKey struct{}
+
+// NewContext returns a context carrying the logger.
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// FromContext returns the logger of the context, or the default logger.
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*Logger); ok {
+		return logger
+	}
+	return Default()
+}
@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newLoggerForTest(level Level) (*Logger, *bytes.Buffer) {
+	var out bytes.Buffer
+	logger := New(&out, level)
+	logger.Now = func() time.Time { return time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC) }
+	return logger, &out
+}
+
+func TestLogger_WritesCloudLoggingJSON(t *testing.T) {
+	logger, out := newLoggerForTest(LevelInfo)
+	logger.With("user_id", "42").Warn("Quota warning", "percent", 90, "error", errors.New("boom"))
+
+	want := `{"severity":"WARNING","message":"Quota warning","time":"2023-05-01T12:00:00Z","user_id":"42","percent":90,"error":"boom"}` + "\n"
+	if out.String() != want {
+		t.Errorf("entry = %s, want %s", out.String(), want)
+	}
+}
+
+func TestLogger_FiltersByLevel(t *testing.T) {
+	logger, out := newLoggerForTest(LevelWarn)
+	logger.Info("skipped")
+	logger.Error("kept", "orphan")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("output %q is not a single JSON entry: %v", out.String(), err)
+	}
+	if entry["message"] != "kept" || entry["!BADKEY"] != "orphan" {
+		t.Errorf("entry = %v, want the error entry with a bad key", entry)
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	logger, _ := newLoggerForTest(LevelInfo)
+	if got := FromContext(NewContext(context.Background(), logger)); got != logger {
+		t.Error("FromContext did not return the context's logger")
+	}
+	if got := FromContext(context.Background()); got != Default() {
+		t.Error("FromContext did not fall back to the default logger")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{"": LevelInfo, "debug": LevelDebug, "WARNING": LevelWarn, "error": LevelError} {
+		if got, err := ParseLevel(name); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(verbose) succeeded, want an error")
+	}
+}
@@ -0,0 +1,398 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the default histogram buckets, suited to request
+// durations in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metric is a metric family written in the Prometheus text format.
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics and serves them in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry creates a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]metric),
+	}
+}
+
+// Default is the registry of the application's metrics, served at
+// /metrics.
+var Default = NewRegistry()
+
+// register adds a metric, replacing any metric of the same name.
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[m.name()] = m
+}
+
+// Handler returns a handler serving the metrics in the Prometheus text
+// format, sorted by name.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		r.Write(w)
+	})
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+// family holds the description and labeled series of a metric.
+type family struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]interface{}
+	values map[string][]string
+}
+
+func newFamily(name, help, kind string, labels []string) family {
+	return family{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		series:     make(map[string]interface{}),
+		values:     make(map[string][]string),
+	}
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+// get returns the series of the label values, created by newSeries the
+// first time they are used.
+func (f *family) get(values []string, newSeries func() interface{}) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.metricName, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	series, ok := f.series[key]
+	if !ok {
+		series = newSeries()
+		f.series[key] = series
+		f.values[key] = append([]string(nil), values...)
+	}
+	return series
+}
+
+// each calls fn with the label pairs and series of every series, sorted
+// by label values.
+func (f *family) each(fn func(labels string, series interface{})) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	type entry struct {
+		labels string
+		series interface{}
+	}
+	entries := make([]entry, len(keys))
+	for i, key := range keys {
+		entries[i] = entry{labelPairs(f.labels, f.values[key]), f.series[key]}
+	}
+	f.mu.Unlock()
+
+	for _, e := range entries {
+		fn(e.labels, e.series)
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of the family.
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.metricName, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.metricName, f.kind)
+}
+
+// value is a float64 updated atomically under its own lock.
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) add(delta float64) {
+	v.mu.Lock()
+	v.v += delta
+	v.mu.Unlock()
+}
+
+func (v *value) set(x float64) {
+	v.mu.Lock()
+	v.v = x
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v value
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add adds a non-negative delta to the counter.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.v.add(delta)
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	family
+}
+
+// NewCounterVec registers a new counter with the given labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newFamily(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// WithLabelValues returns the counter of the label values, in the order
+// of the labels.
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	return c.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, series interface{}) {
+		writeSample(w, c.metricName, labels, series.(*Counter).v.get())
+	})
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	v value
+}
+
+// Set sets the gauge.
+func (g *Gauge) Set(x float64) {
+	g.v.set(x)
+}
+
+// Inc adds one to the gauge.
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+// Dec subtracts one from the gauge.
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct {
+	family
+}
+
+// NewGaugeVec registers a new gauge with the given labels.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newFamily(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// WithLabelValues returns the gauge of the label values, in the order of
+// the labels.
+func (g *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return g.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.each(func(labels string, series interface{}) {
+		writeSample(w, g.metricName, labels, series.(*Gauge).v.get())
+	})
+}
+
+// funcMetric is a counter or gauge whose value is read when scraped, e.g.
+// from the statistics of a cache.
+type funcMetric struct {
+	family
+	fn func() float64
+}
+
+// NewCounterFunc registers a counter reading its value from fn.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{newFamily(name, help, "counter", nil), fn})
+}
+
+// NewGaugeFunc registers a gauge reading its value from fn.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{newFamily(name, help, "gauge", nil), fn})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	writeSample(w, m.metricName, "", m.fn())
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(x float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if x <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += x
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	family
+	buckets []float64
+}
+
+// NewHistogramVec registers a new histogram with the given upper bucket
+// bounds, in increasing order, and labels.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{newFamily(name, help, "histogram", labels), buckets}
+	r.register(h)
+	return h
+}
+
+// WithLabelValues returns the histogram of the label values, in the order
+// of the labels.
+func (h *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return h.get(values, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, series interface{}) {
+		histogram := series.(*Histogram)
+		histogram.mu.Lock()
+		counts := append([]uint64(nil), histogram.counts...)
+		count, sum := histogram.count, histogram.sum
+		histogram.mu.Unlock()
+
+		for i, upper := range h.buckets {
+			writeSample(w, h.metricName+"_bucket", joinLabels(labels, `le="`+formatFloat(upper)+`"`), float64(counts[i]))
+		}
+		writeSample(w, h.metricName+"_bucket", joinLabels(labels, `le="+Inf"`), float64(count))
+		writeSample(w, h.metricName+"_sum", labels, sum)
+		writeSample(w, h.metricName+"_count", labels, float64(count))
+	})
+}
+
+// writeSample writes a sample line.
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+// labelPairs formats label names and values as name="value" pairs.
+func labelPairs(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabel(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// joinLabels appends a label pair to formatted pairs.
+func joinLabels(labels, pair string) string {
+	if labels == "" {
+		return pair
+	}
+	return labels + "," + pair
+}
+
+// formatFloat formats a sample value as Prometheus expects.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// escapeLabel escapes backslashes, quotes and newlines in label values.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// escapeHelp escapes backslashes and newlines in help text.
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
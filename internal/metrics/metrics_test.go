@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Requests served.", "route", "status")
+	requests.WithLabelValues("/a", "200").Inc()
+	requests.WithLabelValues("/a", "200").Add(2)
+	requests.WithLabelValues(`/b"`, "500").Inc()
+	inFlight := registry.NewGaugeVec("in_flight", "Requests in flight.", "route")
+	inFlight.WithLabelValues("/a").Inc()
+	registry.NewGaugeFunc("ratio", "A ratio.", func() float64 { return 0.5 })
+
+	var out strings.Builder
+	registry.Write(&out)
+
+	want := `# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight{route="/a"} 1
+# HELP ratio A ratio.
+# TYPE ratio gauge
+ratio 0.5
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/a",status="200"} 3
+requests_total{route="/b\"",status="500"} 1
+`
+	if out.String() != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	registry := NewRegistry()
+	sizes := registry.NewHistogramVec("size_bytes", "Sizes.", []float64{10, 100}, "format")
+	for _, x := range []float64{5, 50, 500} {
+		sizes.WithLabelValues("png").Observe(x)
+	}
+
+	var out strings.Builder
+	registry.Write(&out)
+
+	for _, line := range []string{
+		`size_bytes_bucket{format="png",le="10"} 1`,
+		`size_bytes_bucket{format="png",le="100"} 2`,
+		`size_bytes_bucket{format="png",le="+Inf"} 3`,
+		`size_bytes_sum{format="png"} 555`,
+		`size_bytes_count{format="png"} 3`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Write() is missing %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestLabelValueCount(t *testing.T) {
+	counter := NewRegistry().NewCounterVec("requests_total", "Requests served.", "route")
+	defer func() {
+		if recover() == nil {
+			t.Error("WithLabelValues() with too many values did not panic")
+		}
+	}()
+	counter.WithLabelValues("/a", "200")
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("requests_total", "Requests served.").WithLabelValues().Inc()
+
+	rr := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", got)
+	}
+	if !strings.Contains(rr.Body.String(), "requests_total 1\n") {
+		t.Errorf("body = %q, want the counter", rr.Body.String())
+	}
+}
@@ -0,0 +1,357 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+)
+
+// The access log formats.
+const (
+	// AccessLogJSON logs each request as a JSON entry with flat fields.
+	AccessLogJSON = "json"
+
+	// AccessLogCombined writes each request as a line of the Apache
+	// combined log format.
+	AccessLogCombined = "combined"
+
+	// AccessLogCloud logs each request as a JSON entry with Cloud
+	// Logging's httpRequest structure.
+	AccessLogCloud = "cloud"
+
+	// AccessLogOff disables the access log.
+	AccessLogOff = "off"
+)
+
+// AccessLogConfig configures the access log middleware.
+type AccessLogConfig struct {
+	// Format is AccessLogJSON, AccessLogCombined, AccessLogCloud or
+	// AccessLogOff.
+	Format string
+
+	// Logger writes the JSON and Cloud Logging entries. It defaults to
+	// logging.Default().
+	Logger *logging.Logger
+
+	// Output receives the combined log format lines. It defaults to
+	// standard output.
+	Output io.Writer
+
+	// Secrets lists fragments of query parameter names whose values are
+	// redacted, as in LoggingConfig.
+	Secrets []string
+
+	// TrustedProxies are the proxies whose X-Forwarded-For header is used
+	// to log the client IP, as in IPFilterConfig.
+	TrustedProxies TrustedProxies
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// DefaultAccessLogConfig returns the default access log configuration:
+// JSON entries written by the default logger, with the query credentials
+// of DefaultLoggingConfig redacted.
+func DefaultAccessLogConfig() AccessLogConfig {
+	return AccessLogConfig{
+		Format:  AccessLogJSON,
+		Secrets: DefaultLoggingConfig().Secrets,
+		Now:     time.Now,
+	}
+}
+
+// accessEntry describes a completed request.
+type accessEntry struct {
+	request  *http.Request
+	url      string
+	remoteIP string
+	start    time.Time
+	duration time.Duration
+	status   int
+	bytes    int64
+}
+
+// NewAccessLogMiddleware returns a middleware writing one access log line
+// per request once it completes, with its status, response size and
+// latency. It must come first in the chain to time and record the
+// requests rejected by other middleware.
+func NewAccessLogMiddleware(config AccessLogConfig) func(http.Handler) http.Handler {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	if config.Output == nil {
+		config.Output = os.Stdout
+	}
+	var outputMu sync.Mutex
+
+	return func(next http.Handler) http.Handler {
+		if config.Format == AccessLogOff {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Call the next handler, recording the response
+			start := config.Now()
+			iw, recorder := instrumentWriter(w)
+			next.ServeHTTP(iw, r)
+
+			entry := accessEntry{
+				request:  r,
+				remoteIP: accessRemoteIP(r, config.TrustedProxies),
+				start:    start,
+				duration: config.Now().Sub(start),
+				status:   recorder.status,
+				bytes:    recorder.written,
+			}
+			if entry.status == 0 {
+				entry.status = http.StatusOK
+			}
+			redacted := *r.URL
+			redacted.RawQuery = redactQuery(r.URL.Query(), config.Secrets)
+			entry.url = redacted.RequestURI()
+
+			// Write the entry in the configured format
+			if config.Format == AccessLogCombined {
+				outputMu.Lock()
+				io.WriteString(config.Output, combinedLogLine(entry))
+				outputMu.Unlock()
+				return
+			}
+			logger := config.Logger
+			if logger == nil {
+				logger = logging.Default()
+			}
+			if id := requestid.FromContext(r.Context()); id != "" {
+				logger = logger.With("request_id", id)
+			}
+			if config.Format == AccessLogCloud {
+				logger.Log(accessLevel(entry.status), r.Method+" "+entry.url, "httpRequest", cloudHTTPRequest(entry))
+				return
+			}
+			logger.Log(accessLevel(entry.status), "Request completed",
+				"method", r.Method,
+				"url", entry.url,
+				"protocol", r.Proto,
+				"status", entry.status,
+				"bytes", entry.bytes,
+				"duration_ms", float64(entry.duration.Microseconds())/1000,
+				"remote_ip", entry.remoteIP,
+				"user_agent", r.UserAgent(),
+				"referer", r.Referer())
+		})
+	}
+}
+
+// accessLevel returns the log level of a response status: errors for
+// server errors, warnings for client errors and info otherwise.
+func accessLevel(status int) logging.Level {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return logging.LevelError
+	case status >= http.StatusBadRequest:
+		return logging.LevelWarn
+	default:
+		return logging.LevelInfo
+	}
+}
+
+// combinedLogLine formats the entry in the Apache combined log format.
+func combinedLogLine(entry accessEntry) string {
+	r := entry.request
+	return fmt.Sprintf("%s - - [%s] %q %d %s %q %q\n",
+		entry.remoteIP,
+		entry.start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+entry.url+" "+r.Proto,
+		entry.status,
+		combinedBytes(entry.bytes),
+		orDash(r.Referer()),
+		orDash(r.UserAgent()))
+}
+
+// combinedBytes formats a response size, "-" when empty.
+func combinedBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// accessRemoteIP returns the client IP address, resolved through the
+// trusted proxies as IPFilter does, or "-" when it is unknown.
+func accessRemoteIP(r *http.Request, proxies TrustedProxies) string {
+	if ip := ClientIP(r, proxies); ip != nil {
+		return ip.String()
+	}
+	return "-"
+}
+
+// orDash returns the value, or "-" when empty.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// cloudHTTPRequest returns the entry as Cloud Logging's HttpRequest
+// structure. Sizes are strings, as Cloud Logging encodes 64-bit integers.
+func cloudHTTPRequest(entry accessEntry) map[string]interface{} {
+	r := entry.request
+	request := map[string]interface{}{
+		"requestMethod": r.Method,
+		"requestUrl":    entry.url,
+		"status":        entry.status,
+		"responseSize":  strconv.FormatInt(entry.bytes, 10),
+		"userAgent":     r.UserAgent(),
+		"remoteIp":      entry.remoteIP,
+		"latency":       strconv.FormatFloat(entry.duration.Seconds(), 'f', 9, 64) + "s",
+		"protocol":      r.Proto,
+	}
+	if r.ContentLength > 0 {
+		request["requestSize"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if referer := r.Referer(); referer != "" {
+		request["referer"] = referer
+	}
+	return request
+}
+
+// responseRecorder records the status code and body size of a response
+// while writing it through.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+// WriteHeader records and writes the status code.
+func (w *responseRecorder) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records an implicit 200 OK and writes the data.
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client.
+func (w *responseRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Hijack lets the handler take over the connection, e.g. for WebSockets.
+// The response is recorded as 101 Switching Protocols.
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// ReadFrom copies the body from a reader, letting the server use sendfile
+// for files.
+func (w *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+	w.written += n
+	return n, err
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// unwrapper is implemented by writers wrapping another.
+type unwrapper interface {
+	Unwrap() http.ResponseWriter
+}
+
+// instrumentWriter wraps a writer in a responseRecorder, returning a writer
+// implementing the same optional interfaces among http.Flusher,
+// http.Hijacker and io.ReaderFrom as the original, so handlers checking
+// for them keep working.
+func instrumentWriter(w http.ResponseWriter) (http.ResponseWriter, *responseRecorder) {
+	rec := &responseRecorder{ResponseWriter: w}
+	_, flusher := w.(http.Flusher)
+	_, hijacker := w.(http.Hijacker)
+	_, readerFrom := w.(io.ReaderFrom)
+
+	switch {
+	case flusher && hijacker && readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			unwrapper
+		}{rec, rec, rec, rec, rec}, rec
+	case flusher && hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			unwrapper
+		}{rec, rec, rec, rec}, rec
+	case flusher && readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+			unwrapper
+		}{rec, rec, rec, rec}, rec
+	case hijacker && readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+			unwrapper
+		}{rec, rec, rec, rec}, rec
+	case flusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			unwrapper
+		}{rec, rec, rec}, rec
+	case hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			unwrapper
+		}{rec, rec, rec}, rec
+	case readerFrom:
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+			unwrapper
+		}{rec, rec, rec}, rec
+	default:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+		}{rec, rec}, rec
+	}
+}
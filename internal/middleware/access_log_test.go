@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+)
+
+// serveAccessLogForTest serves a request taking a second and answering
+// 404 with a 9-byte body, and returns what the access log wrote.
+func serveAccessLogForTest(t *testing.T, format string) string {
+	t.Helper()
+	config := DefaultAccessLogConfig()
+	config.Format = format
+	return serveAccessLogWithConfig(t, config, nil)
+}
+
+// serveAccessLogWithConfig serves the request of serveAccessLogForTest,
+// with the headers, through an access log with the config.
+func serveAccessLogWithConfig(t *testing.T, config AccessLogConfig, header http.Header) string {
+	t.Helper()
+	var out bytes.Buffer
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	config.Logger = logging.New(&out, logging.LevelInfo)
+	config.Output = &out
+	config.Now = func() time.Time { return now }
+
+	handler := NewAccessLogMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now = now.Add(time.Second)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hello?token=secret&w=10", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("access log leaks a credential: %s", out.String())
+	}
+	return out.String()
+}
+
+func TestAccessLog_JSON(t *testing.T) {
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(serveAccessLogForTest(t, AccessLogJSON)), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["severity"] != "WARNING" || entry["status"] != float64(404) || entry["bytes"] != float64(9) || entry["duration_ms"] != float64(1000) {
+		t.Errorf("entry = %v, want a warning for a 404 of 9 bytes taking 1000ms", entry)
+	}
+}
+
+func TestAccessLog_Combined(t *testing.T) {
+	want := `192.0.2.1 - - [01/May/2023:12:00:00 +0000] "GET /api/v1/hello?token=%5BREDACTED%5D&w=10 HTTP/1.1" 404 9 "-" "test"` + "\n"
+	if got := serveAccessLogForTest(t, AccessLogCombined); got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+}
+
+func TestAccessLog_Cloud(t *testing.T) {
+	var entry struct {
+		HTTPRequest map[string]interface{} `json:"httpRequest"`
+	}
+	if err := json.Unmarshal([]byte(serveAccessLogForTest(t, AccessLogCloud)), &entry); err != nil {
+		t.Fatal(err)
+	}
+	request := entry.HTTPRequest
+	if request["status"] != float64(404) || request["responseSize"] != "9" || request["latency"] != "1.000000000s" || request["remoteIp"] != "192.0.2.1" {
+		t.Errorf("httpRequest = %v, want a 404 of 9 bytes taking 1s from 192.0.2.1", request)
+	}
+}
+
+func TestAccessLog_ClientIPThroughTrustedProxies(t *testing.T) {
+	header := http.Header{"X-Forwarded-For": {"203.0.113.7"}}
+	config := DefaultAccessLogConfig()
+	config.Format = AccessLogCombined
+
+	// Forwarded addresses are ignored unless the peer is a trusted proxy
+	if got := serveAccessLogWithConfig(t, config, header); !strings.HasPrefix(got, "192.0.2.1 ") {
+		t.Errorf("line = %q, want the peer address", got)
+	}
+	proxies, err := ParseTrustedProxies([]string{"192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TrustedProxies = proxies
+	if got := serveAccessLogWithConfig(t, config, header); !strings.HasPrefix(got, "203.0.113.7 ") {
+		t.Errorf("line = %q, want the forwarded client address", got)
+	}
+}
+
+// hijackableRecorder is a ResponseRecorder that can be hijacked.
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, nil
+}
+
+func TestInstrumentWriter_PreservesInterfaces(t *testing.T) {
+	// httptest.ResponseRecorder is a Flusher but neither a Hijacker nor
+	// a ReaderFrom
+	w, _ := instrumentWriter(httptest.NewRecorder())
+	if _, ok := w.(http.Flusher); !ok {
+		t.Error("Flusher lost")
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		t.Error("Hijacker added")
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		t.Error("ReaderFrom added")
+	}
+
+	w, rec := instrumentWriter(hijackableRecorder{httptest.NewRecorder()})
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		t.Fatal("Hijacker lost")
+	}
+	hijacker.Hijack()
+	if rec.status != http.StatusSwitchingProtocols {
+		t.Errorf("status = %d, want 101", rec.status)
+	}
+	if _, ok := w.(interface{ Unwrap() http.ResponseWriter }); !ok {
+		t.Error("Unwrap lost")
+	}
+}
+
+// plainWriter is a ResponseWriter with none of the optional interfaces.
+type plainWriter struct {
+	header http.Header
+}
+
+func (w *plainWriter) Header() http.Header         { return w.header }
+func (w *plainWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *plainWriter) WriteHeader(statusCode int)  {}
+
+func TestInstrumentWriter_PlainWriter(t *testing.T) {
+	w, rec := instrumentWriter(&plainWriter{header: make(http.Header)})
+	if _, ok := w.(http.Flusher); ok {
+		t.Error("Flusher added")
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		t.Error("Hijacker added")
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		t.Error("ReaderFrom added")
+	}
+	if _, ok := w.(interface{ Unwrap() http.ResponseWriter }); !ok {
+		t.Error("Unwrap lost")
+	}
+	w.Write([]byte("image"))
+	if rec.written != 5 || rec.status != http.StatusOK {
+		t.Errorf("recorded %d bytes with status %d, want 5 and 200", rec.written, rec.status)
+	}
+}
+
+func TestInstrumentWriter_CountsReadFrom(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iw, rec := instrumentWriter(w)
+		readerFrom, ok := iw.(io.ReaderFrom)
+		if !ok {
+			t.Error("ReaderFrom lost")
+			return
+		}
+		readerFrom.ReadFrom(strings.NewReader("image"))
+		if rec.written != 5 || rec.status != http.StatusOK {
+			t.Errorf("recorded %d bytes with status %d, want 5 and 200", rec.written, rec.status)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
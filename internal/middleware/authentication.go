@@ -1,56 +1,166 @@
 package middleware
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net/http"
 	"strings"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// Authentication methods recorded on an Identity.
+const (
+	AuthMethodAPIKey     = "api_key"
+	AuthMethodSignature  = "signature"
+	AuthMethodClientCert = "client_certificate"
+	AuthMethodOAuth      = "oauth2"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request does
+	// not carry its type of credential, so the next one can be tried.
+	ErrNoCredentials = errors.New("no credentials")
+
+	// ErrInvalidCredentials is returned by an Authenticator when the request
+	// carries its type of credential but the credential is not valid.
+	ErrInvalidCredentials = errors.New("invalid credentials")
 )
 
+// Identity describes who made a request and how they proved it.
+type Identity struct {
+	User   *models.User
+	Method string
+	KeyID  string
+
+	// Scopes granted to an OAuth2 access token. Empty for other methods.
+	Scopes []string
+}
+
+// Authenticator validates one type of credential on a request.
+type Authenticator interface {
+	// Authenticate returns the identity proven by the request. It returns
+	// ErrNoCredentials if the request does not carry this type of credential.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// UserStore looks up users for the authenticators.
+// *repositories.FirestoreRepository satisfies this interface.
+type UserStore interface {
+	GetUserByID(ctx context.Context, userID string) (*models.User, error)
+	GetUserByAPIKey(ctx context.Context, userAPIKey string) (*models.User, error)
+}
+
 // AuthenticationMiddleware is a middleware function that checks the request
 // for valid authentication credentials. If the request is not authenticated,
 // the middleware returns an error response.
+//
+// With no authenticators configured every request is let through; use
+// NewAuthenticationMiddleware to require credentials.
 func AuthenticationMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check the request for valid source/referrer credentials
-		// if !validSource(r) {
-		// 	// If the request is not from a valid source, return an error response
-		// 	w.Header().Set("Content-Type", "application/json")
-		// 	json.NewEncoder(w).Encode(`{"status": "error", "message": "Unauthorized request. Please verify you are making a request through a verified channel (i.e RapidAPI, Postman API Marketplace, etc..)."}`)
-		// 	return
-		// }
-
-		// Check the request for valid authentication credentials
-		if !validAuthentication(r) {
-			// If the request is not authenticated, return an error response
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(`{"status": "error", "message": "Unauthorized request. Please provide valid authentication credentials."}`)
-			return
+	return NewAuthenticationMiddleware()(next)
+}
+
+// NewAuthenticationMiddleware returns an authentication middleware that
+// accepts any of the given credential types, tried in order. The identity of
+// an authenticated request is stored in its context.
+func NewAuthenticationMiddleware(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Check the request for valid source/referrer credentials
+			// if !validSource(r) {
+			// 	// If the request is not from a valid source, return an error response
+			// 	w.Header().Set("Content-Type", "application/json")
+			// 	json.NewEncoder(w).Encode(`{"status": "error", "message": "Unauthorized request. Please verify you are making a request through a verified channel (i.e RapidAPI, Postman API Marketplace, etc..)."}`)
+			// 	return
+			// }
+
+			// Nothing to check against, keep the request flowing
+			if len(authenticators) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Check the request for valid authentication credentials
+			identity, err := authenticate(r, authenticators)
+			if err != nil {
+				// If the request is not authenticated, return an error response
+				writeError(w, http.StatusUnauthorized, "Unauthorized request. Please provide valid authentication credentials.")
+				return
+			}
+
+			// If the request is authenticated, call the next middleware/handler in the chain
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+// authenticate tries each authenticator in turn and returns the first
+// identity proven by the request. A credential that is present but invalid
+// fails the request rather than falling through to the next authenticator.
+func authenticate(r *http.Request, authenticators []Authenticator) (*Identity, error) {
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
+		return identity, nil
+	}
+	return nil, ErrNoCredentials
+}
+
+// APIKeyHeader is the request header carrying a user's API key.
+const APIKeyHeader = "X-API-Key"
 
-		// Check if the user exists in the database, and if the user is active
-		// otherwise, create a new user in the database and continue,
-		// if !userExists(r) {
-		// 	// Get the user API key from the request headers
-		// 	userRealIP := r.Header.Get("X-RapidAPI-Real-IP")
-
-		// 	// Get a Firestore client
-		// 	firestoreClient, err := config.GetFirestoreClient()
-
-		// 	// if the user does not exist, create a new user in the database
-		// 	// and continue
-		// 	user, err := repositories.NewFirestoreRepository(firestoreClient).CreateUser(r.Context(), userRealIP)
-		// 	if err != nil {
-		// 		// If there is an error creating the user, return an error response
-		// 		w.Header().Set("Content-Type", "application/json")
-		// 		w.WriteHeader(http.StatusInternalServerError)
-		// 		json.NewEncoder(w).Encode(`{"status": "error", "message": "Error creating user in database."}`)
-		// 		return
-		// 	}
-		// }
-
-		// If the request is authenticated, call the next middleware/handler in the chain
-		next.ServeHTTP(w, r)
-	})
+// APIKeyAuthenticator authenticates requests by the API key in the
+// X-API-Key header.
+type APIKeyAuthenticator struct {
+	users UserStore
+}
+
+// NewAPIKeyAuthenticator creates a new APIKeyAuthenticator.
+func NewAPIKeyAuthenticator(users UserStore) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{
+		users: users,
+	}
+}
+
+// Authenticate looks up the user owning the request's API key.
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	key := strings.TrimSpace(r.Header.Get(APIKeyHeader))
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	user, err := a.users.GetUserByAPIKey(r.Context(), key)
+	if err != nil || !knownUser(user) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		User:   user,
+		Method: AuthMethodAPIKey,
+		KeyID:  keyFingerprint(key),
+	}, nil
+}
+
+// knownUser reports whether a user returned by a store is a stored user,
+// rather than nil or an empty user, whose empty ID all such requests would
+// share.
+func knownUser(user *models.User) bool {
+	return user != nil && user.ID != ""
+}
+
+// keyFingerprint returns a short, non-reversible identifier for an API key
+// that is safe to log and store alongside usage.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:16]
 }
 
 func validSource(r *http.Request) bool {
@@ -80,13 +190,3 @@ func validSource(r *http.Request) bool {
 	}
 	return false
 }
-
-// validAuthentication checks the request for valid authentication credentials.
-// If the request is not authenticated, the function returns false.
-func validAuthentication(r *http.Request) bool {
-	// Implement authentication logic here
-
-	// Validate the token and return true if it's valid, false otherwise
-	// Example: use a JWT library to decode and validate the token
-	return true
-}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// emptyUserStore returns an empty user for every API key, as a query
+// decoded without checking for a match would.
+type emptyUserStore struct {
+	fakeStore
+}
+
+func (s *emptyUserStore) GetUserByAPIKey(ctx context.Context, userAPIKey string) (*models.User, error) {
+	return &models.User{}, nil
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	tests := []struct {
+		name  string
+		users UserStore
+		key   string
+		err   error
+	}{
+		{"no key", newFakeStore(), "", ErrNoCredentials},
+		{"valid key", newFakeStore(), "api-key-1", nil},
+		{"unknown key", newFakeStore(), "api-key-2", ErrInvalidCredentials},
+		{"user without ID", &emptyUserStore{}, "api-key-2", ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+			if tt.key != "" {
+				req.Header.Set(APIKeyHeader, tt.key)
+			}
+			identity, err := NewAPIKeyAuthenticator(tt.users).Authenticate(req)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && identity.User.ID != "user-1" {
+				t.Errorf("user ID = %q, want user-1", identity.User.ID)
+			}
+		})
+	}
+}
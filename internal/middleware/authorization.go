@@ -2,16 +2,38 @@ package middleware
 
 import (
 	"net/http"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
 )
 
 // AuthorizationMiddleware is a middleware function that checks the request
 // for valid authorization credentials. If the request is not authorized,
 // the middleware returns an error response.
 func AuthorizationMiddleware(next http.Handler, requiredRole string) http.Handler {
+	return authorizeRoles(next, requiredRole)
+}
+
+// RequireRole returns a middleware that only lets through users with the
+// given role, for use in middleware chains.
+func RequireRole(requiredRole string) func(http.Handler) http.Handler {
+	return RequireAnyRole(requiredRole)
+}
+
+// RequireAnyRole returns a middleware that only lets through users with at
+// least one of the given roles.
+func RequireAnyRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return authorizeRoles(next, roles...)
+	}
+}
+
+// authorizeRoles wraps next so that it is only called for users with one of
+// the roles.
+func authorizeRoles(next http.Handler, roles ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check the request for valid authorization credentials
-		if !validAuthorization(r, requiredRole) {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		if !validAuthorization(r, roles...) {
+			writeError(w, http.StatusForbidden, "Forbidden. Your account does not have access to this resource.")
 			return
 		}
 
@@ -20,24 +42,40 @@ func AuthorizationMiddleware(next http.Handler, requiredRole string) http.Handle
 	})
 }
 
-// validAuthorization checks the request for valid authorization credentials.
-// If the request is not authorized, the function returns false.
-func validAuthorization(r *http.Request, requiredRole string) bool {
-	// Implement your authorization logic here
-	// Example: check the authenticated user's role against the required role
-	userRole := getUserRole(r)
-	if userRole != requiredRole {
+// HasRole reports whether the user has one of the roles.
+func HasRole(user *models.User, roles ...string) bool {
+	if user == nil {
 		return false
 	}
+	for _, role := range user.Roles {
+		if containsString(roles, role) {
+			return true
+		}
+	}
+	return false
+}
 
-	// If the user has the required role, return true
-	return true
+// validAuthorization checks the request for valid authorization credentials.
+// If the request is not authorized, the function returns false.
+func validAuthorization(r *http.Request, requiredRoles ...string) bool {
+	// Check the authenticated user's roles against the required roles.
+	// Unauthenticated requests have no roles.
+	user, _ := UserFromContext(r.Context())
+	return HasRole(user, requiredRoles...)
 }
 
-// getUserRole retrieves the authenticated user's role from the request context
-// or from the authentication credentials (e.g. JWT claims).
-func getUserRole(r *http.Request) string {
-	// Implement your user role retrieval logic here
-	// Example: retrieve the "role" claim from the JWT token
-	return "admin" // replace with actual user role
+// RequireScope returns a middleware that only lets through OAuth2 access
+// tokens granted the given scope. Other credential types are not scoped and
+// are let through.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, ok := IdentityFromContext(r.Context())
+			if ok && identity.Method == AuthMethodOAuth && !containsString(identity.Scopes, scope) {
+				writeError(w, http.StatusForbidden, "Forbidden. Your token does not have the "+scope+" scope.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
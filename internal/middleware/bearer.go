@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// TokenVerifier verifies OAuth2 access tokens.
+// *services.OAuthService satisfies this interface.
+type TokenVerifier interface {
+	VerifyAccessToken(ctx context.Context, token string) (*models.AccessToken, error)
+}
+
+// BearerTokenAuthenticator authenticates requests by an OAuth2 access token
+// in the "Authorization: Bearer" header.
+type BearerTokenAuthenticator struct {
+	tokens TokenVerifier
+	users  UserStore
+}
+
+// NewBearerTokenAuthenticator creates a new BearerTokenAuthenticator.
+func NewBearerTokenAuthenticator(tokens TokenVerifier, users UserStore) *BearerTokenAuthenticator {
+	return &BearerTokenAuthenticator{
+		tokens: tokens,
+		users:  users,
+	}
+}
+
+// Authenticate verifies the bearer token and returns the identity of the
+// user it was issued to, with the token's scopes.
+func (a *BearerTokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := a.tokens.VerifyAccessToken(r.Context(), token)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	user, err := a.users.GetUserByID(r.Context(), claims.UserID)
+	if err != nil || !knownUser(user) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		User:   user,
+		Method: AuthMethodOAuth,
+		KeyID:  claims.ClientID,
+		Scopes: claims.Scopes,
+	}, nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// fakeTokenVerifier accepts a fixed set of tokens.
+type fakeTokenVerifier map[string]*models.AccessToken
+
+func (v fakeTokenVerifier) VerifyAccessToken(ctx context.Context, token string) (*models.AccessToken, error) {
+	if claims, ok := v[token]; ok {
+		return claims, nil
+	}
+	return nil, errors.New("invalid token")
+}
+
+func TestBearerTokenAuthenticator(t *testing.T) {
+	verifier := fakeTokenVerifier{
+		"good": {UserID: "user-1", ClientID: "client-1", Scopes: []string{"images:read"}},
+	}
+	auth := NewBearerTokenAuthenticator(verifier, newFakeStore())
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	identity, err := auth.Authenticate(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if identity.User.ID != "user-1" || identity.Method != AuthMethodOAuth || identity.KeyID != "client-1" || len(identity.Scopes) != 1 {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+
+	req.Header.Set("Authorization", "Bearer bad")
+	if _, err := auth.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("bad token: expected ErrInvalidCredentials, got %v", err)
+	}
+
+	// Other schemes are left to other authenticators
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	if _, err := auth.Authenticate(req); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("basic auth: expected ErrNoCredentials, got %v", err)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	verifier := fakeTokenVerifier{
+		"reader": {UserID: "user-1", ClientID: "client-1", Scopes: []string{"images:read"}},
+		"writer": {UserID: "user-1", ClientID: "client-1", Scopes: []string{"images:write"}},
+	}
+	store := newFakeStore()
+	authenticate := NewAuthenticationMiddleware(NewBearerTokenAuthenticator(verifier, store), NewAPIKeyAuthenticator(store))
+	handler := authenticate(RequireScope("images:write")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"token with the scope", "Authorization", "Bearer writer", http.StatusOK},
+		{"token without the scope", "Authorization", "Bearer reader", http.StatusForbidden},
+		{"api key", APIKeyHeader, "api-key-1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/image/resize", nil)
+			req.Header.Set(tt.header, tt.value)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("got status %d want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a response stored in a ResponseCache.
+type CachedResponse struct {
+	Status int
+	Header map[string][]string
+	Body   []byte
+
+	// Owner is the client whose request populated the entry, e.g.
+	// "user:42" (see clientKey), so a user's entries can be purged.
+	Owner string
+}
+
+// Size returns the approximate memory used by the response in bytes.
+func (c *CachedResponse) Size() int64 {
+	size := int64(len(c.Body) + len(c.Owner))
+	for name, values := range c.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// CacheStats counts the activity of a ResponseCache.
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int64 `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// ResponseCache stores cached responses, each with its own time to live.
+type ResponseCache interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, response *CachedResponse, ttl time.Duration)
+	Delete(key string)
+
+	// PurgePrefix deletes the entries whose key starts with prefix, and
+	// PurgeOwner those populated by the owner. Both return the number of
+	// entries deleted.
+	PurgePrefix(prefix string) int
+	PurgeOwner(owner string) int
+
+	Stats() CacheStats
+}
+
+// CacheTier is a tier of a TieredCache, holding entries of up to
+// MaxEntryBytes bytes (zero is unbounded).
+type CacheTier struct {
+	Cache         ResponseCache
+	MaxEntryBytes int64
+}
+
+// TieredCache is a ResponseCache storing each entry in the first of its
+// tiers that accepts its size, e.g. small responses in memory and larger
+// ones on disk.
+type TieredCache struct {
+	tiers []CacheTier
+
+	mu     sync.Mutex
+	hits   int64
+	misses int64
+}
+
+// NewTieredCache creates a new TieredCache looking up entries in the tiers
+// in order.
+func NewTieredCache(tiers ...CacheTier) *TieredCache {
+	return &TieredCache{
+		tiers: tiers,
+	}
+}
+
+// Get returns the entry from the first tier holding it.
+func (c *TieredCache) Get(key string) (*CachedResponse, bool) {
+	for _, tier := range c.tiers {
+		if response, ok := tier.Cache.Get(key); ok {
+			c.count(&c.hits)
+			return response, true
+		}
+	}
+	c.count(&c.misses)
+	return nil, false
+}
+
+// Set stores the entry in the first tier accepting its size, and removes
+// any older copy from the other tiers. Entries too large for every tier
+// are not stored.
+func (c *TieredCache) Set(key string, response *CachedResponse, ttl time.Duration) {
+	size := response.Size()
+	stored := false
+	for _, tier := range c.tiers {
+		if !stored && (tier.MaxEntryBytes <= 0 || size <= tier.MaxEntryBytes) {
+			tier.Cache.Set(key, response, ttl)
+			stored = true
+			continue
+		}
+		tier.Cache.Delete(key)
+	}
+}
+
+// Delete removes the entry from every tier.
+func (c *TieredCache) Delete(key string) {
+	for _, tier := range c.tiers {
+		tier.Cache.Delete(key)
+	}
+}
+
+// PurgePrefix deletes the entries whose key starts with prefix from every
+// tier.
+func (c *TieredCache) PurgePrefix(prefix string) int {
+	purged := 0
+	for _, tier := range c.tiers {
+		purged += tier.Cache.PurgePrefix(prefix)
+	}
+	return purged
+}
+
+// PurgeOwner deletes the entries populated by the owner from every tier.
+func (c *TieredCache) PurgeOwner(owner string) int {
+	purged := 0
+	for _, tier := range c.tiers {
+		purged += tier.Cache.PurgeOwner(owner)
+	}
+	return purged
+}
+
+// Stats returns the hits and misses of the cache as a whole, and the sum of
+// the tiers' evictions, entries and bytes.
+func (c *TieredCache) Stats() CacheStats {
+	c.mu.Lock()
+	stats := CacheStats{Hits: c.hits, Misses: c.misses}
+	c.mu.Unlock()
+
+	for _, tier := range c.tiers {
+		tierStats := tier.Cache.Stats()
+		stats.Evictions += tierStats.Evictions
+		stats.Entries += tierStats.Entries
+		stats.Bytes += tierStats.Bytes
+	}
+	return stats
+}
+
+// TierStats returns the stats of each tier.
+func (c *TieredCache) TierStats() []CacheStats {
+	stats := make([]CacheStats, len(c.tiers))
+	for i, tier := range c.tiers {
+		stats[i] = tier.Cache.Stats()
+	}
+	return stats
+}
+
+// count increments a counter of the cache.
+func (c *TieredCache) count(counter *int64) {
+	c.mu.Lock()
+	*counter++
+	c.mu.Unlock()
+}
+
+// matchesPrefix reports whether key starts with prefix; an empty prefix
+// matches nothing, so purges are never accidentally total.
+func matchesPrefix(key, prefix string) bool {
+	return prefix != "" && strings.HasPrefix(key, prefix)
+}
@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"container/list"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// diskEntry is the index entry of a response stored by a DiskCache.
+type diskEntry struct {
+	key       string
+	owner     string
+	file      string
+	size      int64
+	expiresAt time.Time
+}
+
+// DiskCache is a ResponseCache storing responses as files in a local
+// directory, bounded by their total size. When full, the least recently
+// used entries are evicted. The index is kept in memory, so entries do not
+// survive a restart.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	bytes   int64
+	stats   CacheStats
+}
+
+// NewDiskCache creates a new DiskCache holding up to maxBytes bytes of
+// responses in dir, removing responses left there by a previous process.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*.cache"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range stale {
+		os.Remove(file)
+	}
+
+	return &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		Now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}, nil
+}
+
+// Get reads the entry if it has not expired, marking it recently used. The
+// file is read without holding the index lock.
+func (c *DiskCache) Get(key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	element, ok := c.entries[key]
+	var stale string
+	if ok && !c.Now().Before(element.Value.(*diskEntry).expiresAt) {
+		stale = c.remove(element)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		c.mu.Unlock()
+		removeFiles(stale)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	entry := element.Value.(*diskEntry)
+	c.mu.Unlock()
+
+	// The entry may be removed while its file is read, which then fails
+	response, err := readCachedResponse(entry.file)
+
+	c.mu.Lock()
+	if err != nil {
+		// Drop the entry if its file is unreadable
+		if current, ok := c.entries[key]; ok && current == element {
+			stale = c.remove(element)
+		}
+		c.stats.Misses++
+		c.mu.Unlock()
+		removeFiles(stale)
+		return nil, false
+	}
+	c.stats.Hits++
+	c.mu.Unlock()
+	return response, true
+}
+
+// Set writes the entry for ttl, evicting the least recently used entries to
+// make room. Entries larger than the cache, or that fail to write, are not
+// stored. The file is written before the index is locked, and only added
+// to the index once complete.
+func (c *DiskCache) Set(key string, response *CachedResponse, ttl time.Duration) {
+	size := response.Size() + int64(len(key))
+	if size > c.maxBytes {
+		c.Delete(key)
+		return
+	}
+	file, err := c.write(response)
+	if err != nil {
+		c.Delete(key)
+		return
+	}
+
+	c.mu.Lock()
+	var stale []string
+	if element, ok := c.entries[key]; ok {
+		stale = append(stale, c.remove(element))
+	}
+	c.entries[key] = c.order.PushFront(&diskEntry{
+		key:       key,
+		owner:     response.Owner,
+		file:      file,
+		size:      size,
+		expiresAt: c.Now().Add(ttl),
+	})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		stale = append(stale, c.remove(c.order.Back()))
+		c.stats.Evictions++
+	}
+	c.mu.Unlock()
+
+	removeFiles(stale...)
+}
+
+// Delete removes the entry.
+func (c *DiskCache) Delete(key string) {
+	c.mu.Lock()
+	var stale string
+	if element, ok := c.entries[key]; ok {
+		stale = c.remove(element)
+	}
+	c.mu.Unlock()
+
+	removeFiles(stale)
+}
+
+// PurgePrefix deletes the entries whose key starts with prefix.
+func (c *DiskCache) PurgePrefix(prefix string) int {
+	return c.purge(func(entry *diskEntry) bool {
+		return matchesPrefix(entry.key, prefix)
+	})
+}
+
+// PurgeOwner deletes the entries populated by the owner.
+func (c *DiskCache) PurgeOwner(owner string) int {
+	return c.purge(func(entry *diskEntry) bool {
+		return owner != "" && entry.owner == owner
+	})
+}
+
+// Stats returns the cache's activity and size.
+func (c *DiskCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = int64(len(c.entries))
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// purge deletes the entries matching the predicate.
+func (c *DiskCache) purge(match func(*diskEntry) bool) int {
+	c.mu.Lock()
+	var stale []string
+	for _, element := range c.entries {
+		if match(element.Value.(*diskEntry)) {
+			stale = append(stale, c.remove(element))
+		}
+	}
+	c.mu.Unlock()
+
+	removeFiles(stale...)
+	return len(stale)
+}
+
+// remove deletes an entry from the index and returns its file, which the
+// caller deletes with removeFiles once c.mu is released. c.mu must be
+// held.
+func (c *DiskCache) remove(element *list.Element) string {
+	entry := c.order.Remove(element).(*diskEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+	return entry.file
+}
+
+// write encodes the response to a new file in the cache directory and
+// returns its path. Each entry has its own file, so files are never
+// replaced while being read.
+func (c *DiskCache) write(response *CachedResponse) (string, error) {
+	file, err := os.CreateTemp(c.dir, "*.cache")
+	if err != nil {
+		return "", err
+	}
+	if err := gob.NewEncoder(file).Encode(response); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// readCachedResponse decodes the response stored in the file.
+func readCachedResponse(path string) (*CachedResponse, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	response := &CachedResponse{}
+	if err := gob.NewDecoder(file).Decode(response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// removeFiles deletes the files of removed entries, skipping empty paths.
+func removeFiles(paths ...string) {
+	for _, path := range paths {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruEntry is an entry of an LRUCache.
+type lruEntry struct {
+	key       string
+	response  *CachedResponse
+	size      int64
+	expiresAt time.Time
+}
+
+// LRUCache is an in-memory ResponseCache bounded by the total size of its
+// entries. When full, the least recently used entries are evicted.
+type LRUCache struct {
+	maxBytes int64
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	bytes   int64
+	stats   CacheStats
+}
+
+// NewLRUCache creates a new LRUCache holding up to maxBytes bytes of
+// responses.
+func NewLRUCache(maxBytes int64) *LRUCache {
+	return &LRUCache{
+		maxBytes: maxBytes,
+		Now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the entry if it has not expired, marking it recently used.
+func (c *LRUCache) Get(key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if ok && !c.Now().Before(element.Value.(*lruEntry).expiresAt) {
+		c.remove(element)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).response, true
+}
+
+// Set stores the entry for ttl, evicting the least recently used entries
+// to make room. Entries larger than the cache are not stored.
+func (c *LRUCache) Set(key string, response *CachedResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	size := response.Size() + int64(len(key))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{
+		key:       key,
+		response:  response,
+		size:      size,
+		expiresAt: c.Now().Add(ttl),
+	})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Delete removes the entry.
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// PurgePrefix deletes the entries whose key starts with prefix.
+func (c *LRUCache) PurgePrefix(prefix string) int {
+	return c.purge(func(entry *lruEntry) bool {
+		return matchesPrefix(entry.key, prefix)
+	})
+}
+
+// PurgeOwner deletes the entries populated by the owner.
+func (c *LRUCache) PurgeOwner(owner string) int {
+	return c.purge(func(entry *lruEntry) bool {
+		return owner != "" && entry.response.Owner == owner
+	})
+}
+
+// Stats returns the cache's activity and size.
+func (c *LRUCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = int64(len(c.entries))
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// purge deletes the entries matching the predicate.
+func (c *LRUCache) purge(match func(*lruEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for _, element := range c.entries {
+		if match(element.Value.(*lruEntry)) {
+			c.remove(element)
+			purged++
+		}
+	}
+	return purged
+}
+
+// remove deletes an entry. c.mu must be held.
+func (c *LRUCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*lruEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
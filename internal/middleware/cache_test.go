@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newCachedResponseForTest(owner string, size int) *CachedResponse {
+	return &CachedResponse{Status: 200, Body: make([]byte, size), Owner: owner}
+}
+
+func TestLRUCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRUCache(300)
+	c.Set("a", newCachedResponseForTest("", 100), time.Minute)
+	c.Set("b", newCachedResponseForTest("", 100), time.Minute)
+	c.Get("a")
+	c.Set("c", newCachedResponseForTest("", 100), time.Minute)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Entries != 2 || stats.Bytes != 202 {
+		t.Errorf("stats = %+v, want 1 eviction, 2 entries and 202 bytes", stats)
+	}
+}
+
+func TestLRUCache_ExpiresEntries(t *testing.T) {
+	now := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	c := NewLRUCache(1 << 10)
+	c.Now = func() time.Time { return now }
+	c.Set("short", newCachedResponseForTest("", 1), time.Second)
+	c.Set("long", newCachedResponseForTest("", 1), time.Hour)
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("short"); ok {
+		t.Error("short did not expire")
+	}
+	if _, ok := c.Get("long"); !ok {
+		t.Error("long expired")
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("stats = %+v, want 1 hit, 1 miss and 1 entry", stats)
+	}
+}
+
+func TestLRUCache_Purges(t *testing.T) {
+	c := NewLRUCache(1 << 10)
+	c.Set("/api/v1/image/resize?a", newCachedResponseForTest("user:1", 1), time.Minute)
+	c.Set("/api/v1/image/resize?b", newCachedResponseForTest("user:2", 1), time.Minute)
+	c.Set("/api/v1/image/crop?a", newCachedResponseForTest("user:1", 1), time.Minute)
+
+	if purged := c.PurgePrefix(""); purged != 0 {
+		t.Errorf("empty prefix purged %d entries, want 0", purged)
+	}
+	if purged := c.PurgePrefix("/api/v1/image/resize"); purged != 2 {
+		t.Errorf("prefix purged %d entries, want 2", purged)
+	}
+	if purged := c.PurgeOwner("user:1"); purged != 1 {
+		t.Errorf("owner purged %d entries, want 1", purged)
+	}
+	if stats := c.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("stats = %+v, want an empty cache", stats)
+	}
+}
+
+func TestDiskCache_StoresAndPurges(t *testing.T) {
+	c, err := NewDiskCache(t.TempDir(), 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", &CachedResponse{Status: 201, Header: map[string][]string{"Content-Type": {"image/png"}}, Body: []byte("image"), Owner: "user:1"}, time.Minute)
+
+	response, ok := c.Get("a")
+	if !ok {
+		t.Fatal("a not found")
+	}
+	if response.Status != 201 || string(response.Body) != "image" || response.Header["Content-Type"][0] != "image/png" {
+		t.Errorf("response = %+v, want the stored response", response)
+	}
+
+	if purged := c.PurgeOwner("user:1"); purged != 1 {
+		t.Errorf("owner purged %d entries, want 1", purged)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("a was not purged")
+	}
+}
+
+func TestDiskCache_ConcurrentAccess(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir, 1<<12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace, read and evict the same few entries at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := strconv.Itoa(j % 4)
+				c.Set(key, newCachedResponseForTest("", 100*(i+1)), time.Minute)
+				if response, ok := c.Get(key); ok && len(response.Body) == 0 {
+					t.Errorf("%s: read an empty response", key)
+				}
+				if j%10 == 0 {
+					c.PurgePrefix(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Only the files of indexed entries are left
+	files, err := filepath.Glob(filepath.Join(dir, "*.cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); int64(len(files)) != stats.Entries {
+		t.Errorf("%d files for %d entries", len(files), stats.Entries)
+	}
+}
+
+func TestTieredCache_StoresBySize(t *testing.T) {
+	memory := NewLRUCache(1 << 10)
+	disk, err := NewDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTieredCache(CacheTier{Cache: memory, MaxEntryBytes: 100}, CacheTier{Cache: disk})
+
+	c.Set("small", newCachedResponseForTest("", 10), time.Minute)
+	c.Set("large", newCachedResponseForTest("", 1000), time.Minute)
+
+	if _, ok := memory.Get("small"); !ok {
+		t.Error("small not in memory")
+	}
+	if _, ok := disk.Get("large"); !ok {
+		t.Error("large not on disk")
+	}
+	if _, ok := c.Get("large"); !ok {
+		t.Error("large not found")
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Entries != 2 {
+		t.Errorf("stats = %+v, want 1 hit and 2 entries", stats)
+	}
+}
@@ -2,62 +2,252 @@ package middleware
 
 import (
 	"bytes"
-	"io"
 	"net/http"
-	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
 	"time"
-
-	cache "github.com/patrickmn/go-cache"
 )
 
+// CacheStatusHeader reports whether a response was served from the cache.
+const CacheStatusHeader = "X-Cache"
+
+// CacheConfig configures the caching middleware.
+type CacheConfig struct {
+	// Cache stores the responses.
+	Cache ResponseCache
+
+	// TTL is how long responses are cached, unless they set their own with
+	// Cache-Control s-maxage or max-age.
+	TTL time.Duration
+
+	// Methods lists the cacheable request methods. Image operations are
+	// POST requests whose result only depends on the request.
+	Methods []string
+
+	// VaryHeaders lists the request headers that select between
+	// responses, and are part of the cache key.
+	VaryHeaders []string
+
+	// MaxBodyBytes is the largest request body hashed into the key, and the
+	// largest response body cached. Larger requests bypass the cache.
+	MaxBodyBytes int64
+}
+
+// DefaultCacheConfig returns the default cache configuration: GET, HEAD and
+// POST responses cached in a 64MB in-memory LRU cache for 5 minutes,
+// varying on Accept and Accept-Encoding, with bodies up to 32MB.
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		Cache:        NewLRUCache(64 << 20),
+		TTL:          5 * time.Minute,
+		Methods:      []string{http.MethodGet, http.MethodHead, http.MethodPost},
+		VaryHeaders:  []string{"Accept", "Accept-Encoding"},
+		MaxBodyBytes: 32 << 20,
+	}
+}
+
 // CachingMiddleware is a middleware function that checks the
 // request against a caching policy. If the response is cached,
 // the middleware returns the cached response. Otherwise, the
 // middleware calls the next handler in the chain and caches
 // the response.
 func CachingMiddleware(next http.Handler) http.Handler {
-	// Initialize the cache with a default expiration time of 5 minutes
-	c := cache.New(5*time.Minute, 10*time.Minute)
+	return NewCachingMiddleware(DefaultCacheConfig())(next)
+}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Generate a cache key based on the request URL and method
-		cacheKey := r.RemoteAddr + r.RequestURI + r.FormValue("image") + r.FormValue("format")
+// NewCachingMiddleware returns a caching middleware with the given
+// configuration. Responses are shared by all clients making the same
+// request: the same method, path, query, vary headers and body. Only
+// successful responses without Cache-Control no-store or private, or
+// cookies, are cached. Keys start with the request path, so responses can
+// be purged by path prefix.
+func NewCachingMiddleware(config CacheConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		c := config.Cache
+		if c == nil {
+			c = NewLRUCache(64 << 20)
+		}
 
-		// Check if the response is already cached
-		if cachedResponse, found := c.Get(cacheKey); found {
-			// If the response is cached, return the cached response
-			cachedResponseBytes, ok := cachedResponse.([]byte)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Skip requests that are not cacheable
+			if !containsString(config.Methods, r.Method) || hasCacheDirective(r.Header, "no-store") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Generate a cache key based on the request
+			key, ok := cacheKey(r, config)
 			if !ok {
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				next.ServeHTTP(w, r)
 				return
 			}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(cachedResponseBytes)
-			return
+			// Check if the response is already cached
+			if response, found := c.Get(key); found {
+				for name, values := range response.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set(CacheStatusHeader, "HIT")
+
+				// Revalidate the client's copy without sending the body
+				if notModified(r, response.Header) {
+					writeNotModified(w)
+					return
+				}
+				w.WriteHeader(response.Status)
+				if r.Method != http.MethodHead {
+					w.Write(response.Body)
+				}
+				return
+			}
+
+			// Otherwise, call the next handler in the chain, recording the
+			// headers it sets and its response body
+			before := w.Header().Clone()
+			w.Header().Set(CacheStatusHeader, "MISS")
+			cw := &cacheWriter{statusWriter: statusWriter{ResponseWriter: w}, max: config.MaxBodyBytes}
+			next.ServeHTTP(cw, r)
+
+			// Cache the response for future requests if it may be reused
+			status := cw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if cw.overflow || !cacheableResponse(status, w.Header()) {
+				return
+			}
+			ttl := responseTTL(w.Header(), config.TTL)
+			if ttl <= 0 {
+				return
+			}
+			// Keep an ETag with the response, so it can be revalidated
+			// without hashing its body again
+			header := changedHeaders(before, w.Header())
+			if header.Get("ETag") == "" {
+				header.Set("ETag", strongETag(cw.body.Bytes()))
+			}
+			c.Set(key, &CachedResponse{
+				Status: status,
+				Header: header,
+				Body:   cw.body.Bytes(),
+				Owner:  clientKey(r),
+			}, ttl)
+		})
+	}
+}
+
+// cacheWriter writes the response through while keeping a copy of its
+// body, up to max bytes.
+type cacheWriter struct {
+	statusWriter
+
+	body     bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+// Write writes and copies the body.
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if !w.overflow {
+		if int64(w.body.Len()+len(p)) > w.max {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.statusWriter.Write(p)
+}
+
+// cacheKey returns the cache key of the request: its normalized path,
+// sorted query, method, vary headers and a hash of its body. It reports
+// false if the body is too large to hash.
+func cacheKey(r *http.Request, config CacheConfig) (string, bool) {
+	var key strings.Builder
+	key.WriteString(path.Clean("/" + r.URL.Path))
+	key.WriteString("?")
+	key.WriteString(r.URL.Query().Encode())
+	key.WriteString("\n")
+	key.WriteString(r.Method)
+	for _, name := range config.VaryHeaders {
+		key.WriteString("\n")
+		key.WriteString(http.CanonicalHeaderKey(name))
+		key.WriteString(": ")
+		key.WriteString(strings.Join(r.Header.Values(name), ", "))
+	}
+
+	// Hash the body, leaving it in place for the handler
+	if r.Body != nil && r.Body != http.NoBody {
+		body, complete, err := peekBody(r, config.MaxBodyBytes)
+		if err != nil || !complete {
+			return "", false
 		}
+		key.WriteString("\n")
+		key.WriteString(bodyHash(r, body))
+	}
+	return key.String(), true
+}
 
-		// Otherwise, call the next handler in the chain and cache the response
-		recorder := httptest.NewRecorder()
-		next.ServeHTTP(recorder, r)
+// cacheableResponse reports whether a response may be cached: a successful
+// full response without cookies or Cache-Control no-store or private.
+func cacheableResponse(status int, header http.Header) bool {
+	if status < http.StatusOK || status >= http.StatusMultipleChoices || status == http.StatusPartialContent {
+		return false
+	}
+	if header.Get("Set-Cookie") != "" {
+		return false
+	}
+	return !hasCacheDirective(header, "no-store") && !hasCacheDirective(header, "private")
+}
 
-		// Copy the response body to a buffer to cache the response
-		buffer := bytes.NewBuffer(nil)
-		_, err := io.Copy(buffer, recorder.Body)
-		if err != nil {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+// responseTTL returns how long a response may be cached: its Cache-Control
+// s-maxage, else its max-age, else the default.
+func responseTTL(header http.Header, ttl time.Duration) time.Duration {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cacheDirective(header, directive); ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
 		}
+	}
+	return ttl
+}
 
-		// Cache the response for future requests
-		c.Set(cacheKey, buffer.Bytes(), cache.DefaultExpiration)
+// hasCacheDirective reports whether the Cache-Control header contains the
+// directive.
+func hasCacheDirective(header http.Header, directive string) bool {
+	_, ok := cacheDirective(header, directive)
+	return ok
+}
 
-		// Write the response to the original writer
-		recorder.Result().Body.Close()
-		for k, v := range recorder.Header() {
-			w.Header()[k] = v
+// cacheDirective returns the value of a Cache-Control directive, and
+// whether the header contains it.
+func cacheDirective(header http.Header, directive string) (string, bool) {
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if strings.EqualFold(name, directive) {
+				return strings.Trim(argument, `"`), true
+			}
+		}
+	}
+	return "", false
+}
+
+// changedHeaders returns the headers of after that differ from before,
+// i.e. those set by the handler rather than by earlier middleware.
+func changedHeaders(before, after http.Header) http.Header {
+	changed := make(http.Header)
+	for name, values := range after {
+		if name == CacheStatusHeader {
+			continue
+		}
+		if previous, ok := before[name]; !ok || strings.Join(previous, "\x00") != strings.Join(values, "\x00") {
+			changed[name] = append([]string(nil), values...)
 		}
-		w.WriteHeader(recorder.Code)
-		w.Write(buffer.Bytes())
-	})
+	}
+	return changed
 }
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// imageHandler is the handler behind the response middleware in tests. It
+// counts its calls and answers with its status and headers, a PNG content
+// type, and the request body, or "image" for requests without one.
+type imageHandler struct {
+	status int
+	header http.Header
+
+	// release, if set, holds each call until it is closed. Calls whose
+	// request went away meanwhile answer 503.
+	release <-chan struct{}
+
+	calls int32
+}
+
+func (h *imageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&h.calls, 1)
+	if h.release != nil {
+		<-h.release
+		if r.Context().Err() != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if len(body) == 0 {
+		body = []byte("image")
+	}
+	for name, values := range h.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if h.status != 0 {
+		w.WriteHeader(h.status)
+	}
+	w.Write(body)
+}
+
+// Calls returns the number of calls so far.
+func (h *imageHandler) Calls() int {
+	return int(atomic.LoadInt32(&h.calls))
+}
+
+// serveRequest serves the request with the handler and returns the
+// response.
+func serveRequest(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	return rr
+}
+
+// newImageRequest returns a POST request uploading the body.
+func newImageRequest(target, body string) *http.Request {
+	return httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+}
+
+func TestCachingMiddleware_SharesResponsesBetweenClients(t *testing.T) {
+	next := &imageHandler{status: http.StatusCreated}
+	handler := NewCachingMiddleware(DefaultCacheConfig())(next)
+
+	first := newImageRequest("/api/v1/image/resize?w=10&h=20", "image")
+	first.RemoteAddr = "192.0.2.1:1234"
+	serveRequest(handler, first)
+	second := newImageRequest("/api/v1//image/resize?h=20&w=10", "image")
+	second.RemoteAddr = "192.0.2.2:5678"
+	rr := serveRequest(handler, second)
+
+	if next.Calls() != 1 {
+		t.Errorf("handler called %d times, want 1", next.Calls())
+	}
+	if got := rr.Header().Get(CacheStatusHeader); got != "HIT" {
+		t.Errorf("%s = %q, want HIT", CacheStatusHeader, got)
+	}
+	if rr.Code != http.StatusCreated {
+		t.Errorf("status = %d, want 201", rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", got)
+	}
+	if rr.Body.String() != "image" {
+		t.Errorf("body = %q, want image", rr.Body.String())
+	}
+}
+
+func TestCachingMiddleware_KeysOnBody(t *testing.T) {
+	next := &imageHandler{}
+	handler := NewCachingMiddleware(DefaultCacheConfig())(next)
+
+	serveRequest(handler, newImageRequest("/api/v1/image/resize", "first"))
+	rr := serveRequest(handler, newImageRequest("/api/v1/image/resize", "second"))
+
+	if next.Calls() != 2 || rr.Body.String() != "second" {
+		t.Errorf("handler called %d times and returned %q, want 2 and second", next.Calls(), rr.Body.String())
+	}
+}
+
+func TestCachingMiddleware_SkipsUncacheableResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		cacheControl string
+	}{
+		{"error", http.StatusBadRequest, ""},
+		{"no-store", http.StatusOK, "no-store"},
+		{"private", http.StatusOK, "private, max-age=60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &imageHandler{status: tt.status, header: http.Header{}}
+			if tt.cacheControl != "" {
+				next.header.Set("Cache-Control", tt.cacheControl)
+			}
+			handler := NewCachingMiddleware(DefaultCacheConfig())(next)
+
+			serveRequest(handler, newImageRequest("/api/v1/image/resize", "image"))
+			serveRequest(handler, newImageRequest("/api/v1/image/resize", "image"))
+			if next.Calls() != 2 {
+				t.Errorf("handler called %d times, want 2", next.Calls())
+			}
+		})
+	}
+}
+
+func TestCachingMiddleware_HonorsMaxAge(t *testing.T) {
+	next := &imageHandler{header: http.Header{"Cache-Control": {"max-age=0"}}}
+	handler := NewCachingMiddleware(DefaultCacheConfig())(next)
+
+	serveRequest(handler, newImageRequest("/api/v1/image/resize", "image"))
+	serveRequest(handler, newImageRequest("/api/v1/image/resize", "image"))
+
+	if next.Calls() != 2 {
+		t.Errorf("handler called %d times, want 2", next.Calls())
+	}
+}
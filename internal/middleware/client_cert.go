@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// CertUserMapper extracts the user ID from a verified client certificate.
+// It returns false if the certificate does not name a user.
+type CertUserMapper func(cert *x509.Certificate) (string, bool)
+
+// MapCertCommonName maps a client certificate to the user ID in its
+// subject common name.
+func MapCertCommonName(cert *x509.Certificate) (string, bool) {
+	userID := strings.TrimSpace(cert.Subject.CommonName)
+	return userID, userID != ""
+}
+
+// MapCertSAN returns a mapper that takes the user ID from the first subject
+// alternative name starting with prefix, checking URIs, then DNS names,
+// then email addresses. For example, with the prefix
+// "spiffe://example.com/user/" the SAN URI
+// "spiffe://example.com/user/abc123" maps to user "abc123".
+func MapCertSAN(prefix string) CertUserMapper {
+	return func(cert *x509.Certificate) (string, bool) {
+		names := make([]string, 0, len(cert.URIs)+len(cert.DNSNames)+len(cert.EmailAddresses))
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+		names = append(names, cert.DNSNames...)
+		names = append(names, cert.EmailAddresses...)
+
+		for _, name := range names {
+			if userID, ok := strings.CutPrefix(name, prefix); ok && userID != "" {
+				return userID, true
+			}
+		}
+		return "", false
+	}
+}
+
+// ClientCertAuthenticator authenticates requests by the TLS client
+// certificate the server verified during the handshake.
+type ClientCertAuthenticator struct {
+	users  UserStore
+	mapper CertUserMapper
+}
+
+// NewClientCertAuthenticator creates a new ClientCertAuthenticator. The
+// mapper defaults to MapCertCommonName.
+func NewClientCertAuthenticator(users UserStore, mapper CertUserMapper) *ClientCertAuthenticator {
+	if mapper == nil {
+		mapper = MapCertCommonName
+	}
+	return &ClientCertAuthenticator{
+		users:  users,
+		mapper: mapper,
+	}
+}
+
+// Authenticate returns the identity of the user named by the verified client
+// certificate. Certificates that were presented but not verified against
+// the configured CA bundle are not accepted.
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	// Only handle TLS connections with a verified client certificate
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	// Map the certificate to a user
+	userID, ok := a.mapper(cert)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	user, err := a.users.GetUserByID(r.Context(), userID)
+	if err != nil || !knownUser(user) {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Identify the certificate by its fingerprint
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	return &Identity{
+		User:   user,
+		Method: AuthMethodClientCert,
+		KeyID:  hex.EncodeToString(fingerprint[:]),
+	}, nil
+}
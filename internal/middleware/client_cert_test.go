@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func newClientCertRequest(cert *x509.Certificate) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/api/v1/hello", nil)
+	req.TLS = &tls.ConnectionState{}
+	if cert != nil {
+		req.TLS.PeerCertificates = []*x509.Certificate{cert}
+		req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return req
+}
+
+func TestClientCertAuthenticator_CommonName(t *testing.T) {
+	auth := NewClientCertAuthenticator(newFakeStore(), nil)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "user-1"}, Raw: []byte("cert")}
+	identity, err := auth.Authenticate(newClientCertRequest(cert))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if identity.User.ID != "user-1" || identity.Method != AuthMethodClientCert || identity.KeyID == "" {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+
+	// A certificate naming an unknown user is rejected
+	cert = &x509.Certificate{Subject: pkix.Name{CommonName: "user-2"}, Raw: []byte("cert")}
+	if _, err := auth.Authenticate(newClientCertRequest(cert)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown user: expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestClientCertAuthenticator_SAN(t *testing.T) {
+	auth := NewClientCertAuthenticator(newFakeStore(), MapCertSAN("spiffe://internal/user/"))
+
+	uri, _ := url.Parse("spiffe://internal/user/user-1")
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ignored"}, URIs: []*url.URL{uri}}
+	identity, err := auth.Authenticate(newClientCertRequest(cert))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if identity.User.ID != "user-1" {
+		t.Errorf("got user %q want %q", identity.User.ID, "user-1")
+	}
+
+	// A certificate without a matching SAN is rejected
+	cert = &x509.Certificate{DNSNames: []string{"other.internal"}}
+	if _, err := auth.Authenticate(newClientCertRequest(cert)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestClientCertAuthenticator_Unverified(t *testing.T) {
+	auth := NewClientCertAuthenticator(newFakeStore(), nil)
+
+	// Plain HTTP
+	if _, err := auth.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil)); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("plain HTTP: expected ErrNoCredentials, got %v", err)
+	}
+
+	// TLS with a presented but unverified certificate
+	req := newClientCertRequest(nil)
+	req.TLS.PeerCertificates = []*x509.Certificate{{Subject: pkix.Name{CommonName: "user-1"}}}
+	if _, err := auth.Authenticate(req); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("unverified certificate: expected ErrNoCredentials, got %v", err)
+	}
+
+	// A verified certificate for an unknown user
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "nobody"}}
+	if _, err := auth.Authenticate(newClientCertRequest(cert)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown user: expected ErrInvalidCredentials, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+)
+
+// CoalescedHeader marks responses shared with an identical request that
+// was already being processed.
+const CoalescedHeader = "X-Coalesced"
+
+// CoalesceConfig configures the Coalescer.
+type CoalesceConfig struct {
+	// Operations lists the image operations, the last segment of the
+	// request path, whose identical concurrent requests are coalesced.
+	Operations []string
+
+	// MaxBodyBytes is the largest request body hashed. Larger requests are
+	// processed on their own.
+	MaxBodyBytes int64
+
+	// Timeout bounds the shared processing of a request. It runs detached
+	// from the requests waiting for it, so one of them going away does not
+	// abort it for the others.
+	Timeout time.Duration
+
+	// MaxProcessing is the number of image requests the instance can
+	// process at once. While it is reached the instance reports itself not
+	// ready, so new requests go to other instances. 0 means no limit.
+	MaxProcessing int
+}
+
+// DefaultCoalesceConfig returns the default coalescing configuration:
+// convert, resize and crop requests of up to 32MB, processed for at most a
+// minute.
+func DefaultCoalesceConfig() CoalesceConfig {
+	return CoalesceConfig{
+		Operations:   []string{"convert", "resize", "crop"},
+		MaxBodyBytes: 32 << 20,
+		Timeout:      time.Minute,
+	}
+}
+
+// flight is the shared processing of identical requests.
+type flight struct {
+	done     chan struct{}
+	response *CachedResponse
+}
+
+// Coalescer processes identical concurrent image requests once: the same
+// path, parameters and source image. The first request is processed
+// and the others wait for, and receive a copy of, its response.
+type Coalescer struct {
+	config CoalesceConfig
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// NewCoalescer creates a new Coalescer.
+func NewCoalescer(config CoalesceConfig) *Coalescer {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultCoalesceConfig().Timeout
+	}
+	return &Coalescer{
+		config:  config,
+		flights: make(map[string]*flight),
+	}
+}
+
+// Middleware is a middleware function that coalesces identical concurrent
+// image requests. A request whose client goes away stops waiting, while the
+// shared processing continues for the others.
+func (c *Coalescer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only image operations with a complete body are coalesced
+		if !containsString(c.config.Operations, operation(r)) || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, complete, err := peekBody(r, c.config.MaxBodyBytes)
+		if err != nil || !complete {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := coalesceKey(r, body)
+
+		// Join the processing of an identical request, or start it
+		c.mu.Lock()
+		f, shared := c.flights[key]
+		if !shared {
+			f = &flight{done: make(chan struct{})}
+			c.flights[key] = f
+			go c.process(key, f, next, r)
+		}
+		c.mu.Unlock()
+
+		// Wait for the response, unless the client goes away first
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return
+		}
+
+		// Write a copy of the shared response
+		for name, values := range f.response.Header {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+		if shared {
+			w.Header().Set(CoalescedHeader, "true")
+		}
+		w.WriteHeader(f.response.Status)
+		w.Write(f.response.Body)
+	})
+}
+
+// process runs the next handler for the first of the identical requests,
+// detached from its cancellation, and hands its response to the waiters.
+func (c *Coalescer) process(key string, f *flight, next http.Handler, r *http.Request) {
+	ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, c.config.Timeout)
+	defer cancel()
+
+	bw := &bufferWriter{header: make(http.Header)}
+	defer func() {
+		// A panic fails the waiting requests rather than the server
+		if err := recover(); err != nil {
+			logging.FromContext(r.Context()).Error("Coalesced request panicked", "panic", fmt.Sprint(err))
+			bw = &bufferWriter{header: make(http.Header)}
+			writeError(bw, http.StatusInternalServerError, "Unable to process the request.")
+		}
+
+		f.response = &CachedResponse{
+			Status: bw.status,
+			Header: bw.header,
+			Body:   bw.body.Bytes(),
+		}
+		if f.response.Status == 0 {
+			f.response.Status = http.StatusOK
+		}
+
+		// New requests start over once the response is handed out
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+
+	next.ServeHTTP(bw, r.WithContext(ctx))
+}
+
+// Processing returns the number of image requests being processed, each
+// possibly shared by several identical requests.
+func (c *Coalescer) Processing() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.flights)
+}
+
+// coalesceKey returns the key of identical requests: the cleaned path, the
+// sorted query and form parameters, the Accept header and a hash of the
+// source image. Multipart forms are keyed on their values and files rather
+// than their encoding, which differs between clients.
+func coalesceKey(r *http.Request, body []byte) string {
+	params := r.URL.Query()
+	hash := sha256.New()
+
+	var digest string
+	mediaType, mediaParams, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" && hashMultipart(body, mediaParams["boundary"], params, hash) {
+		digest = hex.EncodeToString(hash.Sum(nil))
+	} else {
+		params = r.URL.Query()
+		digest = bodyHash(r, body)
+	}
+
+	var key strings.Builder
+	key.WriteString(path.Clean("/" + r.URL.Path))
+	key.WriteString("?")
+	key.WriteString(params.Encode())
+	key.WriteString("\nAccept: ")
+	key.WriteString(strings.Join(r.Header.Values("Accept"), ", "))
+	key.WriteString("\n")
+	key.WriteString(digest)
+	return key.String()
+}
+
+// hashMultipart adds the values of a multipart form to params and hashes
+// its files. It reports false if the form is invalid.
+func hashMultipart(body []byte, boundary string, params url.Values, hash io.Writer) bool {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return false
+			}
+			params.Add(part.FormName(), string(value))
+			continue
+		}
+		io.WriteString(hash, part.FormName()+"\n")
+		if _, err := io.Copy(hash, part); err != nil {
+			return false
+		}
+	}
+}
+
+// bufferWriter is a ResponseWriter keeping the response in memory.
+type bufferWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// Header returns the response headers.
+func (w *bufferWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader records the status code.
+func (w *bufferWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+// Write records an implicit 200 OK and buffers the data.
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+// detachedContext keeps the values of a context without its deadline and
+// cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+// Deadline reports that the context has no deadline.
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done returns nil, as the context is never canceled.
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+// Err returns nil, as the context is never canceled.
+func (detachedContext) Err() error {
+	return nil
+}
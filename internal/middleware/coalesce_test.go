@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// waitingContext is a request context noting when the request starts
+// waiting for its flight, which is when the coalescer first asks for its
+// Done channel.
+type waitingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan struct{}
+}
+
+// Done notes that the request is waiting.
+func (c *waitingContext) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.waiting) })
+	return c.Context.Done()
+}
+
+// withWaiting returns the request with a context closing the returned
+// channel once the request waits for its flight.
+func withWaiting(r *http.Request) (*http.Request, <-chan struct{}) {
+	ctx := &waitingContext{Context: r.Context(), waiting: make(chan struct{})}
+	return r.WithContext(ctx), ctx.waiting
+}
+
+func TestCoalescer_SharesIdenticalRequests(t *testing.T) {
+	release := make(chan struct{})
+	next := &imageHandler{release: release}
+	c := NewCoalescer(DefaultCoalesceConfig())
+	handler := c.Middleware(next)
+
+	recorders := make([]*httptest.ResponseRecorder, 5)
+	var wg sync.WaitGroup
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		req, waiting := withWaiting(httptest.NewRequest(http.MethodPost, "/api/v1/image/resize?w=10&h=20", strings.NewReader("image")))
+		wg.Add(1)
+		go func(rr *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handler.ServeHTTP(rr, req)
+		}(recorders[i])
+		<-waiting
+	}
+	if n := c.Processing(); n != 1 {
+		t.Errorf("%d requests processing, want 1", n)
+	}
+	close(release)
+	wg.Wait()
+
+	if next.Calls() != 1 {
+		t.Errorf("handler called %d times, want 1", next.Calls())
+	}
+	coalesced := 0
+	for _, rr := range recorders {
+		if rr.Code != http.StatusOK || rr.Body.String() != "image" || rr.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("response = %d %q, want 200 image", rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get(CoalescedHeader) == "true" {
+			coalesced++
+		}
+	}
+	if coalesced != len(recorders)-1 {
+		t.Errorf("%d responses coalesced, want %d", coalesced, len(recorders)-1)
+	}
+}
+
+func TestCoalescer_WaiterCancellationDoesNotAbortWork(t *testing.T) {
+	release := make(chan struct{})
+	next := &imageHandler{release: release}
+	handler := NewCoalescer(DefaultCoalesceConfig()).Middleware(next)
+
+	// The first request, which started the work, goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	first, firstWaiting := withWaiting(httptest.NewRequest(http.MethodPost, "/api/v1/image/convert", strings.NewReader("image")).WithContext(ctx))
+	firstDone := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), first)
+		close(firstDone)
+	}()
+	<-firstWaiting
+
+	rr := httptest.NewRecorder()
+	second, secondWaiting := withWaiting(httptest.NewRequest(http.MethodPost, "/api/v1/image/convert", strings.NewReader("image")))
+	secondDone := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(rr, second)
+		close(secondDone)
+	}()
+	<-secondWaiting
+
+	cancel()
+	<-firstDone
+	close(release)
+	<-secondDone
+
+	if next.Calls() != 1 || rr.Code != http.StatusOK || rr.Body.String() != "image" {
+		t.Errorf("handler called %d times and returned %d %q, want 1 and 200 image", next.Calls(), rr.Code, rr.Body.String())
+	}
+}
+
+func TestCoalescer_KeysOnParametersAndSource(t *testing.T) {
+	base := httptest.NewRequest(http.MethodPost, "/api/v1/image/resize?w=10", nil)
+	tests := []struct {
+		name   string
+		target string
+		body   string
+	}{
+		{"parameters", "/api/v1/image/resize?w=20", "image"},
+		{"operation", "/api/v1/image/crop?w=10", "image"},
+		{"route", "/api/v2/image/resize?w=10", "image"},
+		{"source", "/api/v1/image/resize?w=10", "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.target, nil)
+			if coalesceKey(req, []byte(tt.body)) == coalesceKey(base, []byte("image")) {
+				t.Error("different requests share a key")
+			}
+		})
+	}
+}
+
+func TestCoalesceKey_IgnoresMultipartEncoding(t *testing.T) {
+	form := func(boundary string) (*http.Request, []byte) {
+		body := "--" + boundary + "\r\n" +
+			"Content-Disposition: form-data; name=\"width\"\r\n\r\n10\r\n" +
+			"--" + boundary + "\r\n" +
+			"Content-Disposition: form-data; name=\"image\"; filename=\"a.png\"\r\n\r\nimage\r\n" +
+			"--" + boundary + "--\r\n"
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/image/resize", strings.NewReader(body))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+		return req, []byte(body)
+	}
+
+	first, firstBody := form("first")
+	second, secondBody := form("second")
+	if coalesceKey(first, firstBody) != coalesceKey(second, secondBody) {
+		t.Error("identical forms have different keys")
+	}
+}
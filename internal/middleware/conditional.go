@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ConditionalConfig configures the conditional request middleware.
+type ConditionalConfig struct {
+	// Methods lists the request methods answered with 304 Not Modified
+	// when the client's copy is current.
+	Methods []string
+
+	// CacheControl is set on responses without a Cache-Control header.
+	// The default, no-cache, lets browsers and CDNs store responses but
+	// revalidate them with the ETag before reuse.
+	CacheControl string
+
+	// Vary lists the request headers added to the Vary header, those that
+	// select between responses of the same URL.
+	Vary []string
+
+	// MaxBodyBytes is the largest response body hashed into an ETag.
+	// Larger responses are sent as they are written, without an ETag.
+	MaxBodyBytes int64
+}
+
+// DefaultConditionalConfig returns the default conditional request
+// configuration: GET and HEAD requests, no-cache responses varying on
+// Accept and Accept-Encoding, and ETags for bodies up to 32MB.
+func DefaultConditionalConfig() ConditionalConfig {
+	return ConditionalConfig{
+		Methods:      []string{http.MethodGet, http.MethodHead},
+		CacheControl: "no-cache",
+		Vary:         []string{"Accept", "Accept-Encoding"},
+		MaxBodyBytes: 32 << 20,
+	}
+}
+
+// NewConditionalMiddleware returns a middleware answering conditional
+// requests. Successful responses get a strong ETag, the hash of their body,
+// unless the handler set one, and keep the Last-Modified header set by the
+// handler from the stored object's metadata. Requests whose If-None-Match,
+// or otherwise If-Modified-Since, header shows the client's copy is current
+// are answered with 304 Not Modified and no body.
+func NewConditionalMiddleware(config ConditionalConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !containsString(config.Methods, r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Buffer the response to hash its body
+			cw := &conditionalWriter{ResponseWriter: w, max: config.MaxBodyBytes}
+			next.ServeHTTP(cw, r)
+			if cw.passthrough {
+				return
+			}
+
+			// Only successful responses that may be stored are validated
+			header := w.Header()
+			status := cw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if status != http.StatusOK || hasCacheDirective(header, "no-store") {
+				cw.flush()
+				return
+			}
+			if header.Get("ETag") == "" {
+				header.Set("ETag", strongETag(cw.body.Bytes()))
+			}
+			if header.Get("Cache-Control") == "" && config.CacheControl != "" {
+				header.Set("Cache-Control", config.CacheControl)
+			}
+			for _, name := range config.Vary {
+				addVary(header, name)
+			}
+
+			if notModified(r, header) {
+				writeNotModified(w)
+				return
+			}
+			cw.flush()
+		})
+	}
+}
+
+// conditionalWriter buffers the response until the next handler returns,
+// or writes it through once its body exceeds max bytes.
+type conditionalWriter struct {
+	http.ResponseWriter
+
+	status      int
+	body        bytes.Buffer
+	max         int64
+	passthrough bool
+}
+
+// WriteHeader records the status code.
+func (w *conditionalWriter) WriteHeader(statusCode int) {
+	if w.passthrough {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+// Write buffers the data, switching to writing through when the body
+// grows too large to hash.
+func (w *conditionalWriter) Write(p []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if int64(w.body.Len()+len(p)) > w.max {
+		w.flush()
+		w.passthrough = true
+		return w.ResponseWriter.Write(p)
+	}
+	return w.body.Write(p)
+}
+
+// flush writes the buffered status and body.
+func (w *conditionalWriter) flush() {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.body.Len() > 0 {
+		w.ResponseWriter.Write(w.body.Bytes())
+	}
+	w.body = bytes.Buffer{}
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (w *conditionalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// strongETag returns a strong entity tag for the body: a hash of its
+// content, so identical responses share it across instances.
+func strongETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified reports whether the client's copy of the response is
+// current: its If-None-Match header matches the ETag, or without
+// If-None-Match, the response was not modified since If-Modified-Since.
+func notModified(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := header.Get("ETag")
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || (etag != "" && weakETag(candidate) == weakETag(etag)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ifModifiedSince)
+}
+
+// weakETag strips the weak indicator from an entity tag, as If-None-Match
+// uses the weak comparison.
+func weakETag(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
+
+// writeNotModified writes a 304 Not Modified response, keeping the
+// validators and caching headers but not the body's metadata.
+func writeNotModified(w http.ResponseWriter) {
+	header := w.Header()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// addVary adds a request header to the Vary header unless it is already
+// listed.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			listed = strings.TrimSpace(listed)
+			if listed == "*" || strings.EqualFold(listed, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
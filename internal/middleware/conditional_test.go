@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConditionalMiddleware_SetsValidators(t *testing.T) {
+	handler := NewConditionalMiddleware(DefaultConditionalConfig())(&imageHandler{})
+	rr := serveRequest(handler, httptest.NewRequest(http.MethodGet, "/api/v1/image/1", nil))
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "image" {
+		t.Fatalf("response = %d %q, want 200 image", rr.Code, rr.Body.String())
+	}
+	if got, want := rr.Header().Get("ETag"), strongETag([]byte("image")); got != want {
+		t.Errorf("ETag = %q, want %q", got, want)
+	}
+	if got := rr.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", got)
+	}
+	if got := rr.Header().Values("Vary"); len(got) != 2 {
+		t.Errorf("Vary = %q, want Accept and Accept-Encoding", got)
+	}
+}
+
+func TestConditionalMiddleware_NotModified(t *testing.T) {
+	modified := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	etag := strongETag([]byte("image"))
+	handler := NewConditionalMiddleware(DefaultConditionalConfig())(&imageHandler{
+		header: http.Header{"Last-Modified": {modified.Format(http.TimeFormat)}},
+	})
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"matching etag", http.Header{"If-None-Match": {`"other", ` + etag}}, http.StatusNotModified},
+		{"weak etag", http.Header{"If-None-Match": {"W/" + etag}}, http.StatusNotModified},
+		{"any etag", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{"stale etag", http.Header{"If-None-Match": {`"other"`}}, http.StatusOK},
+		{"not modified since", http.Header{"If-Modified-Since": {modified.Format(http.TimeFormat)}}, http.StatusNotModified},
+		{"modified since", http.Header{"If-Modified-Since": {modified.Add(-time.Hour).Format(http.TimeFormat)}}, http.StatusOK},
+		{"etag takes precedence", http.Header{
+			"If-None-Match":     {`"other"`},
+			"If-Modified-Since": {modified.Format(http.TimeFormat)},
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/image/1", nil)
+			req.Header = tt.header
+			rr := serveRequest(handler, req)
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if tt.want == http.StatusNotModified && (rr.Body.Len() != 0 || rr.Header().Get("ETag") != etag) {
+				t.Errorf("304 response has body %q and ETag %q, want none and %q", rr.Body.String(), rr.Header().Get("ETag"), etag)
+			}
+		})
+	}
+}
+
+func TestConditionalMiddleware_RevalidatesCachedResponses(t *testing.T) {
+	next := &imageHandler{}
+	handler := NewConditionalMiddleware(DefaultConditionalConfig())(NewCachingMiddleware(DefaultCacheConfig())(next))
+
+	etag := serveRequest(handler, httptest.NewRequest(http.MethodGet, "/api/v1/image/1", nil)).Header().Get("ETag")
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/image/1", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr := serveRequest(handler, req)
+
+	if rr.Code != http.StatusNotModified || next.Calls() != 1 {
+		t.Errorf("status = %d after %d handler calls, want 304 after 1", rr.Code, next.Calls())
+	}
+	if got := rr.Header().Get(CacheStatusHeader); got != "HIT" {
+		t.Errorf("%s = %q, want HIT", CacheStatusHeader, got)
+	}
+}
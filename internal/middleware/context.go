@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"context"
+	"net"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// contextKey is the type used for values stored in the request context by
+// this package, so they cannot collide with keys from other packages.
+type contextKey string
+
+const (
+	// identityContextKey stores the *Identity of an authenticated request
+	identityContextKey contextKey = "identity"
+
+	// clientIPContextKey stores the client net.IP resolved by IPFilter
+	clientIPContextKey contextKey = "client_ip"
+)
+
+// WithIdentity returns a copy of ctx carrying the given identity.
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey, identity)
+}
+
+// IdentityFromContext returns the identity stored in ctx by
+// AuthenticationMiddleware, if any.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey).(*Identity)
+	return identity, ok && identity != nil
+}
+
+// UserFromContext returns the authenticated user stored in ctx, if any.
+func UserFromContext(ctx context.Context) (*models.User, bool) {
+	identity, ok := IdentityFromContext(ctx)
+	if !ok || identity.User == nil {
+		return nil, false
+	}
+	return identity.User, true
+}
+
+// WithClientIP returns a copy of ctx carrying the client IP address.
+func WithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPContextKey, ip)
+}
+
+// ClientIPFromContext returns the client IP address stored in ctx by
+// IPFilter, if any.
+func ClientIPFromContext(ctx context.Context) (net.IP, bool) {
+	ip, ok := ctx.Value(clientIPContextKey).(net.IP)
+	return ip, ok && ip != nil
+}
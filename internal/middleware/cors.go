@@ -0,0 +1,297 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+	"github.com/gorilla/mux"
+)
+
+// CORSConfig configures cross-origin access for browser clients.
+type CORSConfig struct {
+	// AllowedOrigins lists the origins allowed to call the API. Entries may
+	// be an exact origin ("https://app.example.com"), a wildcard subdomain
+	// ("https://*.example.com") or "*" for any origin.
+	AllowedOrigins []string
+
+	// AllowedHeaders lists the request headers browsers may send. "*"
+	// allows any header.
+	AllowedHeaders []string
+
+	// ExposedHeaders lists the response headers browsers may read.
+	ExposedHeaders []string
+
+	// AllowCredentials lets browsers send cookies and authorization headers.
+	// It cannot be combined with the "*" origin.
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+// DefaultCORSConfig returns the default CORS configuration. No origins are
+// allowed until configured.
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedHeaders: []string{
+			"Accept",
+			"Authorization",
+			"Content-Type",
+			APIKeyHeader,
+			SignatureDateHeader,
+			SignatureNonceHeader,
+			requestid.Header,
+		},
+		ExposedHeaders: []string{
+			"RateLimit-Limit",
+			"RateLimit-Remaining",
+			"RateLimit-Reset",
+			"RateLimit-Policy",
+			"Retry-After",
+			QuotaUsedHeader,
+			QuotaLimitHeader,
+			QuotaResetHeader,
+			QuotaWarningHeader,
+			QuotaOverageHeader,
+			requestid.Header,
+		},
+		MaxAge: 10 * time.Minute,
+	}
+}
+
+// ErrCORSWildcardCredentials is returned by CORSConfig.Validate when
+// credentials are allowed from any origin.
+var ErrCORSWildcardCredentials = errors.New(`the "*" origin cannot be allowed with credentials`)
+
+// Validate reports whether the configuration is usable. Allowing
+// credentials from any origin would let every website make authenticated
+// requests on behalf of its visitors, so browsers refuse it and so does
+// Validate.
+func (config CORSConfig) Validate() error {
+	if config.AllowCredentials && containsString(config.AllowedOrigins, "*") {
+		return ErrCORSWildcardCredentials
+	}
+	return nil
+}
+
+// CORS answers preflight requests and adds CORS headers to responses for
+// the routes of a gorilla/mux router.
+type CORS struct {
+	config         CORSConfig
+	router         *mux.Router
+	allowedHeaders map[string]bool
+	allowAnyHeader bool
+}
+
+// NewCORS creates a new CORS handler for the routes of router. If config
+// allows credentials, a "*" origin is ignored rather than matching every
+// origin; check the configuration with Validate first.
+func NewCORS(config CORSConfig, router *mux.Router) *CORS {
+	c := &CORS{
+		config:         config,
+		router:         router,
+		allowedHeaders: make(map[string]bool),
+	}
+	for _, header := range config.AllowedHeaders {
+		if header == "*" {
+			c.allowAnyHeader = true
+		}
+		c.allowedHeaders[http.CanonicalHeaderKey(header)] = true
+	}
+	return c
+}
+
+// Middleware is a middleware function that answers CORS preflight requests
+// and adds the CORS headers to responses for allowed origins. Register it
+// with router.Use so it runs for every matched route.
+func (c *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses differ by origin, so caches must key on it
+		w.Header().Add("Vary", "Origin")
+
+		// Same-origin and non-browser requests need no CORS headers
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Answer preflight requests without calling the route handler
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			c.preflight(w, r, origin)
+			return
+		}
+
+		// Let allowed origins read the response
+		if c.originAllowed(origin) {
+			c.setOriginHeaders(w, origin)
+			if len(c.config.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.config.ExposedHeaders, ", "))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PreflightHandler answers OPTIONS requests that are not CORS preflights
+// with the methods allowed on the path. Register it on the router for the
+// OPTIONS method after every other route, so that routes registered for
+// other methods do not answer OPTIONS with 405 Method Not Allowed.
+func (c *CORS) PreflightHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods := c.routeMethods(r)
+		if len(methods) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// preflight answers a CORS preflight request.
+func (c *CORS) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	// The path must exist
+	methods := c.routeMethods(r)
+	if len(methods) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The origin, method and headers must all be allowed
+	method := r.Header.Get("Access-Control-Request-Method")
+	requestedHeaders := parseHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+	if !c.originAllowed(origin) || !containsString(methods, method) || !c.headersAllowed(requestedHeaders) {
+		writeError(w, http.StatusForbidden, "Cross-origin request not allowed.")
+		return
+	}
+
+	c.setOriginHeaders(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(requestedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(requestedHeaders, ", "))
+	}
+	if c.config.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.config.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setOriginHeaders sets the headers granting the origin access.
+func (c *CORS) setOriginHeaders(w http.ResponseWriter, origin string) {
+	// Only origins matched by name are echoed, since the wildcard is not
+	// allowed with credentials
+	if !c.config.AllowCredentials && containsString(c.config.AllowedOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.config.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// originAllowed reports whether the origin matches an allowed origin.
+func (c *CORS) originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.config.AllowedOrigins {
+		if allowed == "*" && c.config.AllowCredentials {
+			continue
+		}
+		if matchOrigin(strings.ToLower(allowed), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAllowed reports whether every requested header is allowed.
+func (c *CORS) headersAllowed(headers []string) bool {
+	if c.allowAnyHeader {
+		return true
+	}
+	for _, header := range headers {
+		if !c.allowedHeaders[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+	return true
+}
+
+// routeMethods returns the methods of the router's routes matching the
+// request path, including OPTIONS.
+func (c *CORS) routeMethods(r *http.Request) []string {
+	seen := map[string]bool{}
+	c.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		var match mux.RouteMatch
+		if !route.Match(r, &match) && match.MatchErr != mux.ErrMethodMismatch {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			seen[method] = true
+		}
+		return nil
+	})
+
+	// Only the catch-all OPTIONS route matched, so the path does not exist
+	delete(seen, http.MethodOptions)
+	if len(seen) == 0 {
+		return nil
+	}
+
+	methods := []string{http.MethodOptions}
+	for method := range seen {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// matchOrigin reports whether origin matches the allowed pattern, which may
+// be "*" or contain a single "*" standing for one or more subdomain labels.
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+
+	prefix, suffix, found := strings.Cut(pattern, "*")
+	if !found || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+
+	// The wildcard must only cover host labels, not a scheme, port or path
+	if len(prefix)+len(suffix) >= len(origin) {
+		return false
+	}
+	labels := origin[len(prefix) : len(origin)-len(suffix)]
+	for _, ch := range labels {
+		if !(ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '.') {
+			return false
+		}
+	}
+	return !strings.HasPrefix(labels, ".") && !strings.HasSuffix(labels, ".")
+}
+
+// parseHeaderList splits a comma separated list of header names.
+func parseHeaderList(value string) []string {
+	var headers []string
+	for _, header := range strings.Split(value, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
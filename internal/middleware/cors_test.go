@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func newCORSRouter(config CORSConfig) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}).Methods("GET")
+	router.HandleFunc("/api/v1/image/resize", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}).Methods("POST")
+
+	cors := NewCORS(config, router)
+	router.Use(cors.Middleware)
+	router.Methods(http.MethodOptions).Handler(cors.PreflightHandler())
+	return router
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	config := DefaultCORSConfig()
+	config.AllowedOrigins = []string{"https://app.example.com", "https://*.example.org"}
+	config.AllowCredentials = true
+	router := newCORSRouter(config)
+
+	tests := []struct {
+		name    string
+		path    string
+		origin  string
+		method  string
+		headers string
+		want    int
+	}{
+		{"exact origin", "/api/v1/image/resize", "https://app.example.com", "POST", "Content-Type, X-API-Key", http.StatusNoContent},
+		{"wildcard subdomain", "/api/v1/hello", "https://a.b.example.org", "GET", "", http.StatusNoContent},
+		{"wildcard needs a subdomain", "/api/v1/hello", "https://example.org", "GET", "", http.StatusForbidden},
+		{"wildcard lookalike", "/api/v1/hello", "https://evil-example.org", "GET", "", http.StatusForbidden},
+		{"wildcard port", "/api/v1/hello", "https://a.example.org:8443", "GET", "", http.StatusForbidden},
+		{"unknown origin", "/api/v1/hello", "https://evil.com", "GET", "", http.StatusForbidden},
+		{"method not routed", "/api/v1/hello", "https://app.example.com", "DELETE", "", http.StatusForbidden},
+		{"header not allowed", "/api/v1/hello", "https://app.example.com", "GET", "X-Secret", http.StatusForbidden},
+		{"unknown path", "/api/v1/missing", "https://app.example.com", "GET", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, tt.path, nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			if tt.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d want %d", rr.Code, tt.want)
+			}
+			if tt.want != http.StatusNoContent {
+				return
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tt.origin {
+				t.Errorf("got Access-Control-Allow-Origin %q want %q", got, tt.origin)
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+				t.Errorf("got Access-Control-Allow-Credentials %q", got)
+			}
+			if got := rr.Header().Get("Access-Control-Max-Age"); got != "600" {
+				t.Errorf("got Access-Control-Max-Age %q", got)
+			}
+		})
+	}
+}
+
+func TestCORS_ActualRequest(t *testing.T) {
+	config := DefaultCORSConfig()
+	config.AllowedOrigins = []string{"*"}
+	router := newCORSRouter(config)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+	req.Header.Set("Origin", "https://anywhere.example")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d want %d", rr.Code, http.StatusOK)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("got Access-Control-Allow-Origin %q want %q", got, "*")
+	}
+	if got := rr.Header().Get("Access-Control-Expose-Headers"); got == "" {
+		t.Errorf("missing Access-Control-Expose-Headers")
+	}
+}
+
+func TestCORS_PlainOptions(t *testing.T) {
+	router := newCORSRouter(DefaultCORSConfig())
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodOptions, "/api/v1/hello", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got status %d want %d", rr.Code, http.StatusNoContent)
+	}
+	if got, want := rr.Header().Get("Allow"), "GET, OPTIONS"; got != want {
+		t.Errorf("got Allow %q want %q", got, want)
+	}
+}
+
+func TestCORS_WildcardWithCredentials(t *testing.T) {
+	config := DefaultCORSConfig()
+	config.AllowedOrigins = []string{"*", "https://app.example.com"}
+	config.AllowCredentials = true
+	if err := config.Validate(); err != ErrCORSWildcardCredentials {
+		t.Errorf("Validate: got %v want %v", err, ErrCORSWildcardCredentials)
+	}
+	router := newCORSRouter(config)
+
+	// Any other origin is not granted access, with or without credentials
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("got Access-Control-Allow-Origin %q for an unlisted origin", got)
+	}
+
+	// Listed origins still are
+	req.Header.Set("Origin", "https://app.example.com")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("got Access-Control-Allow-Origin %q want %q", got, "https://app.example.com")
+	}
+}
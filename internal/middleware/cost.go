@@ -0,0 +1,331 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+
+	"go.opencensus.io/trace"
+
+	// Register the decoders of the supported image formats
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// RequestCostHeader is the response header reporting the estimated cost of
+// a request.
+const RequestCostHeader = "X-Request-Cost"
+
+// costContextKey stores the *requestCost of a request
+const costContextKey contextKey = "request_cost"
+
+// CostConfig configures how the cost of image requests is computed:
+// input megapixels times the operation's weight, plus a unit per
+// OutputBytesPerUnit bytes of response.
+type CostConfig struct {
+	// Weights maps an operation, the last segment of the request path
+	// (e.g. "resize"), to its cost per input megapixel.
+	Weights map[string]float64
+
+	// DefaultWeight applies to operations without a weight.
+	DefaultWeight float64
+
+	// OutputBytesPerUnit is the number of response bytes charged as one
+	// unit. Zero does not charge for output.
+	OutputBytesPerUnit int64
+
+	// MaxBodyBytes is the largest request body buffered. The dimensions of
+	// larger images are read from their first MaxBodyBytes bytes.
+	MaxBodyBytes int64
+}
+
+// DefaultCostConfig returns the default cost configuration: a unit per
+// megapixel converted or resized, half a unit per megapixel cropped, and a
+// unit per megabyte of output.
+func DefaultCostConfig() CostConfig {
+	return CostConfig{
+		Weights: map[string]float64{
+			"convert": 1,
+			"resize":  1,
+			"crop":    0.5,
+		},
+		DefaultWeight:      1,
+		OutputBytesPerUnit: 1 << 20,
+		MaxBodyBytes:       32 << 20,
+	}
+}
+
+// requestCost is the cost of a request, estimated before it is handled and
+// reconciled with the actual cost afterwards.
+type requestCost struct {
+	estimated  int64
+	megapixels float64
+
+	// measured reports whether the image dimensions could be read
+	measured bool
+
+	mu          sync.Mutex
+	reconcilers []func(delta int64)
+	finishers   []func(actual int64)
+}
+
+// onReconcile registers fn to be called with the difference between the
+// actual and the estimated cost once the request has finished.
+func (c *requestCost) onReconcile(fn func(delta int64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconcilers = append(c.reconcilers, fn)
+}
+
+// onFinish registers fn to be called with the actual cost once the
+// request has finished.
+func (c *requestCost) onFinish(fn func(actual int64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finishers = append(c.finishers, fn)
+}
+
+// reconcile calls the registered reconcilers with the cost difference, and
+// the registered finishers with the actual cost.
+func (c *requestCost) reconcile(actual int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if delta := actual - c.estimated; delta != 0 {
+		for _, fn := range c.reconcilers {
+			fn(delta)
+		}
+	}
+	for _, fn := range c.finishers {
+		fn(actual)
+	}
+}
+
+// RequestCost returns the estimated cost of the request stored in ctx by
+// the cost middleware, or 1 for requests without an estimate.
+func RequestCost(ctx context.Context) int64 {
+	if cost, ok := ctx.Value(costContextKey).(*requestCost); ok {
+		return cost.estimated
+	}
+	return 1
+}
+
+// NewCostMiddleware returns a middleware estimating the cost of image
+// requests from the dimensions of the uploaded image, read with
+// image.DecodeConfig before the image is processed. The rate limit and
+// quota middleware after it charge the estimate, and are charged the
+// difference once the actual output size is known.
+func NewCostMiddleware(config CostConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Only uploads are costed by their content
+			if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Read the body, leaving it in place for the handler
+			body, complete, err := peekBody(r, config.MaxBodyBytes)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("The request body is limited to %d bytes.", tooLarge.Limit))
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "Unable to read the request body.")
+				return
+			}
+
+			// Weigh the input megapixels by the operation. The image header
+			// is at the start of the body, so bodies too large to buffer
+			// whole are measured from the part read.
+			var megapixels, work float64
+			_, span := trace.StartSpan(r.Context(), "image.decode_config")
+			imageConfig, format, measured := decodeImageConfig(body, r.Header.Get("Content-Type"))
+			if measured {
+				megapixels = float64(imageConfig.Width) * float64(imageConfig.Height) / 1e6
+				work = megapixels * config.weight(operation(r))
+				imageInputMegapixels.WithLabelValues(format).Observe(megapixels)
+				span.AddAttributes(
+					trace.StringAttribute("image.format", format),
+					trace.Float64Attribute("image.megapixels", megapixels),
+				)
+			}
+			span.End()
+
+			// Estimate the output to be the size of the input
+			inputBytes := int64(len(body))
+			if !complete && r.ContentLength > inputBytes {
+				inputBytes = r.ContentLength
+			}
+			cost := &requestCost{
+				estimated:  config.cost(work, inputBytes),
+				megapixels: megapixels,
+				measured:   measured,
+			}
+			r = r.WithContext(context.WithValue(r.Context(), costContextKey, cost))
+			w.Header().Set(RequestCostHeader, strconv.FormatInt(cost.estimated, 10))
+
+			// Call the next handler, recording the response size
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+
+			// Failed requests did no work worth charging for
+			actual := int64(1)
+			if sw.status < http.StatusBadRequest {
+				actual = config.cost(work, sw.written)
+				if format := imageFormat(w.Header().Get("Content-Type")); format != "" {
+					imageOutputBytes.WithLabelValues(format).Observe(float64(sw.written))
+				}
+			}
+			cost.reconcile(actual)
+		})
+	}
+}
+
+// allowRequest checks a request against the limiter, charging its
+// estimated cost when the limiter supports costs, and registers the
+// reconciliation of its actual cost.
+func allowRequest(r *http.Request, limiter Limiter, key string, limit int64) Decision {
+	cost, ok := r.Context().Value(costContextKey).(*requestCost)
+	costLimiter, weighted := limiter.(CostLimiter)
+	if !ok || !weighted {
+		return limiter.Allow(key, limit)
+	}
+
+	decision := costLimiter.AllowN(key, limit, cost.estimated)
+	if decision.Allowed {
+		cost.onReconcile(func(delta int64) {
+			costLimiter.Charge(key, limit, delta)
+		})
+	}
+	return decision
+}
+
+// weight returns the cost per megapixel of the operation.
+func (c CostConfig) weight(operation string) float64 {
+	if weight, ok := c.Weights[operation]; ok {
+		return weight
+	}
+	return c.DefaultWeight
+}
+
+// cost returns the units charged for the work and output size, at least 1.
+func (c CostConfig) cost(work float64, outputBytes int64) int64 {
+	units := int64(math.Ceil(work))
+	if c.OutputBytesPerUnit > 0 {
+		units += (outputBytes + c.OutputBytesPerUnit - 1) / c.OutputBytesPerUnit
+	}
+	if units < 1 {
+		return 1
+	}
+	return units
+}
+
+// operation returns the last segment of the request path, such as
+// "resize" for /api/v1/image/resize.
+func operation(r *http.Request) string {
+	return path.Base(r.URL.Path)
+}
+
+// bufferedBody is a request body read whole into memory by peekBody. It
+// replaces the request body, so the middleware peeking after the first
+// share its bytes and their hash instead of copying the body again.
+type bufferedBody struct {
+	*bytes.Reader
+	data []byte
+
+	hashOnce sync.Once
+	hash     string
+}
+
+// Close does nothing: the original body was closed once read.
+func (b *bufferedBody) Close() error {
+	return nil
+}
+
+// sum returns the hex SHA-256 of the body, computed once.
+func (b *bufferedBody) sum() string {
+	b.hashOnce.Do(func() {
+		sum := sha256.Sum256(b.data)
+		b.hash = hex.EncodeToString(sum[:])
+	})
+	return b.hash
+}
+
+// peekBody reads up to max bytes of the request body and puts them back
+// in front of the rest. It reports whether the whole body was read. A body
+// already read whole by an earlier call is reused rather than read again.
+func peekBody(r *http.Request, max int64) ([]byte, bool, error) {
+	if buffered, ok := r.Body.(*bufferedBody); ok && buffered.Len() == len(buffered.data) {
+		return buffered.data, int64(len(buffered.data)) <= max, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	complete := int64(len(body)) <= max
+	if complete {
+		r.Body.Close()
+		r.Body = &bufferedBody{Reader: bytes.NewReader(body), data: body}
+	} else {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+	return body, complete, nil
+}
+
+// bodyHash returns the hex SHA-256 of a body returned by peekBody for the
+// request, reusing the hash computed by earlier middleware if any.
+func bodyHash(r *http.Request, body []byte) string {
+	if buffered, ok := r.Body.(*bufferedBody); ok {
+		return buffered.sum()
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// decodeImageConfig reads the dimensions and format of the image in the
+// body, either the whole body or the first file of a multipart form. The
+// body may be truncated after the image header.
+func decodeImageConfig(body []byte, contentType string) (image.Config, string, bool) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/form-data" {
+		imageConfig, format, err := image.DecodeConfig(bytes.NewReader(body))
+		return imageConfig, format, err == nil
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return image.Config{}, "", false
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		imageConfig, format, err := image.DecodeConfig(part)
+		return imageConfig, format, err == nil
+	}
+}
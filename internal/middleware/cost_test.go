@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// encodePNG returns a blank PNG of the given size.
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCostLimiters_ChargeByCost(t *testing.T) {
+	clock := newFakeClock()
+	config := LimiterConfig{Period: time.Minute, Now: clock.Now}
+	shared := DefaultSharedLimiterConfig()
+	shared.LimiterConfig = config
+	limiters := map[string]CostLimiter{
+		AlgorithmTokenBucket:   NewTokenBucket(config),
+		AlgorithmGCRA:          NewGCRA(config),
+		AlgorithmSlidingWindow: NewSlidingWindowLog(config),
+		"shared":               NewSharedLimiter(NewMemoryCounterStore(), shared),
+	}
+
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			if !limiter.AllowN("user:1", 10, 6).Allowed {
+				t.Fatal("first request costing 6 of 10: rejected, want allowed")
+			}
+			if limiter.AllowN("user:1", 10, 6).Allowed {
+				t.Fatal("second request costing 6 of 10: allowed, want rejected")
+			}
+
+			// A refund makes room again
+			limiter.Charge("user:1", 10, -6)
+			if !limiter.AllowN("user:1", 10, 6).Allowed {
+				t.Error("after a refund: rejected, want allowed")
+			}
+
+			// Requests costing more than the limit are allowed on a full
+			// limit, and leave the key in debt
+			if !limiter.AllowN("user:2", 10, 25).Allowed {
+				t.Error("request costing more than the limit: rejected, want allowed")
+			}
+			if limiter.Allow("user:2", 10).Allowed {
+				t.Error("after exceeding the limit: allowed, want rejected")
+			}
+		})
+	}
+}
+
+func TestCostMiddleware_EstimatesAndReconciles(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewTokenBucket(LimiterConfig{Period: time.Minute, Now: clock.Now})
+	rateLimit := DefaultRateLimitConfig()
+	rateLimit.Limiter = limiter
+	rateLimit.DefaultLimit = 100
+
+	cost := DefaultCostConfig()
+	cost.Weights = map[string]float64{"resize": 2}
+
+	// The handler returns 3 MB of output
+	output := bytes.Repeat([]byte("x"), 3<<20)
+	router := mux.NewRouter()
+	router.Handle("/api/v1/image/{operation}", NewCostMiddleware(cost)(NewRateLimitingMiddleware(rateLimit)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(output)
+		}),
+	)))
+
+	// 2 megapixels at weight 2, plus a unit for the small input
+	body := encodePNG(t, 2000, 1000)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/image/resize", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "image/png")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if got := rr.Header().Get(RequestCostHeader); got != "5" {
+		t.Errorf("%s = %q, want 5", RequestCostHeader, got)
+	}
+
+	// The actual cost is 4 units of work and 3 of output
+	bucket := limiter.buckets["ip:192.0.2.1"]
+	if bucket == nil || bucket.tokens != 93 {
+		t.Errorf("bucket = %+v, want 93 tokens left after a cost of 7", bucket)
+	}
+}
+
+func TestDecodeImageConfig_Multipart(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("format", "jpg")
+	part, _ := form.CreateFormFile("image", "photo.png")
+	part.Write(encodePNG(t, 640, 480))
+	form.Close()
+
+	config, _, ok := decodeImageConfig(body.Bytes(), form.FormDataContentType())
+	if !ok || config.Width != 640 || config.Height != 480 {
+		t.Errorf("decodeImageConfig() = %+v, %v, want 640x480", config, ok)
+	}
+
+	if _, _, ok := decodeImageConfig([]byte("not an image"), "image/png"); ok {
+		t.Error("decodeImageConfig() ok for a non-image body")
+	}
+}
+
+func TestPeekBody_LeavesBodyInPlace(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))
+	peeked, complete, err := peekBody(req, 4)
+	if err != nil || complete || len(peeked) != 5 {
+		t.Fatalf("peekBody() = %q, %v, %v, want 5 bytes of an incomplete body", peeked, complete, err)
+	}
+
+	var rest bytes.Buffer
+	rest.ReadFrom(req.Body)
+	if rest.String() != "0123456789" {
+		t.Errorf("body after peek = %q, want the whole body", rest.String())
+	}
+}
+
+func TestPeekBody_ReusesBufferedBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))
+	first, complete, err := peekBody(req, 32)
+	if err != nil || !complete {
+		t.Fatalf("peekBody() = %q, %v, %v, want the complete body", first, complete, err)
+	}
+	hash := bodyHash(req, first)
+
+	// Later middleware share the bytes and hash instead of copying them
+	second, complete, err := peekBody(req, 32)
+	if err != nil || !complete || &second[0] != &first[0] {
+		t.Errorf("second peekBody() copied the body")
+	}
+	if got := bodyHash(req, second); got != hash {
+		t.Errorf("bodyHash() = %q, want %q", got, hash)
+	}
+
+	var rest bytes.Buffer
+	rest.ReadFrom(req.Body)
+	if rest.String() != "0123456789" {
+		t.Errorf("body after peeks = %q, want the whole body", rest.String())
+	}
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CounterStore keeps counters shared by every instance of the API, so that
+// limits hold across instances instead of multiplying with their number.
+// *repositories.FirestoreRepository satisfies this interface.
+type CounterStore interface {
+	// IncrementCounter atomically adds delta to the counter and returns its
+	// new value. The counter may be deleted once expiresAt has passed.
+	IncrementCounter(ctx context.Context, key string, delta int64, expiresAt time.Time) (int64, error)
+}
+
+// memoryCounter is a counter of MemoryCounterStore.
+type memoryCounter struct {
+	count     int64
+	expiresAt time.Time
+}
+
+// MemoryCounterStore is an in-memory CounterStore, for a single instance
+// and for tests.
+type MemoryCounterStore struct {
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	mu        sync.Mutex
+	counters  map[string]*memoryCounter
+	lastPrune time.Time
+}
+
+// NewMemoryCounterStore creates a new MemoryCounterStore.
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{
+		Now:      time.Now,
+		counters: make(map[string]*memoryCounter),
+	}
+}
+
+// IncrementCounter adds delta to the counter and returns its new value.
+func (s *MemoryCounterStore) IncrementCounter(ctx context.Context, key string, delta int64, expiresAt time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.Now()
+	s.prune(now)
+
+	// Expired counters start again from zero
+	counter, ok := s.counters[key]
+	if !ok || !now.Before(counter.expiresAt) {
+		counter = &memoryCounter{}
+		s.counters[key] = counter
+	}
+	counter.count += delta
+	if expiresAt.After(counter.expiresAt) {
+		counter.expiresAt = expiresAt
+	}
+	return counter.count, nil
+}
+
+// prune deletes expired counters, at most once a minute. s.mu must be held.
+func (s *MemoryCounterStore) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+
+	for key, counter := range s.counters {
+		if !now.Before(counter.expiresAt) {
+			delete(s.counters, key)
+		}
+	}
+}
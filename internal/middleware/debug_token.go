@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+const (
+	// AuthMethodDebugToken is recorded on identities proven by a debug token.
+	AuthMethodDebugToken = "debug_token"
+
+	// DebugRole is the role granted to requests carrying a valid debug token.
+	DebugRole = "debug"
+
+	// DebugTokenHeader is the request header carrying a debug token.
+	DebugTokenHeader = "X-Debug-Token"
+)
+
+// DebugTokenAuthenticator authenticates requests to the debug endpoints by
+// a shared token that is only valid until a fixed time, so that profiling
+// can be enabled for a live incident without handing out admin credentials
+// that outlive it.
+type DebugTokenAuthenticator struct {
+	digest    [sha256.Size]byte
+	expiresAt time.Time
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewDebugTokenAuthenticator creates a new DebugTokenAuthenticator accepting
+// token until expiresAt.
+func NewDebugTokenAuthenticator(token string, expiresAt time.Time) *DebugTokenAuthenticator {
+	return &DebugTokenAuthenticator{
+		digest:    sha256.Sum256([]byte(token)),
+		expiresAt: expiresAt,
+		Now:       time.Now,
+	}
+}
+
+// ExpiresAt returns the time the token stops being accepted.
+func (a *DebugTokenAuthenticator) ExpiresAt() time.Time {
+	return a.expiresAt
+}
+
+// Authenticate checks the debug token header and returns an identity with
+// the debug role.
+func (a *DebugTokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := r.Header.Get(DebugTokenHeader)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+
+	// Compare digests in constant time so the token cannot be guessed
+	// byte by byte from response timings
+	digest := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(digest[:], a.digest[:]) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Reject the token once its time box has passed
+	if !a.Now().Before(a.expiresAt) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		User: &models.User{
+			ID:    "debug-token",
+			Roles: []string{DebugRole},
+		},
+		Method: AuthMethodDebugToken,
+		KeyID:  keyFingerprint(token),
+	}, nil
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDebugTokenAuthenticator(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	auth := NewDebugTokenAuthenticator("incident-42", now.Add(time.Hour))
+	auth.Now = func() time.Time { return now }
+
+	newRequest := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/heap", nil)
+		if token != "" {
+			req.Header.Set(DebugTokenHeader, token)
+		}
+		return req
+	}
+
+	if _, err := auth.Authenticate(newRequest("")); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("no token: err = %v, want ErrNoCredentials", err)
+	}
+	if _, err := auth.Authenticate(newRequest("wrong")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong token: err = %v, want ErrInvalidCredentials", err)
+	}
+
+	identity, err := auth.Authenticate(newRequest("incident-42"))
+	if err != nil {
+		t.Fatalf("valid token: err = %v", err)
+	}
+	if identity.Method != AuthMethodDebugToken || !containsString(identity.User.Roles, DebugRole) {
+		t.Errorf("identity = %+v, want debug token identity with the debug role", identity)
+	}
+
+	// The token stops working once its time box has passed
+	now = now.Add(time.Hour)
+	if _, err := auth.Authenticate(newRequest("incident-42")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expired token: err = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestRequireAnyRole(t *testing.T) {
+	handler := RequireAnyRole("admin", DebugRole)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// A debug token holder is let through
+	auth := NewDebugTokenAuthenticator("incident-42", time.Now().Add(time.Hour))
+	req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+	req.Header.Set(DebugTokenHeader, "incident-42")
+	rr := httptest.NewRecorder()
+	NewAuthenticationMiddleware(auth)(handler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("debug token: status = %d, want 200", rr.Code)
+	}
+
+	// Anonymous requests are not
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("anonymous: status = %d, want 403", rr.Code)
+	}
+}
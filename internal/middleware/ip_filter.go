@@ -0,0 +1,283 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// IPFilterConfig configures IPFilter.
+type IPFilterConfig struct {
+	// TrustedProxies are the proxies whose X-Forwarded-For header is used
+	// to find the client IP.
+	TrustedProxies TrustedProxies
+
+	// Allow, if not empty, is the only networks allowed to call the API.
+	Allow IPNetworks
+
+	// Deny lists networks that may never call the API.
+	Deny IPNetworks
+
+	// BanThreshold is the number of offending responses (see BanStatuses)
+	// an IP may receive within BanWindow before it is banned for
+	// BanDuration. Zero disables automatic bans.
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+
+	// BanStatuses are the response status codes counted as offences.
+	BanStatuses []int
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// DefaultIPFilterConfig returns the default IP filter configuration:
+// no allow or deny lists, and a 15 minute ban for IPs receiving 20
+// Unauthorized or Too Many Requests responses within a minute.
+func DefaultIPFilterConfig() IPFilterConfig {
+	return IPFilterConfig{
+		BanThreshold: 20,
+		BanWindow:    time.Minute,
+		BanDuration:  15 * time.Minute,
+		BanStatuses:  []int{http.StatusUnauthorized, http.StatusTooManyRequests},
+		Now:          time.Now,
+	}
+}
+
+// ipOffences counts the offences of an IP in the current window.
+type ipOffences struct {
+	count       int
+	windowStart time.Time
+}
+
+// IPFilter resolves the client IP of each request, enforces global and
+// per-user allow and deny lists, and temporarily bans IPs that repeatedly
+// fail authentication or exceed their rate limit. Offences and bans are
+// kept in memory, so each instance counts and bans IPs on its own.
+type IPFilter struct {
+	config IPFilterConfig
+
+	mu        sync.Mutex
+	offences  map[string]*ipOffences
+	bans      map[string]models.Ban
+	lastPrune time.Time
+}
+
+// NewIPFilter creates a new IPFilter.
+func NewIPFilter(config IPFilterConfig) *IPFilter {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &IPFilter{
+		config:   config,
+		offences: make(map[string]*ipOffences),
+		bans:     make(map[string]models.Ban),
+	}
+}
+
+// Middleware is a middleware function that resolves the client IP, stores
+// it in the request context and rejects denied or banned IPs. It must run
+// before authentication and rate limiting so that it can count their
+// rejections towards a ban.
+func (f *IPFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Resolve the client IP through the trusted proxies
+		ip := ClientIP(r, f.config.TrustedProxies)
+		r = r.WithContext(WithClientIP(r.Context(), ip))
+
+		// Check the global lists
+		if f.config.Deny.Contains(ip) || (len(f.config.Allow) > 0 && !f.config.Allow.Contains(ip)) {
+			writeError(w, http.StatusForbidden, "Requests from this IP address are not allowed.")
+			return
+		}
+
+		// Check for an active ban
+		if ban, ok := f.activeBan(ip.String()); ok {
+			retryAfter := int(ban.ExpiresAt.Sub(f.config.Now()).Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeError(w, http.StatusForbidden, "This IP address is temporarily banned. Please try again later.")
+			return
+		}
+
+		// Call the next handler, recording the response status
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		// Count offending responses towards a ban
+		if f.config.BanThreshold > 0 && containsInt(f.config.BanStatuses, sw.status) {
+			f.recordOffence(ip.String(), sw.status)
+		}
+	})
+}
+
+// UserMiddleware is a middleware function that enforces the authenticated
+// user's own allow and deny lists. It must run after authentication.
+func (f *IPFilter) UserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip, ok := ClientIPFromContext(r.Context())
+		if !ok {
+			ip = ClientIP(r, f.config.TrustedProxies)
+		}
+
+		if !userAllowsIP(user, ip) {
+			writeError(w, http.StatusForbidden, "Requests from this IP address are not allowed for this account.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Bans returns the active bans, soonest to expire first.
+func (f *IPFilter) Bans() []models.Ban {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.config.Now()
+	bans := make([]models.Ban, 0, len(f.bans))
+	for ip, ban := range f.bans {
+		if !now.Before(ban.ExpiresAt) {
+			delete(f.bans, ip)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].ExpiresAt.Before(bans[j].ExpiresAt)
+	})
+	return bans
+}
+
+// Unban lifts the ban on an IP and forgets its offences. It reports
+// whether the IP was banned.
+func (f *IPFilter) Unban(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, banned := f.bans[ip]
+	delete(f.bans, ip)
+	delete(f.offences, ip)
+	return banned
+}
+
+// activeBan returns the unexpired ban on an IP, if any.
+func (f *IPFilter) activeBan(ip string) (models.Ban, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ban, ok := f.bans[ip]
+	if !ok {
+		return ban, false
+	}
+	if !f.config.Now().Before(ban.ExpiresAt) {
+		delete(f.bans, ip)
+		return ban, false
+	}
+	return ban, true
+}
+
+// recordOffence counts an offending response for an IP and bans it once
+// it reaches the threshold within the window.
+func (f *IPFilter) recordOffence(ip string, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.config.Now()
+	f.prune(now)
+
+	// Start a new window if the previous one has passed
+	offences, ok := f.offences[ip]
+	if !ok || now.Sub(offences.windowStart) >= f.config.BanWindow {
+		offences = &ipOffences{windowStart: now}
+		f.offences[ip] = offences
+	}
+	offences.count++
+
+	if offences.count < f.config.BanThreshold {
+		return
+	}
+
+	// Ban the IP and start counting afresh once the ban expires
+	f.bans[ip] = models.Ban{
+		IP:        ip,
+		Reason:    fmt.Sprintf("%d responses with status %d within %s", offences.count, status, f.config.BanWindow),
+		Offences:  offences.count,
+		BannedAt:  now,
+		ExpiresAt: now.Add(f.config.BanDuration),
+	}
+	delete(f.offences, ip)
+}
+
+// prune forgets expired offence windows and bans, at most once per window,
+// so the maps do not grow without bound. f.mu must be held.
+func (f *IPFilter) prune(now time.Time) {
+	if now.Sub(f.lastPrune) < f.config.BanWindow {
+		return
+	}
+	f.lastPrune = now
+
+	for ip, offences := range f.offences {
+		if now.Sub(offences.windowStart) >= f.config.BanWindow {
+			delete(f.offences, ip)
+		}
+	}
+	for ip, ban := range f.bans {
+		if !now.Before(ban.ExpiresAt) {
+			delete(f.bans, ip)
+		}
+	}
+}
+
+// userAllowsIP reports whether the user's own lists allow the IP. Invalid
+// entries are ignored.
+func userAllowsIP(user *models.User, ip net.IP) bool {
+	if len(user.DeniedCIDRs) > 0 {
+		deny, _ := ParseIPNetworks(validCIDRs(user.DeniedCIDRs))
+		if deny.Contains(ip) {
+			return false
+		}
+	}
+	if len(user.AllowedCIDRs) > 0 {
+		allow, _ := ParseIPNetworks(validCIDRs(user.AllowedCIDRs))
+		return allow.Contains(ip)
+	}
+	return true
+}
+
+// validCIDRs returns the entries that parse as a CIDR or IP address.
+func validCIDRs(values []string) []string {
+	valid := make([]string, 0, len(values))
+	for _, value := range values {
+		if _, err := ParseIPNetworks([]string{value}); err == nil {
+			valid = append(valid, value)
+		}
+	}
+	return valid
+}
+
+// containsInt reports whether values contains n.
+func containsInt(values []int, n int) bool {
+	for _, value := range values {
+		if value == n {
+			return true
+		}
+	}
+	return false
+}
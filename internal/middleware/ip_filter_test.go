@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+func mustParseIPNetworks(t *testing.T, values ...string) IPNetworks {
+	t.Helper()
+	networks, err := ParseIPNetworks(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return networks
+}
+
+func TestClientIP_TrustedProxyChain(t *testing.T) {
+	proxies := mustParseIPNetworks(t, "10.0.0.0/8")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.2:4000"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.7, 10.0.0.1")
+
+	// The spoofed leftmost entry is ignored; the first untrusted hop wins
+	if ip := ClientIP(req, proxies); ip.String() != "203.0.113.7" {
+		t.Errorf("ClientIP = %s, want 203.0.113.7", ip)
+	}
+
+	// Without trusted proxies the header is ignored
+	if ip := ClientIP(req, nil); ip.String() != "10.0.0.2" {
+		t.Errorf("ClientIP = %s, want 10.0.0.2", ip)
+	}
+}
+
+func TestIPFilter_GlobalLists(t *testing.T) {
+	config := DefaultIPFilterConfig()
+	config.Allow = mustParseIPNetworks(t, "192.0.2.0/24")
+	config.Deny = mustParseIPNetworks(t, "192.0.2.66")
+	handler := NewIPFilter(config).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := map[string]int{
+		"192.0.2.1:1234":    http.StatusOK,
+		"192.0.2.66:1234":   http.StatusForbidden,
+		"198.51.100.1:1234": http.StatusForbidden,
+	}
+	for remoteAddr, want := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("%s: status = %d, want %d", remoteAddr, rr.Code, want)
+		}
+	}
+}
+
+func TestIPFilter_BansRepeatedOffenders(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	config := DefaultIPFilterConfig()
+	config.BanThreshold = 3
+	config.Now = func() time.Time { return now }
+	filter := NewIPFilter(config)
+
+	status := http.StatusUnauthorized
+	handler := filter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Three failed authentications trigger a ban
+	for i := 0; i < 3; i++ {
+		if rr := serve(); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d, want 401", i, rr.Code)
+		}
+	}
+	status = http.StatusOK
+	rr := serve()
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("banned status = %d, want 403", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After header not set on ban")
+	}
+	if bans := filter.Bans(); len(bans) != 1 || bans[0].IP != "203.0.113.7" {
+		t.Fatalf("Bans() = %+v, want one ban for 203.0.113.7", bans)
+	}
+
+	// The ban expires after BanDuration
+	now = now.Add(config.BanDuration)
+	if rr := serve(); rr.Code != http.StatusOK {
+		t.Errorf("status after expiry = %d, want 200", rr.Code)
+	}
+	if bans := filter.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() after expiry = %+v, want none", bans)
+	}
+}
+
+func TestIPFilter_Unban(t *testing.T) {
+	config := DefaultIPFilterConfig()
+	config.BanThreshold = 1
+	filter := NewIPFilter(config)
+	filter.recordOffence("203.0.113.7", http.StatusTooManyRequests)
+
+	if !filter.Unban("203.0.113.7") {
+		t.Error("Unban() = false, want true for a banned IP")
+	}
+	if filter.Unban("203.0.113.7") {
+		t.Error("Unban() = true, want false once lifted")
+	}
+}
+
+func TestIPFilter_UserLists(t *testing.T) {
+	filter := NewIPFilter(DefaultIPFilterConfig())
+	handler := filter.UserMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	user := &models.User{
+		ID:           "user-1",
+		AllowedCIDRs: []string{"192.0.2.0/24"},
+		DeniedCIDRs:  []string{"192.0.2.66"},
+	}
+
+	tests := map[string]int{
+		"192.0.2.1:1234":    http.StatusOK,
+		"192.0.2.66:1234":   http.StatusForbidden,
+		"198.51.100.1:1234": http.StatusForbidden,
+	}
+	for remoteAddr, want := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req = req.WithContext(WithIdentity(req.Context(), &Identity{User: user, Method: AuthMethodAPIKey}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("%s: status = %d, want %d", remoteAddr, rr.Code, want)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	handler := RequireRole("admin")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name  string
+		roles []string
+		want  int
+	}{
+		{"admin", []string{"admin"}, http.StatusOK},
+		{"user", []string{"user"}, http.StatusForbidden},
+		{"no roles", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin/bans", nil)
+		user := &models.User{ID: "user-1", Roles: tt.roles}
+		req = req.WithContext(WithIdentity(req.Context(), &Identity{User: user}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rr.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// Limit types reported in the error body of a 429 response.
+const (
+	LimitTypeRateLimit = "rate_limit"
+	LimitTypeQuota     = "quota"
+)
+
+// LimitStatus describes where a client stands against a rate limit or
+// quota after a request.
+type LimitStatus struct {
+	// Limit is the number of requests allowed per Window.
+	Limit  int64
+	Window time.Duration
+
+	// Remaining is the number of requests left before the limit is hit.
+	Remaining int64
+
+	// Reset is the time until the full limit is available again.
+	Reset time.Duration
+
+	// RetryAfter is the time until the next request will be allowed, for
+	// rejected requests.
+	RetryAfter time.Duration
+}
+
+// setLimitHeaders sets the IETF RateLimit headers for the status. When more
+// than one limit applies, each is listed in RateLimit-Policy and the other
+// headers describe the one closest to being exhausted.
+func setLimitHeaders(w http.ResponseWriter, status LimitStatus) {
+	header := w.Header()
+	header.Add("RateLimit-Policy", fmt.Sprintf("%d;w=%d", status.Limit, ceilSeconds(status.Window)))
+
+	if current := header.Get("RateLimit-Remaining"); current != "" {
+		if remaining, err := strconv.ParseInt(current, 10, 64); err == nil && remaining <= status.Remaining {
+			return
+		}
+	}
+	header.Set("RateLimit-Limit", strconv.FormatInt(status.Limit, 10))
+	header.Set("RateLimit-Remaining", strconv.FormatInt(status.Remaining, 10))
+	header.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(status.Reset), 10))
+}
+
+// writeLimitExceeded writes a 429 Too Many Requests response with a
+// Retry-After header and an error body identifying the limit that tripped.
+func writeLimitExceeded(w http.ResponseWriter, r *http.Request, limitType string, status LimitStatus) {
+	limitRejections.WithLabelValues(limitType, routeTemplate(r)).Inc()
+
+	// Always ask for at least a second, so clients do not retry in a loop
+	retryAfter := ceilSeconds(status.RetryAfter)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+
+	message := "Rate limit exceeded. Please slow down and retry after the time given in Retry-After."
+	if limitType == LimitTypeQuota {
+		message = "Quota exceeded. Please retry after the time given in Retry-After or upgrade your plan."
+	}
+
+	writePayload(w, http.StatusTooManyRequests, models.Payload{
+		Status:  "error",
+		Message: message,
+		Data: map[string]interface{}{
+			"limit_type":  limitType,
+			"limit":       status.Limit,
+			"remaining":   status.Remaining,
+			"reset":       ceilSeconds(status.Reset),
+			"retry_after": retryAfter,
+		},
+	})
+}
+
+// ceilSeconds returns d in whole seconds, rounded up.
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+func TestRateLimitingMiddleware_Headers(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	config := DefaultRateLimitConfig()
+	config.DefaultLimit = 2
+	config.Period = time.Minute
+	config.Now = func() time.Time { return now }
+	handler := NewRateLimitingMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil))
+		return rr
+	}
+
+	// Successful responses report the remaining requests
+	rr := serve()
+	want := map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "1",
+		"RateLimit-Reset":     "30",
+		"RateLimit-Policy":    "2;w=60",
+	}
+	for name, value := range want {
+		if got := rr.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	// Rejected responses say when to retry and which limit tripped
+	serve()
+	rr = serve()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if got := rr.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("RateLimit-Remaining = %q, want 0", got)
+	}
+
+	var payload models.Payload
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := payload.Data.(map[string]interface{})
+	if payload.Status != "error" || data["limit_type"] != LimitTypeRateLimit {
+		t.Errorf("payload = %+v, want an error with limit_type %q", payload, LimitTypeRateLimit)
+	}
+}
+
+func TestSetLimitHeaders_MostRestrictive(t *testing.T) {
+	rr := httptest.NewRecorder()
+	setLimitHeaders(rr, LimitStatus{Limit: 100, Window: time.Minute, Remaining: 90, Reset: time.Second})
+	setLimitHeaders(rr, LimitStatus{Limit: 1000, Window: time.Hour, Remaining: 5, Reset: time.Hour})
+	setLimitHeaders(rr, LimitStatus{Limit: 10, Window: time.Second, Remaining: 8, Reset: time.Second})
+
+	if got := rr.Header().Get("RateLimit-Remaining"); got != "5" {
+		t.Errorf("RateLimit-Remaining = %q, want the lowest remaining 5", got)
+	}
+	if got := rr.Header().Get("RateLimit-Limit"); got != "1000" {
+		t.Errorf("RateLimit-Limit = %q, want 1000", got)
+	}
+	if got := rr.Header().Values("RateLimit-Policy"); len(got) != 3 {
+		t.Errorf("RateLimit-Policy = %v, want all three policies", got)
+	}
+}
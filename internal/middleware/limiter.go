@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rate limiting algorithms selectable by name with NewLimiter.
+const (
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmGCRA          = "gcra"
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmConcurrency   = "concurrency"
+)
+
+// Limiter decides whether a request counted against a key, such as a user
+// or client IP, is within the key's limit.
+type Limiter interface {
+	// Allow records a request against the key and reports whether it is
+	// within limit. If allowed, the decision's Release must be called once
+	// the request has finished.
+	Allow(key string, limit int64) Decision
+}
+
+// CostLimiter is a Limiter that can charge requests by their cost, such as
+// the image processing work they cause, instead of one unit each.
+type CostLimiter interface {
+	Limiter
+
+	// AllowN records a request costing n units against the key. A request
+	// costing more than the whole limit is allowed once the full limit is
+	// available, leaving the key in debt.
+	AllowN(key string, limit, n int64) Decision
+
+	// Charge adjusts the key's usage by n units, which may be negative,
+	// without checking the limit. It reconciles an estimated cost with the
+	// actual cost once a request has finished.
+	Charge(key string, limit, n int64)
+}
+
+// Decision is the outcome of a Limiter.Allow call.
+type Decision struct {
+	Allowed bool
+	Status  LimitStatus
+
+	// Release ends an allowed request. It is a no-op for limiters that only
+	// count requests over time.
+	Release func()
+}
+
+// LimiterConfig configures the limiter implementations.
+type LimiterConfig struct {
+	// Period is the window limits are expressed over: a limit of 10 with a
+	// Period of a minute allows 10 requests a minute. Concurrency limiters
+	// ignore it.
+	Period time.Duration
+
+	// IdleTimeout is how long the state of a key is kept once its usage has
+	// fully reset, so memory does not grow with every client ever seen.
+	IdleTimeout time.Duration
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// DefaultLimiterConfig returns the default limiter configuration: limits
+// per second, and state kept for ten idle minutes.
+func DefaultLimiterConfig() LimiterConfig {
+	return LimiterConfig{
+		Period:      time.Second,
+		IdleTimeout: 10 * time.Minute,
+		Now:         time.Now,
+	}
+}
+
+// NewLimiter creates the limiter for the named algorithm.
+func NewLimiter(algorithm string, config LimiterConfig) (Limiter, error) {
+	switch algorithm {
+	case AlgorithmTokenBucket, "":
+		return NewTokenBucket(config), nil
+	case AlgorithmGCRA:
+		return NewGCRA(config), nil
+	case AlgorithmSlidingWindow:
+		return NewSlidingWindowLog(config), nil
+	case AlgorithmConcurrency:
+		return NewConcurrencyLimiter(), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+}
+
+// withDefaults fills in the zero fields of a limiter configuration.
+func (c LimiterConfig) withDefaults() LimiterConfig {
+	defaults := DefaultLimiterConfig()
+	if c.Period <= 0 {
+		c.Period = defaults.Period
+	}
+	if c.Now == nil {
+		c.Now = defaults.Now
+	}
+	return c
+}
+
+// pruneDue reports whether idle state should be pruned now, at most once
+// per IdleTimeout, and records the prune.
+func (c LimiterConfig) pruneDue(lastPrune *time.Time, now time.Time) bool {
+	if c.IdleTimeout <= 0 || now.Sub(*lastPrune) < c.IdleTimeout {
+		return false
+	}
+	*lastPrune = now
+	return true
+}
+
+// admissionCost returns the units that must be available to allow a
+// request costing n, which is capped at the limit so that expensive
+// requests are not rejected forever.
+func admissionCost(n, limit int64) int64 {
+	if n > limit {
+		return limit
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// denyAll is the decision for a key whose limit is zero or less.
+func denyAll(config LimiterConfig, limit int64) Decision {
+	return Decision{
+		Status:  LimitStatus{Limit: limit, Window: config.Period, RetryAfter: config.Period},
+		Release: func() {},
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimiter is a Limiter that caps the number of requests of a key
+// in flight at once, regardless of their rate. It suits expensive routes
+// such as image processing, where slow requests matter more than many.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	inFlight map[string]int64
+}
+
+// NewConcurrencyLimiter creates a new ConcurrencyLimiter.
+func NewConcurrencyLimiter() *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		inFlight: make(map[string]int64),
+	}
+}
+
+// Allow starts a request for the key if fewer than limit are in flight.
+func (l *ConcurrencyLimiter) Allow(key string, limit int64) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := LimitStatus{Limit: limit}
+	if l.inFlight[key] >= limit {
+		// There is no schedule to predict when a request will finish
+		status.RetryAfter = time.Second
+		return Decision{Status: status, Release: func() {}}
+	}
+
+	l.inFlight[key]++
+	status.Remaining = limit - l.inFlight[key]
+
+	var once sync.Once
+	return Decision{
+		Allowed: true,
+		Status:  status,
+		Release: func() {
+			once.Do(func() { l.release(key) })
+		},
+	}
+}
+
+// InFlight returns the number of requests of the key in flight.
+func (l *ConcurrencyLimiter) InFlight(key string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight[key]
+}
+
+// release ends a request for the key, forgetting keys with none in flight.
+func (l *ConcurrencyLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight[key]--
+	if l.inFlight[key] <= 0 {
+		delete(l.inFlight, key)
+	}
+}
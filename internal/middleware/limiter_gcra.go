@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// GCRA is a Limiter implementing the generic cell rate algorithm. Each key
+// only stores its theoretical arrival time (TAT): the time at which its
+// usage will have fully drained. Requests are spaced Period/limit apart,
+// with bursts of up to limit requests.
+type GCRA struct {
+	config LimiterConfig
+
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewGCRA creates a new GCRA limiter.
+func NewGCRA(config LimiterConfig) *GCRA {
+	return &GCRA{
+		config: config.withDefaults(),
+		tats:   make(map[string]time.Time),
+	}
+}
+
+// Allow checks the request against the key's theoretical arrival time.
+func (l *GCRA) Allow(key string, limit int64) Decision {
+	return l.AllowN(key, limit, 1)
+}
+
+// AllowN checks a request costing n units against the key's theoretical
+// arrival time. Each unit counts as one request at the sustained rate.
+func (l *GCRA) AllowN(key string, limit, n int64) Decision {
+	if limit <= 0 {
+		return denyAll(l.config, limit)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.config.Now()
+	tat, interval := l.tat(key, limit, now)
+
+	// A request is allowed if, after adding it, the usage still drains
+	// within one period
+	allowAt := tat.Add(time.Duration(admissionCost(n, limit))*interval - l.config.Period)
+
+	status := LimitStatus{Limit: limit, Window: l.config.Period}
+	if now.Before(allowAt) {
+		status.Reset = tat.Sub(now)
+		status.RetryAfter = allowAt.Sub(now)
+		return Decision{Status: status, Release: func() {}}
+	}
+
+	newTAT := tat.Add(time.Duration(n) * interval)
+	l.tats[key] = newTAT
+	if remaining := int64((l.config.Period - newTAT.Sub(now)) / interval); remaining > 0 {
+		status.Remaining = remaining
+	}
+	status.Reset = newTAT.Sub(now)
+	return Decision{Allowed: true, Status: status, Release: func() {}}
+}
+
+// Charge moves the key's theoretical arrival time by n units, back for
+// negative n.
+func (l *GCRA) Charge(key string, limit, n int64) {
+	if limit <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.config.Now()
+	tat, interval := l.tat(key, limit, now)
+	tat = tat.Add(time.Duration(n) * interval)
+	if tat.Before(now) {
+		tat = now
+	}
+	l.tats[key] = tat
+}
+
+// tat returns the key's theoretical arrival time, no earlier than now, and
+// the emission interval between requests at the sustained rate. l.mu must
+// be held.
+func (l *GCRA) tat(key string, limit int64, now time.Time) (time.Time, time.Duration) {
+	l.prune(now)
+
+	interval := l.config.Period / time.Duration(limit)
+	if interval <= 0 {
+		interval = 1
+	}
+
+	tat, ok := l.tats[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+	return tat, interval
+}
+
+// prune forgets keys whose usage drained more than IdleTimeout ago. l.mu
+// must be held.
+func (l *GCRA) prune(now time.Time) {
+	if !l.config.pruneDue(&l.lastPrune, now) {
+		return
+	}
+	for key, tat := range l.tats {
+		if now.Sub(tat) >= l.config.IdleTimeout {
+			delete(l.tats, key)
+		}
+	}
+}
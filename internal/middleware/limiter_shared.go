@@ -0,0 +1,352 @@
+package middleware
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+)
+
+// SharedLimiterConfig configures a SharedLimiter.
+type SharedLimiterConfig struct {
+	LimiterConfig
+
+	// Namespace separates the counters of limiters sharing a store, such as
+	// the rate limit and quota of the same user.
+	Namespace string
+
+	// BatchSize is the most requests an instance reserves from the store at
+	// once. Reserved requests are served without a store write, so a larger
+	// batch means fewer writes, but requests reserved by an instance that
+	// stops receiving traffic are lost for the rest of the window.
+	BatchSize int64
+
+	// Tolerance is the fraction of a limit each instance may allow on its
+	// own per window while the store is unavailable. Zero rejects requests
+	// that cannot be counted; 1 lets each instance allow the full limit.
+	Tolerance float64
+
+	// Timeout bounds each store call.
+	Timeout time.Duration
+}
+
+// DefaultSharedLimiterConfig returns the default shared limiter
+// configuration: per second windows, batches of up to 10 requests, and a
+// 10% allowance per instance while the store is unavailable.
+func DefaultSharedLimiterConfig() SharedLimiterConfig {
+	return SharedLimiterConfig{
+		LimiterConfig: DefaultLimiterConfig(),
+		BatchSize:     10,
+		Tolerance:     0.1,
+		Timeout:       2 * time.Second,
+	}
+}
+
+// sharedWindow is an instance's view of a key's current window.
+type sharedWindow struct {
+	mu sync.Mutex
+
+	start time.Time
+
+	// reserved is the number of requests reserved from the store and not
+	// yet served by this instance
+	reserved int64
+
+	// total is the last known count in the store, across all instances
+	total int64
+
+	// unconfirmed counts the requests allowed while the store was
+	// unavailable
+	unconfirmed int64
+
+	// refill is closed once the reservation in flight, if any, completes
+	refill chan struct{}
+
+	// retryAt is when the store is tried again after failing
+	retryAt time.Time
+}
+
+// SharedLimiter is a Limiter counting requests in fixed windows of Period
+// in a CounterStore shared by all instances. To avoid a store write per
+// request, each instance reserves requests in batches and serves them
+// locally.
+type SharedLimiter struct {
+	store  CounterStore
+	config SharedLimiterConfig
+
+	mu        sync.Mutex
+	windows   map[string]*sharedWindow
+	lastPrune time.Time
+}
+
+// NewSharedLimiter creates a new SharedLimiter counting in store.
+func NewSharedLimiter(store CounterStore, config SharedLimiterConfig) *SharedLimiter {
+	config.LimiterConfig = config.LimiterConfig.withDefaults()
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultSharedLimiterConfig().Timeout
+	}
+	return &SharedLimiter{
+		store:   store,
+		config:  config,
+		windows: make(map[string]*sharedWindow),
+	}
+}
+
+// Allow serves the request from this instance's reservation, reserving
+// more from the store when it runs out.
+func (l *SharedLimiter) Allow(key string, limit int64) Decision {
+	return l.AllowN(key, limit, 1)
+}
+
+// AllowN serves a request costing n units from this instance's
+// reservation, reserving more from the store when it runs short. The
+// window is not locked during store calls: a single reservation per key is
+// in flight at a time, and requests it would not cover wait for it.
+func (l *SharedLimiter) AllowN(key string, limit, n int64) Decision {
+	if limit <= 0 {
+		return denyAll(l.config.LimiterConfig, limit)
+	}
+
+	need := admissionCost(n, limit)
+	for {
+		now := l.config.Now()
+		window, end := l.lockWindow(key, now)
+
+		// Wait for the reservation in flight if the current one does not
+		// cover the request
+		if window.reserved < need && window.refill != nil {
+			refill := window.refill
+			window.mu.Unlock()
+			<-refill
+			continue
+		}
+
+		allowed := window.reserved >= need
+		if !allowed {
+			var retry bool
+			allowed, retry = l.reserve(key, limit, window, now, end, need)
+			if retry {
+				// The window ended during the reservation
+				window.mu.Unlock()
+				continue
+			}
+		}
+		var debt int64
+		if allowed {
+			debt = consume(window, n)
+		}
+		decision := l.decision(window, limit, now, end, allowed)
+		start := window.start
+		window.mu.Unlock()
+
+		l.settle(key, start, end, debt)
+		return decision
+	}
+}
+
+// decision builds the decision for the window. window.mu must be held.
+func (l *SharedLimiter) decision(window *sharedWindow, limit int64, now, end time.Time, allowed bool) Decision {
+	status := LimitStatus{
+		Limit:     limit,
+		Window:    l.config.Period,
+		Remaining: limit - window.total + window.reserved,
+		Reset:     end.Sub(now),
+	}
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	} else if status.Remaining > limit {
+		status.Remaining = limit
+	}
+	if !allowed {
+		status.RetryAfter = end.Sub(now)
+	}
+	return Decision{Allowed: allowed, Status: status, Release: func() {}}
+}
+
+// Charge takes n units from this instance's reservation, counting any
+// shortfall in the store, or returns them to the reservation if n is
+// negative.
+func (l *SharedLimiter) Charge(key string, limit, n int64) {
+	window, end := l.lockWindow(key, l.config.Now())
+	if n < 0 {
+		window.reserved -= n
+		window.mu.Unlock()
+		return
+	}
+	debt := consume(window, n)
+	start := window.start
+	window.mu.Unlock()
+
+	l.settle(key, start, end, debt)
+}
+
+// lockWindow returns the key's window state for the current window,
+// locked, and the end of the window.
+func (l *SharedLimiter) lockWindow(key string, now time.Time) (*sharedWindow, time.Time) {
+	start := now.Truncate(l.config.Period)
+	window := l.window(key, now)
+	window.mu.Lock()
+
+	// Start afresh in a new window
+	if !window.start.Equal(start) {
+		window.start = start
+		window.reserved = 0
+		window.total = 0
+		window.unconfirmed = 0
+		window.refill = nil
+	}
+	return window, start.Add(l.config.Period)
+}
+
+// consume takes n units from the reservation and returns the shortfall, if
+// any, which must be counted in the store with settle. window.mu must be
+// held.
+func consume(window *sharedWindow, n int64) int64 {
+	window.reserved -= n
+	if window.reserved >= 0 {
+		return 0
+	}
+	debt := -window.reserved
+	window.reserved = 0
+	return debt
+}
+
+// settle counts a request costing more than was reserved in the store,
+// best effort, so that it is not free. The window must not be locked.
+func (l *SharedLimiter) settle(key string, start, end time.Time, debt int64) {
+	if debt <= 0 {
+		return
+	}
+	total, err := l.increment(key, start, end, debt)
+	if err != nil {
+		logging.Default().Error("Rate limit store unavailable", "error", err)
+		return
+	}
+
+	window, _ := l.lockWindow(key, l.config.Now())
+	if window.start.Equal(start) && total > window.total {
+		window.total = total
+	}
+	window.mu.Unlock()
+}
+
+// reserve reserves a batch of requests, or at least need units, for the
+// window from the store and reports whether the reservation now covers
+// need, or whether the window ended meanwhile and the request must be
+// retried. The window is unlocked during the store call, and locked again
+// on return. While the store is unavailable it allows up to the tolerance
+// instead. window.mu must be held.
+func (l *SharedLimiter) reserve(key string, limit int64, window *sharedWindow, now, end time.Time, need int64) (allowed, retry bool) {
+	// Nothing left to reserve as far as we know
+	batch := l.config.BatchSize
+	if short := need - window.reserved; short > batch {
+		batch = short
+	}
+	if left := limit - window.total; left < batch {
+		batch = left
+	}
+	if batch <= 0 {
+		return false, false
+	}
+
+	// Count locally, within the tolerance, until the store is retried
+	if now.Before(window.retryAt) {
+		return l.tolerate(limit, window, need), false
+	}
+
+	// Call the store with the window unlocked, so requests the current
+	// reservation covers are not held up
+	start := window.start
+	refill := make(chan struct{})
+	window.refill = refill
+	window.mu.Unlock()
+	total, err := l.increment(key, start, end, batch)
+	window.mu.Lock()
+	if window.refill == refill {
+		window.refill = nil
+	}
+	close(refill)
+	if !window.start.Equal(start) {
+		return false, true
+	}
+
+	if err != nil {
+		logging.Default().Error("Rate limit store unavailable", "error", err)
+		window.retryAt = now.Add(l.config.Timeout)
+		return l.tolerate(limit, window, need), false
+	}
+
+	// Other instances may have used part of the batch's share
+	if total > window.total {
+		window.total = total
+	}
+	granted := batch
+	if over := total - limit; over > 0 {
+		granted -= over
+	}
+	if granted > 0 {
+		window.reserved += granted
+	}
+	return window.reserved >= need, false
+}
+
+// tolerate allows need units without the store if the window's requests
+// allowed that way stay within the tolerance. window.mu must be held.
+func (l *SharedLimiter) tolerate(limit int64, window *sharedWindow, need int64) bool {
+	if float64(window.unconfirmed+need) > l.config.Tolerance*float64(limit) {
+		return false
+	}
+	window.unconfirmed += need
+	window.reserved += need
+	return true
+}
+
+// increment adds delta to the key's counter for the window starting at
+// start in the store.
+func (l *SharedLimiter) increment(key string, start, end time.Time, delta int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.config.Timeout)
+	defer cancel()
+
+	counterKey := l.config.Namespace + ":" + key + "@" + strconv.FormatInt(start.Unix(), 10)
+	return l.store.IncrementCounter(ctx, counterKey, delta, end)
+}
+
+// window returns the instance's window state for the key, creating it if
+// needed.
+func (l *SharedLimiter) window(key string, now time.Time) *sharedWindow {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	window, ok := l.windows[key]
+	if !ok {
+		window = &sharedWindow{}
+		l.windows[key] = window
+	}
+	return window
+}
+
+// prune forgets keys whose window ended more than IdleTimeout ago. l.mu
+// must be held.
+func (l *SharedLimiter) prune(now time.Time) {
+	if !l.config.pruneDue(&l.lastPrune, now) {
+		return
+	}
+	for key, window := range l.windows {
+		// Skip windows in use rather than block every key
+		if !window.mu.TryLock() {
+			continue
+		}
+		idle := now.Sub(window.start) >= l.config.Period+l.config.IdleTimeout
+		window.mu.Unlock()
+		if idle {
+			delete(l.windows, key)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// countingStore counts the calls made to a CounterStore and can simulate
+// an outage.
+type countingStore struct {
+	CounterStore
+	calls int
+	down  bool
+}
+
+func (s *countingStore) IncrementCounter(ctx context.Context, key string, delta int64, expiresAt time.Time) (int64, error) {
+	s.calls++
+	if s.down {
+		return 0, errors.New("store unavailable")
+	}
+	return s.CounterStore.IncrementCounter(ctx, key, delta, expiresAt)
+}
+
+func newSharedLimiterForTest(store CounterStore, clock *fakeClock, batch int64) *SharedLimiter {
+	config := DefaultSharedLimiterConfig()
+	config.Period = time.Minute
+	config.Now = clock.Now
+	config.BatchSize = batch
+	return NewSharedLimiter(store, config)
+}
+
+func TestSharedLimiter_LimitHoldsAcrossInstances(t *testing.T) {
+	clock := newFakeClock()
+	memory := NewMemoryCounterStore()
+	memory.Now = clock.Now
+
+	// Two instances sharing a store allow the limit once between them
+	first := newSharedLimiterForTest(memory, clock, 3)
+	second := newSharedLimiterForTest(memory, clock, 3)
+	total := allowed(first, "user:1", 10, 6) + allowed(second, "user:1", 10, 6) + allowed(first, "user:1", 10, 6)
+	if total != 10 {
+		t.Errorf("instances allowed %d requests together, want 10", total)
+	}
+
+	// The next window starts afresh
+	clock.Advance(time.Minute)
+	if got := allowed(second, "user:1", 10, 10); got != 10 {
+		t.Errorf("next window: allowed %d, want 10", got)
+	}
+}
+
+func TestSharedLimiter_BatchesStoreWrites(t *testing.T) {
+	clock := newFakeClock()
+	store := &countingStore{CounterStore: NewMemoryCounterStore()}
+	limiter := newSharedLimiterForTest(store, clock, 10)
+
+	if got := allowed(limiter, "user:1", 100, 30); got != 30 {
+		t.Fatalf("allowed %d, want 30", got)
+	}
+	if store.calls != 3 {
+		t.Errorf("store called %d times for 30 requests, want 3", store.calls)
+	}
+}
+
+func TestSharedLimiter_ToleranceWhileStoreIsDown(t *testing.T) {
+	clock := newFakeClock()
+	store := &countingStore{CounterStore: NewMemoryCounterStore(), down: true}
+	limiter := newSharedLimiterForTest(store, clock, 10)
+
+	// The default tolerance allows 10% of the limit without the store
+	if got := allowed(limiter, "user:1", 50, 50); got != 5 {
+		t.Errorf("allowed %d while the store is down, want 5", got)
+	}
+}
+
+// blockingStore holds each increment until released.
+type blockingStore struct {
+	CounterStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) IncrementCounter(ctx context.Context, key string, delta int64, expiresAt time.Time) (int64, error) {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.CounterStore.IncrementCounter(ctx, key, delta, expiresAt)
+}
+
+func TestSharedLimiter_ReservesWithoutLockingTheWindow(t *testing.T) {
+	clock := newFakeClock()
+	memory := NewMemoryCounterStore()
+	memory.Now = clock.Now
+	limiter := newSharedLimiterForTest(memory, clock, 10)
+
+	// Leave 2 units of the first batch reserved
+	if got := allowed(limiter, "user:1", 100, 8); got != 8 {
+		t.Fatalf("allowed %d, want 8", got)
+	}
+
+	// A request costing 5 reserves more, and waits on the store
+	store := &blockingStore{CounterStore: memory, entered: make(chan struct{}), release: make(chan struct{})}
+	limiter.store = store
+	done := make(chan Decision)
+	go func() { done <- limiter.AllowN("user:1", 100, 5) }()
+	<-store.entered
+
+	// Meanwhile, requests covered by the reservation are served
+	served := make(chan Decision)
+	go func() { served <- limiter.Allow("user:1", 100) }()
+	select {
+	case decision := <-served:
+		if !decision.Allowed {
+			t.Error("request covered by the reservation was rejected")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request covered by the reservation waited for the store")
+	}
+
+	close(store.release)
+	if decision := <-done; !decision.Allowed {
+		t.Error("request reserving from the store was rejected")
+	}
+}
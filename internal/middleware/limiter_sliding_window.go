@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// windowEntry is a request logged by SlidingWindowLog, with its cost.
+type windowEntry struct {
+	at   time.Time
+	cost int64
+}
+
+// SlidingWindowLog is a Limiter that logs the time of each allowed request
+// per key and allows at most limit requests, or units of cost, in any
+// Period. It is exact, at the cost of storing up to limit entries per key.
+type SlidingWindowLog struct {
+	config LimiterConfig
+
+	mu        sync.Mutex
+	logs      map[string][]windowEntry
+	lastPrune time.Time
+}
+
+// NewSlidingWindowLog creates a new SlidingWindowLog limiter.
+func NewSlidingWindowLog(config LimiterConfig) *SlidingWindowLog {
+	return &SlidingWindowLog{
+		config: config.withDefaults(),
+		logs:   make(map[string][]windowEntry),
+	}
+}
+
+// Allow checks the number of requests logged for the key in the last
+// Period.
+func (l *SlidingWindowLog) Allow(key string, limit int64) Decision {
+	return l.AllowN(key, limit, 1)
+}
+
+// AllowN checks the cost of the requests logged for the key in the last
+// Period, and logs the request if it fits.
+func (l *SlidingWindowLog) AllowN(key string, limit, n int64) Decision {
+	if limit <= 0 {
+		return denyAll(l.config, limit)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.config.Now()
+	log, used := l.window(key, now)
+
+	need := admissionCost(n, limit)
+	allowed := used+need <= limit
+	if allowed {
+		log = append(log, windowEntry{at: now, cost: n})
+		used += n
+	}
+	l.logs[key] = log
+
+	status := LimitStatus{Limit: limit, Window: l.config.Period}
+	if used < limit {
+		status.Remaining = limit - used
+	}
+	if len(log) > 0 {
+		status.Reset = log[len(log)-1].at.Add(l.config.Period).Sub(now)
+	}
+	if !allowed {
+		// Wait until enough of the logged cost has left the window
+		for _, entry := range log {
+			used -= entry.cost
+			if used+need <= limit {
+				status.RetryAfter = entry.at.Add(l.config.Period).Sub(now)
+				break
+			}
+		}
+	}
+	return Decision{Allowed: allowed, Status: status, Release: func() {}}
+}
+
+// Charge logs n units of cost for the key now, or a refund for negative n.
+func (l *SlidingWindowLog) Charge(key string, limit, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.config.Now()
+	log, _ := l.window(key, now)
+	l.logs[key] = append(log, windowEntry{at: now, cost: n})
+}
+
+// window returns the key's log without the requests older than one Period,
+// and their total cost. l.mu must be held.
+func (l *SlidingWindowLog) window(key string, now time.Time) ([]windowEntry, int64) {
+	l.prune(now)
+
+	log := l.logs[key]
+	start := now.Add(-l.config.Period)
+	i := 0
+	for i < len(log) && !log[i].at.After(start) {
+		i++
+	}
+	log = log[i:]
+
+	var used int64
+	for _, entry := range log {
+		used += entry.cost
+	}
+	return log, used
+}
+
+// prune forgets keys without requests for IdleTimeout. l.mu must be held.
+func (l *SlidingWindowLog) prune(now time.Time) {
+	if !l.config.pruneDue(&l.lastPrune, now) {
+		return
+	}
+	for key, log := range l.logs {
+		if len(log) == 0 || now.Sub(log[len(log)-1].at) >= l.config.Period+l.config.IdleTimeout {
+			delete(l.logs, key)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is an injectable clock for deterministic limiter tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// allowed counts the requests allowed out of n for the key.
+func allowed(limiter Limiter, key string, limit int64, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if limiter.Allow(key, limit).Allowed {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRateLimiters_BurstAndRefill(t *testing.T) {
+	algorithms := []string{AlgorithmTokenBucket, AlgorithmGCRA, AlgorithmSlidingWindow}
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter, err := NewLimiter(algorithm, LimiterConfig{Period: time.Minute, Now: clock.Now})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The full limit may be used at once
+			if got := allowed(limiter, "user:1", 4, 10); got != 4 {
+				t.Fatalf("burst: allowed %d, want 4", got)
+			}
+
+			// Other keys are unaffected
+			if got := allowed(limiter, "user:2", 4, 1); got != 1 {
+				t.Errorf("other key: allowed %d, want 1", got)
+			}
+
+			// The rejected request says when to retry
+			decision := limiter.Allow("user:1", 4)
+			if decision.Allowed || decision.Status.RetryAfter <= 0 || decision.Status.Remaining != 0 {
+				t.Errorf("exhausted: decision = %+v, want rejected with RetryAfter", decision)
+			}
+
+			// The whole limit is back after a period
+			clock.Advance(time.Minute)
+			if got := allowed(limiter, "user:1", 4, 10); got != 4 {
+				t.Errorf("after a period: allowed %d, want 4", got)
+			}
+		})
+	}
+}
+
+func TestTokenBucket_RefillsGradually(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewTokenBucket(LimiterConfig{Period: time.Minute, Now: clock.Now})
+	allowed(limiter, "user:1", 4, 4)
+
+	// A quarter of a period refills one token
+	clock.Advance(15 * time.Second)
+	if got := allowed(limiter, "user:1", 4, 4); got != 1 {
+		t.Errorf("allowed %d, want 1", got)
+	}
+}
+
+func TestGCRA_SpacesRequests(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewGCRA(LimiterConfig{Period: time.Minute, Now: clock.Now})
+
+	decision := limiter.Allow("user:1", 2)
+	if decision.Status.Remaining != 1 || decision.Status.Reset != 30*time.Second {
+		t.Errorf("first: status = %+v, want 1 remaining and reset in 30s", decision.Status)
+	}
+	limiter.Allow("user:1", 2)
+
+	decision = limiter.Allow("user:1", 2)
+	if decision.Allowed || decision.Status.RetryAfter != 30*time.Second {
+		t.Errorf("third: decision = %+v, want rejected with RetryAfter 30s", decision)
+	}
+
+	clock.Advance(30 * time.Second)
+	if !limiter.Allow("user:1", 2).Allowed {
+		t.Error("after the emission interval: rejected, want allowed")
+	}
+}
+
+func TestSlidingWindowLog_NoBoundaryBurst(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewSlidingWindowLog(LimiterConfig{Period: time.Minute, Now: clock.Now})
+
+	// Requests late in one minute still count early in the next
+	clock.Advance(50 * time.Second)
+	allowed(limiter, "user:1", 4, 4)
+	clock.Advance(20 * time.Second)
+	if got := allowed(limiter, "user:1", 4, 4); got != 0 {
+		t.Errorf("allowed %d, want 0 within the sliding window", got)
+	}
+
+	clock.Advance(40 * time.Second)
+	if got := allowed(limiter, "user:1", 4, 4); got != 4 {
+		t.Errorf("allowed %d, want 4 once the window has passed", got)
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := NewConcurrencyLimiter()
+
+	first := limiter.Allow("user:1", 2)
+	second := limiter.Allow("user:1", 2)
+	if !first.Allowed || !second.Allowed {
+		t.Fatal("rejected a request within the concurrency limit")
+	}
+	if limiter.Allow("user:1", 2).Allowed {
+		t.Error("allowed a third request in flight, want rejected")
+	}
+
+	// Releasing is idempotent and frees a slot
+	first.Release()
+	first.Release()
+	if got := limiter.InFlight("user:1"); got != 1 {
+		t.Errorf("InFlight = %d, want 1", got)
+	}
+	if !limiter.Allow("user:1", 2).Allowed {
+		t.Error("rejected a request after a release, want allowed")
+	}
+}
+
+func TestLimiters_EvictIdleKeys(t *testing.T) {
+	clock := newFakeClock()
+	config := LimiterConfig{Period: time.Second, IdleTimeout: time.Minute, Now: clock.Now}
+
+	bucket := NewTokenBucket(config)
+	gcra := NewGCRA(config)
+	window := NewSlidingWindowLog(config)
+	for _, limiter := range []Limiter{bucket, gcra, window} {
+		limiter.Allow("ip:192.0.2.1", 1)
+		limiter.Allow("ip:192.0.2.2", 1)
+	}
+
+	clock.Advance(2 * time.Minute)
+	for _, limiter := range []Limiter{bucket, gcra, window} {
+		limiter.Allow("ip:192.0.2.3", 1)
+	}
+
+	if len(bucket.buckets) != 1 || len(gcra.tats) != 1 || len(window.logs) != 1 {
+		t.Errorf("kept %d buckets, %d TATs and %d logs, want 1 each after idle eviction",
+			len(bucket.buckets), len(gcra.tats), len(window.logs))
+	}
+}
+
+func TestNewLimiter_UnknownAlgorithm(t *testing.T) {
+	if _, err := NewLimiter("leaky", DefaultLimiterConfig()); err == nil {
+		t.Error("NewLimiter() error = nil, want an error for an unknown algorithm")
+	}
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucketState is the bucket of one key.
+type tokenBucketState struct {
+	tokens float64
+	last   time.Time
+}
+
+// TokenBucket is a Limiter that gives each key a bucket of limit tokens,
+// refilled at limit tokens per Period. Each request takes a token, or one
+// per unit of cost, so clients may burst up to the full limit.
+type TokenBucket struct {
+	config LimiterConfig
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucketState
+	lastPrune time.Time
+}
+
+// NewTokenBucket creates a new TokenBucket limiter.
+func NewTokenBucket(config LimiterConfig) *TokenBucket {
+	return &TokenBucket{
+		config:  config.withDefaults(),
+		buckets: make(map[string]*tokenBucketState),
+	}
+}
+
+// Allow takes a token from the key's bucket, if there is one.
+func (l *TokenBucket) Allow(key string, limit int64) Decision {
+	return l.AllowN(key, limit, 1)
+}
+
+// AllowN takes n tokens from the key's bucket, if there are enough.
+func (l *TokenBucket) AllowN(key string, limit, n int64) Decision {
+	if limit <= 0 {
+		return denyAll(l.config, limit)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, perToken := l.refill(key, limit)
+
+	// Take the tokens if there are enough
+	need := float64(admissionCost(n, limit))
+	allowed := bucket.tokens >= need
+	if allowed {
+		bucket.tokens -= float64(n)
+	}
+
+	status := LimitStatus{
+		Limit:  limit,
+		Window: l.config.Period,
+		Reset:  time.Duration((float64(limit) - bucket.tokens) * float64(perToken)),
+	}
+	if bucket.tokens > 0 {
+		status.Remaining = int64(bucket.tokens)
+	}
+	if !allowed {
+		status.RetryAfter = time.Duration((need - bucket.tokens) * float64(perToken))
+	}
+	return Decision{Allowed: allowed, Status: status, Release: func() {}}
+}
+
+// Charge takes n tokens from the key's bucket, or returns them if n is
+// negative.
+func (l *TokenBucket) Charge(key string, limit, n int64) {
+	if limit <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, _ := l.refill(key, limit)
+	bucket.tokens -= float64(n)
+	if bucket.tokens > float64(limit) {
+		bucket.tokens = float64(limit)
+	}
+}
+
+// refill returns the key's bucket, refilled for the time elapsed since the
+// last request, and the time it takes to refill one token. l.mu must be
+// held.
+func (l *TokenBucket) refill(key string, limit int64) (*tokenBucketState, time.Duration) {
+	now := l.config.Now()
+	l.prune(now)
+
+	// New buckets start full
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucketState{tokens: float64(limit), last: now}
+		l.buckets[key] = bucket
+	}
+
+	// Refill the bucket for the time elapsed since the last request
+	perToken := l.config.Period / time.Duration(limit)
+	if perToken <= 0 {
+		perToken = 1
+	}
+	bucket.tokens += float64(now.Sub(bucket.last)) / float64(perToken)
+	if bucket.tokens > float64(limit) {
+		bucket.tokens = float64(limit)
+	}
+	bucket.last = now
+
+	return bucket, perToken
+}
+
+// prune forgets buckets that have been full for IdleTimeout. l.mu must be
+// held.
+func (l *TokenBucket) prune(now time.Time) {
+	if !l.config.pruneDue(&l.lastPrune, now) {
+		return
+	}
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= l.config.Period+l.config.IdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
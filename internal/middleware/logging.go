@@ -1,24 +1,125 @@
 package middleware
 
 import (
-	"encoding/json"
-	"fmt"
 	"net/http"
-	"time"
+	"net/url"
+	"strings"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+	"go.opencensus.io/trace"
 )
 
+// RedactedValue replaces credentials in logged headers and query
+// parameters.
+const RedactedValue = "[REDACTED]"
+
+// LoggingConfig configures the logging middleware.
+type LoggingConfig struct {
+	// Logger writes the request log entries. It defaults to
+	// logging.Default().
+	Logger *logging.Logger
+
+	// Headers lists the request headers logged. Other headers are left out.
+	Headers []string
+
+	// Secrets lists fragments of header and query parameter names whose
+	// values are credentials, matched case-insensitively, e.g. "token"
+	// matches X-Debug-Token and access_token. Their values are redacted
+	// even when the header is logged.
+	Secrets []string
+}
+
+// DefaultLoggingConfig returns the default logging configuration: the
+// default logger, a few descriptive request headers, and redaction of
+// authorization, cookie, key, token, secret, signature and password
+// values.
+func DefaultLoggingConfig() LoggingConfig {
+	return LoggingConfig{
+		Headers: []string{"User-Agent", "Accept", "Content-Type", "Content-Length", "Referer", "X-Forwarded-For"},
+		Secrets: []string{"authorization", "cookie", "key", "token", "secret", "signature", "password", "nonce"},
+	}
+}
+
 // LoggingMiddleware is a middleware function that logs the
 // request details.
 func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Log the request details
-		headersJSON, _ := json.Marshal(r.Header)
-		logMessage := fmt.Sprintf("[%s] %s %s %s | User-Agent: %s | Headers: %s",
-			time.Now().Format("2006-01-02 15:04:05"), r.Method, r.RequestURI, r.RemoteAddr,
-			r.Header.Get("User-Agent"), headersJSON)
-		fmt.Println(logMessage)
-
-		next.ServeHTTP(w, r)
-	})
+	return NewLoggingMiddleware(DefaultLoggingConfig())(next)
+}
+
+// NewLoggingMiddleware returns a logging middleware with the given
+// configuration. It logs each request with its allowed headers and its
+// query, credentials redacted, and makes a logger describing the request
+// available to handlers through logging.FromContext.
+func NewLoggingMiddleware(config LoggingConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := config.Logger
+			if logger == nil {
+				logger = logging.Default()
+			}
+
+			// Describe the request in every entry logged while serving it
+			logger = logger.With("method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			if id := requestid.FromContext(r.Context()); id != "" {
+				logger = logger.With("request_id", id)
+			}
+			if span := trace.FromContext(r.Context()); span != nil && span.SpanContext().IsSampled() {
+				logger = logger.With("trace_id", span.SpanContext().TraceID.String())
+			}
+			if user, ok := UserFromContext(r.Context()); ok {
+				logger = logger.With("user_id", user.ID)
+			}
+			r = r.WithContext(logging.NewContext(r.Context(), logger))
+
+			// Log the request details. Completed requests are recorded by
+			// the access log.
+			logger.Debug("Request received",
+				"query", redactQuery(r.URL.Query(), config.Secrets),
+				"headers", loggedHeaders(r.Header, config))
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
+// loggedHeaders returns the allowed request headers, credentials redacted.
+func loggedHeaders(header http.Header, config LoggingConfig) map[string]string {
+	logged := make(map[string]string)
+	for _, name := range config.Headers {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		value := strings.Join(values, ", ")
+		if isSecret(name, config.Secrets) {
+			value = RedactedValue
+		}
+		logged[http.CanonicalHeaderKey(name)] = value
+	}
+	return logged
+}
+
+// redactQuery returns the encoded query with credential values redacted.
+func redactQuery(query url.Values, secrets []string) string {
+	redacted := make(url.Values, len(query))
+	for name, values := range query {
+		if isSecret(name, secrets) {
+			values = []string{RedactedValue}
+		}
+		redacted[name] = values
+	}
+	return redacted.Encode()
+}
+
+// isSecret reports whether a header or parameter name contains one of the
+// secret fragments.
+func isSecret(name string, secrets []string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secrets {
+		if strings.Contains(name, strings.ToLower(secret)) {
+			return true
+		}
+	}
+	return false
+}
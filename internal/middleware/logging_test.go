@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+)
+
+func TestLoggingMiddleware_RedactsCredentials(t *testing.T) {
+	var out bytes.Buffer
+	config := DefaultLoggingConfig()
+	config.Logger = logging.New(&out, logging.LevelDebug)
+	config.Headers = append(config.Headers, "Authorization")
+
+	var handlerLogger *logging.Logger
+	handler := NewLoggingMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerLogger = logging.FromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hello?access_token=secret1&w=10", nil)
+	req.Header.Set("Authorization", "Bearer secret2")
+	req.Header.Set(APIKeyHeader, "secret3")
+	req.Header.Set("User-Agent", "test")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("log entry leaks a credential: %s", out.String())
+	}
+	var entry struct {
+		Severity string            `json:"severity"`
+		Path     string            `json:"path"`
+		Query    string            `json:"query"`
+		Headers  map[string]string `json:"headers"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry %q is not JSON: %v", out.String(), err)
+	}
+	if entry.Severity != "DEBUG" || entry.Path != "/api/v1/hello" {
+		t.Errorf("entry = %+v, want a DEBUG entry for /api/v1/hello", entry)
+	}
+	if entry.Query != "access_token=%5BREDACTED%5D&w=10" {
+		t.Errorf("query = %q, want the token redacted", entry.Query)
+	}
+	if entry.Headers["Authorization"] != RedactedValue || entry.Headers["User-Agent"] != "test" {
+		t.Errorf("headers = %v, want Authorization redacted and User-Agent logged", entry.Headers)
+	}
+	if _, ok := entry.Headers[APIKeyHeader]; ok {
+		t.Errorf("headers = %v, want headers outside the allowlist left out", entry.Headers)
+	}
+	if handlerLogger == nil || handlerLogger == logging.Default() {
+		t.Error("handler did not receive the request logger")
+	}
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/metrics"
+	"github.com/gorilla/mux"
+)
+
+// The metrics of the middleware, served from metrics.Default.
+var (
+	httpRequests = metrics.Default.NewCounterVec("http_requests_total",
+		"HTTP requests served, by method, route template and status code.",
+		"method", "route", "status")
+	httpRequestDuration = metrics.Default.NewHistogramVec("http_request_duration_seconds",
+		"Duration of HTTP requests in seconds, by method and route template.",
+		metrics.DefaultBuckets, "method", "route")
+	httpRequestsInFlight = metrics.Default.NewGaugeVec("http_requests_in_flight",
+		"HTTP requests being served, by route template.",
+		"route")
+	limitRejections = metrics.Default.NewCounterVec("limit_rejections_total",
+		"Requests rejected by rate limits and quotas, by limit type and route template.",
+		"limit_type", "route")
+
+	imageInputMegapixels = metrics.Default.NewHistogramVec("image_input_megapixels",
+		"Megapixels of uploaded images, by input format.",
+		[]float64{0.1, 0.5, 1, 2, 5, 12, 25, 50, 100, 200}, "format")
+	imageOutputBytes = metrics.Default.NewHistogramVec("image_output_bytes",
+		"Size in bytes of image responses, by output format.",
+		[]float64{1 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}, "format")
+)
+
+// MetricsMiddleware is a middleware function that records the rate,
+// errors and duration of requests, and the requests in flight, by the
+// template of the route they matched (e.g. /admin/bans/{ip}) so the number
+// of series stays bounded.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		inFlight := httpRequestsInFlight.WithLabelValues(route)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		// Call the next handler, recording the response status
+		start := time.Now()
+		iw, recorder := instrumentWriter(w)
+		next.ServeHTTP(iw, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// RegisterCacheMetrics registers the hits, misses, evictions, hit ratio
+// and size of the response cache with the registry.
+func RegisterCacheMetrics(registry *metrics.Registry, cache ResponseCache) {
+	registry.NewCounterFunc("cache_hits_total", "Responses served from the response cache.", func() float64 {
+		return float64(cache.Stats().Hits)
+	})
+	registry.NewCounterFunc("cache_misses_total", "Cacheable requests not found in the response cache.", func() float64 {
+		return float64(cache.Stats().Misses)
+	})
+	registry.NewCounterFunc("cache_evictions_total", "Responses evicted from the response cache to make room.", func() float64 {
+		return float64(cache.Stats().Evictions)
+	})
+	registry.NewGaugeFunc("cache_hit_ratio", "Share of cacheable requests served from the response cache.", func() float64 {
+		stats := cache.Stats()
+		if stats.Hits+stats.Misses == 0 {
+			return 0
+		}
+		return float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	})
+	registry.NewGaugeFunc("cache_entries", "Responses in the response cache.", func() float64 {
+		return float64(cache.Stats().Entries)
+	})
+	registry.NewGaugeFunc("cache_bytes", "Size in bytes of the responses in the response cache.", func() float64 {
+		return float64(cache.Stats().Bytes)
+	})
+}
+
+// routeTemplate returns the path template of the route the request
+// matched, or "unmatched".
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// imageFormat returns the format of an image media type, e.g. "png" for
+// image/png, or "" for other media types.
+func imageFormat(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !strings.HasPrefix(mediaType, "image/") {
+		return ""
+	}
+	return strings.TrimPrefix(mediaType, "image/")
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/metrics"
+	"github.com/gorilla/mux"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Handle("/test/bans/{ip}", MetricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeLimitExceeded(w, r, LimitTypeQuota, LimitStatus{Limit: 1})
+	})))
+
+	for i := 0; i < 2; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/test/bans/192.0.2.1", nil))
+	}
+
+	var out strings.Builder
+	metrics.Default.Write(&out)
+	for _, line := range []string{
+		`http_requests_total{method="DELETE",route="/test/bans/{ip}",status="429"} 2`,
+		`http_request_duration_seconds_count{method="DELETE",route="/test/bans/{ip}"} 2`,
+		`http_requests_in_flight{route="/test/bans/{ip}"} 0`,
+		`limit_rejections_total{limit_type="quota",route="/test/bans/{ip}"} 2`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("metrics are missing %q", line)
+		}
+	}
+}
+
+func TestRegisterCacheMetrics(t *testing.T) {
+	cache := NewLRUCache(1 << 20)
+	cache.Set("a", &CachedResponse{Status: http.StatusOK, Body: []byte("hello")}, time.Minute)
+	cache.Get("a")
+	cache.Get("b")
+
+	registry := metrics.NewRegistry()
+	RegisterCacheMetrics(registry, cache)
+	var out strings.Builder
+	registry.Write(&out)
+
+	for _, line := range []string{"cache_hits_total 1", "cache_misses_total 1", "cache_hit_ratio 0.5", "cache_entries 1"} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// PlanConfig configures the plan middleware.
+type PlanConfig struct {
+	// Plans gives the operations and image sizes each subscription plan
+	// allows.
+	Plans models.PlanCatalog
+
+	// Operations lists the image operations, the last segment of the
+	// request path, restricted by the plans. Other requests are not.
+	Operations []string
+}
+
+// DefaultPlanConfig returns the default plan configuration: the default
+// plans, restricting the convert, resize and crop operations.
+func DefaultPlanConfig() PlanConfig {
+	return PlanConfig{
+		Plans:      models.DefaultPlanCatalog(),
+		Operations: []string{"convert", "resize", "crop"},
+	}
+}
+
+// NewPlanMiddleware returns a middleware rejecting image requests outside
+// the user's plan: operations the plan does not include, and uploads larger
+// than it allows. It must run after authentication and before the cost
+// middleware, so oversized uploads are rejected before they are read.
+func NewPlanMiddleware(config PlanConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Only image operations of users with a plan are restricted
+			plan, op, ok := requestPlan(config, r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Check the operation is included in the plan
+			if !plan.AllowsOperation(op) {
+				writeError(w, http.StatusForbidden, fmt.Sprintf("The %s operation is not included in the %s plan.", op, plan.Name))
+				return
+			}
+
+			// Check the upload is within the plan's size limit, stopping
+			// the middleware after this one from reading any further
+			if plan.MaxImageBytes > 0 {
+				if r.ContentLength > plan.MaxImageBytes {
+					writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Images are limited to %d bytes on the %s plan.", plan.MaxImageBytes, plan.Name))
+					return
+				}
+				if r.Body != nil {
+					r.Body = http.MaxBytesReader(w, r.Body, plan.MaxImageBytes)
+				}
+			}
+
+			// Serve the request
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NewPlanImageMiddleware returns a middleware rejecting images with more
+// megapixels than the user's plan allows, or whose dimensions cannot be
+// read when the plan limits them. It must run after the cost
+// middleware, which reads the image dimensions, and before the rate limit
+// and quota middleware, so rejected requests are not charged.
+func NewPlanImageMiddleware(config PlanConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			plan, _, ok := requestPlan(config, r)
+			cost, costed := r.Context().Value(costContextKey).(*requestCost)
+			if ok && costed && plan.MaxMegapixels > 0 {
+				if !cost.measured {
+					writeError(w, http.StatusUnsupportedMediaType, "Unable to read the dimensions of the image.")
+					return
+				}
+				if cost.megapixels > plan.MaxMegapixels {
+					writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Images are limited to %g megapixels on the %s plan.", plan.MaxMegapixels, plan.Name))
+					return
+				}
+			}
+
+			// Serve the request
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestPlan returns the plan of the request's user and the image
+// operation requested. It reports false for requests the plans do not
+// restrict.
+func requestPlan(config PlanConfig, r *http.Request) (models.Plan, string, bool) {
+	user, _ := UserFromContext(r.Context())
+	plan, ok := config.Plans.PlanFor(user)
+	op := operation(r)
+	if !ok || !containsString(config.Operations, op) {
+		return models.Plan{}, op, false
+	}
+	return plan, op, true
+}
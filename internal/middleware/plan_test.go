@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+func TestPlanMiddleware(t *testing.T) {
+	config := DefaultPlanConfig()
+	config.Plans = models.PlanCatalog{
+		"free": {Operations: []string{"resize"}, MaxImageBytes: 1 << 20, MaxMegapixels: 1},
+	}
+	handler := NewPlanMiddleware(config)(NewCostMiddleware(DefaultCostConfig())(NewPlanImageMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))))
+
+	tests := []struct {
+		name   string
+		path   string
+		width  int
+		status int
+	}{
+		{"included operation", "/api/v1/image/resize", 100, http.StatusOK},
+		{"excluded operation", "/api/v1/image/crop", 100, http.StatusForbidden},
+		{"too many megapixels", "/api/v1/image/resize", 2000, http.StatusRequestEntityTooLarge},
+		{"other request", "/api/v1/hello", 2000, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(encodePNG(t, tt.width, 1000)))
+			req = req.WithContext(WithIdentity(req.Context(), &Identity{User: &models.User{ID: "user-1"}}))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestPlanMiddleware_UnknownSubscription(t *testing.T) {
+	config := DefaultPlanConfig()
+	config.Plans = models.PlanCatalog{
+		"free": {Operations: []string{"resize"}},
+	}
+	handler := NewPlanMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Subscriptions missing from the catalog are held to the free plan
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/image/crop", bytes.NewReader(encodePNG(t, 10, 10)))
+	req = req.WithContext(WithIdentity(req.Context(), &Identity{User: &models.User{ID: "user-1", Subscription: "platinum"}}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	io.Reader
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func TestPlanMiddleware_OversizedUploadNotBuffered(t *testing.T) {
+	config := DefaultPlanConfig()
+	config.Plans = models.PlanCatalog{
+		"free": {Operations: []string{"resize"}, MaxImageBytes: 1 << 20},
+	}
+	handler := NewPlanMiddleware(config)(NewCostMiddleware(DefaultCostConfig())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("oversized upload reached the handler")
+	})))
+
+	// The upload has no Content-Length, so it is only caught while read
+	body := &countingReader{Reader: bytes.NewReader(make([]byte, 8<<20))}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/image/resize", body)
+	req.ContentLength = -1
+	req = req.WithContext(WithIdentity(req.Context(), &Identity{User: &models.User{ID: "user-1"}}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	if body.read > 2<<20 {
+		t.Errorf("read %d bytes of an upload over the 1 MB plan limit", body.read)
+	}
+}
+
+func TestPlanImageMiddleware_LargeUploads(t *testing.T) {
+	config := DefaultPlanConfig()
+	config.Plans = models.PlanCatalog{
+		"free": {Operations: []string{"resize"}, MaxMegapixels: 1},
+	}
+	costConfig := DefaultCostConfig()
+	costConfig.MaxBodyBytes = 64
+	handler := NewCostMiddleware(costConfig)(NewPlanImageMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	tests := []struct {
+		name   string
+		body   []byte
+		status int
+	}{
+		{"small image", encodePNG(t, 100, 1000), http.StatusOK},
+		{"too many megapixels", encodePNG(t, 2000, 1000), http.StatusRequestEntityTooLarge},
+		{"unreadable dimensions", bytes.Repeat([]byte("x"), 1000), http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each body is larger than the cost middleware buffers
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/image/resize", bytes.NewReader(tt.body))
+			req = req.WithContext(WithIdentity(req.Context(), &Identity{User: &models.User{ID: "user-1"}}))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+		})
+	}
+}
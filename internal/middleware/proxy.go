@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IPNetworks is a list of IP networks, such as an allowlist or the set of
+// trusted proxies.
+type IPNetworks []*net.IPNet
+
+// TrustedProxies is the set of networks whose forwarding headers
+// (X-Forwarded-For, X-Forwarded-Proto, ...) are believed.
+type TrustedProxies = IPNetworks
+
+// ParseIPNetworks parses a list of CIDRs or single IP addresses.
+func ParseIPNetworks(values []string) (IPNetworks, error) {
+	networks := make(IPNetworks, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		// Treat single addresses as a network of one
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP network %q: %w", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ParseTrustedProxies parses a list of trusted proxy CIDRs or addresses.
+func ParseTrustedProxies(values []string) (TrustedProxies, error) {
+	return ParseIPNetworks(values)
+}
+
+// Contains reports whether ip belongs to one of the networks.
+func (n IPNetworks) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustsRequest reports whether the request came directly from a trusted
+// proxy, so its forwarding headers can be believed.
+func (n IPNetworks) TrustsRequest(r *http.Request) bool {
+	return n.Contains(remoteIP(r))
+}
+
+// ClientIP returns the IP address of the client that made the request.
+// X-Forwarded-For is walked from the nearest hop outwards, skipping trusted
+// proxies, so a client cannot spoof its address by sending the header
+// itself. Without trusted proxies this is the direct peer's address.
+func ClientIP(r *http.Request, proxies TrustedProxies) net.IP {
+	ip := remoteIP(r)
+	if !proxies.Contains(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// A malformed entry cannot be trusted or walked past
+			break
+		}
+		ip = hop
+		if !proxies.Contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// remoteIP returns the IP address of the direct peer of the request.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -1,73 +1,437 @@
 package middleware
 
 import (
-	"fmt"
+	"context"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// Quota response headers.
+const (
+	QuotaUsedHeader    = "X-Quota-Used"
+	QuotaLimitHeader   = "X-Quota-Limit"
+	QuotaResetHeader   = "X-Quota-Reset"
+	QuotaWarningHeader = "X-Quota-Warning"
+	QuotaOverageHeader = "X-Quota-Overage"
 )
 
-// UserQuota stores the usage and limit information for a user
-type UserQuota struct {
-	Usage  int64
-	Limit  int64
-	Last   time.Time
-	Tokens int64
+// QuotaConfig configures the quota middleware. Quotas are the number of
+// requests, or units of cost, allowed per monthly billing period.
+type QuotaConfig struct {
+	// Store persists the usage counters, so usage survives deploys and is
+	// shared by all instances. It defaults to an in-memory store.
+	Store CounterStore
+
+	// DefaultLimit applies to anonymous clients and to users without their
+	// own quota (models.User.Quota) or a plan with one. Zero or less is
+	// unlimited.
+	DefaultLimit int64
+
+	// Plans gives the quota of each subscription plan, and whether usage
+	// over it is billed instead of blocked.
+	Plans models.PlanCatalog
+
+	// WarnAt lists the percentages of the quota at which clients are
+	// warned with the X-Quota-Warning header, and Warn is called once per
+	// billing period.
+	WarnAt []int
+	Warn   func(key string, percent int)
+
+	// FlushEvery and FlushInterval bound how much usage an instance counts
+	// locally before writing it to the store: at most FlushEvery units or
+	// FlushInterval.
+	FlushEvery    int64
+	FlushInterval time.Duration
+
+	// Retention is how long usage counters are kept after their billing
+	// period ends.
+	Retention time.Duration
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// DefaultQuotaConfig returns the default quota configuration: the monthly
+// quotas of the default plans, and warnings at 80%, 90% and 100%.
+func DefaultQuotaConfig() QuotaConfig {
+	return QuotaConfig{
+		DefaultLimit: 1000,
+		Plans:        models.DefaultPlanCatalog(),
+		WarnAt:       []int{80, 90, 100},
+		Warn: func(key string, percent int) {
+			logging.Default().Warn("Quota warning", "client", key, "percent", percent)
+		},
+		FlushEvery:    20,
+		FlushInterval: 10 * time.Second,
+		Retention:     90 * 24 * time.Hour,
+		Now:           time.Now,
+	}
 }
 
-// QuotaMiddleware is a middleware function that enforces a quota
-// for each user based on a token bucket algorithm.
+// QuotaMiddleware is a middleware function that enforces a monthly quota
+// for each user with the default configuration.
 func QuotaMiddleware(next http.Handler) http.Handler {
-	// Your quota middleware logic goes here
-	// Use a sync.Map to store the UserQuota information for each user
-	userQuotas := new(sync.Map)
+	return NewQuotaMiddleware(DefaultQuotaConfig())(next)
+}
 
-	// Return the middleware function
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the user's ID from the request
-		userID := "someUserID" // Replace this with your code to extract the user ID from the request
+// NewQuotaMiddleware returns a quota middleware with the given
+// configuration. Its usage is only written to the store while requests are
+// counted, every FlushEvery units or once FlushInterval has passed, so
+// usage counted since the last write is lost on shutdown. Use a Quota to
+// also write it periodically and on Close.
+func NewQuotaMiddleware(config QuotaConfig) func(http.Handler) http.Handler {
+	return newQuota(config).Middleware
+}
 
-		// Get or create the user's quota information
-		userQuota, _ := userQuotas.LoadOrStore(userID, &UserQuota{
-			Usage:  0,
-			Limit:  100000000, // Replace with your desired limit
-			Last:   time.Now(),
-			Tokens: 5, // Replace with your desired initial tokens
-		})
+// Quota enforces the monthly quotas. Usage is counted per authenticated
+// user, or per client IP for anonymous requests, and resets on each user's
+// billing anniversary (models.User.BillingAnchor), or at the start of each
+// calendar month. Each instance counts usage locally and writes it to the
+// store every FlushEvery units, every FlushInterval, and on Close.
+type Quota struct {
+	config   QuotaConfig
+	counters *quotaCounters
 
-		// Calculate the time elapsed since the last request
-		elapsed := time.Since(userQuota.(*UserQuota).Last)
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
 
-		// Calculate the number of tokens that should be added to the bucket
-		addTokens := int64(elapsed.Seconds() * float64(userQuota.(*UserQuota).Limit) / 3600)
+// NewQuota creates a new Quota and starts writing its usage to the store
+// every FlushInterval.
+func NewQuota(config QuotaConfig) *Quota {
+	q := newQuota(config)
+	go q.run()
+	return q
+}
 
-		// Add the tokens to the bucket, up to the maximum limit
-		userQuota.(*UserQuota).Tokens = min(userQuota.(*UserQuota).Tokens+addTokens, userQuota.(*UserQuota).Limit)
+// newQuota creates a new Quota without starting its periodic flush.
+func newQuota(config QuotaConfig) *Quota {
+	if config.Store == nil {
+		config.Store = NewMemoryCounterStore()
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	sort.Ints(config.WarnAt)
+	q := &Quota{
+		config: config,
+		counters: &quotaCounters{
+			config:  config,
+			periods: make(map[string]*quotaPeriod),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	return q
+}
 
-		// Check if the request can be served
-		if userQuota.(*UserQuota).Tokens > 0 {
-			// Serve the request
-			userQuota.(*UserQuota).Tokens--
-			userQuota.(*UserQuota).Usage++
-			userQuota.(*UserQuota).Last = time.Now()
+// Close stops the periodic flush and writes the pending usage of every
+// key to the store. Usage counted afterwards is still written as it is
+// counted.
+func (q *Quota) Close() {
+	q.closeOnce.Do(func() {
+		close(q.stop)
+		<-q.done
+		q.counters.flushAll()
+	})
+}
 
-			// Print the quota information
-			fmt.Printf("User %s: %d/%d tokens, %d/%d requests\n", userID, userQuota.(*UserQuota).Tokens, userQuota.(*UserQuota).Limit, userQuota.(*UserQuota).Usage, userQuota.(*UserQuota).Limit)
+// run writes the pending usage to the store every FlushInterval until the
+// Quota is closed.
+func (q *Quota) run() {
+	defer close(q.done)
+	if q.config.FlushInterval <= 0 {
+		<-q.stop
+		return
+	}
 
-			next.ServeHTTP(w, r)
+	ticker := time.NewTicker(q.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.counters.flushAll()
+		case <-q.stop:
 			return
 		}
+	}
+}
+
+// Middleware is a middleware function that enforces the quotas. It must run
+// after authentication and after the cost middleware.
+func (q *Quota) Middleware(next http.Handler) http.Handler {
+	config, quotas := q.config, q.counters
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user's quota and billing period
+		now := config.Now()
+		user, _ := UserFromContext(r.Context())
+		limit, metered := config.limitFor(user)
+		var anchor time.Time
+		if user != nil {
+			anchor = user.BillingAnchor
+		}
+		start, end := models.BillingPeriod(anchor, now)
+
+		// Charge the request's estimated cost against the quota
+		key := clientKey(r)
+		cost, _ := r.Context().Value(costContextKey).(*requestCost)
+		units := RequestCost(r.Context())
+		usage, allowed := quotas.charge(key, start, end, units, limit, metered)
+
+		// Report the quota status on the response
+		setQuotaHeaders(w, usage, limit, now)
+		for i := len(config.WarnAt) - 1; i >= 0 && limit > 0; i-- {
+			if usage.used*100 >= int64(config.WarnAt[i])*limit {
+				w.Header().Set(QuotaWarningHeader, strconv.Itoa(config.WarnAt[i]))
+				break
+			}
+		}
+		if usage.warn > 0 && config.Warn != nil {
+			config.Warn(key, usage.warn)
+		}
+
+		if !allowed {
+			// Return an error response if the quota has been exceeded
+			writeLimitExceeded(w, r, LimitTypeQuota, quotaStatus(usage, limit, now))
+			return
+		}
+
+		// Charge the difference once the actual cost is known
+		if cost != nil {
+			cost.onReconcile(func(delta int64) {
+				quotas.charge(key, start, end, delta, 0, true)
+			})
+		}
 
-		// Return an error response if the quota has been exceeded
-		http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+		// Serve the request
+		next.ServeHTTP(w, r)
 	})
+}
+
+// limitFor returns the user's quota and whether usage over it is billed
+// rather than blocked.
+func (c QuotaConfig) limitFor(user *models.User) (int64, bool) {
+	if user == nil {
+		return c.DefaultLimit, false
+	}
+
+	plan, _ := c.Plans.PlanFor(user)
+	if user.Quota > 0 {
+		return int64(user.Quota), plan.Metered
+	}
+	if plan.Quota > 0 {
+		return plan.Quota, plan.Metered
+	}
+	return c.DefaultLimit, plan.Metered
+}
+
+// quotaUsage is a snapshot of a key's usage in a billing period.
+type quotaUsage struct {
+	used       int64
+	start, end time.Time
 
+	// warn is the warning threshold crossed by this request, if any
+	warn int
 }
 
-// min returns the smaller of two integers
-func min(a, b int64) int64 {
-	if a < b {
-		return a
+// quotaPeriod is an instance's view of a key's usage in a billing period.
+type quotaPeriod struct {
+	mu sync.Mutex
+
+	start, end time.Time
+
+	// used is the usage in the store plus pending
+	used int64
+
+	// pending is the usage not yet written to the store
+	pending   int64
+	loaded    bool
+	lastFlush time.Time
+
+	// warned is the highest warning threshold crossed
+	warned int
+}
+
+// quotaCounters holds the usage of each user or client IP in their
+// current billing period, persisted in the configured store.
+type quotaCounters struct {
+	config QuotaConfig
+
+	mu      sync.Mutex
+	periods map[string]*quotaPeriod
+}
+
+// charge adds units to the key's usage in the billing period from start to
+// end, unless that would exceed a positive limit and the usage is not
+// metered. It returns the resulting usage and whether the units were
+// charged.
+func (q *quotaCounters) charge(key string, start, end time.Time, units, limit int64, metered bool) (quotaUsage, bool) {
+	period := q.period(key)
+	period.mu.Lock()
+	defer period.mu.Unlock()
+
+	now := q.config.Now()
+
+	// Start afresh on the billing anniversary
+	if !period.start.Equal(start) {
+		q.flush(key, period, now)
+		period.start, period.end = start, end
+		period.used, period.pending, period.loaded, period.warned = 0, 0, false, 0
+	}
+
+	// Pick up the usage of earlier deploys and other instances
+	if !period.loaded {
+		q.load(key, period)
+	}
+
+	usage := quotaUsage{used: period.used, start: start, end: end}
+	if limit > 0 && period.used+units > limit && !metered {
+		return usage, false
+	}
+
+	period.used += units
+	period.pending += units
+	if period.pending >= q.config.FlushEvery || now.Sub(period.lastFlush) >= q.config.FlushInterval {
+		q.flush(key, period, now)
+	}
+	usage.used = period.used
+
+	// Warn once per period for each threshold crossed
+	for _, percent := range q.config.WarnAt {
+		if limit > 0 && percent > period.warned && period.used*100 >= int64(percent)*limit {
+			period.warned = percent
+			usage.warn = percent
+		}
+	}
+	return usage, true
+}
+
+// period returns the key's period state, creating it if needed. Periods of
+// keys idle since their billing period ended are forgotten.
+func (q *quotaCounters) period(key string) *quotaPeriod {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	period, ok := q.periods[key]
+	if !ok {
+		now := q.config.Now()
+		for key, period := range q.periods {
+			if period.mu.TryLock() {
+				idle := period.pending == 0 && !now.Before(period.end)
+				period.mu.Unlock()
+				if idle {
+					delete(q.periods, key)
+				}
+			}
+		}
+		period = &quotaPeriod{}
+		q.periods[key] = period
+	}
+	return period
+}
+
+// flushAll writes the pending usage of every key to the store, and
+// forgets the keys idle since their billing period ended.
+func (q *quotaCounters) flushAll() {
+	q.mu.Lock()
+	keys := make([]string, 0, len(q.periods))
+	periods := make([]*quotaPeriod, 0, len(q.periods))
+	for key, period := range q.periods {
+		keys = append(keys, key)
+		periods = append(periods, period)
+	}
+	q.mu.Unlock()
+
+	now := q.config.Now()
+	for i, period := range periods {
+		period.mu.Lock()
+		q.flush(keys[i], period, now)
+		idle := period.pending == 0 && !now.Before(period.end)
+		period.mu.Unlock()
+
+		if idle {
+			q.mu.Lock()
+			if q.periods[keys[i]] == period {
+				delete(q.periods, keys[i])
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// load reads the key's usage for the period from the store. period.mu must
+// be held.
+func (q *quotaCounters) load(key string, period *quotaPeriod) {
+	total, err := q.increment(key, period, 0)
+	if err != nil {
+		logging.Default().Error("Quota store unavailable", "error", err)
+		return
+	}
+	period.used = total + period.pending
+	period.loaded = true
+}
+
+// flush writes the key's pending usage for the period to the store.
+// period.mu must be held.
+func (q *quotaCounters) flush(key string, period *quotaPeriod, now time.Time) {
+	period.lastFlush = now
+	if period.pending == 0 || period.start.IsZero() {
+		return
+	}
+
+	total, err := q.increment(key, period, period.pending)
+	if err != nil {
+		// Keep the usage pending and try again with the next flush
+		logging.Default().Error("Quota store unavailable", "error", err)
+		return
+	}
+	period.pending = 0
+	period.used = total
+	period.loaded = true
+}
+
+// increment adds delta to the key's usage counter for the period in the
+// store and returns its new value.
+func (q *quotaCounters) increment(key string, period *quotaPeriod, delta int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	counterKey := "quota:" + key + "@" + strconv.FormatInt(period.start.Unix(), 10)
+	return q.config.Store.IncrementCounter(ctx, counterKey, delta, period.end.Add(q.config.Retention))
+}
+
+// setQuotaHeaders sets the X-Quota headers and the RateLimit headers for
+// the quota.
+func setQuotaHeaders(w http.ResponseWriter, usage quotaUsage, limit int64, now time.Time) {
+	w.Header().Set(QuotaUsedHeader, strconv.FormatInt(usage.used, 10))
+	if limit <= 0 {
+		return
+	}
+	w.Header().Set(QuotaLimitHeader, strconv.FormatInt(limit, 10))
+	w.Header().Set(QuotaResetHeader, usage.end.UTC().Format(time.RFC3339))
+	if over := usage.used - limit; over > 0 {
+		w.Header().Set(QuotaOverageHeader, strconv.FormatInt(over, 10))
+	}
+	setLimitHeaders(w, quotaStatus(usage, limit, now))
+}
+
+// quotaStatus returns the status of a quota for the RateLimit headers.
+func quotaStatus(usage quotaUsage, limit int64, now time.Time) LimitStatus {
+	status := LimitStatus{
+		Limit:      limit,
+		Window:     usage.end.Sub(usage.start),
+		Reset:      usage.end.Sub(now),
+		RetryAfter: usage.end.Sub(now),
+	}
+	if usage.used < limit {
+		status.Remaining = limit - usage.used
 	}
-	return b
+	return status
 }
@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// newQuotaHandlerForTest returns a quota middleware around an OK handler
+// and a function serving a request as the user.
+func newQuotaHandlerForTest(config QuotaConfig) func(user *models.User) *httptest.ResponseRecorder {
+	handler := NewQuotaMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	return func(user *models.User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+		req = req.WithContext(WithIdentity(req.Context(), &Identity{User: user}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+}
+
+func newQuotaConfigForTest(clock *fakeClock) QuotaConfig {
+	store := NewMemoryCounterStore()
+	store.Now = clock.Now
+	config := DefaultQuotaConfig()
+	config.Store = store
+	config.Warn = nil
+	config.Now = clock.Now
+	return config
+}
+
+func TestQuotaMiddleware_Exceeded(t *testing.T) {
+	serve := newQuotaHandlerForTest(newQuotaConfigForTest(newFakeClock()))
+	user := &models.User{ID: "user-1", Subscription: "basic", Quota: 1}
+
+	rr := serve(user)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d, want 200", rr.Code)
+	}
+	if got := rr.Header().Get(QuotaUsedHeader); got != "1" {
+		t.Errorf("%s = %q, want 1", QuotaUsedHeader, got)
+	}
+	if got := rr.Header().Get(QuotaLimitHeader); got != "1" {
+		t.Errorf("%s = %q, want 1", QuotaLimitHeader, got)
+	}
+
+	rr = serve(user)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status = %d, want 429", rr.Code)
+	}
+	var payload models.Payload
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := payload.Data.(map[string]interface{})
+	if data["limit_type"] != LimitTypeQuota {
+		t.Errorf("limit_type = %v, want %q", data["limit_type"], LimitTypeQuota)
+	}
+}
+
+func TestQuotaMiddleware_MeteredOverage(t *testing.T) {
+	serve := newQuotaHandlerForTest(newQuotaConfigForTest(newFakeClock()))
+	user := &models.User{ID: "user-1", Subscription: "Pro", Quota: 2}
+
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		if rr = serve(user); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i+1, rr.Code)
+		}
+	}
+	if got := rr.Header().Get(QuotaOverageHeader); got != "1" {
+		t.Errorf("%s = %q, want 1", QuotaOverageHeader, got)
+	}
+}
+
+func TestQuotaMiddleware_UnknownSubscriptionGetsFreeQuota(t *testing.T) {
+	serve := newQuotaHandlerForTest(newQuotaConfigForTest(newFakeClock()))
+	user := &models.User{ID: "user-1", Subscription: "platinum"}
+
+	want := strconv.FormatInt(models.DefaultPlanCatalog()[models.FreePlan].Quota, 10)
+	if got := serve(user).Header().Get(QuotaLimitHeader); got != want {
+		t.Errorf("%s = %q, want %s", QuotaLimitHeader, got, want)
+	}
+}
+
+func TestQuotaMiddleware_Warnings(t *testing.T) {
+	config := newQuotaConfigForTest(newFakeClock())
+	config.WarnAt = []int{50, 100}
+	var warnings []int
+	config.Warn = func(key string, percent int) {
+		warnings = append(warnings, percent)
+	}
+	serve := newQuotaHandlerForTest(config)
+	user := &models.User{ID: "user-1", Quota: 4}
+
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		rr = serve(user)
+	}
+	if got := rr.Header().Get(QuotaWarningHeader); got != "50" {
+		t.Errorf("%s = %q, want 50", QuotaWarningHeader, got)
+	}
+	if len(warnings) != 1 || warnings[0] != 50 {
+		t.Errorf("warnings = %v, want [50]", warnings)
+	}
+}
+
+func TestQuotaMiddleware_ResetsOnBillingAnniversary(t *testing.T) {
+	clock := newFakeClock()
+	clock.now = time.Date(2023, 5, 14, 12, 0, 0, 0, time.UTC)
+	serve := newQuotaHandlerForTest(newQuotaConfigForTest(clock))
+	user := &models.User{
+		ID:            "user-1",
+		Quota:         1,
+		BillingAnchor: time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC),
+	}
+
+	if rr := serve(user); rr.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d, want 200", rr.Code)
+	}
+	if rr := serve(user); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status = %d, want 429", rr.Code)
+	}
+
+	clock.Advance(24 * time.Hour)
+	rr := serve(user)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("after the anniversary: status = %d, want 200", rr.Code)
+	}
+	if got, want := rr.Header().Get(QuotaResetHeader), "2023-06-15T00:00:00Z"; got != want {
+		t.Errorf("%s = %q, want %q", QuotaResetHeader, got, want)
+	}
+}
+
+func TestQuotaMiddleware_PersistsAcrossInstances(t *testing.T) {
+	clock := newFakeClock()
+	config := newQuotaConfigForTest(clock)
+	config.FlushEvery = 1
+	user := &models.User{ID: "user-1", Quota: 2}
+
+	// Two instances sharing a store count the same usage
+	first := newQuotaHandlerForTest(config)
+	second := newQuotaHandlerForTest(config)
+	first(user)
+	first(user)
+	if rr := second(user); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d on another instance, want 429", rr.Code)
+	}
+}
+
+// storedUsage returns the user's usage in the store for the current
+// billing period.
+func storedUsage(t *testing.T, config QuotaConfig, userID string) int64 {
+	t.Helper()
+	start, end := models.BillingPeriod(time.Time{}, config.Now())
+	key := "quota:user:" + userID + "@" + strconv.FormatInt(start.Unix(), 10)
+	total, err := config.Store.IncrementCounter(context.Background(), key, 0, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return total
+}
+
+// serveQuota serves a request of the user through the quota.
+func serveQuota(quota *Quota, user *models.User) {
+	handler := quota.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+	req = req.WithContext(WithIdentity(req.Context(), &Identity{User: user}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestQuota_CloseFlushesPendingUsage(t *testing.T) {
+	config := newQuotaConfigForTest(newFakeClock())
+	config.FlushInterval = time.Hour
+	quota := NewQuota(config)
+	user := &models.User{ID: "user-1"}
+
+	// The usage stays pending, below FlushEvery and FlushInterval
+	for i := 0; i < 3; i++ {
+		serveQuota(quota, user)
+	}
+	if got := storedUsage(t, config, user.ID); got != 0 {
+		t.Errorf("stored usage before Close = %d, want 0", got)
+	}
+
+	quota.Close()
+	if got := storedUsage(t, config, user.ID); got != 3 {
+		t.Errorf("stored usage after Close = %d, want 3", got)
+	}
+}
+
+func TestQuota_FlushesPendingUsagePeriodically(t *testing.T) {
+	config := DefaultQuotaConfig()
+	config.Store = NewMemoryCounterStore()
+	config.Warn = nil
+	config.FlushInterval = 20 * time.Millisecond
+	quota := NewQuota(config)
+	defer quota.Close()
+	user := &models.User{ID: "user-1"}
+
+	// Usage pending after the requests stop is written without another
+	for i := 0; i < 3; i++ {
+		serveQuota(quota, user)
+	}
+	deadline := time.Now().Add(time.Second)
+	for storedUsage(t, config, user.ID) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stored usage = %d after a second, want 3", storedUsage(t, config, user.ID))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQuotaMiddleware_FlushesAsCounted(t *testing.T) {
+	config := newQuotaConfigForTest(newFakeClock())
+	config.FlushEvery = 2
+	config.FlushInterval = time.Hour
+	serve := newQuotaHandlerForTest(config)
+	user := &models.User{ID: "user-1"}
+
+	// Without a Quota to close, usage is written every FlushEvery units
+	serve(user)
+	if got := storedUsage(t, config, user.ID); got != 0 {
+		t.Errorf("stored usage after one request = %d, want 0", got)
+	}
+	serve(user)
+	if got := storedUsage(t, config, user.ID); got != 2 {
+		t.Errorf("stored usage after two requests = %d, want 2", got)
+	}
+}
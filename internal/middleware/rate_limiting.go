@@ -2,69 +2,156 @@ package middleware
 
 import (
 	"net/http"
-	"sync"
 	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/gorilla/mux"
 )
 
-// RateLimiter stores the usage and limit information for a rate-limited endpoint
-type RateLimiter struct {
-	Usage int64
-	Limit int64
-	Last  time.Time
-	Mutex sync.Mutex
+// RateLimitConfig configures the rate limiting middleware. Limits are the
+// number of requests allowed per Period, which is also the burst size.
+type RateLimitConfig struct {
+	// Limiter applies the limits. When nil, one is created for Algorithm
+	// with Period, IdleTimeout and Now.
+	Limiter   Limiter
+	Algorithm string
+
+	// Period is the window the limits are expressed over.
+	Period time.Duration
+
+	// DefaultLimit applies to anonymous clients and to users without their
+	// own limit or a plan with one.
+	DefaultLimit int64
+
+	// Plans gives the limit of each subscription plan. A user's own
+	// RateLimit takes precedence.
+	Plans models.PlanCatalog
+
+	// Routes maps a route path template (e.g. "/api/v1/image/resize") to a
+	// limit that replaces the user's limit on that route. Overridden routes
+	// are counted separately from the rest of the API.
+	Routes map[string]int64
+
+	// RouteLimiters maps a route path template to the limiter used on that
+	// route instead of Limiter, e.g. a ConcurrencyLimiter for expensive
+	// routes. Like Routes, these routes are counted separately.
+	RouteLimiters map[string]Limiter
+
+	// IdleTimeout is how long a limiter is kept after its last request.
+	IdleTimeout time.Duration
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// DefaultRateLimitConfig returns the default rate limit configuration:
+// 32 requests per second, or the limits of the default plans.
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Algorithm:    AlgorithmTokenBucket,
+		Period:       time.Second,
+		DefaultLimit: 32,
+		Plans:        models.DefaultPlanCatalog(),
+		IdleTimeout:  10 * time.Minute,
+		Now:          time.Now,
+	}
 }
 
 // RateLimitingMiddleware is a middleware function that checks the
 // request against a rate limit policy. If the request exceeds the
 // rate limit, the middleware returns an error response.
 func RateLimitingMiddleware(next http.Handler) http.Handler {
-	// Your rate limiting middleware logic goes here
-	// Use a sync.Map to store the RateLimiter information for each endpoint
-	endpointLimiters := new(sync.Map)
-
-	// Return the middleware function
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the endpoint's URL from the request
-		endpoint := r.URL.Path
-
-		// Get or create the endpoint's rate limiter
-		endpointLimiter, _ := endpointLimiters.LoadOrStore(endpoint, &RateLimiter{
-			Usage: 0,
-			Limit: 32, // Replace with new limit
-			Last:  time.Now(),
-		})
-
-		// Acquire a mutex lock to avoid race conditions
-		endpointLimiter.(*RateLimiter).Mutex.Lock()
-		defer endpointLimiter.(*RateLimiter).Mutex.Unlock()
+	return NewRateLimitingMiddleware(DefaultRateLimitConfig())(next)
+}
 
-		// Calculate the time elapsed since the last request
-		elapsed := time.Since(endpointLimiter.(*RateLimiter).Last)
+// NewRateLimitingMiddleware returns a rate limiting middleware with the
+// given configuration. Requests are counted per authenticated user, or per
+// client IP for anonymous requests, so it must run after authentication.
+// It panics if Algorithm is unknown and no Limiter is given.
+func NewRateLimitingMiddleware(config RateLimitConfig) func(http.Handler) http.Handler {
+	if config.Limiter == nil {
+		limiter, err := NewLimiter(config.Algorithm, LimiterConfig{
+			Period:      config.Period,
+			IdleTimeout: config.IdleTimeout,
+			Now:         config.Now,
+		})
+		if err != nil {
+			panic(err)
+		}
+		config.Limiter = limiter
+	}
 
-		// Calculate the number of requests that should be allowed
-		numRequests := int64(elapsed.Seconds() * float64(endpointLimiter.(*RateLimiter).Limit))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Find who is calling, what they are allowed and which limiter applies
+			limiter, key, limit := config.limiterFor(r)
 
-		// Update the rate limiter information
-		endpointLimiter.(*RateLimiter).Usage = max(endpointLimiter.(*RateLimiter).Usage-numRequests, 0) + 1
-		endpointLimiter.(*RateLimiter).Last = time.Now()
+			// Check if the request can be served. Limits without a window,
+			// such as concurrency caps, have no RateLimit headers.
+			decision := allowRequest(r, limiter, key, limit)
+			if decision.Status.Window > 0 {
+				setLimitHeaders(w, decision.Status)
+			}
+			if !decision.Allowed {
+				// Return an error response if the rate limit has been exceeded
+				writeLimitExceeded(w, r, LimitTypeRateLimit, decision.Status)
+				return
+			}
 
-		// Check if the request can be served
-		if endpointLimiter.(*RateLimiter).Usage <= endpointLimiter.(*RateLimiter).Limit {
 			// Serve the request
+			defer decision.Release()
 			next.ServeHTTP(w, r)
-			return
+		})
+	}
+}
+
+// limiterFor returns the limiter, key and limit for the request.
+func (c RateLimitConfig) limiterFor(r *http.Request) (Limiter, string, int64) {
+	// Count authenticated users by ID, everyone else by client IP
+	key := clientKey(r)
+	limiter := c.Limiter
+	limit := c.DefaultLimit
+	if user, ok := UserFromContext(r.Context()); ok {
+		if user.RateLimit > 0 {
+			limit = int64(user.RateLimit)
+		} else if plan, ok := c.Plans.PlanFor(user); ok && plan.RateLimit > 0 {
+			limit = plan.RateLimit
 		}
+	}
 
-		// Return an error response if the rate limit has been exceeded
-		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
-	})
+	// Overridden routes get their own count
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return limiter, key, limit
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return limiter, key, limit
+	}
+	routeLimit, hasLimit := c.Routes[template]
+	routeLimiter, hasLimiter := c.RouteLimiters[template]
+	if hasLimit {
+		limit = routeLimit
+	}
+	if hasLimiter {
+		limiter = routeLimiter
+	}
+	if hasLimit || hasLimiter {
+		key += " " + template
+	}
 
+	return limiter, key, limit
 }
 
-// max returns the larger of two integers
-func max(a, b int64) int64 {
-	if a > b {
-		return a
+// clientKey identifies who made the request for counting: the
+// authenticated user, or the client IP for anonymous requests.
+func clientKey(r *http.Request) string {
+	if user, ok := UserFromContext(r.Context()); ok {
+		return "user:" + user.ID
+	}
+	ip, ok := ClientIPFromContext(r.Context())
+	if !ok {
+		ip = remoteIP(r)
 	}
-	return b
+	return "ip:" + ip.String()
 }
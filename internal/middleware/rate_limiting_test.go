@@ -3,9 +3,11 @@ package middleware
 import (
 	"net/http"
 	"net/http/httptest"
-	"sync"
 	"testing"
 	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/gorilla/mux"
 )
 
 func TestRateLimitingMiddleware(t *testing.T) {
@@ -19,7 +21,7 @@ func TestRateLimitingMiddleware(t *testing.T) {
 
 	// Call the middleware function with the mock handler and the new request
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(RateLimitingMiddleware(mockHandler))
+	handler := RateLimitingMiddleware(mockHandler)
 	handler.ServeHTTP(rr, req)
 
 	// Assert that the middleware function returns the expected response status code
@@ -37,20 +39,23 @@ func TestRateLimitingMiddleware_RateLimitExceeded(t *testing.T) {
 	// Create a new request with a URL that matches the rate-limited endpoint
 	req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
 
-	// Create a rate limiter with a usage that exceeds the limit
-	rateLimiter := &RateLimiter{
-		Usage: 33,
-		Limit: 32,
-		Last:  time.Now().Add(-1 * time.Minute),
+	// Create a rate limiter whose limit for the client has been used up
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	rateLimiter := NewTokenBucket(LimiterConfig{
+		Period: time.Minute,
+		Now:    func() time.Time { return now },
+	})
+	for i := 0; i < 32; i++ {
+		rateLimiter.Allow("ip:192.0.2.1", 32)
 	}
 
-	// Use a sync.Map to store the rate limiter information for the endpoint
-	endpointLimiters := new(sync.Map)
-	endpointLimiters.Store("/example", rateLimiter)
+	// Inject the rate limiter into the middleware
+	config := DefaultRateLimitConfig()
+	config.Limiter = rateLimiter
 
 	// Call the middleware function with the mock handler and the new request
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(RateLimitingMiddleware(mockHandler))
+	handler := NewRateLimitingMiddleware(config)(mockHandler)
 	handler.ServeHTTP(rr, req)
 
 	// Assert that the middleware function returns the expected response status code
@@ -58,3 +63,91 @@ func TestRateLimitingMiddleware_RateLimitExceeded(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
 	}
 }
+
+func TestRateLimitingMiddleware_PerUser(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	config := DefaultRateLimitConfig()
+	config.DefaultLimit = 2
+	config.Plans = models.PlanCatalog{"pro": {RateLimit: 3}}
+	config.Now = func() time.Time { return now }
+	handler := NewRateLimitingMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(user *models.User) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+		if user != nil {
+			req = req.WithContext(WithIdentity(req.Context(), &Identity{User: user}))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	allowed := func(user *models.User) int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			if serve(user) == http.StatusOK {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Each user gets their own limit, from their account, their tier or
+	// the default, and one user exhausting theirs does not affect another
+	tests := []struct {
+		user *models.User
+		want int
+	}{
+		{&models.User{ID: "noisy"}, 2},
+		{&models.User{ID: "custom", RateLimit: 5}, 5},
+		{&models.User{ID: "pro", Subscription: "PRO"}, 3},
+		{nil, 2},
+	}
+	for _, tt := range tests {
+		if got := allowed(tt.user); got != tt.want {
+			t.Errorf("user %+v: allowed %d requests, want %d", tt.user, got, tt.want)
+		}
+	}
+
+	// Usage drains over the period
+	now = now.Add(config.Period)
+	if got := allowed(&models.User{ID: "noisy"}); got != 2 {
+		t.Errorf("after a period: allowed %d requests, want 2", got)
+	}
+}
+
+func TestRateLimitingMiddleware_RouteOverride(t *testing.T) {
+	config := DefaultRateLimitConfig()
+	config.DefaultLimit = 5
+	config.Routes = map[string]int64{"/api/v1/image/{op}": 1}
+	limit := NewRateLimitingMiddleware(config)
+
+	router := mux.NewRouter()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	router.Handle("/api/v1/image/{op}", limit(ok))
+	router.Handle("/api/v1/hello", limit(ok))
+
+	codes := func(path string, n int) []int {
+		var codes []int
+		for i := 0; i < n; i++ {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+			codes = append(codes, rr.Code)
+		}
+		return codes
+	}
+
+	if got := codes("/api/v1/image/resize", 2); got[0] != http.StatusOK || got[1] != http.StatusTooManyRequests {
+		t.Errorf("overridden route codes = %v, want [200 429]", got)
+	}
+
+	// The rest of the API is counted separately
+	for _, code := range codes("/api/v1/hello", 5) {
+		if code != http.StatusOK {
+			t.Errorf("default route code = %d, want 200", code)
+		}
+	}
+}
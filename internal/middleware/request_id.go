@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+)
+
+// RequestIDConfig configures the request ID middleware.
+type RequestIDConfig struct {
+	// TrustIncoming uses valid X-Request-ID headers sent by clients or
+	// proxies, so a request can be followed across services. Otherwise
+	// every request gets a new ID.
+	TrustIncoming bool
+}
+
+// DefaultRequestIDConfig returns the default request ID configuration,
+// which accepts valid incoming request IDs.
+func DefaultRequestIDConfig() RequestIDConfig {
+	return RequestIDConfig{
+		TrustIncoming: true,
+	}
+}
+
+// NewRequestIDMiddleware returns a middleware giving every request an ID:
+// the incoming X-Request-ID header when trusted and valid, or a new random
+// ID. The ID is stored in the request context (see requestid.FromContext)
+// and echoed in the X-Request-ID response header. It must come first in
+// the chain so every log line and error response carries the ID.
+func NewRequestIDMiddleware(config RequestIDConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(requestid.Header)
+			if !config.TrustIncoming || !requestid.Valid(id) {
+				id = requestid.New()
+			}
+
+			// Forward the ID in place of an invalid one, and echo it
+			r.Header.Set(requestid.Header, id)
+			w.Header().Set(requestid.Header, id)
+			next.ServeHTTP(w, r.WithContext(requestid.NewContext(r.Context(), id)))
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		trust    bool
+		keep     bool
+	}{
+		{"valid incoming", "client-id-1", true, true},
+		{"invalid incoming", "bad id", true, false},
+		{"untrusted incoming", "client-id-1", false, false},
+		{"missing", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := NewRequestIDMiddleware(RequestIDConfig{TrustIncoming: tt.trust})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = requestid.FromContext(r.Context())
+				writeError(w, http.StatusBadRequest, "Invalid request.")
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+			if tt.incoming != "" {
+				req.Header.Set(requestid.Header, tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			echoed := rr.Header().Get(requestid.Header)
+			if !requestid.Valid(seen) || echoed != seen {
+				t.Fatalf("context ID %q and echoed ID %q, want the same valid ID", seen, echoed)
+			}
+			if (seen == tt.incoming) != tt.keep {
+				t.Errorf("ID = %q with incoming %q, want kept = %v", seen, tt.incoming, tt.keep)
+			}
+
+			var payload models.Payload
+			json.NewDecoder(rr.Body).Decode(&payload)
+			if payload.RequestID != seen {
+				t.Errorf("error body request_id = %q, want %q", payload.RequestID, seen)
+			}
+		})
+	}
+}
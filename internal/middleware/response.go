@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+)
+
+// writeError writes a models.Payload error body with the given status code.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writePayload(w, status, models.Payload{
+		Status:  "error",
+		Message: message,
+	})
+}
+
+// writePayload encodes the payload as JSON and writes it with the given
+// status code.
+func writePayload(w http.ResponseWriter, status int, payload models.Payload) {
+	// Errors carry the request ID set by the request ID middleware
+	if payload.Status == "error" && payload.RequestID == "" {
+		payload.RequestID = w.Header().Get(requestid.Header)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(payload)
+}
+
+// statusWriter records the status code and the number of body bytes
+// written by the next handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+// WriteHeader records and writes the status code.
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records an implicit 200 OK and writes the data.
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client.
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
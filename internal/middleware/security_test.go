@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newSecurityHandler(t *testing.T, config SecurityConfig, contentType string) http.Handler {
+	t.Helper()
+	return NewSecurityMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestSecurityMiddleware_Headers(t *testing.T) {
+	handler := newSecurityHandler(t, DefaultSecurityConfig(), "application/json")
+
+	// Plain HTTP gets the security headers but not HSTS
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil))
+	for _, header := range []string{"X-Content-Type-Options", "Referrer-Policy", "Permissions-Policy", "Content-Security-Policy"} {
+		if rr.Header().Get(header) == "" {
+			t.Errorf("missing %s header", header)
+		}
+	}
+	if rr.Header().Get("Strict-Transport-Security") != "" {
+		t.Errorf("HSTS must not be sent over plain HTTP")
+	}
+
+	// HTTPS gets HSTS
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+	req.TLS = &tls.ConnectionState{}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got, want := rr.Header().Get("Strict-Transport-Security"), "max-age=31536000; includeSubDomains"; got != want {
+		t.Errorf("got HSTS %q want %q", got, want)
+	}
+
+	// The content security policy only applies to JSON
+	handler = newSecurityHandler(t, DefaultSecurityConfig(), "image/png")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil))
+	if rr.Header().Get("Content-Security-Policy") != "" {
+		t.Errorf("unexpected Content-Security-Policy on image response")
+	}
+}
+
+func TestSecurityMiddleware_EnforceHTTPS(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultSecurityConfig()
+	config.EnforceHTTPS = true
+	config.TrustedProxies = proxies
+	handler := newSecurityHandler(t, config, "application/json")
+
+	tests := []struct {
+		name       string
+		method     string
+		remoteAddr string
+		proto      string
+		want       int
+	}{
+		{"plain GET is redirected", http.MethodGet, "203.0.113.5:1234", "", http.StatusPermanentRedirect},
+		{"plain POST is rejected", http.MethodPost, "203.0.113.5:1234", "", http.StatusForbidden},
+		{"trusted proxy https", http.MethodPost, "10.1.2.3:1234", "https", http.StatusOK},
+		{"trusted single address https", http.MethodPost, "192.0.2.1:1234", "https", http.StatusOK},
+		{"trusted proxy http", http.MethodPost, "10.1.2.3:1234", "http", http.StatusForbidden},
+		{"spoofed by client behind proxy", http.MethodPost, "10.1.2.3:1234", "https, http", http.StatusForbidden},
+		{"untrusted peer claims https", http.MethodPost, "203.0.113.5:1234", "https", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://api.example.com/api/v1/hello?x=1", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("got status %d want %d", rr.Code, tt.want)
+			}
+			if rr.Code == http.StatusPermanentRedirect && rr.Header().Get("Location") != "https://api.example.com/api/v1/hello?x=1" {
+				t.Errorf("unexpected redirect location %q", rr.Header().Get("Location"))
+			}
+		})
+	}
+}
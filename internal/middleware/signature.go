@@ -0,0 +1,400 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	cache "github.com/patrickmn/go-cache"
+)
+
+// Request signing headers and formats. A signed request carries:
+//
+//	X-Date: 20230415T101500Z
+//	X-Nonce: <unique value per request>
+//	Authorization: HMAC-SHA256 Credential=<key id>, SignedHeaders=host;x-date;x-nonce, Signature=<hex>
+const (
+	SignatureAlgorithm   = "HMAC-SHA256"
+	SignatureDateHeader  = "X-Date"
+	SignatureNonceHeader = "X-Nonce"
+	SignatureDateFormat  = "20060102T150405Z"
+
+	// signatureScope is mixed into the derived signing key so a key derived
+	// for this service cannot be replayed against another one.
+	signatureScope = "api_request"
+
+	// maxNonceLength bounds the nonces kept in the replay cache
+	maxNonceLength = 128
+)
+
+// SigningKeyStore looks up request signing keys.
+// *repositories.FirestoreRepository satisfies this interface.
+type SigningKeyStore interface {
+	GetSigningKey(ctx context.Context, keyID string) (*models.SigningKey, error)
+}
+
+// SignatureConfig configures SignatureAuthenticator.
+type SignatureConfig struct {
+	// MaxSkew is how far the X-Date timestamp may be from the server clock
+	// in either direction.
+	MaxSkew time.Duration
+
+	// MaxBodyBytes bounds the request body read to compute the payload hash.
+	MaxBodyBytes int64
+
+	// RequiredHeaders are headers that must be covered by the signature.
+	RequiredHeaders []string
+
+	// Nonces, when set, remembers the nonces seen by every instance, so a
+	// signed request cannot be replayed against another instance. Without
+	// it, nonces are only remembered per instance. Requests are rejected
+	// while the store is unavailable.
+	Nonces CounterStore
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// DefaultSignatureConfig returns the default request signing configuration.
+func DefaultSignatureConfig() SignatureConfig {
+	return SignatureConfig{
+		MaxSkew:         5 * time.Minute,
+		MaxBodyBytes:    32 << 20,
+		RequiredHeaders: []string{"host", "x-date", "x-nonce"},
+		Now:             time.Now,
+	}
+}
+
+// SignatureAuthenticator authenticates requests signed with a shared HMAC
+// secret, as an alternative to sending an API key.
+type SignatureAuthenticator struct {
+	keys   SigningKeyStore
+	users  UserStore
+	config SignatureConfig
+	nonces *cache.Cache
+}
+
+// NewSignatureAuthenticator creates a new SignatureAuthenticator.
+func NewSignatureAuthenticator(keys SigningKeyStore, users UserStore, config SignatureConfig) *SignatureAuthenticator {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	// Nonces only need to be remembered for as long as their timestamp
+	// would still be accepted
+	window := 2 * config.MaxSkew
+
+	return &SignatureAuthenticator{
+		keys:   keys,
+		users:  users,
+		config: config,
+		nonces: cache.New(window, window),
+	}
+}
+
+// signatureCredentials are the fields of a signed Authorization header.
+type signatureCredentials struct {
+	KeyID         string
+	SignedHeaders []string
+	Signature     string
+}
+
+// Authenticate verifies the request signature and returns the identity of
+// the signing key's owner.
+func (a *SignatureAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	// Only handle requests using this scheme
+	creds, ok := parseSignatureAuthorization(r.Header.Get("Authorization"))
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	// Every required header must be covered by the signature
+	for _, required := range a.config.RequiredHeaders {
+		if !containsString(creds.SignedHeaders, strings.ToLower(required)) {
+			return nil, ErrInvalidCredentials
+		}
+	}
+
+	// Check the timestamp is within the allowed window
+	timestamp := r.Header.Get(SignatureDateHeader)
+	signedAt, err := time.Parse(SignatureDateFormat, timestamp)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if skew := a.config.Now().Sub(signedAt); skew > a.config.MaxSkew || skew < -a.config.MaxSkew {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Every signed request must carry a nonce
+	nonce := r.Header.Get(SignatureNonceHeader)
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Hash the body, leaving it readable for the next handler
+	payloadHash, err := hashRequestBody(r, a.config.MaxBodyBytes)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Look up the signing key
+	key, err := a.keys.GetSigningKey(r.Context(), creds.KeyID)
+	if err != nil || key == nil || key.Disabled {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Recompute the signature and compare in constant time
+	canonical := canonicalRequest(r, creds.SignedHeaders, payloadHash)
+	expected := computeSignature(key.Secret, timestamp, nonce, canonical)
+	provided, err := hex.DecodeString(creds.Signature)
+	if err != nil || !hmac.Equal(expected, provided) {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Reject nonces seen before. This happens after verification so that
+	// unsigned requests cannot fill the cache or burn legitimate nonces.
+	if !a.firstUse(r.Context(), creds.KeyID+":"+nonce) {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Resolve the user owning the key
+	user, err := a.users.GetUserByID(r.Context(), key.UserID)
+	if err != nil || !knownUser(user) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		User:   user,
+		Method: AuthMethodSignature,
+		KeyID:  creds.KeyID,
+	}, nil
+}
+
+// firstUse records the nonce and reports whether it was not seen before,
+// by this instance or, with a shared store, by any instance.
+func (a *SignatureAuthenticator) firstUse(ctx context.Context, nonce string) bool {
+	if err := a.nonces.Add(nonce, struct{}{}, cache.DefaultExpiration); err != nil {
+		return false
+	}
+	if a.config.Nonces == nil {
+		return true
+	}
+
+	// The nonce's timestamp is accepted for up to twice MaxSkew
+	count, err := a.config.Nonces.IncrementCounter(ctx, "nonce:"+nonce, 1, a.config.Now().Add(2*a.config.MaxSkew))
+	if err != nil {
+		logging.FromContext(ctx).Error("Nonce store unavailable", "error", err)
+		return false
+	}
+	return count == 1
+}
+
+// SignRequest signs r with the given key so that SignatureAuthenticator will
+// accept it. The X-Date and X-Nonce headers are set on the request, and the
+// body, if any, is read and replaced so it can still be sent.
+func SignRequest(r *http.Request, keyID, secret, nonce string, now time.Time) error {
+	timestamp := now.UTC().Format(SignatureDateFormat)
+	r.Header.Set(SignatureDateHeader, timestamp)
+	r.Header.Set(SignatureNonceHeader, nonce)
+
+	payloadHash, err := hashRequestBody(r, -1)
+	if err != nil {
+		return err
+	}
+
+	signedHeaders := []string{"host", "x-date", "x-nonce"}
+	if r.Header.Get("Content-Type") != "" {
+		signedHeaders = append(signedHeaders, "content-type")
+	}
+	sort.Strings(signedHeaders)
+
+	canonical := canonicalRequest(r, signedHeaders, payloadHash)
+	signature := computeSignature(secret, timestamp, nonce, canonical)
+
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, SignedHeaders=%s, Signature=%s",
+		SignatureAlgorithm, keyID, strings.Join(signedHeaders, ";"), hex.EncodeToString(signature)))
+	return nil
+}
+
+// parseSignatureAuthorization parses an Authorization header using the
+// HMAC-SHA256 scheme.
+func parseSignatureAuthorization(header string) (signatureCredentials, bool) {
+	var creds signatureCredentials
+
+	params, ok := strings.CutPrefix(header, SignatureAlgorithm+" ")
+	if !ok {
+		return creds, false
+	}
+
+	for _, part := range strings.Split(params, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		switch name {
+		case "Credential":
+			creds.KeyID = value
+		case "SignedHeaders":
+			creds.SignedHeaders = strings.Split(strings.ToLower(value), ";")
+		case "Signature":
+			creds.Signature = value
+		}
+	}
+
+	if creds.KeyID == "" || creds.Signature == "" || len(creds.SignedHeaders) == 0 {
+		return creds, false
+	}
+	return creds, true
+}
+
+// canonicalRequest builds the string that is hashed and signed:
+//
+//	METHOD
+//	/escaped/path
+//	sorted=query&string=values
+//	signed-header:value (one per line, sorted by name)
+//	signed-header;names
+//	hex(sha256(body))
+func canonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	names := make([]string, len(signedHeaders))
+	copy(names, signedHeaders)
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name)
+		headers.WriteString(":")
+		headers.WriteString(canonicalHeaderValue(r, name))
+		headers.WriteString("\n")
+	}
+
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		path,
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// canonicalHeaderValue returns the trimmed, comma-joined values of a header.
+// The Host header is read from r.Host, where net/http moves it.
+func canonicalHeaderValue(r *http.Request, name string) string {
+	if name == "host" {
+		if r.Host != "" {
+			return r.Host
+		}
+		return r.URL.Host
+	}
+
+	values := r.Header.Values(name)
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// canonicalQuery encodes the query with keys and values sorted and spaces
+// encoded as %20.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(query))
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEscape(key)+"="+uriEscape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEscape percent-encodes s per RFC 3986.
+func uriEscape(s string) string {
+	escaped := url.QueryEscape(s)
+	escaped = strings.ReplaceAll(escaped, "+", "%20")
+	return strings.ReplaceAll(escaped, "%7E", "~")
+}
+
+// computeSignature derives a signing key for the timestamp's day from the
+// secret and signs the canonical request with it.
+func computeSignature(secret, timestamp, nonce, canonical string) []byte {
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{
+		SignatureAlgorithm,
+		timestamp,
+		nonce,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	dateKey := hmacSHA256([]byte("HMAC"+secret), []byte(timestamp[:8]))
+	signingKey := hmacSHA256(dateKey, []byte(signatureScope))
+	return hmacSHA256(signingKey, []byte(stringToSign))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key.
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// hashRequestBody returns the hex SHA-256 of the request body and replaces
+// the body so it can be read again. A negative limit reads the whole body.
+func hashRequestBody(r *http.Request, limit int64) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	reader := io.Reader(r.Body)
+	if limit >= 0 {
+		reader = io.LimitReader(r.Body, limit+1)
+	}
+
+	body, err := io.ReadAll(reader)
+	r.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if limit >= 0 && int64(len(body)) > limit {
+		return "", fmt.Errorf("request body exceeds %d bytes", limit)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// containsString reports whether values contains s.
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// fakeStore is an in-memory UserStore and SigningKeyStore for tests.
+type fakeStore struct {
+	users map[string]*models.User
+	keys  map[string]*models.SigningKey
+}
+
+func (s *fakeStore) GetUserByID(ctx context.Context, userID string) (*models.User, error) {
+	if user, ok := s.users[userID]; ok {
+		return user, nil
+	}
+	return nil, errors.New("user not found")
+}
+
+func (s *fakeStore) GetUserByAPIKey(ctx context.Context, userAPIKey string) (*models.User, error) {
+	for _, user := range s.users {
+		for _, key := range user.Keys {
+			if key == userAPIKey {
+				return user, nil
+			}
+		}
+	}
+	return nil, errors.New("user not found")
+}
+
+func (s *fakeStore) GetSigningKey(ctx context.Context, keyID string) (*models.SigningKey, error) {
+	if key, ok := s.keys[keyID]; ok {
+		return key, nil
+	}
+	return nil, errors.New("key not found")
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		users: map[string]*models.User{
+			"user-1": {ID: "user-1", Keys: []string{"api-key-1"}},
+		},
+		keys: map[string]*models.SigningKey{
+			"AKID1": {ID: "AKID1", UserID: "user-1", Secret: "s3cret"},
+		},
+	}
+}
+
+func newSignedRequest(t *testing.T, body string, now time.Time, nonce string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/image/resize?width=200&format=png", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if err := SignRequest(req, "AKID1", "s3cret", nonce, now); err != nil {
+		t.Fatalf("SignRequest: %v", err)
+	}
+	return req
+}
+
+func TestSignatureAuthenticator_ValidRequest(t *testing.T) {
+	now := time.Date(2023, 4, 15, 10, 15, 0, 0, time.UTC)
+	config := DefaultSignatureConfig()
+	config.Now = func() time.Time { return now }
+	auth := NewSignatureAuthenticator(newFakeStore(), newFakeStore(), config)
+
+	req := newSignedRequest(t, "image-bytes", now, "nonce-1")
+	identity, err := auth.Authenticate(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if identity.User.ID != "user-1" || identity.Method != AuthMethodSignature || identity.KeyID != "AKID1" {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+
+	// The body must still be readable by the next handler
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != "image-bytes" {
+		t.Errorf("body was not restored: got %q", body)
+	}
+}
+
+func TestSignatureAuthenticator_Rejections(t *testing.T) {
+	now := time.Date(2023, 4, 15, 10, 15, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		mutate func(r *http.Request) *http.Request
+	}{
+		{"tampered body", func(r *http.Request) *http.Request {
+			r.Body = io.NopCloser(strings.NewReader("other-bytes"))
+			return r
+		}},
+		{"tampered query", func(r *http.Request) *http.Request {
+			r.URL.RawQuery = "width=4000&format=png"
+			return r
+		}},
+		{"tampered signed header", func(r *http.Request) *http.Request {
+			r.Header.Set("Content-Type", "image/png")
+			return r
+		}},
+		{"wrong method", func(r *http.Request) *http.Request {
+			r.Method = http.MethodPut
+			return r
+		}},
+		{"unknown key", func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "AKID1", "AKID2", 1))
+			return r
+		}},
+		{"missing nonce header in signature", func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), ";x-nonce", "", 1))
+			return r
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultSignatureConfig()
+			config.Now = func() time.Time { return now }
+			auth := NewSignatureAuthenticator(newFakeStore(), newFakeStore(), config)
+
+			req := tt.mutate(newSignedRequest(t, "image-bytes", now, "nonce-1"))
+			if _, err := auth.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("expected ErrInvalidCredentials, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSignatureAuthenticator_TimestampWindow(t *testing.T) {
+	now := time.Date(2023, 4, 15, 10, 15, 0, 0, time.UTC)
+	config := DefaultSignatureConfig()
+	config.Now = func() time.Time { return now }
+	auth := NewSignatureAuthenticator(newFakeStore(), newFakeStore(), config)
+
+	for _, signedAt := range []time.Time{now.Add(-6 * time.Minute), now.Add(6 * time.Minute)} {
+		req := newSignedRequest(t, "", signedAt, "nonce-"+signedAt.String())
+		if _, err := auth.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("signed at %v: expected ErrInvalidCredentials, got %v", signedAt, err)
+		}
+	}
+}
+
+func TestSignatureAuthenticator_ReplayRejected(t *testing.T) {
+	now := time.Date(2023, 4, 15, 10, 15, 0, 0, time.UTC)
+	config := DefaultSignatureConfig()
+	config.Now = func() time.Time { return now }
+	auth := NewSignatureAuthenticator(newFakeStore(), newFakeStore(), config)
+
+	if _, err := auth.Authenticate(newSignedRequest(t, "a", now, "nonce-1")); err != nil {
+		t.Fatalf("first request: unexpected error: %v", err)
+	}
+	if _, err := auth.Authenticate(newSignedRequest(t, "a", now, "nonce-1")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("replayed request: expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestSignatureAuthenticator_ReplayAcrossInstances(t *testing.T) {
+	now := time.Date(2023, 4, 15, 10, 15, 0, 0, time.UTC)
+	config := DefaultSignatureConfig()
+	config.Now = func() time.Time { return now }
+	nonces := NewMemoryCounterStore()
+	nonces.Now = config.Now
+	config.Nonces = nonces
+	first := NewSignatureAuthenticator(newFakeStore(), newFakeStore(), config)
+	second := NewSignatureAuthenticator(newFakeStore(), newFakeStore(), config)
+
+	if _, err := first.Authenticate(newSignedRequest(t, "a", now, "nonce-1")); err != nil {
+		t.Fatalf("first request: unexpected error: %v", err)
+	}
+	if _, err := second.Authenticate(newSignedRequest(t, "a", now, "nonce-1")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("request replayed on another instance: expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestAuthenticationMiddleware_Credentials(t *testing.T) {
+	now := time.Now()
+	store := newFakeStore()
+	middleware := NewAuthenticationMiddleware(
+		NewAPIKeyAuthenticator(store),
+		NewSignatureAuthenticator(store, store, DefaultSignatureConfig()),
+	)
+
+	var gotIdentity *Identity
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIdentity, _ = IdentityFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// A signed request is accepted
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newSignedRequest(t, "body", now, "nonce-mw"))
+	if rr.Code != http.StatusOK || gotIdentity == nil || gotIdentity.Method != AuthMethodSignature {
+		t.Errorf("signed request: got status %d identity %+v", rr.Code, gotIdentity)
+	}
+
+	// An API key is accepted
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil)
+	req.Header.Set(APIKeyHeader, "api-key-1")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || gotIdentity == nil || gotIdentity.Method != AuthMethodAPIKey {
+		t.Errorf("api key request: got status %d identity %+v", rr.Code, gotIdentity)
+	}
+
+	// No credentials are rejected
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/hello", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous request: got status %d want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
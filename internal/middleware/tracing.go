@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/tracing"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+)
+
+// TracingConfig configures the tracing middleware.
+type TracingConfig struct {
+	// Propagation reads the caller's span context from requests. It
+	// defaults to the W3C traceparent header.
+	Propagation propagation.HTTPFormat
+
+	// Sampler decides which new traces are sampled. It defaults to the
+	// sampler set up by tracing.Setup.
+	Sampler trace.Sampler
+}
+
+// DefaultTracingConfig returns the default tracing configuration, which
+// continues traces from traceparent headers.
+func DefaultTracingConfig() TracingConfig {
+	return TracingConfig{
+		Propagation: &tracing.TraceContext{},
+	}
+}
+
+// NewTracingMiddleware returns a middleware starting a server span for
+// each request, named by the template of the route it matched. The span
+// continues the caller's trace when the request carries a span context,
+// and records the request ID and response status.
+func NewTracingMiddleware(config TracingConfig) func(http.Handler) http.Handler {
+	if config.Propagation == nil {
+		config.Propagation = &tracing.TraceContext{}
+	}
+	options := []trace.StartOption{trace.WithSpanKind(trace.SpanKindServer)}
+	if config.Sampler != nil {
+		options = append(options, trace.WithSampler(config.Sampler))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routeTemplate(r)
+			name := r.Method + " " + route
+
+			// Continue the caller's trace, if any
+			var ctx context.Context
+			var span *trace.Span
+			if parent, ok := config.Propagation.SpanContextFromRequest(r); ok {
+				ctx, span = trace.StartSpanWithRemoteParent(r.Context(), name, parent, options...)
+			} else {
+				ctx, span = trace.StartSpan(r.Context(), name, options...)
+			}
+			defer span.End()
+
+			span.AddAttributes(
+				trace.StringAttribute(ochttp.MethodAttribute, r.Method),
+				trace.StringAttribute("http.route", route),
+				trace.StringAttribute(ochttp.PathAttribute, r.URL.Path),
+				trace.StringAttribute(ochttp.UserAgentAttribute, r.UserAgent()),
+			)
+			if id := requestid.FromContext(ctx); id != "" {
+				span.AddAttributes(trace.StringAttribute("request_id", id))
+			}
+
+			// Call the next handler, recording the response status
+			iw, recorder := instrumentWriter(w)
+			next.ServeHTTP(iw, r.WithContext(ctx))
+
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.AddAttributes(trace.Int64Attribute(ochttp.StatusCodeAttribute, int64(status)))
+			span.SetStatus(ochttp.TraceStatus(status, http.StatusText(status)))
+		})
+	}
+}
+
+// TraceStage wraps a middleware so the time spent in it, including the
+// stages after it, is recorded in a span named "middleware.<name>".
+func TraceStage(name string, middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		handler := middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := trace.StartSpan(r.Context(), "middleware."+name)
+			defer span.End()
+			handler.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
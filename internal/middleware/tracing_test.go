@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/tracing"
+	"github.com/gorilla/mux"
+	"go.opencensus.io/trace"
+)
+
+// spanRecorder is an exporter keeping the exported spans.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := &spanRecorder{}
+	trace.RegisterExporter(recorder)
+	defer trace.UnregisterExporter(recorder)
+
+	router := mux.NewRouter()
+	stage := TraceStage("quota", func(next http.Handler) http.Handler { return next })
+	router.Handle("/test/trace/{id}", NewTracingMiddleware(DefaultTracingConfig())(stage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusInternalServerError, "Internal server error.")
+	}))))
+
+	req := httptest.NewRequest(http.MethodGet, "/test/trace/1", nil)
+	req.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(recorder.spans) != 2 {
+		t.Fatalf("exported %d spans, want the stage and server spans", len(recorder.spans))
+	}
+	stageSpan, serverSpan := recorder.spans[0], recorder.spans[1]
+
+	// The server span continues the caller's trace
+	if serverSpan.Name != "GET /test/trace/{id}" || serverSpan.SpanKind != trace.SpanKindServer {
+		t.Errorf("server span = %q (kind %d), want the route template", serverSpan.Name, serverSpan.SpanKind)
+	}
+	if serverSpan.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || serverSpan.ParentSpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("server span %s/%s, want the caller's trace and span", serverSpan.TraceID, serverSpan.ParentSpanID)
+	}
+	if serverSpan.Attributes["http.status_code"] != int64(http.StatusInternalServerError) || serverSpan.Code == trace.StatusCodeOK {
+		t.Errorf("server span attributes %v and status %v, want a failed 500", serverSpan.Attributes, serverSpan.Status)
+	}
+
+	// The stage span is a child of the server span
+	if stageSpan.Name != "middleware.quota" || stageSpan.ParentSpanID != serverSpan.SpanID {
+		t.Errorf("stage span %q with parent %s, want middleware.quota under %s", stageSpan.Name, stageSpan.ParentSpanID, serverSpan.SpanID)
+	}
+}
@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+)
+
+// UsageRecorder records billable requests in the usage ledger.
+// *services.UsageService satisfies this interface.
+type UsageRecorder interface {
+	RecordUsage(ctx context.Context, event models.UsageEvent) error
+}
+
+// UsageMeterConfig configures the UsageMeter.
+type UsageMeterConfig struct {
+	// Recorder receives a usage event for each billable request.
+	Recorder UsageRecorder
+
+	// Plans gives the price per unit of request cost of each subscription
+	// plan, recorded as the event's amount. What users are billed is
+	// computed from the events by the pricing engine.
+	Plans models.PlanCatalog
+
+	// QueueSize is the number of events queued for the recorder. When the
+	// queue is full, events are recorded before the response completes.
+	QueueSize int
+
+	// Timeout bounds each call to the recorder.
+	Timeout time.Duration
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// DefaultUsageMeterConfig returns the default usage meter configuration: the
+// prices of the default plans, and a queue of 1024 events.
+func DefaultUsageMeterConfig() UsageMeterConfig {
+	return UsageMeterConfig{
+		Plans:     models.DefaultPlanCatalog(),
+		QueueSize: 1024,
+		Timeout:   5 * time.Second,
+		Now:       time.Now,
+	}
+}
+
+// UsageMeter records a usage event for every billable request: requests of
+// authenticated users that did not fail with a server error. Events are
+// written to the recorder in the background.
+type UsageMeter struct {
+	config UsageMeterConfig
+
+	mu     sync.RWMutex
+	closed bool
+	events chan models.UsageEvent
+	done   chan struct{}
+}
+
+// NewUsageMeter creates a new UsageMeter and starts writing its events.
+func NewUsageMeter(config UsageMeterConfig) *UsageMeter {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultUsageMeterConfig().Timeout
+	}
+	m := &UsageMeter{
+		config: config,
+		events: make(chan models.UsageEvent, config.QueueSize),
+		done:   make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// Middleware is a middleware function that meters billable requests. It
+// must run after the cost middleware, which provides the cost of image
+// requests, and after the rate limit and quota middleware, so rejected
+// requests are not billed.
+func (m *UsageMeter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only authenticated users are billed
+		identity, ok := IdentityFromContext(r.Context())
+		if !ok || identity.User == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Call the next handler, recording the response
+		start := m.config.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status >= http.StatusInternalServerError {
+			return
+		}
+
+		event := models.UsageEvent{
+			UserID:    identity.User.ID,
+			KeyID:     identity.KeyID,
+			RequestID: requestid.FromContext(r.Context()),
+			Operation: operation(r),
+			Status:    status,
+			Timestamp: start.UTC(),
+		}
+		if r.ContentLength > 0 {
+			event.InputBytes = r.ContentLength
+		}
+		plan, _ := m.config.Plans.PlanFor(identity.User)
+		finish := func(cost int64) {
+			event.OutputBytes = sw.written
+			event.DurationMS = m.config.Now().Sub(start).Milliseconds()
+			event.Cost = cost
+			event.Amount = float64(cost) * plan.UnitPrice
+			m.record(event)
+		}
+
+		// Image requests are billed their actual cost once it is known
+		if cost, ok := r.Context().Value(costContextKey).(*requestCost); ok {
+			event.Megapixels = cost.megapixels
+			cost.onFinish(finish)
+			return
+		}
+		finish(1)
+	})
+}
+
+// Close stops the background writer once the queued events are recorded.
+// Events metered afterwards are recorded before their response completes.
+func (m *UsageMeter) Close() {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.events)
+	}
+	m.mu.Unlock()
+	<-m.done
+}
+
+// record queues the event, or records it right away if the queue is full
+// or the meter closed.
+func (m *UsageMeter) record(event models.UsageEvent) {
+	m.mu.RLock()
+	if !m.closed {
+		select {
+		case m.events <- event:
+			m.mu.RUnlock()
+			return
+		default:
+		}
+	}
+	m.mu.RUnlock()
+	m.write(event)
+}
+
+// run writes the queued events until the meter is closed.
+func (m *UsageMeter) run() {
+	defer close(m.done)
+	for event := range m.events {
+		m.write(event)
+	}
+}
+
+// write records the event with the recorder.
+func (m *UsageMeter) write(event models.UsageEvent) {
+	// The event is written after its request completed, under its ID
+	ctx, cancel := context.WithTimeout(requestid.NewContext(context.Background(), event.RequestID), m.config.Timeout)
+	defer cancel()
+
+	if err := m.config.Recorder.RecordUsage(ctx, event); err != nil {
+		logging.Default().Error("Could not record usage", "user_id", event.UserID, "request_id", event.RequestID, "error", err)
+	}
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// usageEvents is a UsageRecorder keeping the recorded events.
+type usageEvents struct {
+	mu     sync.Mutex
+	events []models.UsageEvent
+}
+
+func (u *usageEvents) RecordUsage(ctx context.Context, event models.UsageEvent) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.events = append(u.events, event)
+	return nil
+}
+
+func TestUsageMeter_RecordsBillableRequests(t *testing.T) {
+	recorder := &usageEvents{}
+	config := DefaultUsageMeterConfig()
+	config.Recorder = recorder
+	meter := NewUsageMeter(config)
+
+	status := http.StatusOK
+	handler := NewCostMiddleware(DefaultCostConfig())(meter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("converted"))
+	})))
+	serve := func(user *models.User) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/image/resize", bytes.NewReader(encodePNG(t, 2000, 1000)))
+		if user != nil {
+			req = req.WithContext(WithIdentity(req.Context(), &Identity{User: user, KeyID: "key-1"}))
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Anonymous requests and server errors are not billed
+	user := &models.User{ID: "user-1", Subscription: "basic"}
+	serve(user)
+	serve(nil)
+	status = http.StatusInternalServerError
+	serve(user)
+	meter.Close()
+
+	if len(recorder.events) != 1 {
+		t.Fatalf("recorded %d events, want 1", len(recorder.events))
+	}
+	event := recorder.events[0]
+	if event.UserID != "user-1" || event.KeyID != "key-1" || event.Operation != "resize" {
+		t.Errorf("event = %+v, want user-1, key-1, resize", event)
+	}
+	if event.Megapixels != 2 || event.Cost != 3 || event.OutputBytes != int64(len("converted")) {
+		t.Errorf("megapixels, cost, output = %v, %d, %d, want 2, 3, 9", event.Megapixels, event.Cost, event.OutputBytes)
+	}
+	if want := 3 * config.Plans["basic"].UnitPrice; event.Amount != want {
+		t.Errorf("amount = %v, want %v", event.Amount, want)
+	}
+}
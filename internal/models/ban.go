@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// Ban is a temporary block on an IP address that repeatedly failed
+// authentication or exceeded its rate limit.
+type Ban struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Offences  int       `json:"offences"`
+	BannedAt  time.Time `json:"banned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
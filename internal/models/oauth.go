@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// OAuthClient is an OAuth2 client registered to a user for the
+// client_credentials grant. Only a hash of the client secret is stored.
+type OAuthClient struct {
+	ID         string   `json:"id"`
+	SecretHash string   `json:"secret_hash"`
+	Scopes     []string `json:"scopes"`
+	Disabled   bool     `json:"disabled"`
+}
+
+// AccessToken describes an issued OAuth2 access token.
+type AccessToken struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	ClientID  string    `json:"client_id"`
+	Scopes    []string  `json:"scopes"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -4,4 +4,8 @@ type Payload struct {
 	Status  string      `json:"status"`
 	Message string      `json:"message"`
 	Data    interface{} `json:"data"`
-}
\ No newline at end of file
+
+	// RequestID identifies the request of an error, to correlate it with
+	// the logs.
+	RequestID string `json:"request_id,omitempty"`
+}
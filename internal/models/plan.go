@@ -0,0 +1,155 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Plan is a subscription plan: its limits and its pricing.
+type Plan struct {
+	Name string `json:"name"`
+
+	// Quota is the units of cost included per billing period, and
+	// RateLimit the requests allowed per second. Zero falls back to the
+	// middleware defaults, or to the user's own Quota and RateLimit.
+	Quota     int64 `json:"quota"`
+	RateLimit int64 `json:"rate_limit"`
+
+	// Metered plans are billed for usage over their quota instead of being
+	// blocked.
+	Metered bool `json:"metered"`
+
+	// MaxImageBytes and MaxMegapixels bound the uploaded images. Zero is
+	// unbounded.
+	MaxImageBytes int64   `json:"max_image_bytes"`
+	MaxMegapixels float64 `json:"max_megapixels"`
+
+	// Operations lists the image operations included. Empty includes all.
+	Operations []string `json:"operations"`
+
+	// BasePrice is charged per billing period with usage, UnitPrice per
+	// unit of cost within the quota and OverageUnitPrice per unit over it.
+	BasePrice        float64 `json:"base_price"`
+	UnitPrice        float64 `json:"unit_price"`
+	OverageUnitPrice float64 `json:"overage_unit_price"`
+}
+
+// AllowsOperation reports whether the plan includes the operation.
+func (p Plan) AllowsOperation(operation string) bool {
+	if len(p.Operations) == 0 {
+		return true
+	}
+	for _, allowed := range p.Operations {
+		if allowed == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanCatalog maps plan names (lower case) to plans.
+type PlanCatalog map[string]Plan
+
+// FreePlan is the plan of users without a subscription.
+const FreePlan = "free"
+
+// PlanFor returns the plan of the user's subscription, compared case
+// insensitively, or the free plan for users without one or with a
+// subscription not in the catalog, so that they are never left unlimited.
+// It reports false for anonymous users and catalogs without a free plan.
+func (c PlanCatalog) PlanFor(user *User) (Plan, bool) {
+	if user == nil {
+		return Plan{}, false
+	}
+	name := strings.ToLower(user.Subscription)
+	plan, ok := c[name]
+	if !ok {
+		name = FreePlan
+		plan, ok = c[name]
+	}
+	if ok && plan.Name == "" {
+		plan.Name = name
+	}
+	return plan, ok
+}
+
+// DefaultPlanCatalog returns the default plans: free, basic, pro, ultra,
+// and custom plans, whose limits are set on each user.
+func DefaultPlanCatalog() PlanCatalog {
+	return PlanCatalog{
+		"free": {
+			Name:          "free",
+			Quota:         100,
+			RateLimit:     4,
+			MaxImageBytes: 5 << 20,
+			MaxMegapixels: 12,
+			Operations:    []string{"convert", "resize"},
+		},
+		"basic": {
+			Name:          "basic",
+			Quota:         10000,
+			RateLimit:     32,
+			MaxImageBytes: 20 << 20,
+			MaxMegapixels: 50,
+			BasePrice:     9,
+			UnitPrice:     0.002,
+		},
+		"pro": {
+			Name:             "pro",
+			Quota:            100000,
+			RateLimit:        64,
+			Metered:          true,
+			MaxImageBytes:    50 << 20,
+			MaxMegapixels:    100,
+			BasePrice:        49,
+			UnitPrice:        0.0015,
+			OverageUnitPrice: 0.002,
+		},
+		"ultra": {
+			Name:             "ultra",
+			Quota:            1000000,
+			RateLimit:        128,
+			Metered:          true,
+			MaxImageBytes:    100 << 20,
+			MaxMegapixels:    200,
+			BasePrice:        199,
+			UnitPrice:        0.001,
+			OverageUnitPrice: 0.0015,
+		},
+		"custom": {
+			Name:             "custom",
+			Metered:          true,
+			UnitPrice:        0.001,
+			OverageUnitPrice: 0.001,
+		},
+	}
+}
+
+// BillingPeriod returns the monthly billing period containing now, which
+// starts on the anniversary of anchor each month, or on the first of each
+// month for a zero anchor. Anniversaries on days a month does not have
+// fall on its last day.
+func BillingPeriod(anchor, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	if anchor.IsZero() {
+		anchor = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	anchor = anchor.UTC()
+
+	start := anniversary(anchor, now.Year(), now.Month())
+	if start.After(now) {
+		start = anniversary(anchor, now.Year(), now.Month()-1)
+	}
+	end := anniversary(anchor, start.Year(), start.Month()+1)
+	return start, end
+}
+
+// anniversary returns the anniversary of anchor in the given month.
+func anniversary(anchor time.Time, year int, month time.Month) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	day := anchor.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, anchor.Hour(), anchor.Minute(), anchor.Second(), 0, time.UTC)
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlanCatalog_PlanFor(t *testing.T) {
+	catalog := DefaultPlanCatalog()
+	tests := []struct {
+		user *User
+		plan string
+		ok   bool
+	}{
+		{nil, "", false},
+		{&User{}, "free", true},
+		{&User{Subscription: "Pro"}, "pro", true},
+		{&User{Subscription: "platinum"}, "free", true},
+	}
+	for _, tt := range tests {
+		plan, ok := catalog.PlanFor(tt.user)
+		if plan.Name != tt.plan || ok != tt.ok {
+			t.Errorf("PlanFor(%+v) = %q, %v, want %q, %v", tt.user, plan.Name, ok, tt.plan, tt.ok)
+		}
+	}
+
+	// Without a free plan, unknown subscriptions have no plan
+	if plan, ok := (PlanCatalog{"pro": {}}).PlanFor(&User{Subscription: "platinum"}); ok {
+		t.Errorf("PlanFor without a free plan = %q, true, want false", plan.Name)
+	}
+}
+
+func TestPlan_AllowsOperation(t *testing.T) {
+	free := DefaultPlanCatalog()["free"]
+	if !free.AllowsOperation("resize") || free.AllowsOperation("crop") {
+		t.Errorf("free plan operations = %v, want resize but not crop", free.Operations)
+	}
+	if !(Plan{}).AllowsOperation("crop") {
+		t.Error("plan without operations does not allow crop")
+	}
+}
+
+func TestBillingPeriod(t *testing.T) {
+	date := func(month time.Month, day int) time.Time {
+		return time.Date(2023, month, day, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name       string
+		anchor     time.Time
+		now        time.Time
+		start, end time.Time
+	}{
+		{"calendar month", time.Time{}, date(5, 14), date(5, 1), date(6, 1)},
+		{"before anniversary", date(1, 15), date(5, 14), date(4, 15), date(5, 15)},
+		{"on anniversary", date(1, 15), date(5, 15), date(5, 15), date(6, 15)},
+		{"short month", date(1, 31), date(2, 28), date(2, 28), date(3, 31)},
+		{"year boundary", date(3, 20), date(1, 5), time.Date(2022, 12, 20, 0, 0, 0, 0, time.UTC), date(1, 20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := BillingPeriod(tt.anchor, tt.now)
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Errorf("BillingPeriod = %v to %v, want %v to %v", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+package models
+
+// SigningKey is a shared secret used by server-to-server clients to sign
+// requests with HMAC instead of sending an API key.
+type SigningKey struct {
+	ID       string `json:"id"`
+	UserID   string `json:"user_id"`
+	Secret   string `json:"secret"`
+	Disabled bool   `json:"disabled"`
+}
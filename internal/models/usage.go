@@ -0,0 +1,67 @@
+package models
+
+import "time"
+
+// UsageEvent records one billable request in the append-only usage ledger.
+type UsageEvent struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	KeyID       string    `json:"key_id"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Operation   string    `json:"operation"`
+	Status      int       `json:"status"`
+	InputBytes  int64     `json:"input_bytes"`
+	OutputBytes int64     `json:"output_bytes"`
+	Megapixels  float64   `json:"megapixels"`
+	DurationMS  int64     `json:"duration_ms"`
+	Cost        int64     `json:"cost"`
+	Amount      float64   `json:"amount"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// UsageSummary aggregates the usage events of a period.
+type UsageSummary struct {
+	Period      string  `json:"period"`
+	Requests    int     `json:"requests"`
+	InputBytes  int64   `json:"input_bytes"`
+	OutputBytes int64   `json:"output_bytes"`
+	Megapixels  float64 `json:"megapixels"`
+	DurationMS  int64   `json:"duration_ms"`
+	Cost        int64   `json:"cost"`
+	Amount      float64 `json:"amount"`
+}
+
+// Add adds an event to the summary.
+func (s *UsageSummary) Add(event UsageEvent) {
+	s.Requests++
+	s.InputBytes += event.InputBytes
+	s.OutputBytes += event.OutputBytes
+	s.Megapixels += event.Megapixels
+	s.DurationMS += event.DurationMS
+	s.Cost += event.Cost
+	s.Amount += event.Amount
+}
+
+// UsagePeriod is a user's usage and charge in a billing period, as last
+// reconciled from the usage ledger.
+type UsagePeriod struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Requests     int       `json:"requests"`
+	Cost         int64     `json:"cost"`
+	Charge       float64   `json:"charge"`
+	ReconciledAt time.Time `json:"reconciled_at"`
+}
+
+// UsageReport is a user's usage between two times, in total and per day or
+// month.
+type UsageReport struct {
+	UserID      string         `json:"user_id"`
+	From        time.Time      `json:"from"`
+	To          time.Time      `json:"to"`
+	Granularity string         `json:"granularity"`
+	Operation   string         `json:"operation,omitempty"`
+	KeyID       string         `json:"key_id,omitempty"`
+	Total       UsageSummary   `json:"total"`
+	Periods     []UsageSummary `json:"periods"`
+}
@@ -1,19 +1,26 @@
 package models
 
+import "time"
+
 type User struct {
-	Affiliations  []string `json:"affiliations"`
-	Email         string   `json:"email"`
-	ForwardedIP   string   `json:"forwarded_ip"`
-	ForwardedHost string   `json:"forwarded_host"`
-	ID            string   `json:"id"`
-	Keys          []string `json:"keys"`
-	LoyaltyScore  string   `json:"loyalty_score"`
-	Platform      string   `json:"platform"`
-	Quota         int      `json:"quota"`
-	RateLimit     int      `json:"rate_limit"`
-	RealIP        string   `json:"real_ip"`
-	Spend         float64  `json:"spend"`
-	Subscription  string   `json:"subscription"`
-	Username      string   `json:"username"`
-	Volume        int      `json:"volume"`
-}
\ No newline at end of file
+	Affiliations  []string      `json:"affiliations"`
+	AllowedCIDRs  []string      `json:"allowed_cidrs"`
+	BillingAnchor time.Time     `json:"billing_anchor"`
+	DeniedCIDRs   []string      `json:"denied_cidrs"`
+	Email         string        `json:"email"`
+	ForwardedIP   string        `json:"forwarded_ip"`
+	ForwardedHost string        `json:"forwarded_host"`
+	ID            string        `json:"id"`
+	Keys          []string      `json:"keys"`
+	LoyaltyScore  string        `json:"loyalty_score"`
+	OAuthClients  []OAuthClient `json:"oauth_clients"`
+	Platform      string        `json:"platform"`
+	Quota         int           `json:"quota"`
+	RateLimit     int           `json:"rate_limit"`
+	RealIP        string        `json:"real_ip"`
+	Roles         []string      `json:"roles"`
+	Spend         float64       `json:"spend"`
+	Subscription  string        `json:"subscription"`
+	Username      string        `json:"username"`
+	Volume        int           `json:"volume"`
+}
@@ -2,12 +2,14 @@ package repositories
 
 import (
 	"context"
-	"fmt"
 	"io"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/requestid"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/tracing"
+	"go.opencensus.io/trace"
 )
 
 // CloudStorageRepository is a repository for uploading images to Google Cloud Storage.
@@ -26,8 +28,6 @@ func NewCloudStorageRepository(bucketName string, client *storage.Client) (*Clou
 	// Calculate the time 6 minutes from now
 	expirationTime := now.Add(6 * time.Minute)
 
-	fmt.Printf("Expiration time: ", expirationTime)
-
 	// Define the lifecycle rule
 	rule := &storage.Lifecycle{
 		Rules: []storage.LifecycleRule{
@@ -59,18 +59,25 @@ func NewCloudStorageRepository(bucketName string, client *storage.Client) (*Clou
 
 // UploadImage uploads an image to Google Cloud Storage.
 func (r *CloudStorageRepository) UploadImage(ctx context.Context, name string, data io.Reader) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "CloudStorageRepository.UploadImage")
+	defer span.End()
+
 	// Create a new object in the bucket
 	obj := r.bucket.Object(name)
 
-	// Create a new writer for the object
+	// Create a new writer for the object, recording the request that
+	// uploaded it
 	wc := obj.NewWriter(ctx)
+	if id := requestid.FromContext(ctx); id != "" {
+		wc.Metadata = map[string]string{"request-id": id}
+	}
 	if _, err := io.Copy(wc, data); err != nil {
-		return "", err
+		return "", tracing.RecordError(span, err)
 	}
 
 	// Close the writer
 	if err := wc.Close(); err != nil {
-		return "", err
+		return "", tracing.RecordError(span, err)
 	}
 
 	// Set the cache control header on the uploaded object
@@ -81,7 +88,7 @@ func (r *CloudStorageRepository) UploadImage(ctx context.Context, name string, d
 
 	// Update the object attributes
 	if _, err := obj.Update(ctx, attrs); err != nil {
-		return "", err
+		return "", tracing.RecordError(span, err)
 	}
 
 	// Get the public URL of the uploaded object and return it
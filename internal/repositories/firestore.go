@@ -2,11 +2,18 @@ package repositories
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"firebase.google.com/go/v4/db"
 	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/tracing"
+	"go.opencensus.io/trace"
 )
 
 // FirestoreRepository is a repository that retrieves data from Firestore.
@@ -21,8 +28,21 @@ func NewFirestoreRepository(client *db.Client) *FirestoreRepository {
 	}
 }
 
+// Ping checks that Firestore can be read, for readiness checks.
+func (r *FirestoreRepository) Ping(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.Ping")
+	defer span.End()
+
+	var users map[string]interface{}
+	ref := r.client.NewRef("api-image-converter-users")
+	return tracing.RecordError(span, ref.OrderByKey().LimitToFirst(1).Get(ctx, &users))
+}
+
 // CustomAction performs a custom action for a user in Firestore.
 func (r *FirestoreRepository) CustomAction(ctx context.Context, userID string, actionType string) (string, error) {
+	_, span := trace.StartSpan(ctx, "FirestoreRepository.CustomAction")
+	defer span.End()
+
 	// Custom logic for performing a specific action based on actionType
 	// For example, you can implement different actions based on the value of actionType
 
@@ -31,7 +51,7 @@ func (r *FirestoreRepository) CustomAction(ctx context.Context, userID string, a
 		// Perform some action
 		return "Action completed", nil
 	} else {
-		return "", errors.New("Invalid action type")
+		return "", tracing.RecordError(span, errors.New("Invalid action type"))
 	}
 }
 
@@ -52,59 +72,151 @@ func (r *FirestoreRepository) CustomAction(ctx context.Context, userID string, a
 
 // GetUserByID retrieves a user by ID from Firestore.
 func (r *FirestoreRepository) GetUserByID(ctx context.Context, userID string) (*models.User, error) {
-	var user models.User
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.GetUserByID")
+	defer span.End()
+
+	if !validPathSegment(userID) {
+		return nil, tracing.RecordError(span, fmt.Errorf("invalid user ID %q", userID))
+	}
+
+	// A missing user reads as null
+	var user *models.User
 	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-users/%s", userID))
 	if err := ref.Get(ctx, &user); err != nil {
-		return nil, err
+		return nil, tracing.RecordError(span, err)
+	}
+	if user == nil {
+		return nil, tracing.RecordError(span, fmt.Errorf("user %s not found", userID))
 	}
 	user.ID = userID
-	return &user, nil
+	return user, nil
 }
 
 // GetUserByEmail retrieves a user by email from Firestore.
 func (r *FirestoreRepository) GetUserByEmail(ctx context.Context, userEmail string) (*models.User, error) {
-	var user models.User
-	ref := r.client.NewRef("api-image-converter-users")
-	if err := ref.OrderByChild("email").EqualTo(userEmail).LimitToFirst(1).Get(ctx, &user); err != nil {
-		return nil, err
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.GetUserByEmail")
+	defer span.End()
+
+	user, err := r.queryUser(ctx, "email", userEmail)
+	if err != nil {
+		return nil, tracing.RecordError(span, err)
 	}
-	return &user, nil
+	return user, nil
 }
 
-// GetUserByAPIKey retrieves a user by API key from Firestore.
+// GetUserByAPIKey retrieves the user owning an API key from Firestore,
+// through the index of the users' keys by hash (see UpdateUserKeys).
 func (r *FirestoreRepository) GetUserByAPIKey(ctx context.Context, userAPIKey string) (*models.User, error) {
-	var user models.User
-	ref := r.client.NewRef("api-image-converter-users")
-	if err := ref.OrderByChild("api_key").EqualTo(userAPIKey).LimitToFirst(1).Get(ctx, &user); err != nil {
-		return nil, err
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.GetUserByAPIKey")
+	defer span.End()
+
+	if userAPIKey == "" {
+		return nil, tracing.RecordError(span, errors.New("empty API key"))
+	}
+
+	var index struct {
+		UserID string `json:"user_id"`
 	}
-	return &user, nil
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-api-keys/%s", apiKeyHash(userAPIKey)))
+	if err := ref.Get(ctx, &index); err != nil {
+		return nil, tracing.RecordError(span, err)
+	}
+	if index.UserID == "" {
+		return nil, tracing.RecordError(span, errors.New("API key not found"))
+	}
+	return r.GetUserByID(ctx, index.UserID)
 }
 
 // GetUserByRealIP retrieves a user by real IP from Firestore.
 func (r *FirestoreRepository) GetUserByRealIP(ctx context.Context, userRealIP string) (*models.User, error) {
-	var user models.User
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.GetUserByRealIP")
+	defer span.End()
+
+	user, err := r.queryUser(ctx, "real_ip", userRealIP)
+	if err != nil {
+		return nil, tracing.RecordError(span, err)
+	}
+	return user, nil
+}
+
+// queryUser retrieves the first user whose child field equals value. The
+// query returns the matching users keyed by ID, or nothing.
+func (r *FirestoreRepository) queryUser(ctx context.Context, field, value string) (*models.User, error) {
+	var users map[string]models.User
 	ref := r.client.NewRef("api-image-converter-users")
-	if err := ref.OrderByChild("real_ip").EqualTo(userRealIP).LimitToFirst(1).Get(ctx, &user); err != nil {
+	if err := ref.OrderByChild(field).EqualTo(value).LimitToFirst(1).Get(ctx, &users); err != nil {
 		return nil, err
 	}
-	return &user, nil
+	for id, user := range users {
+		user.ID = id
+		return &user, nil
+	}
+	return nil, fmt.Errorf("no user with %s %q", field, value)
+}
+
+// GetSigningKey retrieves a request signing key by key ID from Firestore.
+func (r *FirestoreRepository) GetSigningKey(ctx context.Context, keyID string) (*models.SigningKey, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.GetSigningKey")
+	defer span.End()
+
+	if !validPathSegment(keyID) {
+		return nil, tracing.RecordError(span, fmt.Errorf("invalid signing key ID %q", keyID))
+	}
+
+	var key models.SigningKey
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-signing-keys/%s", keyID))
+	if err := ref.Get(ctx, &key); err != nil {
+		return nil, tracing.RecordError(span, err)
+	}
+	if key.Secret == "" {
+		return nil, tracing.RecordError(span, fmt.Errorf("signing key %s not found", keyID))
+	}
+	key.ID = keyID
+	return &key, nil
+}
+
+// GetUserByOAuthClientID retrieves the user owning an OAuth2 client from Firestore.
+func (r *FirestoreRepository) GetUserByOAuthClientID(ctx context.Context, clientID string) (*models.User, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.GetUserByOAuthClientID")
+	defer span.End()
+
+	if !validPathSegment(clientID) {
+		return nil, tracing.RecordError(span, fmt.Errorf("invalid oauth client ID %q", clientID))
+	}
+
+	var index struct {
+		UserID string `json:"user_id"`
+	}
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-oauth-clients/%s", clientID))
+	if err := ref.Get(ctx, &index); err != nil {
+		return nil, tracing.RecordError(span, err)
+	}
+	if index.UserID == "" {
+		return nil, tracing.RecordError(span, fmt.Errorf("oauth client %s not found", clientID))
+	}
+	return r.GetUserByID(ctx, index.UserID)
 }
 
 // CheckUserRealIP checks the real IP of a user in Firestore.
 func (r *FirestoreRepository) CheckUserRealIP(ctx context.Context, userRealIP string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.CheckUserRealIP")
+	defer span.End()
+
 	user, err := r.GetUserByRealIP(ctx, userRealIP)
 	if err != nil {
-		return "", err
+		return "", tracing.RecordError(span, err)
 	}
 	return user.ID, nil
 }
 
 // CheckUserPlan checks the subscription of a user in Firestore.
 func (r *FirestoreRepository) CheckUserSubscription(ctx context.Context, userID string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.CheckUserSubscription")
+	defer span.End()
+
 	user, err := r.GetUserByID(ctx, userID)
 	if err != nil {
-		return "", err
+		return "", tracing.RecordError(span, err)
 	}
 
 	return user.Subscription, nil
@@ -112,9 +224,12 @@ func (r *FirestoreRepository) CheckUserSubscription(ctx context.Context, userID
 
 // CheckUserQuota checks the quota of a user in Firestore.
 func (r *FirestoreRepository) CheckUserQuota(ctx context.Context, userID string) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.CheckUserQuota")
+	defer span.End()
+
 	user, err := r.GetUserByID(ctx, userID)
 	if err != nil {
-		return 0, err
+		return 0, tracing.RecordError(span, err)
 	}
 
 	return user.Quota, nil
@@ -122,9 +237,12 @@ func (r *FirestoreRepository) CheckUserQuota(ctx context.Context, userID string)
 
 // CheckUserRateLimit checks the rate limit of a user in Firestore.
 func (r *FirestoreRepository) CheckUserRateLimit(ctx context.Context, userID string) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.CheckUserRateLimit")
+	defer span.End()
+
 	user, err := r.GetUserByID(ctx, userID)
 	if err != nil {
-		return 0, err
+		return 0, tracing.RecordError(span, err)
 	}
 
 	return user.RateLimit, nil
@@ -142,25 +260,31 @@ func (r *FirestoreRepository) CheckUserRateLimit(ctx context.Context, userID str
 
 // UpdateUser updates a user in Firestore.
 func (r *FirestoreRepository) UpdateUser(ctx context.Context, userID string, user *models.User) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.UpdateUser")
+	defer span.End()
+
 	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-users/%s", userID))
 	if err := ref.Set(ctx, user); err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 	return nil
 }
 
 // AddQuota adds quota to a user in Firestore.
 func (r *FirestoreRepository) AddQuota(ctx context.Context, userID string, quota int) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.AddQuota")
+	defer span.End()
+
 	user, err := r.GetUserByID(ctx, userID)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 
 	user.Quota += quota
 
 	err = r.UpdateUser(ctx, userID, user)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 
 	return nil
@@ -168,68 +292,370 @@ func (r *FirestoreRepository) AddQuota(ctx context.Context, userID string, quota
 
 // UpdateUserKeys updates the keys of a user in Firestore.
 func (r *FirestoreRepository) UpdateUserKeys(ctx context.Context, userID string, keys []string) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.UpdateUserKeys")
+	defer span.End()
+
 	user, err := r.GetUserByID(ctx, userID)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 
+	previous := user.Keys
 	user.Keys = keys
 
 	err = r.UpdateUser(ctx, userID, user)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
+	}
+
+	// Index the keys by hash for GetUserByAPIKey, and drop the removed ones
+	current := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		current[key] = true
+		ref := r.client.NewRef(fmt.Sprintf("api-image-converter-api-keys/%s", apiKeyHash(key)))
+		if err := ref.Set(ctx, map[string]string{"user_id": userID}); err != nil {
+			return tracing.RecordError(span, err)
+		}
+	}
+	for _, key := range previous {
+		if current[key] {
+			continue
+		}
+		ref := r.client.NewRef(fmt.Sprintf("api-image-converter-api-keys/%s", apiKeyHash(key)))
+		if err := ref.Delete(ctx); err != nil {
+			return tracing.RecordError(span, err)
+		}
 	}
 
 	return nil
 }
 
-// UpdateUserSpend updates the spend of a user in Firestore.
-func (r *FirestoreRepository) UpdateUserSpend(ctx context.Context, userID string, spend float64) error {
+// UpdateUserLoyalty updates the loyalty score status of a user in Firestore.
+func (r *FirestoreRepository) UpdateUserLoyaltyScore(ctx context.Context, userID string, loyaltyStatus string) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.UpdateUserLoyaltyScore")
+	defer span.End()
+
 	user, err := r.GetUserByID(ctx, userID)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 
-	user.Spend += spend
+	user.LoyaltyScore = loyaltyStatus
 
 	err = r.UpdateUser(ctx, userID, user)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 
 	return nil
 }
 
-// UpdateUserLoyalty updates the loyalty score status of a user in Firestore.
-func (r *FirestoreRepository) UpdateUserLoyaltyScore(ctx context.Context, userID string, loyaltyStatus string) error {
+// UpdateUserAffiliations updates the affiliations of a user in Firestore.
+func (r *FirestoreRepository) UpdateUserAffiliations(ctx context.Context, userID string, affiliations []string) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.UpdateUserAffiliations")
+	defer span.End()
+
 	user, err := r.GetUserByID(ctx, userID)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 
-	user.LoyaltyScore = loyaltyStatus
+	user.Affiliations = affiliations
 
 	err = r.UpdateUser(ctx, userID, user)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 
 	return nil
 }
 
-// UpdateUserAffiliations updates the affiliations of a user in Firestore.
-func (r *FirestoreRepository) UpdateUserAffiliations(ctx context.Context, userID string, affiliations []string) error {
+// AddOAuthClient registers an OAuth2 client on a user in Firestore and
+// indexes it by client ID.
+func (r *FirestoreRepository) AddOAuthClient(ctx context.Context, userID string, client models.OAuthClient) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.AddOAuthClient")
+	defer span.End()
+
+	if !validPathSegment(client.ID) {
+		return tracing.RecordError(span, fmt.Errorf("invalid oauth client ID %q", client.ID))
+	}
+
 	user, err := r.GetUserByID(ctx, userID)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 
-	user.Affiliations = affiliations
+	user.OAuthClients = append(user.OAuthClients, client)
 
 	err = r.UpdateUser(ctx, userID, user)
 	if err != nil {
-		return err
+		return tracing.RecordError(span, err)
 	}
 
-	return nil
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-oauth-clients/%s", client.ID))
+	return tracing.RecordError(span, ref.Set(ctx, map[string]string{"user_id": userID}))
+}
+
+// RevokeToken records an OAuth2 access token as revoked in Firestore until
+// it expires.
+func (r *FirestoreRepository) RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.RevokeToken")
+	defer span.End()
+
+	if !validPathSegment(tokenID) {
+		return tracing.RecordError(span, fmt.Errorf("invalid token ID %q", tokenID))
+	}
+
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-revoked-tokens/%s", tokenID))
+	return tracing.RecordError(span, ref.Set(ctx, map[string]int64{"expires_at": expiresAt.Unix()}))
+}
+
+// IsTokenRevoked checks whether an OAuth2 access token was revoked in Firestore.
+func (r *FirestoreRepository) IsTokenRevoked(ctx context.Context, tokenID string) (bool, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.IsTokenRevoked")
+	defer span.End()
+
+	if !validPathSegment(tokenID) {
+		return false, tracing.RecordError(span, fmt.Errorf("invalid token ID %q", tokenID))
+	}
+
+	var revoked struct {
+		ExpiresAt int64 `json:"expires_at"`
+	}
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-revoked-tokens/%s", tokenID))
+	if err := ref.Get(ctx, &revoked); err != nil {
+		return false, tracing.RecordError(span, err)
+	}
+	return revoked.ExpiresAt != 0, nil
+}
+
+// GetImages retrieves all images from Firestore.
+func (r *FirestoreRepository) GetImages(ctx context.Context) ([]*models.Image, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.GetImages")
+	defer span.End()
+
+	var images map[string]*models.Image
+	ref := r.client.NewRef("api-image-converter-images")
+	if err := ref.Get(ctx, &images); err != nil {
+		return nil, tracing.RecordError(span, err)
+	}
+
+	result := make([]*models.Image, 0, len(images))
+	for id, image := range images {
+		image.ID = id
+		result = append(result, image)
+	}
+	return result, nil
+}
+
+// AddImage adds an image to Firestore.
+func (r *FirestoreRepository) AddImage(ctx context.Context, image *models.Image) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.AddImage")
+	defer span.End()
+
+	// Let Firestore generate an ID for new images
+	if image.ID == "" {
+		ref, err := r.client.NewRef("api-image-converter-images").Push(ctx, nil)
+		if err != nil {
+			return tracing.RecordError(span, err)
+		}
+		image.ID = ref.Key
+	}
+
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-images/%s", image.ID))
+	return tracing.RecordError(span, ref.Set(ctx, image))
+}
+
+// usageRecord is a usage event as stored in Firestore, with its timestamp
+// in Unix milliseconds for range queries. The "at" child must be indexed
+// (".indexOn": "at") under each user's usage.
+type usageRecord struct {
+	models.UsageEvent
+	At int64 `json:"at"`
+}
+
+// AppendUsageEvent appends a usage event to its user's ledger in
+// Firestore. Events are never updated once written.
+func (r *FirestoreRepository) AppendUsageEvent(ctx context.Context, event *models.UsageEvent) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.AppendUsageEvent")
+	defer span.End()
+
+	if !validPathSegment(event.UserID) {
+		return tracing.RecordError(span, fmt.Errorf("invalid user ID %q", event.UserID))
+	}
+
+	ref, err := r.client.NewRef(fmt.Sprintf("api-image-converter-usage/%s", event.UserID)).Push(ctx, nil)
+	if err != nil {
+		return tracing.RecordError(span, err)
+	}
+	event.ID = ref.Key
+	return tracing.RecordError(span, ref.Set(ctx, usageRecord{UsageEvent: *event, At: event.Timestamp.UnixMilli()}))
+}
+
+// ListUsageEvents retrieves a user's usage events from Firestore with
+// timestamps in [from, to), oldest first. A zero from lists all events up
+// to to.
+func (r *FirestoreRepository) ListUsageEvents(ctx context.Context, userID string, from, to time.Time) ([]models.UsageEvent, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.ListUsageEvents")
+	defer span.End()
+
+	if !validPathSegment(userID) {
+		return nil, tracing.RecordError(span, fmt.Errorf("invalid user ID %q", userID))
+	}
+
+	var records map[string]usageRecord
+	query := r.client.NewRef(fmt.Sprintf("api-image-converter-usage/%s", userID)).OrderByChild("at")
+	if !from.IsZero() {
+		query = query.StartAt(from.UnixMilli())
+	}
+	if err := query.EndAt(to.UnixMilli()-1).Get(ctx, &records); err != nil {
+		return nil, tracing.RecordError(span, err)
+	}
+
+	events := make([]models.UsageEvent, 0, len(records))
+	for id, record := range records {
+		record.UsageEvent.ID = id
+		events = append(events, record.UsageEvent)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	return events, nil
+}
+
+// SetUserUsage sets the volume and spend of a user in Firestore, as
+// reconciled from the usage ledger, without touching the user's other
+// fields.
+func (r *FirestoreRepository) SetUserUsage(ctx context.Context, userID string, volume int, spend float64) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.SetUserUsage")
+	defer span.End()
+
+	if !validPathSegment(userID) {
+		return tracing.RecordError(span, fmt.Errorf("invalid user ID %q", userID))
+	}
+
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-users/%s", userID))
+	return tracing.RecordError(span, ref.Update(ctx, map[string]interface{}{
+		"volume": volume,
+		"spend":  spend,
+	}))
+}
+
+// ListUsagePeriods retrieves the reconciled usage of each of a user's
+// billing periods from Firestore, oldest first.
+func (r *FirestoreRepository) ListUsagePeriods(ctx context.Context, userID string) ([]models.UsagePeriod, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.ListUsagePeriods")
+	defer span.End()
+
+	if !validPathSegment(userID) {
+		return nil, tracing.RecordError(span, fmt.Errorf("invalid user ID %q", userID))
+	}
+
+	var records map[string]models.UsagePeriod
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-usage-periods/%s", userID))
+	if err := ref.Get(ctx, &records); err != nil {
+		return nil, tracing.RecordError(span, err)
+	}
+
+	periods := make([]models.UsagePeriod, 0, len(records))
+	for _, period := range records {
+		periods = append(periods, period)
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].Start.Before(periods[j].Start)
+	})
+	return periods, nil
+}
+
+// SetUsagePeriod stores the reconciled usage of one of a user's billing
+// periods in Firestore, keyed by the start of the period.
+func (r *FirestoreRepository) SetUsagePeriod(ctx context.Context, userID string, period models.UsagePeriod) error {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.SetUsagePeriod")
+	defer span.End()
+
+	if !validPathSegment(userID) {
+		return tracing.RecordError(span, fmt.Errorf("invalid user ID %q", userID))
+	}
+
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-usage-periods/%s/%d", userID, period.Start.Unix()))
+	return tracing.RecordError(span, ref.Set(ctx, period))
+}
+
+// IncrementCounter atomically adds delta to a shared rate limit or quota
+// counter in Firestore and returns its new value.
+func (r *FirestoreRepository) IncrementCounter(ctx context.Context, key string, delta int64, expiresAt time.Time) (int64, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.IncrementCounter")
+	defer span.End()
+
+	var total int64
+	ref := r.client.NewRef(fmt.Sprintf("api-image-converter-counters/%s", counterPath(key)))
+	err := ref.Transaction(ctx, func(node db.TransactionNode) (interface{}, error) {
+		var counter struct {
+			Count     int64 `json:"count"`
+			ExpiresAt int64 `json:"expires_at"`
+		}
+		if err := node.Unmarshal(&counter); err != nil {
+			return nil, err
+		}
+		counter.Count += delta
+		if expiresAt.Unix() > counter.ExpiresAt {
+			counter.ExpiresAt = expiresAt.Unix()
+		}
+		total = counter.Count
+		return counter, nil
+	})
+	if err != nil {
+		return 0, tracing.RecordError(span, err)
+	}
+	return total, nil
+}
+
+// DeleteExpiredCounters deletes the rate limit and quota counters that
+// expired before now from Firestore, and returns how many were deleted.
+func (r *FirestoreRepository) DeleteExpiredCounters(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := trace.StartSpan(ctx, "FirestoreRepository.DeleteExpiredCounters")
+	defer span.End()
+
+	var expired map[string]interface{}
+	ref := r.client.NewRef("api-image-converter-counters")
+	if err := ref.OrderByChild("expires_at").EndAt(now.Unix()).Get(ctx, &expired); err != nil {
+		return 0, tracing.RecordError(span, err)
+	}
+
+	deleted := 0
+	for key := range expired {
+		if err := ref.Child(key).Delete(ctx); err != nil {
+			return deleted, tracing.RecordError(span, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// apiKeyHash returns the hex SHA-256 hash of an API key, which keys the
+// index of API keys so the keys themselves are not database paths.
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// validPathSegment reports whether a client-supplied ID can be used as a
+// single Firestore path segment. IDs are generated as letters, digits, "-"
+// and "_"; anything else, e.g. "/" or ".", could address other nodes.
+func validPathSegment(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// counterPath encodes a counter key for use as a Firestore path segment,
+// which may not contain ".", "/", "#", "$", "[" or "]".
+func counterPath(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
 }
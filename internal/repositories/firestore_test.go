@@ -0,0 +1,217 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	firebase "firebase.google.com/go/v4"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// fakeDatabase is an in-memory Realtime Database REST API. Values are
+// stored at the paths they are written to, and queries on a path match its
+// direct children.
+type fakeDatabase struct {
+	mu    sync.Mutex
+	nodes map[string]json.RawMessage
+}
+
+func (d *fakeDatabase) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	path := strings.TrimSuffix(r.URL.Path, ".json")
+	switch r.Method {
+	case http.MethodGet:
+		orderBy := r.URL.Query().Get("orderBy")
+		if orderBy == "" {
+			if node, ok := d.nodes[path]; ok {
+				w.Write(node)
+				return
+			}
+			io.WriteString(w, "null")
+			return
+		}
+
+		// Match the children whose field equals equalTo
+		var field string
+		json.Unmarshal([]byte(orderBy), &field)
+		matches := make(map[string]json.RawMessage)
+		for key, node := range d.nodes {
+			id := strings.TrimPrefix(key, path+"/")
+			if id == key || strings.Contains(id, "/") {
+				continue
+			}
+			var child map[string]json.RawMessage
+			json.Unmarshal(node, &child)
+			if string(child[field]) == r.URL.Query().Get("equalTo") {
+				matches[id] = node
+			}
+		}
+		json.NewEncoder(w).Encode(matches)
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		d.nodes[path] = body
+		w.Write(body)
+	case http.MethodDelete:
+		delete(d.nodes, path)
+		io.WriteString(w, "null")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// set stores the value at the path.
+func (d *fakeDatabase) set(t *testing.T, path string, value interface{}) {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.nodes[path] = data
+	d.mu.Unlock()
+}
+
+// newRepositoryForTest returns a repository on a fake database.
+func newRepositoryForTest(t *testing.T) (*FirestoreRepository, *fakeDatabase) {
+	t.Helper()
+	database := &fakeDatabase{nodes: make(map[string]json.RawMessage)}
+	server := httptest.NewServer(database)
+	t.Cleanup(server.Close)
+
+	// A URL without a scheme addresses an emulator, without credentials
+	host := strings.TrimPrefix(server.URL, "http://127.0.0.1")
+	app, err := firebase.NewApp(context.Background(), &firebase.Config{
+		DatabaseURL: "localhost" + host + "?ns=test",
+		ProjectID:   "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := app.Database(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFirestoreRepository(client), database
+}
+
+func TestGetUserByAPIKey(t *testing.T) {
+	repo, database := newRepositoryForTest(t)
+	ctx := context.Background()
+	database.set(t, "/api-image-converter-users/user-1", models.User{Subscription: "pro"})
+	if err := repo.UpdateUserKeys(ctx, "user-1", []string{"key-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := repo.GetUserByAPIKey(ctx, "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != "user-1" || user.Subscription != "pro" {
+		t.Errorf("user = %+v, want user-1 on pro", user)
+	}
+
+	// Unknown and removed keys find no user
+	if user, err := repo.GetUserByAPIKey(ctx, "unknown"); err == nil {
+		t.Errorf("unknown key found %+v", user)
+	}
+	if err := repo.UpdateUserKeys(ctx, "user-1", []string{"key-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := repo.GetUserByAPIKey(ctx, "key-1"); err == nil {
+		t.Errorf("removed key found %+v", user)
+	}
+	if _, err := repo.GetUserByAPIKey(ctx, "key-2"); err != nil {
+		t.Errorf("new key: %v", err)
+	}
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	repo, database := newRepositoryForTest(t)
+	ctx := context.Background()
+	database.set(t, "/api-image-converter-users/user-1", models.User{Email: "a@example.com"})
+
+	user, err := repo.GetUserByEmail(ctx, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != "user-1" {
+		t.Errorf("user ID = %q, want user-1", user.ID)
+	}
+
+	// No match is an error rather than an empty user
+	if user, err := repo.GetUserByEmail(ctx, "b@example.com"); err == nil {
+		t.Errorf("unknown email found %+v", user)
+	}
+}
+
+func TestGetSigningKey_MalformedID(t *testing.T) {
+	repo, database := newRepositoryForTest(t)
+	ctx := context.Background()
+	database.set(t, "/api-image-converter-signing-keys/AKID1", models.SigningKey{UserID: "user-1", Secret: "s3cret"})
+
+	if key, err := repo.GetSigningKey(ctx, "AKID1"); err != nil || key.Secret != "s3cret" {
+		t.Fatalf("GetSigningKey(AKID1) = %+v, %v", key, err)
+	}
+
+	// IDs addressing other nodes are refused
+	for _, keyID := range []string{"", "AKID1/..", "AKID1.x", "AKID1#", "$AKID1", "AKID1[0]", strings.Repeat("A", 129)} {
+		if key, err := repo.GetSigningKey(ctx, keyID); err == nil {
+			t.Errorf("GetSigningKey(%q) = %+v, want an error", keyID, key)
+		}
+	}
+}
+
+func TestGetUserByID(t *testing.T) {
+	repo, database := newRepositoryForTest(t)
+	ctx := context.Background()
+	database.set(t, "/api-image-converter-users/user-1", models.User{Subscription: "pro"})
+
+	user, err := repo.GetUserByID(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != "user-1" || user.Subscription != "pro" {
+		t.Errorf("user = %+v, want user-1 on pro", user)
+	}
+
+	// Missing users and IDs addressing other nodes are errors
+	for _, userID := range []string{"user-2", "", "user-1/keys", "..", "user.1"} {
+		if user, err := repo.GetUserByID(ctx, userID); err == nil {
+			t.Errorf("GetUserByID(%q) = %+v, want an error", userID, user)
+		}
+	}
+}
+
+func TestUsage_InvalidUserID(t *testing.T) {
+	repo, _ := newRepositoryForTest(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	for _, userID := range []string{"", "user-1/keys", "..", "user.1"} {
+		if err := repo.AppendUsageEvent(ctx, &models.UsageEvent{UserID: userID, Timestamp: now}); err == nil {
+			t.Errorf("AppendUsageEvent(%q): want an error", userID)
+		}
+		if _, err := repo.ListUsageEvents(ctx, userID, time.Time{}, now); err == nil {
+			t.Errorf("ListUsageEvents(%q): want an error", userID)
+		}
+		if err := repo.SetUserUsage(ctx, userID, 1, 1); err == nil {
+			t.Errorf("SetUserUsage(%q): want an error", userID)
+		}
+		if _, err := repo.ListUsagePeriods(ctx, userID); err == nil {
+			t.Errorf("ListUsagePeriods(%q): want an error", userID)
+		}
+		if err := repo.SetUsagePeriod(ctx, userID, models.UsagePeriod{Start: now}); err == nil {
+			t.Errorf("SetUsagePeriod(%q): want an error", userID)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Header is the request and response header carrying the request ID.
+const Header = "X-Request-ID"
+
+// MaxLength is the length of the longest request ID accepted from clients.
+const MaxLength = 128
+
+// contextKey stores the request ID in a context
+type contextKey struct{}
+
+// NewContext returns a context carrying the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID of the context, or "" if there is
+// none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// New returns a random request ID of 32 hex characters.
+func New() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// Valid reports whether a client-supplied request ID may be used: 1 to
+// MaxLength letters, digits, '-', '_', '.' or ':', so it cannot inject
+// anything into logs or headers.
+func Valid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Transport is an http.RoundTripper sending the request ID of each
+// outgoing request's context in its X-Request-ID header, e.g. for webhook
+// calls made while serving a request.
+type Transport struct {
+	// Base sends the requests. It defaults to http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+// RoundTrip sends the request with the request ID of its context.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// Round trippers must not modify the caller's request
+	if id := FromContext(req.Context()); id != "" && req.Header.Get(Header) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(Header, id)
+	}
+	return base.RoundTrip(req)
+}
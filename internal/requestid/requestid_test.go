@@ -0,0 +1,51 @@
+package requestid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	tests := map[string]bool{
+		"":                             false,
+		New():                          true,
+		"trace-1:span_2.a":             true,
+		strings.Repeat("a", 128):       true,
+		strings.Repeat("a", 129):       false,
+		"bad id":                       false,
+		"bad\nid":                      false,
+		"<script>":                     false,
+		"9f86d081884c7d659a2feaa0c55a": true,
+	}
+	for id, want := range tests {
+		if got := Valid(id); got != want {
+			t.Errorf("Valid(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestTransport_SendsRequestID(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(Header)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{}}
+	req, _ := http.NewRequestWithContext(NewContext(context.Background(), "abc"), http.MethodPost, server.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got != "abc" {
+		t.Errorf("%s = %q, want abc", Header, got)
+	}
+	if req.Header.Get(Header) != "" {
+		t.Error("the caller's request was modified")
+	}
+}
@@ -0,0 +1,61 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/middleware"
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+)
+
+// pprofProfiles are the runtime profiles served by name. pprof.Index only
+// links to them, so each needs its own route.
+var pprofProfiles = []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"}
+
+// SetupDebugRouter returns a router serving only the pprof profiling
+// endpoints, for a separate listener that is not exposed with the API.
+// Access is restricted in the same way as with WithPprof.
+func SetupDebugRouter(opts ...Option) *mux.Router {
+	// Apply the router options
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	router := mux.NewRouter()
+	security := middleware.NewSecurityMiddleware(o.security)
+	ipFilter := middleware.NewIPFilter(o.ipFilter)
+	registerPprofRoutes(router, debugChain(o, middleware.NewRequestIDMiddleware(o.requestID), middleware.NewAccessLogMiddleware(o.accessLog), security, ipFilter))
+
+	return router
+}
+
+// debugChain returns the middleware chain for the debug endpoints. They
+// accept the API credentials plus the debug authenticators, and are only
+// open to admins and debug token holders.
+func debugChain(o *options, requestID, accessLog, security func(http.Handler) http.Handler, ipFilter *middleware.IPFilter) alice.Chain {
+	authenticators := append(append([]middleware.Authenticator{}, o.authenticators...), o.debugAuthenticators...)
+
+	return alice.New(
+		requestID,
+		accessLog,
+		security,
+		ipFilter.Middleware,
+		middleware.NewAuthenticationMiddleware(authenticators...),
+		middleware.RequireAnyRole("admin", middleware.DebugRole),
+		middleware.NewLoggingMiddleware(o.logging),
+	)
+}
+
+// registerPprofRoutes mounts the pprof endpoints under /debug/pprof/.
+func registerPprofRoutes(router *mux.Router, chain alice.Chain) {
+	router.Handle("/debug/pprof/", chain.ThenFunc(pprof.Index)).Methods("GET")
+	router.Handle("/debug/pprof/cmdline", chain.ThenFunc(pprof.Cmdline)).Methods("GET")
+	router.Handle("/debug/pprof/profile", chain.ThenFunc(pprof.Profile)).Methods("GET")
+	router.Handle("/debug/pprof/symbol", chain.ThenFunc(pprof.Symbol)).Methods("GET", "POST")
+	router.Handle("/debug/pprof/trace", chain.ThenFunc(pprof.Trace)).Methods("GET")
+	for _, profile := range pprofProfiles {
+		router.Handle("/debug/pprof/"+profile, chain.Then(pprof.Handler(profile))).Methods("GET")
+	}
+}
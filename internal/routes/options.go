@@ -0,0 +1,236 @@
+package routes
+
+import (
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/handlers"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/health"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/middleware"
+)
+
+// Option configures the router built by SetupRouter.
+type Option func(*options)
+
+// options holds the dependencies of the router's middleware chain.
+type options struct {
+	authenticators []middleware.Authenticator
+	oauth          *handlers.OAuthHandler
+	security       middleware.SecurityConfig
+	cors           middleware.CORSConfig
+	ipFilter       middleware.IPFilterConfig
+	rateLimit      middleware.RateLimitConfig
+	quota          middleware.QuotaConfig
+	quotas         *middleware.Quota
+	cost           middleware.CostConfig
+	plan           middleware.PlanConfig
+	requestID      middleware.RequestIDConfig
+	tracing        middleware.TracingConfig
+	logging        middleware.LoggingConfig
+	accessLog      middleware.AccessLogConfig
+	conditional    middleware.ConditionalConfig
+	cache          middleware.CacheConfig
+	coalesce       middleware.CoalesceConfig
+	usageMeter     *middleware.UsageMeter
+	usageReports   handlers.UsageReporter
+	health         *health.Registry
+
+	// metrics mounts the Prometheus metrics endpoint
+	metrics bool
+
+	// pprof mounts the profiling endpoints on the API router
+	pprof               bool
+	debugAuthenticators []middleware.Authenticator
+}
+
+// defaultOptions returns the options used when none are given.
+func defaultOptions() *options {
+	return &options{
+		security:    middleware.DefaultSecurityConfig(),
+		cors:        middleware.DefaultCORSConfig(),
+		ipFilter:    middleware.DefaultIPFilterConfig(),
+		rateLimit:   middleware.DefaultRateLimitConfig(),
+		quota:       middleware.DefaultQuotaConfig(),
+		cost:        middleware.DefaultCostConfig(),
+		plan:        middleware.DefaultPlanConfig(),
+		requestID:   middleware.DefaultRequestIDConfig(),
+		tracing:     middleware.DefaultTracingConfig(),
+		logging:     middleware.DefaultLoggingConfig(),
+		accessLog:   middleware.DefaultAccessLogConfig(),
+		conditional: middleware.DefaultConditionalConfig(),
+		cache:       middleware.DefaultCacheConfig(),
+		coalesce:    middleware.DefaultCoalesceConfig(),
+	}
+}
+
+// WithAuthenticators sets the credential types accepted by the
+// authentication middleware, tried in order. Without any, requests are not
+// authenticated.
+func WithAuthenticators(authenticators ...middleware.Authenticator) Option {
+	return func(o *options) {
+		o.authenticators = append(o.authenticators, authenticators...)
+	}
+}
+
+// WithOAuth registers the OAuth2 token, introspection and revocation
+// endpoints served by the given handler.
+func WithOAuth(oauth *handlers.OAuthHandler) Option {
+	return func(o *options) {
+		o.oauth = oauth
+	}
+}
+
+// WithSecurityConfig sets the HTTPS enforcement and security header
+// configuration of the security middleware.
+func WithSecurityConfig(config middleware.SecurityConfig) Option {
+	return func(o *options) {
+		o.security = config
+	}
+}
+
+// WithCORSConfig sets the origins and headers allowed for browser clients.
+func WithCORSConfig(config middleware.CORSConfig) Option {
+	return func(o *options) {
+		o.cors = config
+	}
+}
+
+// WithIPFilterConfig sets the client IP resolution, allow and deny lists
+// and automatic ban settings.
+func WithIPFilterConfig(config middleware.IPFilterConfig) Option {
+	return func(o *options) {
+		o.ipFilter = config
+	}
+}
+
+// WithRateLimitConfig sets the default, per-tier and per-route rate limits.
+func WithRateLimitConfig(config middleware.RateLimitConfig) Option {
+	return func(o *options) {
+		o.rateLimit = config
+	}
+}
+
+// WithQuotaConfig sets the default request quota and how it is counted.
+func WithQuotaConfig(config middleware.QuotaConfig) Option {
+	return func(o *options) {
+		o.quota = config
+	}
+}
+
+// WithQuota enforces the quotas with the given Quota instead of one created
+// from the quota configuration, so its owner can close it on shutdown.
+func WithQuota(quota *middleware.Quota) Option {
+	return func(o *options) {
+		o.quotas = quota
+	}
+}
+
+// WithCostConfig sets how the cost of image requests charged to rate
+// limits and quotas is computed.
+func WithCostConfig(config middleware.CostConfig) Option {
+	return func(o *options) {
+		o.cost = config
+	}
+}
+
+// WithPlanConfig sets the subscription plans restricting the operations
+// and image sizes of image requests.
+func WithPlanConfig(config middleware.PlanConfig) Option {
+	return func(o *options) {
+		o.plan = config
+	}
+}
+
+// WithRequestIDConfig sets whether request IDs sent by clients are used.
+func WithRequestIDConfig(config middleware.RequestIDConfig) Option {
+	return func(o *options) {
+		o.requestID = config
+	}
+}
+
+// WithTracingConfig sets how the spans of requests continue their callers'
+// traces and are sampled.
+func WithTracingConfig(config middleware.TracingConfig) Option {
+	return func(o *options) {
+		o.tracing = config
+	}
+}
+
+// WithLoggingConfig sets the request logger, the logged request headers and
+// the redacted credentials.
+func WithLoggingConfig(config middleware.LoggingConfig) Option {
+	return func(o *options) {
+		o.logging = config
+	}
+}
+
+// WithAccessLogConfig sets the format and destination of the access log.
+func WithAccessLogConfig(config middleware.AccessLogConfig) Option {
+	return func(o *options) {
+		o.accessLog = config
+	}
+}
+
+// WithConditionalConfig sets the methods answered with 304 Not Modified and
+// the default caching headers of responses.
+func WithConditionalConfig(config middleware.ConditionalConfig) Option {
+	return func(o *options) {
+		o.conditional = config
+	}
+}
+
+// WithCacheConfig sets the response cache of billable endpoints and how
+// long responses are kept.
+func WithCacheConfig(config middleware.CacheConfig) Option {
+	return func(o *options) {
+		o.cache = config
+	}
+}
+
+// WithCoalesceConfig sets which identical concurrent image requests are
+// processed once and share their response.
+func WithCoalesceConfig(config middleware.CoalesceConfig) Option {
+	return func(o *options) {
+		o.coalesce = config
+	}
+}
+
+// WithUsage meters billable requests with the given meter and serves
+// usage reports at /api/v1/usage.
+func WithUsage(meter *middleware.UsageMeter, reports handlers.UsageReporter) Option {
+	return func(o *options) {
+		o.usageMeter = meter
+		o.usageReports = reports
+	}
+}
+
+// WithHealth sets the registry of checks run by the /livez and /readyz
+// probes. The router adds its own checks to it.
+func WithHealth(registry *health.Registry) Option {
+	return func(o *options) {
+		o.health = registry
+	}
+}
+
+// WithMetrics mounts the Prometheus metrics endpoint at /metrics. It is not
+// authenticated, so restrict it to scrapers with the IP filter or at the
+// load balancer.
+func WithMetrics() Option {
+	return func(o *options) {
+		o.metrics = true
+	}
+}
+
+// WithPprof mounts the pprof profiling endpoints under /debug/pprof/ on the
+// API router, restricted to admins and debug token holders. Use
+// SetupDebugRouter instead to serve them on a separate listener.
+func WithPprof() Option {
+	return func(o *options) {
+		o.pprof = true
+	}
+}
+
+// WithDebugAuthenticators sets extra credential types accepted only by the
+// debug endpoints, such as a time-boxed debug token.
+func WithDebugAuthenticators(authenticators ...middleware.Authenticator) Option {
+	return func(o *options) {
+		o.debugAuthenticators = append(o.debugAuthenticators, authenticators...)
+	}
+}
@@ -1,50 +1,157 @@
 package routes
 
 import (
-	// "net/http"
-	"net/http/pprof"
+	"net/http"
 
 	"github.com/NathanielRand/boilerplate-go-api-clean/internal/handlers"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/health"
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/metrics"
 	"github.com/NathanielRand/boilerplate-go-api-clean/internal/middleware"
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 )
 
-func SetupRouter() *mux.Router {
+func SetupRouter(opts ...Option) *mux.Router {
+	// Apply the router options
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	// Initialize a new router from the Gorilla Mux library
 	router := mux.NewRouter()
 
-	// Create a new middleware chain using the Alice library
-	chain := alice.New()
+	// Create a new middleware chain using the Alice library, starting with
+	// the request ID, the request span and the access log so every request
+	// is recorded under its ID, and the request metrics so rejected
+	// requests are counted
+	requestID := middleware.NewRequestIDMiddleware(o.requestID)
+	tracing := middleware.NewTracingMiddleware(o.tracing)
+	accessLog := middleware.NewAccessLogMiddleware(o.accessLog)
+	chain := alice.New(requestID, tracing, accessLog, middleware.MetricsMiddleware)
 
-	// Add middleware to the chain for authentication, rate limiting, caching, and quotas
-	chain = chain.Append(middleware.SecurityMiddleware)
-	chain = chain.Append(middleware.AuthenticationMiddleware)
+	// Add middleware to the chain for authentication, rate limiting, caching,
+	// and quotas. Each stage is recorded in a span of the request's trace.
+	stage := middleware.TraceStage
+	security := middleware.NewSecurityMiddleware(o.security)
+	ipFilter := middleware.NewIPFilter(o.ipFilter)
+	chain = chain.Append(stage("security", security))
+	chain = chain.Append(stage("ip_filter", ipFilter.Middleware))
+	chain = chain.Append(stage("authentication", middleware.NewAuthenticationMiddleware(o.authenticators...)))
+	chain = chain.Append(stage("user_ip_filter", ipFilter.UserMiddleware))
 	// chain = chain.Append(func(next http.Handler) http.Handler {
 	// 	return middleware.AuthorizationMiddleware(next, "admin")
 	// })
-	// chain = chain.Append(middleware.RateLimitingMiddleware)
-	// chain = chain.Append(middleware.QuotaMiddleware)
-	// chain = chain.Append(middleware.CachingMiddleware)
-	chain = chain.Append(middleware.LoggingMiddleware)
+	chain = chain.Append(stage("plan", middleware.NewPlanMiddleware(o.plan)))
+	chain = chain.Append(stage("cost", middleware.NewCostMiddleware(o.cost)))
+	chain = chain.Append(stage("plan_image", middleware.NewPlanImageMiddleware(o.plan)))
+	chain = chain.Append(stage("rate_limit", middleware.NewRateLimitingMiddleware(o.rateLimit)))
+	quota := middleware.NewQuotaMiddleware(o.quota)
+	if o.quotas != nil {
+		quota = o.quotas.Middleware
+	}
+	chain = chain.Append(stage("quota", quota))
+	logging := middleware.NewLoggingMiddleware(o.logging)
+	chain = chain.Append(logging)
+	chain = chain.Append(stage("conditional", middleware.NewConditionalMiddleware(o.conditional)))
+
+	// OAuth2 access tokens must also be granted the scope of the endpoint
+	scope := func(scope string) alice.Constructor {
+		return stage("scope", middleware.RequireScope(scope))
+	}
+
+	// Billable endpoints are also recorded in the usage ledger, and their
+	// responses cached. Cache hits are still metered. Identical requests
+	// missing the cache at the same time are processed once.
+	if o.cache.Cache == nil {
+		o.cache.Cache = middleware.NewLRUCache(64 << 20)
+	}
+	coalescer := middleware.NewCoalescer(o.coalesce)
+	billable := func(chain alice.Chain) alice.Chain {
+		if o.usageMeter != nil {
+			chain = chain.Append(stage("usage", o.usageMeter.Middleware))
+		}
+		chain = chain.Append(stage("cache", middleware.NewCachingMiddleware(o.cache)))
+		return chain.Append(stage("coalesce", coalescer.Middleware))
+	}
 
 	// API endpoints to the router
 
 	// General endpoints
-	router.Handle("/api/v1/hello", chain.ThenFunc(handlers.HelloHandler)).Methods("GET")
-	router.Handle("/api/v1/health", chain.ThenFunc(handlers.HealthHandler)).Methods("GET")
+	router.Handle("/api/v1/hello", billable(chain.Append(scope("images:read"))).ThenFunc(handlers.HelloHandler)).Methods("GET")
+
+	// Usage reports
+	if o.usageReports != nil {
+		usage := handlers.NewUsageHandler(o.usageReports)
+		router.Handle("/api/v1/usage", chain.Append(scope("usage:read")).ThenFunc(usage.GetUsageHandler)).Methods("GET")
+	}
+
+	// OAuth2 endpoints authenticate the client themselves, so they use a
+	// chain without the authentication middleware
+	if o.oauth != nil {
+		oauthChain := alice.New(requestID, tracing, accessLog, middleware.MetricsMiddleware, stage("security", security), stage("ip_filter", ipFilter.Middleware), logging)
+		router.Handle("/oauth/token", oauthChain.ThenFunc(o.oauth.TokenHandler)).Methods("POST")
+		router.Handle("/oauth/introspect", oauthChain.ThenFunc(o.oauth.IntrospectHandler)).Methods("POST")
+		router.Handle("/oauth/revoke", oauthChain.ThenFunc(o.oauth.RevokeHandler)).Methods("POST")
+	}
+
+	// Admin endpoints
+	adminChain := chain.Append(stage("authorization", middleware.RequireRole("admin")), scope("admin"))
+	bans := handlers.NewBansHandler(ipFilter)
+	router.Handle("/admin/bans", adminChain.ThenFunc(bans.ListBansHandler)).Methods("GET")
+	router.Handle("/admin/bans/{ip}", adminChain.ThenFunc(bans.LiftBanHandler)).Methods("DELETE")
+	cache := handlers.NewCacheHandler(o.cache.Cache)
+	router.Handle("/admin/cache", adminChain.ThenFunc(cache.CacheStatsHandler)).Methods("GET")
+	router.Handle("/admin/cache", adminChain.ThenFunc(cache.PurgeCacheHandler)).Methods("DELETE")
 
 	// User endpoints
-	// router.Handle("/api/v1/image/convert", chain.ThenFunc(handlers.ImageConvertHandler)).Methods("POST")
-	// router.Handle("/api/v1/image/resize", chain.ThenFunc(handlers.ImageResizeHandler)).Methods("POST")
-	// router.Handle("/api/v1/image/crop", chain.ThenFunc(handlers.ImageCropHandler)).Methods("POST")
-
-	// Debug endpoints
-	router.HandleFunc("/debug/pprof/", pprof.Index)
-	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// imageChain := billable(chain.Append(scope("images:write")))
+	// router.Handle("/api/v1/image/convert", imageChain.ThenFunc(handlers.ImageConvertHandler)).Methods("POST")
+	// router.Handle("/api/v1/image/resize", imageChain.ThenFunc(handlers.ImageResizeHandler)).Methods("POST")
+	// router.Handle("/api/v1/image/crop", imageChain.ThenFunc(handlers.ImageCropHandler)).Methods("POST")
+
+	// Liveness and readiness probes, open to load balancers and
+	// orchestrators. Admins can ask for the result of every check with
+	// ?verbose. Readiness fails while image processing is saturated.
+	if o.health == nil {
+		o.health = health.NewRegistry()
+	}
+	if o.coalesce.MaxProcessing > 0 {
+		o.health.Register("image_workers", health.SaturationCheck(coalescer.Processing, o.coalesce.MaxProcessing), health.DefaultCheckConfig())
+	}
+	probes := handlers.NewProbeHandler(o.health)
+	probeChain := alice.New(requestID)
+	verbose := func(r *http.Request, rm *mux.RouteMatch) bool {
+		_, ok := r.URL.Query()["verbose"]
+		return ok
+	}
+	router.Handle("/livez", adminChain.ThenFunc(probes.VerboseLivenessHandler)).Methods("GET").MatcherFunc(verbose)
+	router.Handle("/livez", probeChain.ThenFunc(probes.LivenessHandler)).Methods("GET")
+	router.Handle("/readyz", adminChain.ThenFunc(probes.VerboseReadinessHandler)).Methods("GET").MatcherFunc(verbose)
+	router.Handle("/readyz", probeChain.ThenFunc(probes.ReadinessHandler)).Methods("GET")
+
+	// The original health endpoint reports readiness to API clients
+	router.Handle("/api/v1/health", chain.ThenFunc(probes.ReadinessHandler)).Methods("GET")
+
+	// Metrics endpoint for Prometheus scrapers, including the response
+	// cache statistics
+	if o.metrics {
+		middleware.RegisterCacheMetrics(metrics.Default, o.cache.Cache)
+		metricsChain := alice.New(requestID, security, ipFilter.Middleware)
+		router.Handle("/metrics", metricsChain.Then(metrics.Default.Handler())).Methods("GET")
+	}
+
+	// Debug endpoints, only when enabled and restricted to admins
+	if o.pprof {
+		registerPprofRoutes(router, debugChain(o, requestID, accessLog, security, ipFilter))
+	}
+
+	// CORS headers for browser clients. Preflight requests are answered
+	// by a catch-all OPTIONS route, registered last so it only matches
+	// paths whose routes do not handle OPTIONS themselves.
+	cors := middleware.NewCORS(o.cors, router)
+	router.Use(cors.Middleware)
+	router.Methods(http.MethodOptions).Handler(cors.PreflightHandler())
 
 	return router
 }
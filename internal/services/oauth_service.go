@@ -0,0 +1,332 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+var (
+	// ErrInvalidClient is returned when OAuth2 client authentication fails.
+	ErrInvalidClient = errors.New("invalid_client")
+
+	// ErrInvalidScope is returned when a client requests scopes it is not
+	// allowed.
+	ErrInvalidScope = errors.New("invalid_scope")
+
+	// ErrInvalidToken is returned for malformed, expired or revoked tokens.
+	ErrInvalidToken = errors.New("invalid_token")
+)
+
+// OAuthClientStore looks up users by their OAuth2 client IDs.
+// *repositories.FirestoreRepository satisfies this interface.
+type OAuthClientStore interface {
+	GetUserByOAuthClientID(ctx context.Context, clientID string) (*models.User, error)
+}
+
+// TokenRevocationStore records revoked access tokens.
+// *repositories.FirestoreRepository satisfies this interface.
+type TokenRevocationStore interface {
+	RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, tokenID string) (bool, error)
+}
+
+// OAuthConfig configures the OAuthService.
+type OAuthConfig struct {
+	// Issuer is the "iss" claim of issued tokens.
+	Issuer string
+
+	// SigningKey is the HMAC-SHA256 key tokens are signed with.
+	SigningKey []byte
+
+	// TokenTTL is how long issued tokens are valid for.
+	TokenTTL time.Duration
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// OAuthService issues and verifies OAuth2 access tokens for the
+// client_credentials grant.
+type OAuthService struct {
+	clients     OAuthClientStore
+	revocations TokenRevocationStore
+	config      OAuthConfig
+}
+
+// NewOAuthService creates a new OAuthService.
+func NewOAuthService(clients OAuthClientStore, revocations TokenRevocationStore, config OAuthConfig) *OAuthService {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	if config.TokenTTL == 0 {
+		config.TokenTTL = 15 * time.Minute
+	}
+	return &OAuthService{
+		clients:     clients,
+		revocations: revocations,
+		config:      config,
+	}
+}
+
+// tokenHeader is the JOSE header of every issued token.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"at+jwt"}`))
+
+// tokenClaims are the JWT claims of an access token.
+type tokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+	ID       string `json:"jti"`
+}
+
+// AuthenticateClient verifies an OAuth2 client's credentials and returns
+// the owning user and the client.
+func (s *OAuthService) AuthenticateClient(ctx context.Context, clientID, clientSecret string) (*models.User, *models.OAuthClient, error) {
+	if clientID == "" || clientSecret == "" {
+		return nil, nil, ErrInvalidClient
+	}
+
+	user, err := s.clients.GetUserByOAuthClientID(ctx, clientID)
+	if err != nil || user == nil {
+		return nil, nil, ErrInvalidClient
+	}
+
+	for i := range user.OAuthClients {
+		client := &user.OAuthClients[i]
+		if client.ID != clientID {
+			continue
+		}
+		if client.Disabled || !VerifyClientSecret(client.SecretHash, clientSecret) {
+			return nil, nil, ErrInvalidClient
+		}
+		return user, client, nil
+	}
+
+	return nil, nil, ErrInvalidClient
+}
+
+// IssueToken authenticates the client and issues an access token for the
+// requested scopes. With no scopes requested, all of the client's scopes
+// are granted.
+func (s *OAuthService) IssueToken(ctx context.Context, clientID, clientSecret string, scopes []string) (string, *models.AccessToken, error) {
+	user, client, err := s.AuthenticateClient(ctx, clientID, clientSecret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Only grant scopes the client is allowed
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		if !containsScope(client.Scopes, scope) {
+			return "", nil, ErrInvalidScope
+		}
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := s.config.Now().UTC().Truncate(time.Second)
+	token := &models.AccessToken{
+		ID:        id,
+		UserID:    user.ID,
+		ClientID:  client.ID,
+		Scopes:    scopes,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.config.TokenTTL),
+	}
+
+	signed, err := s.sign(token)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, token, nil
+}
+
+// VerifyAccessToken checks the token's signature, issuer, expiry and
+// revocation status and returns its claims.
+func (s *OAuthService) VerifyAccessToken(ctx context.Context, token string) (*models.AccessToken, error) {
+	claims, err := s.parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.config.Now().Before(claims.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+
+	revoked, err := s.revocations.IsTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// RevokeToken revokes a token issued to the given user. Tokens that are
+// invalid or belong to another user are ignored, as RFC 7009 requires.
+func (s *OAuthService) RevokeToken(ctx context.Context, token string, userID string) error {
+	claims, err := s.parse(token)
+	if err != nil || claims.UserID != userID {
+		return nil
+	}
+	if !s.config.Now().Before(claims.ExpiresAt) {
+		return nil
+	}
+	return s.revocations.RevokeToken(ctx, claims.ID, claims.ExpiresAt)
+}
+
+// sign encodes the token as a compact JWT signed with HMAC-SHA256.
+func (s *OAuthService) sign(token *models.AccessToken) (string, error) {
+	payload, err := json.Marshal(tokenClaims{
+		Issuer:   s.config.Issuer,
+		Subject:  token.UserID,
+		ClientID: token.ClientID,
+		Scope:    strings.Join(token.Scopes, " "),
+		IssuedAt: token.IssuedAt.Unix(),
+		Expiry:   token.ExpiresAt.Unix(),
+		ID:       token.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(s.mac(signingInput)), nil
+}
+
+// parse verifies the token's signature and issuer and decodes its claims.
+// It does not check expiry or revocation.
+func (s *OAuthService) parse(token string) (*models.AccessToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, s.mac(parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Issuer != s.config.Issuer || claims.Subject == "" || claims.ID == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return &models.AccessToken{
+		ID:        claims.ID,
+		UserID:    claims.Subject,
+		ClientID:  claims.ClientID,
+		Scopes:    strings.Fields(claims.Scope),
+		IssuedAt:  time.Unix(claims.IssuedAt, 0).UTC(),
+		ExpiresAt: time.Unix(claims.Expiry, 0).UTC(),
+	}, nil
+}
+
+// mac returns the HMAC-SHA256 of the signing input under the signing key.
+func (s *OAuthService) mac(signingInput string) []byte {
+	mac := hmac.New(sha256.New, s.config.SigningKey)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// NewOAuthClient generates a client ID and secret allowed the given scopes.
+// The returned client stores only a hash of the secret, which is returned
+// separately and cannot be recovered later.
+func NewOAuthClient(scopes []string) (*models.OAuthClient, string, error) {
+	id, err := randomToken(12)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	hash, err := HashClientSecret(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	return &models.OAuthClient{
+		ID:         id,
+		SecretHash: hash,
+		Scopes:     scopes,
+	}, secret, nil
+}
+
+// HashClientSecret returns a salted hash of a client secret in the form
+// "sha256$<salt>$<hash>". Client secrets are long random values, so a
+// salted SHA-256 is sufficient.
+func HashClientSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256$%s$%s", hex.EncodeToString(salt), hashSecret(salt, secret)), nil
+}
+
+// VerifyClientSecret reports whether secret matches a hash produced by
+// HashClientSecret.
+func VerifyClientSecret(hash, secret string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(parts[2]), []byte(hashSecret(salt, secret))) == 1
+}
+
+// hashSecret returns the hex SHA-256 of the salt followed by the secret.
+func hashSecret(salt []byte, secret string) string {
+	sum := sha256.Sum256(append(append([]byte(nil), salt...), secret...))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns n random bytes encoded as URL-safe base64.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// containsScope reports whether scopes contains scope.
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// fakeOAuthStore is an in-memory OAuthClientStore and TokenRevocationStore.
+type fakeOAuthStore struct {
+	users   map[string]*models.User
+	revoked map[string]time.Time
+}
+
+func (s *fakeOAuthStore) GetUserByOAuthClientID(ctx context.Context, clientID string) (*models.User, error) {
+	for _, user := range s.users {
+		for _, client := range user.OAuthClients {
+			if client.ID == clientID {
+				return user, nil
+			}
+		}
+	}
+	return nil, errors.New("client not found")
+}
+
+func (s *fakeOAuthStore) RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	s.revoked[tokenID] = expiresAt
+	return nil
+}
+
+func (s *fakeOAuthStore) IsTokenRevoked(ctx context.Context, tokenID string) (bool, error) {
+	_, ok := s.revoked[tokenID]
+	return ok, nil
+}
+
+func newTestOAuthService(t *testing.T, now *time.Time) (*OAuthService, *models.OAuthClient, string) {
+	t.Helper()
+	client, secret, err := NewOAuthClient([]string{"images:read", "images:write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeOAuthStore{
+		users: map[string]*models.User{
+			"user-1": {ID: "user-1", OAuthClients: []models.OAuthClient{*client}},
+		},
+		revoked: map[string]time.Time{},
+	}
+	service := NewOAuthService(store, store, OAuthConfig{
+		Issuer:     "test",
+		SigningKey: []byte("signing-key"),
+		TokenTTL:   10 * time.Minute,
+		Now:        func() time.Time { return *now },
+	})
+	return service, client, secret
+}
+
+func TestOAuthService_IssueAndVerify(t *testing.T) {
+	now := time.Date(2023, 4, 15, 10, 0, 0, 0, time.UTC)
+	service, client, secret := newTestOAuthService(t, &now)
+	ctx := context.Background()
+
+	token, issued, err := service.IssueToken(ctx, client.ID, secret, []string{"images:read"})
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	if issued.ExpiresAt.Sub(issued.IssuedAt) != 10*time.Minute {
+		t.Errorf("unexpected token lifetime: %v", issued.ExpiresAt.Sub(issued.IssuedAt))
+	}
+
+	claims, err := service.VerifyAccessToken(ctx, token)
+	if err != nil {
+		t.Fatalf("VerifyAccessToken: %v", err)
+	}
+	if claims.UserID != "user-1" || claims.ClientID != client.ID || strings.Join(claims.Scopes, " ") != "images:read" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	// Tokens stop verifying once they expire
+	now = now.Add(10 * time.Minute)
+	if _, err := service.VerifyAccessToken(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expired token: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestOAuthService_ClientAuthentication(t *testing.T) {
+	now := time.Now()
+	service, client, secret := newTestOAuthService(t, &now)
+	ctx := context.Background()
+
+	if _, _, err := service.IssueToken(ctx, client.ID, secret+"x", nil); !errors.Is(err, ErrInvalidClient) {
+		t.Errorf("wrong secret: expected ErrInvalidClient, got %v", err)
+	}
+	if _, _, err := service.IssueToken(ctx, "unknown", secret, nil); !errors.Is(err, ErrInvalidClient) {
+		t.Errorf("unknown client: expected ErrInvalidClient, got %v", err)
+	}
+	if _, _, err := service.IssueToken(ctx, client.ID, secret, []string{"admin"}); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("disallowed scope: expected ErrInvalidScope, got %v", err)
+	}
+
+	// Without requested scopes the client's scopes are granted
+	_, issued, err := service.IssueToken(ctx, client.ID, secret, nil)
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	if len(issued.Scopes) != 2 {
+		t.Errorf("expected all client scopes, got %v", issued.Scopes)
+	}
+}
+
+func TestOAuthService_TamperedToken(t *testing.T) {
+	now := time.Now()
+	service, client, secret := newTestOAuthService(t, &now)
+	ctx := context.Background()
+
+	token, _, err := service.IssueToken(ctx, client.ID, secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	other, _, _ := service.IssueToken(ctx, client.ID, secret, []string{"images:read"})
+	tampered := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+
+	for _, bad := range []string{tampered, token + "x", "not-a-token"} {
+		if _, err := service.VerifyAccessToken(ctx, bad); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("token %q: expected ErrInvalidToken, got %v", bad, err)
+		}
+	}
+
+	// A token signed with another key is rejected
+	service.config.SigningKey = []byte("other-key")
+	if _, err := service.VerifyAccessToken(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("foreign key: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestOAuthService_Revoke(t *testing.T) {
+	now := time.Now()
+	service, client, secret := newTestOAuthService(t, &now)
+	ctx := context.Background()
+
+	token, _, err := service.IssueToken(ctx, client.ID, secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another user cannot revoke the token
+	if err := service.RevokeToken(ctx, token, "user-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.VerifyAccessToken(ctx, token); err != nil {
+		t.Errorf("token revoked by another user: %v", err)
+	}
+
+	if err := service.RevokeToken(ctx, token, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.VerifyAccessToken(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("revoked token: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestClientSecretHash(t *testing.T) {
+	hash, err := HashClientSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(hash, "secret$") || !VerifyClientSecret(hash, "secret") {
+		t.Errorf("hash %q does not verify", hash)
+	}
+	if VerifyClientSecret(hash, "Secret") || VerifyClientSecret("plain", "plain") {
+		t.Errorf("unexpected verification success")
+	}
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"math"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// PricingEngine computes what users owe for their usage from the prices of
+// their subscription plans.
+type PricingEngine struct {
+	plans models.PlanCatalog
+}
+
+// NewPricingEngine creates a new PricingEngine pricing with the plans.
+func NewPricingEngine(plans models.PlanCatalog) *PricingEngine {
+	return &PricingEngine{
+		plans: plans,
+	}
+}
+
+// PeriodCharge returns what the user owes for a billing period in which
+// they used the given units: the plan's base price, the units within the
+// quota at the unit price, and the rest at the overage price, rounded to
+// the cent. Users without a plan owe nothing.
+func (e *PricingEngine) PeriodCharge(user *models.User, units int64) float64 {
+	plan, ok := e.plans.PlanFor(user)
+	if !ok {
+		return 0
+	}
+
+	// The user's own quota takes precedence over the plan's
+	quota := plan.Quota
+	if user.Quota > 0 {
+		quota = int64(user.Quota)
+	}
+	overagePrice := plan.OverageUnitPrice
+	if overagePrice == 0 {
+		overagePrice = plan.UnitPrice
+	}
+
+	included, overage := units, int64(0)
+	if quota > 0 && units > quota {
+		included, overage = quota, units-quota
+	}
+	charge := plan.BasePrice + float64(included)*plan.UnitPrice + float64(overage)*overagePrice
+	return math.Round(charge*100) / 100
+}
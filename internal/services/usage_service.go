@@ -0,0 +1,277 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// Granularities of usage reports.
+const (
+	GranularityDay   = "day"
+	GranularityMonth = "month"
+)
+
+// ErrInvalidUsageQuery is returned for usage queries with an unknown
+// granularity or an empty time range.
+var ErrInvalidUsageQuery = errors.New("invalid usage query")
+
+// UsageLedger appends and lists usage events.
+// *repositories.FirestoreRepository satisfies this interface.
+type UsageLedger interface {
+	AppendUsageEvent(ctx context.Context, event *models.UsageEvent) error
+	ListUsageEvents(ctx context.Context, userID string, from, to time.Time) ([]models.UsageEvent, error)
+}
+
+// UserUsageStore looks up users and stores their usage per billing period
+// and their volume and spend totals.
+// *repositories.FirestoreRepository satisfies this interface.
+type UserUsageStore interface {
+	GetUserByID(ctx context.Context, userID string) (*models.User, error)
+	ListUsagePeriods(ctx context.Context, userID string) ([]models.UsagePeriod, error)
+	SetUsagePeriod(ctx context.Context, userID string, period models.UsagePeriod) error
+	SetUserUsage(ctx context.Context, userID string, volume int, spend float64) error
+}
+
+// usageClockSkew allows for clock skew between the instances recording
+// usage events.
+const usageClockSkew = time.Minute
+
+// UsageQuery selects the usage events of a report.
+type UsageQuery struct {
+	// From and To bound the report to [From, To). To defaults to now and
+	// From to 30 days, or 12 months, before To.
+	From time.Time
+	To   time.Time
+
+	// Granularity is GranularityDay (the default) or GranularityMonth.
+	Granularity string
+
+	// Operation and KeyID, when set, only report matching events.
+	Operation string
+	KeyID     string
+}
+
+// UsageConfig configures the UsageService.
+type UsageConfig struct {
+	// Pricing computes users' spend from their usage. Without it, spend is
+	// the sum of the events' amounts.
+	Pricing *PricingEngine
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// UsageService records billable requests in the usage ledger, reports
+// usage from it and reconciles each user's volume and spend with it.
+type UsageService struct {
+	ledger UsageLedger
+	users  UserUsageStore
+	config UsageConfig
+
+	mu sync.Mutex
+
+	// pending holds the users with events recorded since their last
+	// reconciliation
+	pending map[string]bool
+}
+
+// NewUsageService creates a new UsageService.
+func NewUsageService(ledger UsageLedger, users UserUsageStore, config UsageConfig) *UsageService {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &UsageService{
+		ledger:  ledger,
+		users:   users,
+		config:  config,
+		pending: make(map[string]bool),
+	}
+}
+
+// RecordUsage appends an event to the ledger. The user's volume and spend
+// are updated by the next ReconcilePending.
+func (s *UsageService) RecordUsage(ctx context.Context, event models.UsageEvent) error {
+	if err := s.ledger.AppendUsageEvent(ctx, &event); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.pending[event.UserID] = true
+	s.mu.Unlock()
+	return nil
+}
+
+// Report aggregates a user's usage events matching the query, in total and
+// per day or month (in UTC). Only periods with usage are listed.
+func (s *UsageService) Report(ctx context.Context, userID string, query UsageQuery) (*models.UsageReport, error) {
+	// Fill in the defaults and check the range
+	layout, err := periodLayout(query.Granularity)
+	if err != nil {
+		return nil, err
+	}
+	if query.Granularity == "" {
+		query.Granularity = GranularityDay
+	}
+	if query.To.IsZero() {
+		query.To = s.config.Now()
+	}
+	if query.From.IsZero() {
+		if query.Granularity == GranularityMonth {
+			query.From = query.To.AddDate(0, -12, 0)
+		} else {
+			query.From = query.To.AddDate(0, 0, -30)
+		}
+	}
+	if !query.From.Before(query.To) {
+		return nil, ErrInvalidUsageQuery
+	}
+
+	events, err := s.ledger.ListUsageEvents(ctx, userID, query.From, query.To)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sum the matching events per period, in time order
+	report := &models.UsageReport{
+		UserID:      userID,
+		From:        query.From,
+		To:          query.To,
+		Granularity: query.Granularity,
+		Operation:   query.Operation,
+		KeyID:       query.KeyID,
+		Periods:     []models.UsageSummary{},
+	}
+	for _, event := range events {
+		if query.Operation != "" && event.Operation != query.Operation {
+			continue
+		}
+		if query.KeyID != "" && event.KeyID != query.KeyID {
+			continue
+		}
+
+		period := event.Timestamp.UTC().Format(layout)
+		if n := len(report.Periods); n == 0 || report.Periods[n-1].Period != period {
+			report.Periods = append(report.Periods, models.UsageSummary{Period: period})
+		}
+		report.Periods[len(report.Periods)-1].Add(event)
+		report.Total.Add(event)
+	}
+	return report, nil
+}
+
+// Reconcile recomputes a user's usage in the billing periods not yet
+// closed from the ledger, priced with the user's current plan, and stores
+// the user's volume (the number of billable requests) and spend across all
+// stored billing periods. A period is closed once it is reconciled after it
+// ended, and keeps the totals it was last reconciled with, so usually only
+// the current period is read. The whole ledger is only read the first time
+// a user is reconciled.
+func (s *UsageService) Reconcile(ctx context.Context, userID string) (int, float64, error) {
+	user, err := s.users.GetUserByID(ctx, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	stored, err := s.users.ListUsagePeriods(ctx, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Read the ledger from the end of the last period reconciled after it
+	// ended, or from its start if it may still get events
+	var from time.Time
+	now := s.config.Now()
+	if n := len(stored); n > 0 {
+		last := stored[n-1]
+		from = last.Start
+		if !last.ReconciledAt.Before(last.End.Add(usageClockSkew)) {
+			from = last.End
+		}
+	}
+	events, err := s.ledger.ListUsageEvents(ctx, userID, from, now.Add(usageClockSkew))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Total the events per billing period and store the totals
+	periods := make(map[time.Time]*models.UsagePeriod)
+	for _, event := range events {
+		start, end := models.BillingPeriod(user.BillingAnchor, event.Timestamp)
+		period, ok := periods[start]
+		if !ok {
+			period = &models.UsagePeriod{Start: start, End: end, ReconciledAt: now}
+			periods[start] = period
+		}
+		period.Requests++
+		period.Cost += event.Cost
+		period.Charge += event.Amount
+	}
+	for _, period := range periods {
+		if s.config.Pricing != nil {
+			period.Charge = s.config.Pricing.PeriodCharge(user, period.Cost)
+		}
+		if err := s.users.SetUsagePeriod(ctx, userID, *period); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Sum the stored periods, replaced by those just reconciled
+	var volume int
+	var spend float64
+	for _, period := range stored {
+		if _, ok := periods[period.Start]; !ok {
+			volume += period.Requests
+			spend += period.Charge
+		}
+	}
+	for _, period := range periods {
+		volume += period.Requests
+		spend += period.Charge
+	}
+	spend = math.Round(spend*100) / 100
+
+	if err := s.users.SetUserUsage(ctx, userID, volume, spend); err != nil {
+		return 0, 0, err
+	}
+	return volume, spend, nil
+}
+
+// ReconcilePending reconciles the users with events recorded by this
+// instance since their last reconciliation. Users that fail are retried on
+// the next call, and the first error is returned.
+func (s *UsageService) ReconcilePending(ctx context.Context) error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]bool)
+	s.mu.Unlock()
+
+	var firstErr error
+	for userID := range pending {
+		if _, _, err := s.Reconcile(ctx, userID); err != nil {
+			s.mu.Lock()
+			s.pending[userID] = true
+			s.mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// periodLayout returns the time layout naming the periods of a
+// granularity.
+func periodLayout(granularity string) (string, error) {
+	switch granularity {
+	case "", GranularityDay:
+		return "2006-01-02", nil
+	case GranularityMonth:
+		return "2006-01", nil
+	default:
+		return "", ErrInvalidUsageQuery
+	}
+}
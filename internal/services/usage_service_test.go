@@ -0,0 +1,236 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/models"
+)
+
+// memoryUsageLedger is an in-memory UsageLedger and UserUsageStore.
+type memoryUsageLedger struct {
+	events  []models.UsageEvent
+	periods map[string]map[time.Time]models.UsagePeriod
+	usage   map[string]models.UsageSummary
+	fail    bool
+
+	// from records the start of each range listed
+	from []time.Time
+
+	// subscription is the users' plan, "pro" by default
+	subscription string
+}
+
+func (l *memoryUsageLedger) AppendUsageEvent(ctx context.Context, event *models.UsageEvent) error {
+	l.events = append(l.events, *event)
+	return nil
+}
+
+func (l *memoryUsageLedger) ListUsageEvents(ctx context.Context, userID string, from, to time.Time) ([]models.UsageEvent, error) {
+	l.from = append(l.from, from)
+	var events []models.UsageEvent
+	for _, event := range l.events {
+		if event.UserID == userID && !event.Timestamp.Before(from) && event.Timestamp.Before(to) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (l *memoryUsageLedger) GetUserByID(ctx context.Context, userID string) (*models.User, error) {
+	subscription := l.subscription
+	if subscription == "" {
+		subscription = "pro"
+	}
+	return &models.User{ID: userID, Subscription: subscription, Quota: 2}, nil
+}
+
+func (l *memoryUsageLedger) ListUsagePeriods(ctx context.Context, userID string) ([]models.UsagePeriod, error) {
+	var periods []models.UsagePeriod
+	for _, period := range l.periods[userID] {
+		periods = append(periods, period)
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].Start.Before(periods[j].Start)
+	})
+	return periods, nil
+}
+
+func (l *memoryUsageLedger) SetUsagePeriod(ctx context.Context, userID string, period models.UsagePeriod) error {
+	if l.periods == nil {
+		l.periods = make(map[string]map[time.Time]models.UsagePeriod)
+	}
+	if l.periods[userID] == nil {
+		l.periods[userID] = make(map[time.Time]models.UsagePeriod)
+	}
+	l.periods[userID][period.Start] = period
+	return nil
+}
+
+func (l *memoryUsageLedger) SetUserUsage(ctx context.Context, userID string, volume int, spend float64) error {
+	if l.fail {
+		return errors.New("store unavailable")
+	}
+	if l.usage == nil {
+		l.usage = make(map[string]models.UsageSummary)
+	}
+	l.usage[userID] = models.UsageSummary{Requests: volume, Amount: spend}
+	return nil
+}
+
+func newUsageServiceForTest() (*UsageService, *memoryUsageLedger) {
+	ledger := &memoryUsageLedger{}
+	now := func() time.Time { return time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC) }
+	return NewUsageService(ledger, ledger, UsageConfig{Now: now}), ledger
+}
+
+func recordForTest(t *testing.T, s *UsageService, events ...models.UsageEvent) {
+	t.Helper()
+	for _, event := range events {
+		if err := s.RecordUsage(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUsageService_Report(t *testing.T) {
+	s, _ := newUsageServiceForTest()
+	at := func(month time.Month, day int) time.Time {
+		return time.Date(2023, month, day, 12, 0, 0, 0, time.UTC)
+	}
+	recordForTest(t, s,
+		models.UsageEvent{UserID: "user-1", KeyID: "key-1", Operation: "resize", Cost: 2, Timestamp: at(4, 30)},
+		models.UsageEvent{UserID: "user-1", KeyID: "key-1", Operation: "resize", Cost: 3, Timestamp: at(5, 2)},
+		models.UsageEvent{UserID: "user-1", KeyID: "key-2", Operation: "crop", Cost: 1, Timestamp: at(5, 2)},
+		models.UsageEvent{UserID: "user-2", KeyID: "key-3", Operation: "resize", Cost: 7, Timestamp: at(5, 2)},
+	)
+
+	tests := []struct {
+		name    string
+		query   UsageQuery
+		periods []string
+		cost    int64
+	}{
+		{"daily", UsageQuery{}, []string{"2023-05-02"}, 4},
+		{"monthly", UsageQuery{Granularity: GranularityMonth}, []string{"2023-04", "2023-05"}, 6},
+		{"by operation", UsageQuery{Granularity: GranularityMonth, Operation: "resize"}, []string{"2023-04", "2023-05"}, 5},
+		{"by key", UsageQuery{Granularity: GranularityMonth, KeyID: "key-2"}, []string{"2023-05"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := s.Report(context.Background(), "user-1", tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Total.Cost != tt.cost {
+				t.Errorf("total cost = %d, want %d", report.Total.Cost, tt.cost)
+			}
+			var periods []string
+			for _, period := range report.Periods {
+				periods = append(periods, period.Period)
+			}
+			if len(periods) != len(tt.periods) {
+				t.Fatalf("periods = %v, want %v", periods, tt.periods)
+			}
+			for i := range periods {
+				if periods[i] != tt.periods[i] {
+					t.Errorf("periods = %v, want %v", periods, tt.periods)
+				}
+			}
+		})
+	}
+}
+
+func TestUsageService_ReportInvalidQuery(t *testing.T) {
+	s, _ := newUsageServiceForTest()
+	for _, query := range []UsageQuery{
+		{Granularity: "hour"},
+		{From: time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if _, err := s.Report(context.Background(), "user-1", query); !errors.Is(err, ErrInvalidUsageQuery) {
+			t.Errorf("Report(%+v) error = %v, want ErrInvalidUsageQuery", query, err)
+		}
+	}
+}
+
+func TestUsageService_ReconcilePending(t *testing.T) {
+	s, ledger := newUsageServiceForTest()
+	at := time.Date(2023, 5, 2, 12, 0, 0, 0, time.UTC)
+	recordForTest(t, s,
+		models.UsageEvent{UserID: "user-1", Amount: 0.25, Timestamp: at},
+		models.UsageEvent{UserID: "user-1", Amount: 0.5, Timestamp: at},
+	)
+
+	// Users that fail are retried on the next call
+	ledger.fail = true
+	if err := s.ReconcilePending(context.Background()); err == nil {
+		t.Fatal("ReconcilePending succeeded with the store unavailable")
+	}
+	ledger.fail = false
+	if err := s.ReconcilePending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ledger.usage["user-1"]; got.Requests != 2 || got.Amount != 0.75 {
+		t.Errorf("volume, spend = %d, %v, want 2, 0.75", got.Requests, got.Amount)
+	}
+}
+
+func TestUsageService_ReconcileWithPricing(t *testing.T) {
+	s, _ := newUsageServiceForTest()
+	plans := models.PlanCatalog{"pro": {BasePrice: 10, UnitPrice: 0.5, OverageUnitPrice: 1}}
+	s.config.Pricing = NewPricingEngine(plans)
+
+	// Two billing periods: 3 units (1 over the quota of 2), then 1 unit
+	recordForTest(t, s,
+		models.UsageEvent{UserID: "user-1", Cost: 3, Timestamp: time.Date(2023, 4, 10, 0, 0, 0, 0, time.UTC)},
+		models.UsageEvent{UserID: "user-1", Cost: 1, Timestamp: time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC)},
+	)
+	volume, spend, err := s.Reconcile(context.Background(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume != 2 || spend != 22.5 {
+		t.Errorf("volume, spend = %d, %v, want 2, 22.5", volume, spend)
+	}
+}
+
+func TestUsageService_ReconcileCurrentPeriodOnly(t *testing.T) {
+	s, ledger := newUsageServiceForTest()
+	plans := models.PlanCatalog{
+		"pro":   {BasePrice: 10, UnitPrice: 0.5, OverageUnitPrice: 1},
+		"basic": {BasePrice: 5, UnitPrice: 0.25},
+	}
+	s.config.Pricing = NewPricingEngine(plans)
+	s.config.Now = func() time.Time { return time.Date(2023, 6, 2, 0, 0, 0, 0, time.UTC) }
+	recordForTest(t, s,
+		models.UsageEvent{UserID: "user-1", Cost: 3, Timestamp: time.Date(2023, 4, 10, 0, 0, 0, 0, time.UTC)},
+		models.UsageEvent{UserID: "user-1", Cost: 1, Timestamp: time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC)},
+	)
+	if _, _, err := s.Reconcile(context.Background(), "user-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A month later, on another plan, the past periods keep their charges
+	now := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	s.config.Now = func() time.Time { return now }
+	ledger.subscription = "basic"
+	recordForTest(t, s, models.UsageEvent{UserID: "user-1", Cost: 2, Timestamp: time.Date(2023, 6, 10, 0, 0, 0, 0, time.UTC)})
+	ledger.from = nil
+	volume, spend, err := s.Reconcile(context.Background(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume != 3 || spend != 28 {
+		t.Errorf("volume, spend = %d, %v, want 3, 28", volume, spend)
+	}
+
+	// The period ending before the previous reconciliation is not read
+	// again
+	if want := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC); len(ledger.from) != 1 || !ledger.from[0].Equal(want) {
+		t.Errorf("listed events from %v, want [%v]", ledger.from, want)
+	}
+}
@@ -0,0 +1,406 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NathanielRand/boilerplate-go-api-clean/internal/logging"
+	"go.opencensus.io/trace"
+)
+
+// StdoutExporter writes spans as JSON lines, for local development.
+type StdoutExporter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewStdoutExporter creates a new StdoutExporter writing to w.
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	return &StdoutExporter{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// stdoutSpan is a span as written by the StdoutExporter.
+type stdoutSpan struct {
+	Name          string                 `json:"name"`
+	TraceID       string                 `json:"trace_id"`
+	SpanID        string                 `json:"span_id"`
+	ParentSpanID  string                 `json:"parent_span_id,omitempty"`
+	Kind          string                 `json:"kind"`
+	Start         time.Time              `json:"start"`
+	DurationMS    float64                `json:"duration_ms"`
+	StatusCode    int32                  `json:"status_code"`
+	StatusMessage string                 `json:"status_message,omitempty"`
+	Attributes    map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// ExportSpan writes the span.
+func (e *StdoutExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.encoder.Encode(stdoutSpan{
+		Name:          s.Name,
+		TraceID:       s.TraceID.String(),
+		SpanID:        s.SpanID.String(),
+		ParentSpanID:  parentSpanID(s),
+		Kind:          spanKindName(s.SpanKind),
+		Start:         s.StartTime,
+		DurationMS:    float64(s.EndTime.Sub(s.StartTime)) / float64(time.Millisecond),
+		StatusCode:    s.Code,
+		StatusMessage: s.Message,
+		Attributes:    s.Attributes,
+	})
+}
+
+// spanSender sends a batch of spans to a tracing backend.
+type spanSender interface {
+	send(spans []*trace.SpanData) error
+}
+
+// batcher is an exporter collecting spans into batches sent in the
+// background, so ending a span never waits for the backend. Spans are
+// dropped while four batches are already waiting.
+type batcher struct {
+	size   int
+	sender spanSender
+
+	mu      sync.Mutex
+	pending []*trace.SpanData
+}
+
+// newBatcher creates a batcher sending batches of size spans, or the spans
+// waiting for interval if fewer.
+func newBatcher(size int, interval time.Duration, sender spanSender) *batcher {
+	if size <= 0 {
+		size = 512
+	}
+	b := &batcher{
+		size:   size,
+		sender: sender,
+	}
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				b.Flush()
+			}
+		}()
+	}
+	return b
+}
+
+// ExportSpan adds the span to the next batch, sending it once full.
+func (b *batcher) ExportSpan(s *trace.SpanData) {
+	b.mu.Lock()
+	if len(b.pending) >= 4*b.size {
+		b.mu.Unlock()
+		return
+	}
+	b.pending = append(b.pending, s)
+	var batch []*trace.SpanData
+	if len(b.pending) >= b.size {
+		batch = b.pending[:b.size:b.size]
+		b.pending = b.pending[b.size:]
+	}
+	b.mu.Unlock()
+
+	if batch != nil {
+		go b.send(batch)
+	}
+}
+
+// Flush sends the waiting spans.
+func (b *batcher) Flush() {
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > b.size {
+			n = b.size
+		}
+		b.send(batch[:n])
+		batch = batch[n:]
+	}
+}
+
+// send sends a batch, logging failures. Failed batches are not retried.
+func (b *batcher) send(batch []*trace.SpanData) {
+	if err := b.sender.send(batch); err != nil {
+		logging.Default().Warn("Could not export spans", "spans", len(batch), "error", err)
+	}
+}
+
+// postJSON posts the body as JSON, failing on non-2xx responses.
+func postJSON(client *http.Client, url string, headers map[string]string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// otlpSender sends spans to an OpenTelemetry collector with OTLP/HTTP in
+// its JSON encoding.
+type otlpSender struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+func (s *otlpSender) send(spans []*trace.SpanData) error {
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = otlpAttributes(map[string]interface{}{"service.name": s.serviceName})
+	var scope otlpScopeSpans
+	scope.Scope.Name = "go.opencensus.io/trace"
+
+	for _, span := range spans {
+		scope.Spans = append(scope.Spans, otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			ParentSpanID:      parentSpanID(span),
+			Name:              span.Name,
+			Kind:              otlpSpanKind(span.SpanKind),
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            otlpSpanStatus(span.Status),
+		})
+	}
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return postJSON(s.client, s.endpoint, s.headers, map[string]interface{}{
+		"resourceSpans": []otlpResourceSpans{resource},
+	})
+}
+
+// otlpAttributes converts span attributes to OTLP key-values, sorted by
+// key.
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]otlpKeyValue, 0, len(keys))
+	for _, key := range keys {
+		var value otlpAnyValue
+		switch v := attributes[key].(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		values = append(values, otlpKeyValue{Key: key, Value: value})
+	}
+	return values
+}
+
+// otlpSpanKind converts an OpenCensus span kind to an OTLP span kind.
+func otlpSpanKind(kind int) int {
+	switch kind {
+	case trace.SpanKindServer:
+		return 2
+	case trace.SpanKindClient:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// otlpSpanStatus converts an OpenCensus status to an OTLP status, which
+// only distinguishes unset and error.
+func otlpSpanStatus(status trace.Status) otlpStatus {
+	if status.Code == trace.StatusCodeOK {
+		return otlpStatus{}
+	}
+	return otlpStatus{Code: 2, Message: status.Message}
+}
+
+// cloudTraceSender sends spans to the Cloud Trace API.
+type cloudTraceSender struct {
+	endpoint  string
+	projectID string
+	client    *http.Client
+}
+
+type cloudTraceString struct {
+	Value string `json:"value"`
+}
+
+type cloudTraceValue struct {
+	StringValue *cloudTraceString `json:"stringValue,omitempty"`
+	IntValue    *string           `json:"intValue,omitempty"`
+	BoolValue   *bool             `json:"boolValue,omitempty"`
+}
+
+type cloudTraceSpan struct {
+	Name         string           `json:"name"`
+	SpanID       string           `json:"spanId"`
+	ParentSpanID string           `json:"parentSpanId,omitempty"`
+	DisplayName  cloudTraceString `json:"displayName"`
+	StartTime    string           `json:"startTime"`
+	EndTime      string           `json:"endTime"`
+	Attributes   struct {
+		AttributeMap map[string]cloudTraceValue `json:"attributeMap,omitempty"`
+	} `json:"attributes"`
+	Status   *cloudTraceStatus `json:"status,omitempty"`
+	SpanKind string            `json:"spanKind"`
+}
+
+type cloudTraceStatus struct {
+	Code    int32  `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (s *cloudTraceSender) send(spans []*trace.SpanData) error {
+	var request struct {
+		Spans []cloudTraceSpan `json:"spans"`
+	}
+	for _, span := range spans {
+		converted := cloudTraceSpan{
+			Name:         fmt.Sprintf("projects/%s/traces/%s/spans/%s", s.projectID, span.TraceID, span.SpanID),
+			SpanID:       span.SpanID.String(),
+			ParentSpanID: parentSpanID(span),
+			DisplayName:  cloudTraceString{Value: span.Name},
+			StartTime:    span.StartTime.UTC().Format(time.RFC3339Nano),
+			EndTime:      span.EndTime.UTC().Format(time.RFC3339Nano),
+			SpanKind:     cloudTraceSpanKind(span.SpanKind),
+		}
+
+		// Cloud Trace has no float attributes, so they are sent as strings
+		converted.Attributes.AttributeMap = make(map[string]cloudTraceValue, len(span.Attributes))
+		for key, value := range span.Attributes {
+			var v cloudTraceValue
+			switch value := value.(type) {
+			case bool:
+				v.BoolValue = &value
+			case int64:
+				s := strconv.FormatInt(value, 10)
+				v.IntValue = &s
+			default:
+				v.StringValue = &cloudTraceString{Value: fmt.Sprint(value)}
+			}
+			converted.Attributes.AttributeMap[key] = v
+		}
+
+		if span.Code != trace.StatusCodeOK {
+			converted.Status = &cloudTraceStatus{Code: span.Code, Message: span.Message}
+		}
+		request.Spans = append(request.Spans, converted)
+	}
+	return postJSON(s.client, s.endpoint, nil, request)
+}
+
+// cloudTraceSpanKind converts an OpenCensus span kind to a Cloud Trace
+// span kind.
+func cloudTraceSpanKind(kind int) string {
+	switch kind {
+	case trace.SpanKindServer:
+		return "SERVER"
+	case trace.SpanKindClient:
+		return "CLIENT"
+	default:
+		return "INTERNAL"
+	}
+}
+
+// spanKindName returns the name of an OpenCensus span kind.
+func spanKindName(kind int) string {
+	switch kind {
+	case trace.SpanKindServer:
+		return "server"
+	case trace.SpanKindClient:
+		return "client"
+	default:
+		return "internal"
+	}
+}
+
+// parentSpanID returns the hex ID of the span's parent, or "" for root
+// spans.
+func parentSpanID(s *trace.SpanData) string {
+	if s.ParentSpanID == (trace.SpanID{}) {
+		return ""
+	}
+	return s.ParentSpanID.String()
+}
@@ -0,0 +1,145 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// testSpan returns a finished server span with a parent and an error.
+func testSpan() *trace.SpanData {
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &trace.SpanData{
+		SpanContext:  sc,
+		ParentSpanID: trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		SpanKind:     trace.SpanKindServer,
+		Name:         "GET /api/v1/hello",
+		StartTime:    start,
+		EndTime:      start.Add(1500 * time.Microsecond),
+		Attributes:   map[string]interface{}{"http.status_code": int64(500), "http.method": "GET"},
+		Status:       trace.Status{Code: trace.StatusCodeUnknown, Message: "Internal Server Error"},
+	}
+}
+
+// captureServer returns a server recording the body of the last request.
+func captureServer(t *testing.T, body *[]byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*body, _ = io.ReadAll(r.Body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStdoutExporter(t *testing.T) {
+	var out strings.Builder
+	NewStdoutExporter(&out).ExportSpan(testSpan())
+
+	var span stdoutSpan
+	if err := json.Unmarshal([]byte(out.String()), &span); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out.String(), err)
+	}
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "0102030405060708" {
+		t.Errorf("IDs = %s/%s, want the span's trace and parent IDs", span.TraceID, span.ParentSpanID)
+	}
+	if span.Kind != "server" || span.DurationMS != 1.5 || span.StatusCode != trace.StatusCodeUnknown {
+		t.Errorf("span = %+v, want a failed 1.5ms server span", span)
+	}
+}
+
+func TestOTLPSender(t *testing.T) {
+	var body []byte
+	server := captureServer(t, &body)
+	batcher := newBatcher(10, 0, &otlpSender{
+		endpoint:    server.URL,
+		serviceName: "test",
+		client:      server.Client(),
+	})
+	batcher.ExportSpan(testSpan())
+	batcher.Flush()
+
+	var request struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		t.Fatalf("invalid JSON %q: %v", body, err)
+	}
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("request = %s, want one resource and scope", body)
+	}
+	if attributes := request.ResourceSpans[0].Resource.Attributes; len(attributes) != 1 || *attributes[0].Value.StringValue != "test" {
+		t.Errorf("resource attributes = %+v, want service.name", attributes)
+	}
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("spans = %+v, want 1", spans)
+	}
+	span := spans[0]
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.Kind != 2 || span.Status.Code != 2 {
+		t.Errorf("span = %+v, want a failed server span", span)
+	}
+	if span.StartTimeUnixNano != "1682942400000000000" {
+		t.Errorf("start = %s, want Unix nanoseconds", span.StartTimeUnixNano)
+	}
+	if len(span.Attributes) != 2 || span.Attributes[1].Key != "http.status_code" || *span.Attributes[1].Value.IntValue != "500" {
+		t.Errorf("attributes = %+v, want sorted typed attributes", span.Attributes)
+	}
+}
+
+func TestCloudTraceSender(t *testing.T) {
+	var body []byte
+	server := captureServer(t, &body)
+	sender := &cloudTraceSender{endpoint: server.URL, projectID: "project", client: server.Client()}
+	if err := sender.send([]*trace.SpanData{testSpan()}); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+
+	var request struct {
+		Spans []cloudTraceSpan `json:"spans"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil || len(request.Spans) != 1 {
+		t.Fatalf("request = %s (%v), want one span", body, err)
+	}
+	span := request.Spans[0]
+	if span.Name != "projects/project/traces/4bf92f3577b34da6a3ce929d0e0e4736/spans/00f067aa0ba902b7" {
+		t.Errorf("name = %q, want the span's resource name", span.Name)
+	}
+	if span.SpanKind != "SERVER" || span.Status == nil || span.StartTime != "2023-05-01T12:00:00Z" {
+		t.Errorf("span = %+v, want a failed server span", span)
+	}
+	if value := span.Attributes.AttributeMap["http.status_code"]; value.IntValue == nil || *value.IntValue != "500" {
+		t.Errorf("http.status_code = %+v, want 500", value)
+	}
+}
+
+func TestBatcherSendsFullBatches(t *testing.T) {
+	sent := make(chan int, 1)
+	batcher := newBatcher(2, 0, senderFunc(func(spans []*trace.SpanData) error {
+		sent <- len(spans)
+		return nil
+	}))
+	batcher.ExportSpan(testSpan())
+	batcher.ExportSpan(testSpan())
+
+	select {
+	case n := <-sent:
+		if n != 2 {
+			t.Errorf("sent %d spans, want 2", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("full batch was not sent")
+	}
+}
+
+// senderFunc adapts a function to a spanSender.
+type senderFunc func(spans []*trace.SpanData) error
+
+func (f senderFunc) send(spans []*trace.SpanData) error {
+	return f(spans)
+}
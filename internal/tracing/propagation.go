@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+)
+
+// TraceparentHeader carries the W3C Trace Context of a request.
+const TraceparentHeader = "traceparent"
+
+// TraceContext propagates span contexts in the W3C traceparent header. Use
+// it with ochttp.Transport to continue traces in outgoing calls. The
+// tracestate header is not propagated.
+type TraceContext struct{}
+
+var _ propagation.HTTPFormat = (*TraceContext)(nil)
+
+// SpanContextFromRequest returns the span context of a valid traceparent
+// header.
+func (*TraceContext) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	return ParseTraceparent(req.Header.Get(TraceparentHeader))
+}
+
+// SpanContextToRequest sets the traceparent header of the request.
+func (*TraceContext) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	req.Header.Set(TraceparentHeader, FormatTraceparent(sc))
+}
+
+// ParseTraceparent parses a traceparent header such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01. Headers of
+// later versions are read as version 00, as the specification requires.
+func ParseTraceparent(header string) (trace.SpanContext, bool) {
+	var sc trace.SpanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 2*len(sc.TraceID) || len(parts[2]) != 2*len(sc.SpanID) || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	// Every part must be lowercase hex, and the IDs must not be all zeros
+	var version, flags [1]byte
+	for _, part := range []struct {
+		hex string
+		dst []byte
+	}{{parts[0], version[:]}, {parts[1], sc.TraceID[:]}, {parts[2], sc.SpanID[:]}, {parts[3], flags[:]}} {
+		if part.hex != strings.ToLower(part.hex) {
+			return trace.SpanContext{}, false
+		}
+		if _, err := hex.Decode(part.dst, []byte(part.hex)); err != nil {
+			return trace.SpanContext{}, false
+		}
+	}
+	if sc.TraceID == (trace.TraceID{}) || sc.SpanID == (trace.SpanID{}) {
+		return trace.SpanContext{}, false
+	}
+	sc.TraceOptions = trace.TraceOptions(flags[0] & 1)
+	return sc, true
+}
+
+// FormatTraceparent formats a span context as a version 00 traceparent
+// header.
+func FormatTraceparent(sc trace.SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, uint32(sc.TraceOptions)&1)
+}
@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"later version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"extra fields in version 00", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"zero span ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"short trace ID", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", false, false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.header)
+			if ok != tt.ok || sc.IsSampled() != tt.sampled {
+				t.Errorf("ParseTraceparent(%q) = sampled %v, %v, want sampled %v, %v", tt.header, sc.IsSampled(), ok, tt.sampled, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTraceContextRoundTrip(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(header)
+	if !ok {
+		t.Fatalf("ParseTraceparent(%q) failed", header)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	format := &TraceContext{}
+	format.SpanContextToRequest(sc, req)
+	if got := req.Header.Get(TraceparentHeader); got != header {
+		t.Errorf("traceparent = %q, want %q", got, header)
+	}
+	if got, ok := format.SpanContextFromRequest(req); !ok || got != sc {
+		t.Errorf("SpanContextFromRequest() = %v, %v, want %v", got, ok, sc)
+	}
+}
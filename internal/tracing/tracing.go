@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/oauth2/google"
+)
+
+// The span exporters selectable with Config.Exporter.
+const (
+	ExporterNone       = "none"
+	ExporterStdout     = "stdout"
+	ExporterOTLP       = "otlp"
+	ExporterCloudTrace = "cloudtrace"
+)
+
+// Config configures the sampling and export of spans.
+type Config struct {
+	// Exporter is where sampled spans are sent: ExporterNone,
+	// ExporterStdout, ExporterOTLP or ExporterCloudTrace.
+	Exporter string
+	// SampleRate is the fraction of new traces sampled. Traces started by
+	// a sampled caller are always sampled.
+	SampleRate float64
+	// ServiceName identifies the service in OTLP resources.
+	ServiceName string
+
+	// Output receives the spans of the stdout exporter, one JSON object
+	// per line. It defaults to os.Stdout.
+	Output io.Writer
+	// Endpoint overrides the OTLP/HTTP traces endpoint, by default
+	// http://localhost:4318/v1/traces, or the Cloud Trace API endpoint.
+	Endpoint string
+	// Headers are sent with every OTLP export, e.g. for authentication.
+	Headers map[string]string
+	// ProjectID is the Google Cloud project spans are written to with
+	// Cloud Trace.
+	ProjectID string
+	// Client sends the OTLP and Cloud Trace exports. Cloud Trace defaults
+	// to a client with the application default credentials.
+	Client *http.Client
+
+	// BatchSize is the number of spans sent per export, and FlushInterval
+	// the longest a span waits to be sent.
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// DefaultConfig returns the default tracing configuration, which samples
+// 1% of new traces but does not export them.
+func DefaultConfig() Config {
+	return Config{
+		Exporter:      ExporterNone,
+		SampleRate:    0.01,
+		ServiceName:   "boilerplate-go-api-clean",
+		BatchSize:     512,
+		FlushInterval: 5 * time.Second,
+	}
+}
+
+// Setup registers the configured exporter and sampler with OpenCensus.
+// The returned function sends the spans still waiting in a batch, and
+// should be called before the process exits.
+func Setup(config Config) (func(), error) {
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(config.SampleRate)})
+
+	var exporter trace.Exporter
+	flush := func() {}
+	switch config.Exporter {
+	case ExporterNone, "":
+		return flush, nil
+	case ExporterStdout:
+		output := config.Output
+		if output == nil {
+			output = os.Stdout
+		}
+		exporter = NewStdoutExporter(output)
+	case ExporterOTLP:
+		client := config.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		endpoint := config.Endpoint
+		if endpoint == "" {
+			endpoint = "http://localhost:4318/v1/traces"
+		}
+		batcher := newBatcher(config.BatchSize, config.FlushInterval, &otlpSender{
+			endpoint:    endpoint,
+			headers:     config.Headers,
+			serviceName: config.ServiceName,
+			client:      client,
+		})
+		exporter, flush = batcher, batcher.Flush
+	case ExporterCloudTrace:
+		if config.ProjectID == "" {
+			return nil, fmt.Errorf("tracing: Cloud Trace needs a project ID")
+		}
+		client := config.Client
+		if client == nil {
+			var err error
+			client, err = google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/trace.append")
+			if err != nil {
+				return nil, fmt.Errorf("tracing: Cloud Trace credentials: %w", err)
+			}
+		}
+		endpoint := config.Endpoint
+		if endpoint == "" {
+			endpoint = "https://cloudtrace.googleapis.com/v2/projects/" + config.ProjectID + "/traces:batchWrite"
+		}
+		batcher := newBatcher(config.BatchSize, config.FlushInterval, &cloudTraceSender{
+			endpoint:  endpoint,
+			projectID: config.ProjectID,
+			client:    client,
+		})
+		exporter, flush = batcher, batcher.Flush
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", config.Exporter)
+	}
+
+	trace.RegisterExporter(exporter)
+	return flush, nil
+}
+
+// RecordError marks the span as failed with the error, if any, and
+// returns the error so it can wrap a return value:
+//
+//	return tracing.RecordError(span, ref.Set(ctx, user))
+func RecordError(span *trace.Span, err error) error {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	return err
+}